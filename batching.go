@@ -0,0 +1,130 @@
+package tasq
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// maxBatchedCalls limits the number of calls combined into one request when
+// Client.BatchDelay is set. Once this many calls are waiting, the batch is
+// sent without waiting for the rest of the delay.
+const maxBatchedCalls = 1000
+
+// A batchCall is a Completed or Keepalive call waiting to be sent as part of
+// a batch request.
+type batchCall struct {
+	ID    string `json:"id"`
+	Lease string `json:"lease,omitempty"`
+
+	done   chan struct{}
+	err    error
+	result *KeepaliveResult
+}
+
+// requestBatcher holds the calls waiting for the next batch requests.
+type requestBatcher struct {
+	lock        sync.Mutex
+	completions []*batchCall
+	keepalives  []*batchCall
+}
+
+// batchCompleted is like CompletedLease, but waits for other completions to
+// send in the same request.
+func (c *Client) batchCompleted(id, lease string) error {
+	call := &batchCall{ID: id, Lease: lease, done: make(chan struct{})}
+	c.enqueueBatch(&c.batcher.completions, call, c.flushCompletions)
+	<-call.done
+	return call.err
+}
+
+// batchKeepalive is like KeepaliveLease, but waits for other keepalives to
+// send in the same request.
+func (c *Client) batchKeepalive(id, lease string) (*KeepaliveResult, error) {
+	call := &batchCall{ID: id, Lease: lease, done: make(chan struct{})}
+	c.enqueueBatch(&c.batcher.keepalives, call, c.flushKeepalives)
+	<-call.done
+	return call.result, call.err
+}
+
+// enqueueBatch adds a call to a list of waiting calls, arranging for flush to
+// be called with the calls once c.BatchDelay has passed since the first one
+// was added, or sooner if the batch is full.
+func (c *Client) enqueueBatch(list *[]*batchCall, call *batchCall, flush func([]*batchCall)) {
+	take := func() []*batchCall {
+		calls := *list
+		*list = nil
+		return calls
+	}
+
+	c.batcher.lock.Lock()
+	defer c.batcher.lock.Unlock()
+	*list = append(*list, call)
+	if len(*list) >= maxBatchedCalls {
+		go flush(take())
+	} else if len(*list) == 1 {
+		time.AfterFunc(c.BatchDelay, func() {
+			c.batcher.lock.Lock()
+			calls := take()
+			c.batcher.lock.Unlock()
+			if len(calls) > 0 {
+				flush(calls)
+			}
+		})
+	}
+}
+
+func (c *Client) flushCompletions(calls []*batchCall) {
+	var response struct {
+		Failed []string `json:"failed"`
+	}
+	query := c.workerValues(url.Values{"count": {"0"}})
+	err := c.postJSONQuery("/task/complete_and_pop", query, calls, &response)
+	failed := map[string]bool{}
+	for _, id := range response.Failed {
+		failed[id] = true
+	}
+	for _, call := range calls {
+		if err != nil {
+			call.err = err
+		} else if failed[call.ID] {
+			call.err = missingTaskError(call.Lease)
+		}
+		close(call.done)
+	}
+}
+
+func (c *Client) flushKeepalives(calls []*batchCall) {
+	var response []*struct {
+		Expiration int64 `json:"expiration"`
+		Attempts   int   `json:"attempts"`
+	}
+	err := c.postJSONQuery("/task/keepalive_batch", timeoutQuery(c.TaskTimeout), calls, &response)
+	if err == nil && len(response) != len(calls) {
+		err = &RemoteError{StatusCode: http.StatusOK, Message: "unexpected number of keepalive results"}
+	}
+	for i, call := range calls {
+		if err != nil {
+			call.err = err
+		} else if info := response[i]; info == nil {
+			call.err = missingTaskError(call.Lease)
+		} else {
+			call.result = &KeepaliveResult{
+				Expiration: time.UnixMilli(info.Expiration),
+				Attempts:   info.Attempts,
+			}
+		}
+		close(call.done)
+	}
+}
+
+// missingTaskError creates the error that the server would have returned for
+// an unbatched call on a task which is no longer in progress.
+func missingTaskError(lease string) error {
+	message := "there was no in-progress task with the specified `id`"
+	if lease != "" {
+		message = "there was no in-progress task with the specified `id` and `lease`"
+	}
+	return &RemoteError{StatusCode: http.StatusOK, Message: message}
+}
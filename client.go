@@ -2,13 +2,21 @@ package tasq
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"hash/crc32"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -16,18 +24,297 @@ import (
 
 const DefaultKeepaliveInterval = time.Second * 30
 
+// RequestIDHeader is the header which identifies each request to the server.
+// See Client.RequestID.
+const RequestIDHeader = "X-Request-ID"
+
+// DefaultMaxKeepaliveFailures is the default number of consecutive failed
+// keepalives after which a RunningTask's lease is considered lost.
+const DefaultMaxKeepaliveFailures = 3
+
+// DefaultMaxIdleConns is the number of idle connections per server kept by
+// DefaultHTTPClient.
+const DefaultMaxIdleConns = 64
+
+// Pop orders for Client.Order and SetOrder. OrderFIFO pops the oldest pending
+// task first, OrderLIFO pops the newest first, and OrderFair takes turns
+// between the producers of the tasks (see PushOptions.Producer).
+const (
+	OrderFIFO = "fifo"
+	OrderLIFO = "lifo"
+	OrderFair = "fair"
+)
+
+// DefaultHTTPClient is shared by all Clients which do not set HTTPClient.
+//
+// Unlike http.DefaultClient, it keeps many idle connections to each server,
+// so that many concurrent workers in one process can reuse connections
+// rather than opening a new one for every request.
+var DefaultHTTPClient = NewHTTPClient(DefaultMaxIdleConns, 0)
+
+// NewHTTPClient creates an *http.Client with its own connection pool.
+//
+// The maxIdle argument is the number of idle connections kept open to each
+// server. If maxConns is non-zero, it limits the total number of connections
+// to each server, and requests wait for a free connection beyond this limit.
+func NewHTTPClient(maxIdle, maxConns int) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 0
+	transport.MaxIdleConnsPerHost = maxIdle
+	transport.MaxConnsPerHost = maxConns
+	return &http.Client{Transport: transport}
+}
+
 // A Task stores information about a popped task.
 type Task struct {
 	ID       string `json:"id"`
 	Contents string `json:"contents"`
+
+	// Lease identifies this particular pop of the task. It may be empty if
+	// the server does not support leases.
+	Lease string `json:"lease,omitempty"`
+
+	// Checksum is the CRC-32C of the contents, in big-endian hex, which the
+	// server recorded when the task was pushed. It may be empty for older
+	// tasks or servers. See VerifyChecksum.
+	Checksum string `json:"checksum,omitempty"`
+
+	// Annotations are the metadata attached to the task with Annotate. They
+	// are only reported by Peek.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// VerifyChecksum checks that the contents of the task match the checksum
+// recorded by the server, to detect corruption in storage or transfer.
+//
+// Returns nil if the task has no checksum.
+func (t *Task) VerifyChecksum() error {
+	return verifyChecksum(t.ID, t.Contents, t.Checksum)
+}
+
+// A ChecksumError is returned when a task's contents do not match its
+// checksum.
+type ChecksumError struct {
+	ID       string
+	Expected string
+	Actual   string
+}
+
+func (c *ChecksumError) Error() string {
+	return "task " + c.ID + " is corrupted: expected checksum " + c.Expected +
+		" but got " + c.Actual
+}
+
+func verifyChecksum(id, contents, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], crc32.Checksum([]byte(contents), checksumTable))
+	if actual := hex.EncodeToString(data[:]); actual != checksum {
+		return &ChecksumError{ID: id, Expected: checksum, Actual: actual}
+	}
+	return nil
 }
 
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
 // QueueCounts stores the number of in-progress, pending, and completed tasks.
 type QueueCounts struct {
 	Completed int64 `json:"completed"`
 	Pending   int64 `json:"pending"`
 	Expired   int64 `json:"expired"`
 	Running   int64 `json:"running"`
+	Delayed   int64 `json:"delayed"`
+	Held      int64 `json:"held"`
+
+	// BackingOff is the number of expired tasks waiting for the context's
+	// backoff delay before they can be popped again. See SetBackoff.
+	BackingOff int64 `json:"backingOff"`
+
+	// Stuck is the number of running tasks which the server's last check
+	// found to be stuck. See StuckTasks.
+	Stuck int64 `json:"stuck"`
+}
+
+// A RemoteError is returned when the server responds to a request with an
+// error message, for example because a task is no longer in progress.
+type RemoteError struct {
+	// StatusCode is the HTTP status of the response. Errors about the
+	// request itself, such as unknown task IDs, have status 200.
+	StatusCode int
+
+	Message string
+
+	// RequestID is the ID of the failed request, which the server includes
+	// in its logs, or "" if the server did not report it.
+	RequestID string
+}
+
+func (r *RemoteError) Error() string {
+	return "remote error: " + r.Message
+}
+
+// KeepaliveResult stores information about a running task after a keepalive.
+type KeepaliveResult struct {
+	// Expiration is the new time at which the task will expire.
+	Expiration time.Time
+
+	// Attempts is the number of times the task has been popped.
+	Attempts int
+}
+
+// RunningTaskInfo describes an in-progress task on the server.
+type RunningTaskInfo struct {
+	ID       string `json:"id"`
+	Contents string `json:"contents"`
+
+	// Expiration is the Unix time in milliseconds when the task will expire
+	// (or expired).
+	Expiration int64 `json:"expiration"`
+
+	// Created is the Unix time in milliseconds when the task was pushed, or
+	// zero if unknown.
+	Created int64 `json:"created,omitempty"`
+
+	// Attempts is the number of times the task has been popped.
+	Attempts int `json:"attempts"`
+
+	// Reserved is true if the task was returned by Reserve and has not been
+	// accepted yet.
+	Reserved bool `json:"reserved,omitempty"`
+
+	// OrderingKey is the key the task was pushed with, if any.
+	OrderingKey string `json:"orderingKey,omitempty"`
+
+	// Producer is the producer the task was pushed by, if any.
+	Producer string `json:"producer,omitempty"`
+
+	// Annotations are the metadata attached to the task with Annotate.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// A StuckTask is a running task which has been popped too many times, or has
+// been running for much longer than the context's tasks usually take.
+type StuckTask struct {
+	RunningTaskInfo
+
+	// RunningTime is the number of seconds the task has spent running,
+	// summed over all of its attempts.
+	RunningTime float64 `json:"runningTime"`
+
+	// Reasons contains "attempts" if the task has reached the attempt
+	// threshold, and "runningTime" if its running time is an outlier.
+	Reasons []string `json:"reasons"`
+
+	// Flagged is the Unix time in milliseconds when the server's background
+	// check first found the task to be stuck, or zero if it has not yet.
+	Flagged int64 `json:"flagged,omitempty"`
+}
+
+// CompletedRecord describes a task in the server's completed log.
+type CompletedRecord struct {
+	ID       string `json:"id"`
+	Contents string `json:"contents"`
+
+	// Completed is the Unix time in milliseconds when the task was completed.
+	Completed int64 `json:"completed"`
+
+	// Worker is the WorkerName of the client which completed the task.
+	Worker string `json:"worker"`
+
+	// Duration is the number of seconds between the last time the task was
+	// popped and its completion, or 0 if unknown.
+	Duration float64 `json:"duration"`
+
+	Attempts int `json:"attempts"`
+
+	// Annotations are the task's annotations when it was completed.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// GroupStatus describes the tasks which were pushed to a group.
+type GroupStatus struct {
+	Total     int64 `json:"total"`
+	Pending   int64 `json:"pending"`
+	Running   int64 `json:"running"`
+	Delayed   int64 `json:"delayed"`
+	Completed int64 `json:"completed"`
+
+	// Finished is the Unix time in milliseconds when the last task in the
+	// group was completed, or 0 if the group has tasks remaining.
+	Finished int64 `json:"finished"`
+
+	// Barrier and Callback are the actions which will be taken when the
+	// group finishes, if any.
+	Barrier  string `json:"barrier"`
+	Callback string `json:"callback"`
+}
+
+// ContextConfig stores the settings of a context on the server.
+type ContextConfig struct {
+	// Backoff is the number of seconds that a task must wait after expiring
+	// for the first time before it can be popped again. The delay doubles
+	// each time the task expires.
+	Backoff float64 `json:"backoff"`
+
+	// MaxBackoff, if non-zero, limits the delay imposed by Backoff.
+	MaxBackoff float64 `json:"maxBackoff"`
+
+	// AlertPending, AlertExpired, and AlertStall are the alert thresholds set
+	// by SetAlerts, where AlertStall is in seconds.
+	AlertPending int64   `json:"alertPending"`
+	AlertExpired int64   `json:"alertExpired"`
+	AlertStall   float64 `json:"alertStall"`
+
+	// CompletedLog is the number of completed tasks which the server
+	// remembers, as set by SetCompletedLog.
+	CompletedLog int `json:"completedLog"`
+
+	// Timeout and MaxTimeout are the default and maximum task timeouts in
+	// seconds, as set by SetTimeouts.
+	Timeout    float64 `json:"timeout"`
+	MaxTimeout float64 `json:"maxTimeout"`
+
+	// Weight is the share of tasks popped by PopAny, as set by SetWeight.
+	Weight int64 `json:"weight"`
+
+	// DrainTime is the number of seconds in which Autoscale aims to finish
+	// the remaining tasks, or 0 for the server's default.
+	DrainTime float64 `json:"drainTime"`
+
+	// Order is the context's default pop order, as set by SetOrder, or ""
+	// for FIFO.
+	Order string `json:"order"`
+
+	// StuckAttempts and StuckDeviations are the thresholds for stuck tasks,
+	// as set by SetStuckThresholds, or 0 for the server's defaults.
+	StuckAttempts   int64   `json:"stuckAttempts"`
+	StuckDeviations float64 `json:"stuckDeviations"`
+}
+
+// AutoscaleHint is a suggested number of workers for a context.
+type AutoscaleHint struct {
+	Workers   int64    `json:"workers"`
+	Remaining int64    `json:"remaining"`
+	Rate      float64  `json:"rate"`
+	PushRate  float64  `json:"pushRate"`
+	Latency   *float64 `json:"latency"`
+	DrainTime float64  `json:"drainTime"`
+}
+
+// PeekResult stores information about the next task in a queue.
+type PeekResult struct {
+	// Task is the next task that would be popped, if there is one.
+	Task *Task
+
+	// If Task is nil, Done indicates that no tasks are pending or running.
+	Done bool
+
+	// If Task is nil and Done is false, Retry is the number of seconds until
+	// the next in-progress task will expire, and Next is that task.
+	Retry float64
+	Next  *Task
 }
 
 // A Client makes API calls to a tasq server.
@@ -43,12 +330,103 @@ type Client struct {
 	Password string
 
 	// KeepaliveInterval is used for the keepalive Goroutine created by the
-	// PopRunningTask method. Defaults to DefaultKeepaliveInterval.
+	// PopRunningTask method. Defaults to DefaultKeepaliveInterval, or a third
+	// of TaskTimeout if that is shorter.
 	KeepaliveInterval time.Duration
+
+	// TaskTimeout, if non-zero, overrides the server's task timeout for tasks
+	// popped by this client, and for their keepalives. See PopWithTimeout.
+	TaskTimeout time.Duration
+
+	// HTTPTimeout, if non-zero, limits the total time of each API call,
+	// including any failover attempts. It does not apply to streamed calls
+	// such as Export and Import.
+	HTTPTimeout time.Duration
+
+	// MaxKeepaliveFailures is the number of consecutive keepalive requests
+	// which may fail (e.g. because the server is unreachable) before a
+	// RunningTask's lease is considered lost. Defaults to
+	// DefaultMaxKeepaliveFailures.
+	//
+	// If the server reports that the task is no longer in progress, the
+	// lease is considered lost immediately.
+	MaxKeepaliveFailures int
+
+	// OnLeaseLost, if non-nil, is called from the keepalive Goroutine of a
+	// RunningTask when its lease is lost, with the last keepalive error.
+	// See RunningTask.Done().
+	OnLeaseLost func(task *RunningTask, err error)
+
+	// FailoverURLs are additional servers, such as standbys, which are tried
+	// in order when a request to the current server fails or the server is a
+	// standby.
+	//
+	// Since a request may fail after the server has already processed it,
+	// failover may cause some operations (e.g. pushes) to happen twice.
+	FailoverURLs []*url.URL
+
+	// CompressRequests, if true, causes JSON request bodies (e.g. for
+	// PushBatch) to be gzipped. The server must support compressed requests.
+	//
+	// Responses are compressed regardless of this setting when the server
+	// supports it.
+	CompressRequests bool
+
+	// HTTPClient, if non-nil, is used to make requests instead of
+	// DefaultHTTPClient.
+	HTTPClient *http.Client
+
+	// WorkerName, if non-empty, is sent along with completions, so that it
+	// appears in the server's completed log.
+	WorkerName string
+
+	// Tags are the capability tags offered by this worker. Pops (and Peek)
+	// only return tasks whose required tags are all included. See
+	// PushTagged.
+	Tags []string
+
+	// Order, if non-empty, is the order in which Pop, PopBatch, and
+	// CompleteAndPop take pending tasks, such as OrderLIFO. Otherwise,
+	// the context's default order is used (see SetOrder).
+	Order string
+
+	// BatchDelay, if non-zero, causes Completed and Keepalive calls (and
+	// their lease variants) to wait up to this long for concurrent calls,
+	// so that they can be sent to the server in a single batch request.
+	// This reduces request volume for processes running many workers.
+	//
+	// Batching requires a server that supports /task/complete_and_pop and
+	// /task/keepalive_batch.
+	BatchDelay time.Duration
+
+	// Metrics, if non-nil, is notified of every request, failover retry, and
+	// keepalive failure.
+	Metrics Metrics
+
+	// UserAgent, if non-empty, is sent as the User-Agent of requests instead
+	// of a default that names the host, process, and WorkerName.
+	UserAgent string
+
+	// RequestID, if non-nil, creates the X-Request-ID header for each
+	// request, which the server records in its logs. By default, random IDs
+	// are used. Failover attempts reuse the ID of the original request.
+	RequestID func() string
+
+	activeLock sync.Mutex
+	active     int
+
+	batcher requestBatcher
+
+	runningLock  sync.Mutex
+	runningTasks map[*RunningTask]struct{}
 }
 
 // NewClient creates a client with a base server URL.
 //
+// The baseURL may be a comma-separated list of URLs, in which case the first
+// URL is the primary server and the rest are used as FailoverURLs. To connect
+// over a Unix domain socket, use a UnixScheme URL.
+//
 // Optionally, a context name can be passed to scope the task queue,
 // as well as a username and password.
 //
@@ -57,14 +435,18 @@ func NewClient(baseURL string, contextUserPass ...string) (*Client, error) {
 	if len(contextUserPass) != 1 && len(contextUserPass) != 3 {
 		panic("zero or one context arguments expected")
 	}
-	parsed, err := url.Parse(baseURL)
-	if err != nil {
-		return nil, errors.Wrap(err, "new client")
-	}
-	if len(contextUserPass) > 0 {
-		parsed.RawQuery = (url.Values{"context": contextUserPass[:1]}).Encode()
+	var urls []*url.URL
+	for _, rawURL := range strings.Split(baseURL, ",") {
+		parsed, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "new client")
+		}
+		if len(contextUserPass) > 0 {
+			parsed.RawQuery = (url.Values{"context": contextUserPass[:1]}).Encode()
+		}
+		urls = append(urls, parsed)
 	}
-	res := &Client{URL: parsed}
+	res := &Client{URL: urls[0], FailoverURLs: urls[1:]}
 	if len(contextUserPass) == 3 {
 		res.Username = contextUserPass[1]
 		res.Password = contextUserPass[2]
@@ -79,6 +461,60 @@ func (c *Client) Push(contents string) (string, error) {
 	return response, err
 }
 
+// PushOptions are settings for PushWithOptions.
+type PushOptions struct {
+	// Limit, if non-zero, prevents the push if the queue already has this
+	// many tasks.
+	Limit int `json:"limit,omitempty"`
+
+	Group       string   `json:"group,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	OrderingKey string   `json:"orderingKey,omitempty"`
+
+	// Producer identifies the submitter of the task, such as a user, so
+	// that pops in OrderFair do not let one submitter starve the others.
+	Producer string `json:"producer,omitempty"`
+
+	// Delay is the time before the task can be popped.
+	Delay time.Duration `json:"-"`
+}
+
+// PushResult is the result of PushWithOptions.
+type PushResult struct {
+	// Pushed is false if the task was not pushed because of the limit.
+	Pushed bool `json:"pushed"`
+
+	ID       string `json:"id"`
+	Checksum string `json:"checksum"`
+
+	// Available is the Unix time in milliseconds when a delayed task can
+	// be popped, or nil if it was not delayed.
+	Available *int64 `json:"available"`
+}
+
+// PushWithOptions adds a task to the queue with the given options, which may
+// be nil. The contents are sent in a JSON request body, so they do not need to
+// be URL-encoded.
+func (c *Client) PushWithOptions(contents string, opts *PushOptions) (*PushResult, error) {
+	if opts == nil {
+		opts = &PushOptions{}
+	}
+	body := struct {
+		*PushOptions
+		Contents string  `json:"contents"`
+		Delay    float64 `json:"delay,omitempty"`
+	}{
+		PushOptions: opts,
+		Contents:    contents,
+		Delay:       opts.Delay.Seconds(),
+	}
+	var result PushResult
+	if err := c.postJSON("/task/push", body, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
 // PushBatch adds a batch of tasks to the queue and return their IDs.
 func (c *Client) PushBatch(contents []string) ([]string, error) {
 	var response []string
@@ -86,23 +522,182 @@ func (c *Client) PushBatch(contents []string) ([]string, error) {
 	return response, err
 }
 
+// PushGroup is like PushBatch, but adds the tasks to a group, whose progress
+// can be checked with GroupStatus.
+func (c *Client) PushGroup(group string, contents []string) ([]string, error) {
+	var response []string
+	err := c.postJSONQuery("/task/push_batch", url.Values{"group": {group}}, contents, &response)
+	return response, err
+}
+
+// PushTagged is like PushBatch, but the tasks may only be popped by clients
+// whose Tags include every one of the given tags.
+func (c *Client) PushTagged(tags []string, contents []string) ([]string, error) {
+	var response []string
+	query := url.Values{"tags": {strings.Join(tags, ",")}}
+	err := c.postJSONQuery("/task/push_batch", query, contents, &response)
+	return response, err
+}
+
+// PushOrdered is like PushBatch, but the tasks share an ordering key, so they
+// are run one at a time, in order, along with any other tasks with the key.
+func (c *Client) PushOrdered(key string, contents []string) ([]string, error) {
+	var response []string
+	query := url.Values{"orderingKey": {key}}
+	err := c.postJSONQuery("/task/push_batch", query, contents, &response)
+	return response, err
+}
+
+// PushFrom is like PushBatch, but records the producer of the tasks, so that
+// pops in OrderFair take turns between them and other producers' tasks.
+func (c *Client) PushFrom(producer string, contents []string) ([]string, error) {
+	var response []string
+	query := url.Values{"producer": {producer}}
+	err := c.postJSONQuery("/task/push_batch", query, contents, &response)
+	return response, err
+}
+
+// GroupStatus counts the tasks in a group by state.
+func (c *Client) GroupStatus(group string) (*GroupStatus, error) {
+	var response GroupStatus
+	if err := c.getQuery("/group/status", url.Values{"id": {group}}, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// OnGroupComplete arranges for a barrier task to be pushed and/or a callback
+// URL to receive a POST request once every task in the group is completed.
+// Either barrier or callback may be empty.
+//
+// This should be called after every task in the group has been pushed, since
+// otherwise the group may finish early. If the group has already finished,
+// the actions are taken immediately.
+func (c *Client) OnGroupComplete(group, barrier, callback string) error {
+	return c.postValues("/group/on_complete", url.Values{
+		"id":       {group},
+		"push":     {barrier},
+		"callback": {callback},
+	}, nil)
+}
+
 // Pop retrieves a pending task from the queue.
 //
 // If no task is returned, a retry time may be returned indicating the number
 // of seconds until the next in-progress task will expire. If this retry time
 // is also nil, then the queue has been exhausted.
 func (c *Client) Pop() (*Task, *float64, error) {
+	return c.PopWithTimeout(c.TaskTimeout)
+}
+
+// PopWithTimeout is like Pop, but the task will expire if it is not
+// completed or kept alive within the timeout, instead of the server's
+// default timeout. A timeout of 0 uses the server's default.
+func (c *Client) PopWithTimeout(timeout time.Duration) (*Task, *float64, error) {
+	return c.pop("/task/pop", c.orderValues(timeoutQuery(timeout)))
+}
+
+// Reserve is like Pop, but the task is only held for the given window (or the
+// server's default of 30 seconds, if window is 0), during which the worker
+// must inspect it and then call Accept or Reject.
+func (c *Client) Reserve(window time.Duration) (*Task, *float64, error) {
+	var query url.Values
+	if window != 0 {
+		query = url.Values{"window": {strconv.FormatFloat(window.Seconds(), 'f', -1, 64)}}
+	}
+	return c.pop("/task/reserve", query)
+}
+
+// Accept gives a task from Reserve a full lease, as if it had just been
+// popped, and returns its new expiration time.
+func (c *Client) Accept(t *Task) (*KeepaliveResult, error) {
+	return c.keepalive("/task/accept", url.Values{"id": {t.ID}, "lease": {t.Lease}})
+}
+
+// Reject puts a task from Reserve back into the queue for another worker,
+// without counting the reservation as an attempt.
+func (c *Client) Reject(t *Task) error {
+	return c.postValues("/task/reject", url.Values{"id": {t.ID}, "lease": {t.Lease}}, nil)
+}
+
+// Hold sets a pending or running task aside, so that it is not popped until
+// Unhold is called with its ID. A running task loses its lease.
+func (c *Client) Hold(id string) error {
+	return c.postValues("/task/hold", url.Values{"id": {id}}, nil)
+}
+
+// Unhold puts a held task back at the end of the pending queue.
+func (c *Client) Unhold(id string) error {
+	return c.postValues("/task/unhold", url.Values{"id": {id}}, nil)
+}
+
+// Held lists the tasks which were set aside by Hold.
+func (c *Client) Held() ([]*Task, error) {
+	var result []*Task
+	err := c.get("/task/held", &result)
+	return result, err
+}
+
+// Sample gets up to n tasks chosen at random from the tasks in the given
+// state, which is "pending", "running", "expired", "backingOff", "delayed", or
+// "held".
+func (c *Client) Sample(n int, state string) ([]*Task, error) {
+	var result []*Task
+	query := url.Values{"n": {strconv.Itoa(n)}, "state": {state}}
+	err := c.getQuery("/task/sample", query, &result)
+	return result, err
+}
+
+// Search finds tasks whose contents contain the substring q.
+//
+// If state is non-empty, only tasks in that state are searched. If limit is
+// non-zero, at most limit tasks are returned.
+//
+// The server examines a bounded number of tasks per request, so a search may
+// stop early, in which case the returned cursor is non-nil and can be passed
+// to SearchFrom to continue the search.
+func (c *Client) Search(q, state string, limit int) ([]*Task, *int, error) {
+	return c.SearchFrom(q, state, limit, 0)
+}
+
+// SearchFrom is like Search, but continues a search from a cursor.
+func (c *Client) SearchFrom(q, state string, limit, cursor int) ([]*Task, *int, error) {
+	var result struct {
+		Tasks  []*Task `json:"tasks"`
+		Cursor *int    `json:"cursor"`
+	}
+	query := url.Values{
+		"q":      {q},
+		"state":  {state},
+		"limit":  {strconv.Itoa(limit)},
+		"cursor": {strconv.Itoa(cursor)},
+	}
+	if err := c.getQuery("/task/search", query, &result); err != nil {
+		return nil, nil, err
+	}
+	return result.Tasks, result.Cursor, nil
+}
+
+func (c *Client) pop(path string, query url.Values) (*Task, *float64, error) {
 	var response struct {
 		ID       *string `json:"id"`
 		Contents *string `json:"contents"`
+		Lease    string  `json:"lease"`
+		Checksum string  `json:"checksum"`
 		Done     bool    `json:"done"`
 		Retry    float64 `json:"retry"`
 	}
-	if err := c.get("/task/pop", &response); err != nil {
+	if err := c.postQuery(path, c.tagValues(query), "", nil, &response); err != nil {
 		return nil, nil, err
 	}
 	if response.ID != nil && response.Contents != nil {
-		return &Task{ID: *response.ID, Contents: *response.Contents}, nil, nil
+		task := &Task{
+			ID:       *response.ID,
+			Contents: *response.Contents,
+			Lease:    response.Lease,
+			Checksum: response.Checksum,
+		}
+		return task, nil, nil
 	} else if response.Done {
 		return nil, nil, nil
 	} else {
@@ -110,6 +705,46 @@ func (c *Client) Pop() (*Task, *float64, error) {
 	}
 }
 
+// PopAny retrieves a pending task from any context whose name starts with
+// prefix, regardless of the client's context, and returns the task along with
+// the name of its context. Tasks are shared between the matching contexts in
+// proportion to their weights (see SetWeight).
+//
+// To complete the task, use a Client for the returned context.
+//
+// The retry time is like that of Pop, for the soonest of the contexts.
+func (c *Client) PopAny(prefix string) (*Task, string, *float64, error) {
+	var response struct {
+		Context  string  `json:"context"`
+		ID       *string `json:"id"`
+		Contents *string `json:"contents"`
+		Lease    string  `json:"lease"`
+		Checksum string  `json:"checksum"`
+		Done     bool    `json:"done"`
+		Retry    float64 `json:"retry"`
+	}
+	query := url.Values{"prefix": {prefix}}
+	for k, v := range timeoutQuery(c.TaskTimeout) {
+		query[k] = v
+	}
+	if err := c.postQuery("/task/pop_any", c.tagValues(query), "", nil, &response); err != nil {
+		return nil, "", nil, err
+	}
+	if response.ID != nil && response.Contents != nil {
+		task := &Task{
+			ID:       *response.ID,
+			Contents: *response.Contents,
+			Lease:    response.Lease,
+			Checksum: response.Checksum,
+		}
+		return task, response.Context, nil, nil
+	} else if response.Done {
+		return nil, "", nil, nil
+	} else {
+		return nil, "", &response.Retry, nil
+	}
+}
+
 // PopBatch retrieves at most n tasks from the queue.
 //
 // If fewer than n tasks are returned, then a retry time (in seconds) may be
@@ -118,12 +753,38 @@ func (c *Client) Pop() (*Task, *float64, error) {
 // If no tasks are returned and the retry time is nil, then the queue has been
 // exhausted.
 func (c *Client) PopBatch(n int) ([]*Task, *float64, error) {
+	return c.PopBatchWithTimeout(n, c.TaskTimeout)
+}
+
+// PopBatchWithTimeout is like PopBatch, but uses a custom task timeout like
+// PopWithTimeout.
+func (c *Client) PopBatchWithTimeout(n int, timeout time.Duration) ([]*Task, *float64, error) {
+	return c.popBatch(url.Values{"count": {strconv.Itoa(n)}}, timeout)
+}
+
+// PopBatchMaxBytes is like PopBatch, but stops adding tasks to the batch once
+// the total size of their contents would exceed maxBytes.
+//
+// At least one task is returned if one is available, even if its contents are
+// larger than maxBytes.
+func (c *Client) PopBatchMaxBytes(n, maxBytes int) ([]*Task, *float64, error) {
+	values := url.Values{
+		"count":    {strconv.Itoa(n)},
+		"maxBytes": {strconv.Itoa(maxBytes)},
+	}
+	return c.popBatch(values, c.TaskTimeout)
+}
+
+func (c *Client) popBatch(values url.Values, timeout time.Duration) ([]*Task, *float64, error) {
 	var response struct {
 		Done  bool    `json:"done"`
 		Retry float64 `json:"retry"`
 		Tasks []*Task `json:"tasks"`
 	}
-	if err := c.postForm("/task/pop_batch", "count", strconv.Itoa(n), &response); err != nil {
+	body := []byte(values.Encode())
+	err := c.postQuery("/task/pop_batch", c.orderValues(c.tagValues(timeoutQuery(timeout))),
+		"application/x-www-form-urlencoded", body, &response)
+	if err != nil {
 		return nil, nil, err
 	}
 	if response.Done {
@@ -146,11 +807,7 @@ func (c *Client) PopRunningTask() (*RunningTask, error) {
 		if err != nil {
 			return nil, err
 		} else if task != nil {
-			interval := c.KeepaliveInterval
-			if interval == 0 {
-				interval = DefaultKeepaliveInterval
-			}
-			return newRunningTask(c, task.Contents, task.ID, interval), nil
+			return newRunningTask(c, task, c.keepaliveInterval()), nil
 		} else if wait != nil {
 			time.Sleep(time.Duration(float64(time.Second) * (*wait)))
 		} else {
@@ -159,20 +816,430 @@ func (c *Client) PopRunningTask() (*RunningTask, error) {
 	}
 }
 
+// Close cancels the keepalive loops of all RunningTasks created by the client
+// (e.g. through PopRunningTask or Tasks) and waits for them to exit, so that
+// the process can exit cleanly without leaking Goroutines.
+//
+// Tasks which were not completed remain in progress on the server until they
+// expire. Close does not prevent further use of the client, but RunningTasks
+// created after Close is called are not affected by it.
+//
+// Close must not be called from OnLeaseLost, since it would wait for the
+// keepalive loop which is calling OnLeaseLost.
+func (c *Client) Close() {
+	c.runningLock.Lock()
+	tasks := make([]*RunningTask, 0, len(c.runningTasks))
+	for task := range c.runningTasks {
+		tasks = append(tasks, task)
+	}
+	c.runningLock.Unlock()
+	for _, task := range tasks {
+		task.Cancel()
+		<-task.exitChan
+	}
+}
+
+// Peek looks at the next task that would be returned by Pop, without
+// actually modifying the queue.
+func (c *Client) Peek() (*PeekResult, error) {
+	var response struct {
+		ID          *string           `json:"id"`
+		Contents    *string           `json:"contents"`
+		Annotations map[string]string `json:"annotations"`
+		Done        bool              `json:"done"`
+		Retry       float64           `json:"retry"`
+		Next        *Task             `json:"next"`
+	}
+	if err := c.getQuery("/task/peek", c.tagValues(nil), &response); err != nil {
+		return nil, err
+	}
+	if response.ID != nil && response.Contents != nil {
+		return &PeekResult{Task: &Task{
+			ID:          *response.ID,
+			Contents:    *response.Contents,
+			Annotations: response.Annotations,
+		}}, nil
+	}
+	return &PeekResult{
+		Done:  response.Done,
+		Retry: response.Retry,
+		Next:  response.Next,
+	}, nil
+}
+
 // Completed tells the server that the identified task was completed.
 func (c *Client) Completed(id string) error {
-	return c.postForm("/task/completed", "id", id, nil)
+	if c.BatchDelay != 0 {
+		return c.batchCompleted(id, "")
+	}
+	return c.postValues("/task/completed", c.workerValues(url.Values{"id": {id}}), nil)
+}
+
+// CompletedLease is like Completed, but fails if the task has been popped
+// again since it was given the lease, e.g. because it expired.
+func (c *Client) CompletedLease(id, lease string) error {
+	if c.BatchDelay != 0 {
+		return c.batchCompleted(id, lease)
+	}
+	values := url.Values{"id": {id}, "lease": {lease}}
+	return c.postValues("/task/completed", c.workerValues(values), nil)
 }
 
 // CompletedBatch tells the server that the identified tasks were completed.
 func (c *Client) CompletedBatch(ids []string) error {
-	return c.postJSON("/task/completed_batch", ids, nil)
+	return c.postJSONQuery("/task/completed_batch", c.workerValues(nil), ids, nil)
+}
+
+// CompleteAndPop marks the tasks as completed and pops up to n more tasks in
+// a single request, like CompletedBatch followed by PopBatch.
+//
+// IDs which could not be completed, because the tasks were no longer in
+// progress, are returned instead of an error, since the popped tasks must
+// still be handled. The other results are like those of PopBatch.
+func (c *Client) CompleteAndPop(ids []string, n int) ([]*Task, *float64, []string, error) {
+	var response struct {
+		Done   bool     `json:"done"`
+		Retry  float64  `json:"retry"`
+		Tasks  []*Task  `json:"tasks"`
+		Failed []string `json:"failed"`
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	query := c.orderValues(c.tagValues(c.workerValues(url.Values{"count": {strconv.Itoa(n)}})))
+	for key, value := range timeoutQuery(c.TaskTimeout) {
+		query[key] = value
+	}
+	if err := c.postJSONQuery("/task/complete_and_pop", query, ids, &response); err != nil {
+		return nil, nil, nil, err
+	}
+	if response.Done {
+		return nil, nil, response.Failed, nil
+	}
+	return response.Tasks, &response.Retry, response.Failed, nil
+}
+
+// CompletedLog gets up to limit of the most recently completed tasks, newest
+// first, or all of the retained tasks if limit is 0. If id is non-empty, only
+// completions of that task are listed.
+//
+// The server only retains completed tasks for contexts which enable it, e.g.
+// with SetCompletedLog.
+func (c *Client) CompletedLog(id string, limit int) ([]*CompletedRecord, error) {
+	query := url.Values{"limit": {strconv.Itoa(limit)}}
+	if id != "" {
+		query.Set("id", id)
+	}
+	var result []*CompletedRecord
+	if err := c.getQuery("/task/completed_log", query, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// RetryCompleted pushes the contents of a task from the completed log as a
+// new task, and returns the new task's ID.
+func (c *Client) RetryCompleted(id string) (string, error) {
+	var response string
+	err := c.postForm("/task/retry_completed", "id", id, &response)
+	return response, err
 }
 
-// Completed tells the server to restart the timeout window for an in-progress
+// SetCompletedLog configures the context to remember the last n completed
+// tasks, or disables the completed log if n is 0.
+func (c *Client) SetCompletedLog(n int) error {
+	return c.postForm("/context/config", "completedLog", strconv.Itoa(n), nil)
+}
+
+// tagValues adds c.Tags to values, creating values if necessary.
+func (c *Client) tagValues(values url.Values) url.Values {
+	if len(c.Tags) == 0 {
+		return values
+	}
+	if values == nil {
+		values = url.Values{}
+	}
+	values.Set("tags", strings.Join(c.Tags, ","))
+	return values
+}
+
+// orderValues adds c.Order to values, creating values if necessary.
+func (c *Client) orderValues(values url.Values) url.Values {
+	if c.Order == "" {
+		return values
+	}
+	if values == nil {
+		values = url.Values{}
+	}
+	values.Set("order", c.Order)
+	return values
+}
+
+// workerValues adds c.WorkerName to values, creating values if necessary.
+func (c *Client) workerValues(values url.Values) url.Values {
+	if c.WorkerName == "" {
+		return values
+	}
+	if values == nil {
+		values = url.Values{}
+	}
+	values.Set("worker", c.WorkerName)
+	return values
+}
+
+// Keepalive tells the server to restart the timeout window for an in-progress
 // task.
-func (c *Client) Keepalive(id string) error {
-	return c.postForm("/task/keepalive", "id", id, nil)
+//
+// The result is nil if the server is too old to report the task's new
+// expiration time and attempt count.
+func (c *Client) Keepalive(id string) (*KeepaliveResult, error) {
+	if c.BatchDelay != 0 {
+		return c.batchKeepalive(id, "")
+	}
+	return c.keepalive("/task/keepalive", url.Values{"id": {id}})
+}
+
+// KeepaliveLease is like Keepalive, but fails if the task has been popped
+// again since it was given the lease.
+func (c *Client) KeepaliveLease(id, lease string) (*KeepaliveResult, error) {
+	if c.BatchDelay != 0 {
+		return c.batchKeepalive(id, lease)
+	}
+	return c.keepalive("/task/keepalive", url.Values{"id": {id}, "lease": {lease}})
+}
+
+func (c *Client) keepalive(path string, values url.Values) (*KeepaliveResult, error) {
+	var response json.RawMessage
+	body := []byte(values.Encode())
+	err := c.postQuery(path, timeoutQuery(c.TaskTimeout),
+		"application/x-www-form-urlencoded", body, &response)
+	if err != nil {
+		return nil, err
+	}
+	var info struct {
+		Expiration int64 `json:"expiration"`
+		Attempts   int   `json:"attempts"`
+	}
+	if err := json.Unmarshal(response, &info); err != nil {
+		// Older servers simply return true.
+		return nil, nil
+	}
+	return &KeepaliveResult{
+		Expiration: time.UnixMilli(info.Expiration),
+		Attempts:   info.Attempts,
+	}, nil
+}
+
+// Clear deletes all pending and running tasks in the queue.
+func (c *Client) Clear() error {
+	return c.postValues("/task/clear", nil, nil)
+}
+
+// Rename moves the context named from to the name to, keeping its tasks,
+// counters, and settings. It is not affected by the client's own context.
+func (c *Client) Rename(from, to string) error {
+	return c.postValues("/context/rename", url.Values{"from": {from}, "to": {to}}, nil)
+}
+
+// Clone copies the context named from to the name to, including its tasks,
+// counters, and settings. It is not affected by the client's own context.
+func (c *Client) Clone(from, to string) error {
+	return c.postValues("/context/clone", url.Values{"from": {from}, "to": {to}}, nil)
+}
+
+// ExpireAll marks all running tasks as expired, allowing them to be popped
+// again immediately, and returns the number of expired tasks.
+func (c *Client) ExpireAll() (int, error) {
+	var n int
+	err := c.postValues("/task/expire_all", nil, &n)
+	return n, err
+}
+
+// Expire marks one running task as expired, allowing it to be popped again
+// immediately.
+func (c *Client) Expire(id string) error {
+	return c.postValues("/task/expire", url.Values{"id": {id}}, nil)
+}
+
+// QueueExpired moves all expired tasks back into the pending queue and
+// returns the number of moved tasks.
+func (c *Client) QueueExpired() (int, error) {
+	var n int
+	err := c.postValues("/task/queue_expired", nil, &n)
+	return n, err
+}
+
+// BulkResult is the outcome of Bulk for one context.
+type BulkResult struct {
+	Context string `json:"context"`
+	Count   int    `json:"count"`
+	Error   string `json:"error"`
+}
+
+// Bulk applies an operation ("clear", "expire_all", or "queue_expired") to
+// each of the named contexts, which are not affected by the client's own
+// context. Failures in individual contexts are reported in the results.
+func (c *Client) Bulk(op string, contexts []string) ([]*BulkResult, error) {
+	var results []*BulkResult
+	err := c.postJSONQuery("/context/bulk", url.Values{"op": {op}}, contexts, &results)
+	return results, err
+}
+
+// Progress reports the progress of an in-progress task, which is visible to
+// anyone inspecting the queue.
+//
+// The value is typically a fraction between 0 and 1, and the message is an
+// optional human-readable description.
+func (c *Client) Progress(id string, value float64, message string) error {
+	return c.progress(id, "", value, message)
+}
+
+func (c *Client) progress(id, lease string, value float64, message string) error {
+	values := url.Values{
+		"id":    {id},
+		"value": {strconv.FormatFloat(value, 'g', -1, 64)},
+	}
+	if lease != "" {
+		values.Set("lease", lease)
+	}
+	if message != "" {
+		values.Set("message", message)
+	}
+	return c.postValues("/task/progress", values, nil)
+}
+
+// Annotate attaches metadata, such as the worker's host or a log URL, to an
+// in-progress task, which is visible when listing or peeking the task and is
+// kept in the completed log.
+//
+// The annotations are merged with the task's existing annotations, and empty
+// values remove annotations. The task's resulting annotations are returned.
+func (c *Client) Annotate(id string, annotations map[string]string) (map[string]string, error) {
+	return c.annotate(id, "", annotations)
+}
+
+func (c *Client) annotate(id, lease string, annotations map[string]string) (map[string]string,
+	error) {
+	query := url.Values{"id": {id}}
+	if lease != "" {
+		query.Set("lease", lease)
+	}
+	var result map[string]string
+	if err := c.postJSONQuery("/task/annotate", query, annotations, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Requeue puts an in-progress task back into the queue, where it cannot be
+// popped again until the delay has passed.
+func (c *Client) Requeue(id string, delay time.Duration) error {
+	return c.requeue(id, "", delay)
+}
+
+func (c *Client) requeue(id, lease string, delay time.Duration) error {
+	values := url.Values{
+		"id":    {id},
+		"delay": {strconv.FormatFloat(delay.Seconds(), 'g', -1, 64)},
+	}
+	if lease != "" {
+		values.Set("lease", lease)
+	}
+	return c.postValues("/task/requeue", values, nil)
+}
+
+// Running lists in-progress tasks in order of expiration, soonest first.
+//
+// If limit is non-zero, at most limit tasks are returned.
+func (c *Client) Running(limit int) ([]*RunningTaskInfo, error) {
+	var result []*RunningTaskInfo
+	err := c.getQuery("/task/running", url.Values{"limit": {strconv.Itoa(limit)}}, &result)
+	return result, err
+}
+
+// StuckTasks lists the running tasks which have been popped too many times,
+// or which have been running for much longer than the context's tasks
+// usually take, in order of expiration.
+func (c *Client) StuckTasks() ([]*StuckTask, error) {
+	var result []*StuckTask
+	err := c.get("/task/stuck", &result)
+	return result, err
+}
+
+// Config gets the settings of the context.
+func (c *Client) Config() (*ContextConfig, error) {
+	var result ContextConfig
+	if err := c.get("/context/config", &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// SetBackoff configures the context to delay each expired task before it can
+// be popped again, doubling the delay each time the task expires, up to
+// maxBackoff (if non-zero).
+func (c *Client) SetBackoff(backoff, maxBackoff time.Duration) error {
+	return c.postValues("/context/config", url.Values{
+		"backoff":    {strconv.FormatFloat(backoff.Seconds(), 'g', -1, 64)},
+		"maxBackoff": {strconv.FormatFloat(maxBackoff.Seconds(), 'g', -1, 64)},
+	}, nil)
+}
+
+// SetAlerts configures the server to alert when the context has more than
+// pending pending tasks, more than expired expired tasks, or has had no tasks
+// completed for stall while tasks remain. Zero values disable the
+// corresponding alerts.
+func (c *Client) SetAlerts(pending, expired int64, stall time.Duration) error {
+	return c.postValues("/context/config", url.Values{
+		"alertPending": {strconv.FormatInt(pending, 10)},
+		"alertExpired": {strconv.FormatInt(expired, 10)},
+		"alertStall":   {strconv.FormatFloat(stall.Seconds(), 'g', -1, 64)},
+	}, nil)
+}
+
+// SetTimeouts configures the context's task timeouts. Tasks popped without a
+// timeout (see PopWithTimeout) expire after timeout instead of the server's
+// default, and workers may not request timeouts longer than maxTimeout. Zero
+// values use the server's defaults.
+func (c *Client) SetTimeouts(timeout, maxTimeout time.Duration) error {
+	return c.postValues("/context/config", url.Values{
+		"timeout":    {strconv.FormatFloat(timeout.Seconds(), 'g', -1, 64)},
+		"maxTimeout": {strconv.FormatFloat(maxTimeout.Seconds(), 'g', -1, 64)},
+	}, nil)
+}
+
+// SetWeight sets the share of tasks which PopAny takes from this context,
+// relative to other contexts. The default weight is 1.
+func (c *Client) SetWeight(weight int64) error {
+	return c.postForm("/context/config", "weight", strconv.FormatInt(weight, 10), nil)
+}
+
+// SetOrder sets the order in which pops take pending tasks from the context
+// by default, which is OrderFIFO unless set otherwise. OrderLIFO and
+// OrderFair are only supported by in-memory contexts.
+func (c *Client) SetOrder(order string) error {
+	return c.postForm("/context/config", "order", order, nil)
+}
+
+// SetStuckThresholds configures when running tasks are reported as stuck:
+// once they have been popped attempts times, or once their total running
+// time is more than deviations standard deviations above the context's mean
+// latency. Zero values use the server's defaults.
+func (c *Client) SetStuckThresholds(attempts int64, deviations float64) error {
+	return c.postValues("/context/config", url.Values{
+		"stuckAttempts":   {strconv.FormatInt(attempts, 10)},
+		"stuckDeviations": {strconv.FormatFloat(deviations, 'g', -1, 64)},
+	}, nil)
+}
+
+// Autoscale gets a suggested number of workers for the context, using the
+// context's drainTime setting.
+func (c *Client) Autoscale() (*AutoscaleHint, error) {
+	var result AutoscaleHint
+	if err := c.get("/autoscale", &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
 }
 
 // QueueCounts gets the number of tasks in each queue.
@@ -184,50 +1251,301 @@ func (c *Client) QueueCounts() (*QueueCounts, error) {
 	return &result, nil
 }
 
-func (c *Client) get(path string, output interface{}) error {
-	reqURL := c.urlForPath(path)
-	req, err := http.NewRequest("GET", reqURL.String(), nil)
+// AllQueueCounts gets the number of tasks in each queue for every context on
+// the server, regardless of the client's context.
+//
+// Returns the names of the contexts and their corresponding counts.
+func (c *Client) AllQueueCounts() ([]string, []*QueueCounts, error) {
+	var result struct {
+		Names  []string       `json:"names"`
+		Counts []*QueueCounts `json:"counts"`
+	}
+	if err := c.getQuery("/counts", url.Values{"all": {"1"}}, &result); err != nil {
+		return nil, nil, err
+	}
+	return result.Names, result.Counts, nil
+}
+
+// CountsDelta lists the contexts whose counts changed since a previous call.
+type CountsDelta struct {
+	// Cursor should be passed to the next call to CountsDelta.
+	Cursor string `json:"cursor"`
+
+	// Reset is true if every matching context is listed, because the cursor
+	// was empty or could not be used (e.g. because the server restarted). In
+	// this case, any context which is not listed no longer exists.
+	Reset bool `json:"reset"`
+
+	Names   []string       `json:"names"`
+	Counts  []*QueueCounts `json:"counts"`
+	Removed []string       `json:"removed"`
+}
+
+// CountsDelta gets the counts of the contexts matching pattern, where '*'
+// matches any sequence of characters, which were modified since the given
+// cursor. Pass an empty cursor to list every matching context.
+//
+// Removed contexts should be forgotten before applying the listed counts,
+// since a context may have been removed and then created again.
+func (c *Client) CountsDelta(pattern, cursor string) (*CountsDelta, error) {
+	var result CountsDelta
+	query := url.Values{"context": {pattern}, "since": {cursor}}
+	if err := c.getQuery("/counts/delta", query, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Export writes every task in the queue which is not in progress to w as
+// newline-delimited JSON, in the format accepted by Import.
+//
+// Unlike most methods, Export does not fail over to other servers once it
+// has started writing to w.
+func (c *Client) Export(w io.Writer) error {
+	resp, err := c.stream("GET", "/task/export", "", nil)
 	if err != nil {
-		return errors.Wrap(err, "get "+path)
+		return errors.Wrap(err, "export")
 	}
-	if c.Username != "" || c.Password != "" {
-		req.SetBasicAuth(c.Username, c.Password)
+	defer resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("content-type"), "application/x-ndjson") {
+		return errors.Wrap(c.handleResponse(resp, nil, nil), "export")
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return errors.Wrap(err, "export")
+	}
+	return nil
+}
+
+// Import pushes the tasks read from r, which should be in the format written
+// by Export, and returns the number of tasks pushed. The tasks keep their
+// routing fields, and delayed or held tasks are delayed or held again.
+//
+// Since r cannot be re-read, Import does not fail over to other servers. If
+// an error occurs partway through, some of the tasks may have been pushed.
+func (c *Client) Import(r io.Reader) (int, error) {
+	resp, err := c.stream("POST", "/task/import", "application/x-ndjson", r)
+	var count int
+	if err := c.handleResponse(resp, err, &count); err != nil {
+		return count, errors.Wrap(err, "import")
 	}
-	resp, err := http.DefaultClient.Do(req)
-	if err := c.handleResponse(resp, err, output); err != nil {
+	return count, nil
+}
+
+func (c *Client) get(path string, output interface{}) error {
+	return c.getQuery(path, nil, output)
+}
+
+func (c *Client) getQuery(path string, query url.Values, output interface{}) error {
+	if err := c.do("GET", path, query, "", nil, output); err != nil {
 		return errors.Wrap(err, "get "+path)
 	}
 	return nil
 }
 
 func (c *Client) postForm(path, key, value string, output interface{}) error {
-	postBody := strings.NewReader(url.QueryEscape(key) + "=" + url.QueryEscape(value))
+	return c.postValues(path, url.Values{key: {value}}, output)
+}
+
+func (c *Client) postValues(path string, values url.Values, output interface{}) error {
+	postBody := []byte(values.Encode())
 	return c.post(path, "application/x-www-form-urlencoded", postBody, output)
 }
 
 func (c *Client) postJSON(path string, input, output interface{}) error {
+	return c.postJSONQuery(path, nil, input, output)
+}
+
+func (c *Client) postJSONQuery(path string, query url.Values, input, output interface{}) error {
 	data, err := json.Marshal(input)
 	if err != nil {
 		return errors.Wrap(err, "post "+path)
 	}
-	return c.post(path, "application/json", bytes.NewReader(data), output)
+	return c.postQuery(path, query, "application/json", data, output)
+}
+
+func (c *Client) post(path string, contentType string, input []byte, output interface{}) error {
+	return c.postQuery(path, nil, contentType, input, output)
+}
+
+func (c *Client) postQuery(path string, query url.Values, contentType string, input []byte,
+	output interface{}) error {
+	if err := c.do("POST", path, query, contentType, input, output); err != nil {
+		return errors.Wrap(err, "post "+path)
+	}
+	return nil
+}
+
+// do performs a request, trying each of the server URLs in turn (starting
+// with the one which most recently worked) until one of them can be reached
+// and is not a standby.
+func (c *Client) do(method, path string, query url.Values, contentType string, body []byte,
+	output interface{}) (err error) {
+	if c.Metrics != nil {
+		t1 := time.Now()
+		defer func() {
+			c.Metrics.Request(path, time.Since(t1), err)
+		}()
+	}
+
+	var contentEncoding string
+	if c.CompressRequests && contentType == "application/json" {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+		contentEncoding = "gzip"
+	}
+
+	ctx := context.Background()
+	if c.HTTPTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.HTTPTimeout)
+		defer cancel()
+	}
+
+	baseURLs := append([]*url.URL{c.URL}, c.FailoverURLs...)
+	c.activeLock.Lock()
+	start := c.active % len(baseURLs)
+	c.activeLock.Unlock()
+
+	requestID := c.newRequestID()
+
+	var lastErr error
+	for i := 0; i < len(baseURLs); i++ {
+		idx := (start + i) % len(baseURLs)
+		reqURL, client := c.requestTarget(baseURLs[idx], path)
+		if query != nil {
+			values := reqURL.Query()
+			for k, v := range query {
+				values[k] = v
+			}
+			reqURL.RawQuery = values.Encode()
+		}
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, reqURL.String(), bodyReader)
+		if err != nil {
+			return err
+		}
+		if contentType != "" {
+			req.Header.Set("content-type", contentType)
+		}
+		if contentEncoding != "" {
+			req.Header.Set("content-encoding", contentEncoding)
+		}
+		c.setHeaders(req, requestID)
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode == http.StatusServiceUnavailable &&
+			len(baseURLs) > 1 {
+			lastErr = c.handleResponse(resp, nil, nil)
+			c.retrying(path, i, len(baseURLs), lastErr)
+			continue
+		} else if err != nil {
+			lastErr = err
+			c.retrying(path, i, len(baseURLs), lastErr)
+			continue
+		}
+		c.activeLock.Lock()
+		c.active = idx
+		c.activeLock.Unlock()
+		return c.handleResponse(resp, nil, output)
+	}
+	return lastErr
 }
 
-func (c *Client) post(path string, contentType string, input io.Reader, output interface{}) error {
-	reqURL := c.urlForPath(path)
-	req, err := http.NewRequest("POST", reqURL.String(), input)
+// retrying reports a failover retry to c.Metrics after the request to the
+// i-th of n servers failed, unless it was the last server.
+func (c *Client) retrying(path string, i, n int, err error) {
+	if c.Metrics != nil && i+1 < n {
+		c.Metrics.Retry(path, err)
+	}
+}
+
+// stream performs a request with a streamed body or response, using the
+// server which most recently worked.
+//
+// The latency reported to c.Metrics only includes the time until the response
+// headers are received.
+func (c *Client) stream(method, path, contentType string, body io.Reader) (
+	resp *http.Response, err error) {
+	if c.Metrics != nil {
+		t1 := time.Now()
+		defer func() {
+			c.Metrics.Request(path, time.Since(t1), err)
+		}()
+	}
+
+	baseURLs := append([]*url.URL{c.URL}, c.FailoverURLs...)
+	c.activeLock.Lock()
+	baseURL := baseURLs[c.active%len(baseURLs)]
+	c.activeLock.Unlock()
+
+	reqURL, client := c.requestTarget(baseURL, path)
+	req, err := http.NewRequest(method, reqURL.String(), body)
 	if err != nil {
-		return errors.Wrap(err, "get "+path)
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("content-type", contentType)
 	}
-	req.Header.Set("content-type", contentType)
+	c.setHeaders(req, c.newRequestID())
+	return client.Do(req)
+}
+
+// setHeaders adds the headers common to every request.
+func (c *Client) setHeaders(req *http.Request, requestID string) {
 	if c.Username != "" || c.Password != "" {
 		req.SetBasicAuth(c.Username, c.Password)
 	}
-	resp, err := http.DefaultClient.Do(req)
-	if err := c.handleResponse(resp, err, output); err != nil {
-		return errors.Wrap(err, "post "+path)
+	req.Header.Set("user-agent", c.userAgent())
+	req.Header.Set(RequestIDHeader, requestID)
+}
+
+func (c *Client) userAgent() string {
+	if c.UserAgent != "" {
+		return c.UserAgent
 	}
-	return nil
+	hostname, _ := os.Hostname()
+	res := "tasq-go-client (host " + hostname + "; pid " + strconv.Itoa(os.Getpid())
+	if c.WorkerName != "" {
+		res += "; worker " + c.WorkerName
+	}
+	return res + ")"
+}
+
+func (c *Client) newRequestID() string {
+	if c.RequestID != nil {
+		return c.RequestID()
+	}
+	var data [8]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(data[:])
+}
+
+func (c *Client) keepaliveInterval() time.Duration {
+	if c.KeepaliveInterval != 0 {
+		return c.KeepaliveInterval
+	}
+	if c.TaskTimeout != 0 && c.TaskTimeout/3 < DefaultKeepaliveInterval {
+		return c.TaskTimeout / 3
+	}
+	return DefaultKeepaliveInterval
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return DefaultHTTPClient
 }
 
 func (c *Client) handleResponse(resp *http.Response, err error, output interface{}) error {
@@ -244,14 +1562,27 @@ func (c *Client) handleResponse(resp *http.Response, err error, output interface
 	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
 		return err
 	} else if response.Error != nil {
-		return errors.New("remote error: " + *response.Error)
+		return &RemoteError{
+			StatusCode: resp.StatusCode,
+			Message:    *response.Error,
+			RequestID:  resp.Header.Get(RequestIDHeader),
+		}
 	} else {
 		return nil
 	}
 }
 
-func (c *Client) urlForPath(p string) *url.URL {
-	u := *c.URL
+// timeoutQuery creates the query for a custom task timeout, or returns nil
+// for the server's default timeout.
+func timeoutQuery(timeout time.Duration) url.Values {
+	if timeout == 0 {
+		return nil
+	}
+	return url.Values{"timeout": {strconv.FormatFloat(timeout.Seconds(), 'g', -1, 64)}}
+}
+
+func urlForPath(base *url.URL, p string) *url.URL {
+	u := *base
 	if u.Path == "/" || u.Path == "" {
 		u.Path = p
 	} else {
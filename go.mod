@@ -5,4 +5,5 @@ go 1.14
 require (
 	github.com/pkg/errors v0.9.1
 	github.com/unixpickle/essentials v1.3.0
+	go.etcd.io/bbolt v1.3.6
 )
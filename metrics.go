@@ -0,0 +1,49 @@
+package tasq
+
+import "time"
+
+// Metrics receives events about a Client's requests, for example to export
+// them to a monitoring system such as Prometheus.
+//
+// Methods may be called concurrently, and should return quickly since they
+// are called from the Goroutines making the requests.
+type Metrics interface {
+	// Request is called when an API call finishes, with the path of the
+	// endpoint (e.g. "/task/pop"), the total latency including any
+	// failover attempts, and the resulting error (or nil).
+	Request(path string, latency time.Duration, err error)
+
+	// Retry is called when a request to one server fails and the request is
+	// retried on the next server in FailoverURLs.
+	Retry(path string, err error)
+
+	// KeepaliveFailure is called when a RunningTask's keepalive request fails,
+	// with the number of consecutive failures so far.
+	KeepaliveFailure(task *RunningTask, failures int, err error)
+}
+
+// MetricsFuncs implements Metrics by calling the non-nil functions, for when
+// only some events are of interest.
+type MetricsFuncs struct {
+	RequestFunc          func(path string, latency time.Duration, err error)
+	RetryFunc            func(path string, err error)
+	KeepaliveFailureFunc func(task *RunningTask, failures int, err error)
+}
+
+func (m *MetricsFuncs) Request(path string, latency time.Duration, err error) {
+	if m.RequestFunc != nil {
+		m.RequestFunc(path, latency, err)
+	}
+}
+
+func (m *MetricsFuncs) Retry(path string, err error) {
+	if m.RetryFunc != nil {
+		m.RetryFunc(path, err)
+	}
+}
+
+func (m *MetricsFuncs) KeepaliveFailure(task *RunningTask, failures int, err error) {
+	if m.KeepaliveFailureFunc != nil {
+		m.KeepaliveFailureFunc(task, failures, err)
+	}
+}
@@ -1,8 +1,11 @@
 package tasq
 
 import (
+	"net/http"
 	"sync"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 // A RunningTask represents an in-progress task that is actively being
@@ -11,36 +14,82 @@ import (
 //
 // The object will automatically manage a background Goroutine that sends
 // keepalives to the server until Completed() or Cancel() is called on it.
+// If the keepalives fail, the lease is lost and Done() is closed; see
+// Client.MaxKeepaliveFailures.
 type RunningTask struct {
 	Contents string
 	ID       string
+	Lease    string
+	Checksum string
 
 	client *Client
 
 	cancelLock sync.Mutex
 	cancelled  bool
 	cancelChan chan struct{}
+
+	lostChan chan struct{}
+	lostErr  error
+
+	exitChan chan struct{}
 }
 
-func newRunningTask(client *Client, contents, id string, interval time.Duration) *RunningTask {
+func newRunningTask(client *Client, task *Task, interval time.Duration) *RunningTask {
 	r := &RunningTask{
-		Contents:   contents,
-		ID:         id,
+		Contents:   task.Contents,
+		ID:         task.ID,
+		Lease:      task.Lease,
+		Checksum:   task.Checksum,
 		client:     client,
 		cancelChan: make(chan struct{}),
+		lostChan:   make(chan struct{}),
+		exitChan:   make(chan struct{}),
 	}
+	client.addRunningTask(r)
 	go r.keepaliveLoop(interval)
 	return r
 }
 
 // Completed marks the task as complete and cancels the keepalive loop.
 //
+// If the server issued a lease for the task, completion fails if the task has
+// since been popped by another worker.
+//
 // Even if this returns an error, the keepalive loop will be stopped.
 func (r *RunningTask) Completed() error {
 	r.Cancel()
+	if r.Lease != "" {
+		return r.client.CompletedLease(r.ID, r.Lease)
+	}
 	return r.client.Completed(r.ID)
 }
 
+// VerifyChecksum is like Task.VerifyChecksum.
+func (r *RunningTask) VerifyChecksum() error {
+	return verifyChecksum(r.ID, r.Contents, r.Checksum)
+}
+
+// Requeue cancels the keepalive loop and puts the task back into the queue,
+// where it cannot be popped again until the delay has passed.
+//
+// This is useful when a task fails for a temporary reason, such as a rate
+// limit, and should be retried later by any worker.
+func (r *RunningTask) Requeue(delay time.Duration) error {
+	r.Cancel()
+	return r.client.requeue(r.ID, r.Lease, delay)
+}
+
+// Progress reports the progress of the task to the server.
+func (r *RunningTask) Progress(value float64, message string) error {
+	return r.client.progress(r.ID, r.Lease, value, message)
+}
+
+// Annotate attaches metadata to the task on the server, like
+// Client.Annotate.
+func (r *RunningTask) Annotate(annotations map[string]string) (map[string]string, error) {
+	return r.client.annotate(r.ID, r.Lease, annotations)
+}
+
 // Cancel the task's keepalive loop.
 //
 // This may be called any number of times, even if the task was completed,
@@ -54,13 +103,94 @@ func (r *RunningTask) Cancel() {
 	}
 }
 
+// Done returns a channel which is closed if the task's lease is lost, i.e.
+// if the server reports that the task is no longer in progress, or if too
+// many keepalives fail in a row. In this case, the task may be given to
+// another worker, so the worker can stop working on it.
+//
+// The channel is not closed by Completed(), Requeue(), or Cancel().
+func (r *RunningTask) Done() <-chan struct{} {
+	return r.lostChan
+}
+
+// Err returns the keepalive error which caused the lease to be lost, or nil
+// if Done() has not been closed.
+func (r *RunningTask) Err() error {
+	select {
+	case <-r.lostChan:
+		return r.lostErr
+	default:
+		return nil
+	}
+}
+
 func (r *RunningTask) keepaliveLoop(interval time.Duration) {
+	defer func() {
+		r.client.removeRunningTask(r)
+		close(r.exitChan)
+	}()
+	maxFailures := r.client.MaxKeepaliveFailures
+	if maxFailures == 0 {
+		maxFailures = DefaultMaxKeepaliveFailures
+	}
+	var failures int
 	for {
 		select {
 		case <-time.After(interval):
 		case <-r.cancelChan:
 			return
 		}
-		r.client.Keepalive(r.ID)
+		var err error
+		if r.Lease != "" {
+			_, err = r.client.KeepaliveLease(r.ID, r.Lease)
+		} else {
+			_, err = r.client.Keepalive(r.ID)
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		if r.client.Metrics != nil {
+			r.client.Metrics.KeepaliveFailure(r, failures, err)
+		}
+		remoteErr, ok := errors.Cause(err).(*RemoteError)
+		if failures >= maxFailures || (ok && remoteErr.StatusCode == http.StatusOK) {
+			r.leaseLost(err)
+			return
+		}
 	}
 }
+
+func (r *RunningTask) leaseLost(err error) {
+	r.cancelLock.Lock()
+	if r.cancelled {
+		// The task was completed or cancelled during the keepalive.
+		r.cancelLock.Unlock()
+		return
+	}
+	r.cancelled = true
+	close(r.cancelChan)
+	r.cancelLock.Unlock()
+
+	r.lostErr = err
+	close(r.lostChan)
+	if r.client.OnLeaseLost != nil {
+		r.client.OnLeaseLost(r, err)
+	}
+}
+
+func (c *Client) addRunningTask(r *RunningTask) {
+	c.runningLock.Lock()
+	defer c.runningLock.Unlock()
+	if c.runningTasks == nil {
+		c.runningTasks = map[*RunningTask]struct{}{}
+	}
+	c.runningTasks[r] = struct{}{}
+}
+
+func (c *Client) removeRunningTask(r *RunningTask) {
+	c.runningLock.Lock()
+	defer c.runningLock.Unlock()
+	delete(c.runningTasks, r)
+}
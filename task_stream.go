@@ -0,0 +1,103 @@
+package tasq
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A TaskStream yields running tasks from a queue until the queue is exhausted.
+//
+// Create one with Client.Tasks().
+type TaskStream struct {
+	// C yields popped tasks, and is closed when the queue is exhausted, the
+	// context is cancelled, or an error occurs.
+	//
+	// Every task received from C must be completed or cancelled.
+	C <-chan *RunningTask
+
+	errLock sync.Mutex
+	err     error
+}
+
+// Tasks pops tasks in batches of batchSize and yields them on a TaskStream,
+// waiting for running tasks to expire as needed.
+//
+// Each task has a keepalive loop as soon as it is popped, even before it is
+// received from the stream. The stream only pops another batch once every
+// task from the previous batch has been received.
+//
+// For example:
+//
+//	stream := client.Tasks(ctx, 10)
+//	for task := range stream.C {
+//	    ...
+//	    task.Completed()
+//	}
+//	if err := stream.Err(); err != nil {
+//	    ...
+//	}
+func (c *Client) Tasks(ctx context.Context, batchSize int) *TaskStream {
+	ch := make(chan *RunningTask)
+	res := &TaskStream{C: ch}
+	go func() {
+		defer close(ch)
+		res.setErr(c.streamTasks(ctx, batchSize, ch))
+	}()
+	return res
+}
+
+// Err returns the error which stopped the stream, if any.
+//
+// This should be called after C is closed. If the queue was exhausted, the
+// result is nil.
+func (t *TaskStream) Err() error {
+	t.errLock.Lock()
+	defer t.errLock.Unlock()
+	return t.err
+}
+
+func (t *TaskStream) setErr(err error) {
+	t.errLock.Lock()
+	defer t.errLock.Unlock()
+	t.err = err
+}
+
+func (c *Client) streamTasks(ctx context.Context, batchSize int, ch chan<- *RunningTask) error {
+	interval := c.keepaliveInterval()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		tasks, wait, err := c.PopBatch(batchSize)
+		if err != nil {
+			return err
+		}
+		if len(tasks) == 0 {
+			if wait == nil {
+				return nil
+			}
+			select {
+			case <-time.After(time.Duration(float64(time.Second) * (*wait))):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		running := make([]*RunningTask, len(tasks))
+		for i, task := range tasks {
+			running[i] = newRunningTask(c, task, interval)
+		}
+		for i, task := range running {
+			select {
+			case ch <- task:
+			case <-ctx.Done():
+				// The remaining tasks will expire on the server.
+				for _, t := range running[i:] {
+					t.Cancel()
+				}
+				return ctx.Err()
+			}
+		}
+	}
+}
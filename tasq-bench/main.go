@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/tasq"
+)
+
+func main() {
+	var host string
+	var context string
+	var username string
+	var password string
+	var workers int
+	var duration time.Duration
+	var taskSize int
+	var batchSize int
+	var prefill int
+	var pushWeight float64
+	var popWeight float64
+	var completeFraction float64
+	flag.StringVar(&host, "host", "", "server URL")
+	flag.StringVar(&context, "context", "tasq-bench", "tasq context name")
+	flag.StringVar(&username, "username", "", "basic auth username")
+	flag.StringVar(&password, "password", "", "basic auth password")
+	flag.IntVar(&workers, "workers", 8, "number of concurrent clients")
+	flag.DurationVar(&duration, "duration", 10*time.Second, "length of the benchmark")
+	flag.IntVar(&taskSize, "task-size", 64, "number of bytes in each task")
+	flag.IntVar(&batchSize, "batch-size", 1, "number of tasks to push or pop per request")
+	flag.IntVar(&prefill, "prefill", 0, "number of tasks to push before starting")
+	flag.Float64Var(&pushWeight, "push-weight", 1, "relative frequency of push operations")
+	flag.Float64Var(&popWeight, "pop-weight", 1, "relative frequency of pop operations")
+	flag.Float64Var(&completeFraction, "complete-fraction", 1,
+		"fraction of popped tasks to complete (the rest expire)")
+	flag.Parse()
+
+	if host == "" {
+		essentials.Die("Must provide -host argument. See -help.")
+	} else if workers <= 0 || batchSize <= 0 {
+		essentials.Die("The -workers and -batch-size arguments must be positive.")
+	} else if pushWeight < 0 || popWeight < 0 || pushWeight+popWeight == 0 {
+		essentials.Die("Invalid -push-weight and -pop-weight arguments.")
+	}
+
+	client, err := tasq.NewClient(host, context, username, password)
+	essentials.Must(err)
+
+	contents := strings.Repeat("x", taskSize)
+	for i := 0; i < prefill; i += batchSize {
+		n := essentials.MinInt(batchSize, prefill-i)
+		_, err := client.PushBatch(repeatString(contents, n))
+		essentials.Must(err)
+	}
+
+	stats := NewStats()
+	deadline := time.Now().Add(duration)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			gen := rand.New(rand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				if gen.Float64()*(pushWeight+popWeight) < pushWeight {
+					push(client, stats, contents, batchSize)
+				} else {
+					popAndComplete(client, stats, gen, batchSize, completeFraction)
+				}
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+
+	stats.Report(duration)
+}
+
+func push(client *tasq.Client, stats *Stats, contents string, batchSize int) {
+	t1 := time.Now()
+	var err error
+	if batchSize == 1 {
+		_, err = client.Push(contents)
+	} else {
+		_, err = client.PushBatch(repeatString(contents, batchSize))
+	}
+	stats.Add("push", time.Since(t1), batchSize, err)
+}
+
+func popAndComplete(client *tasq.Client, stats *Stats, gen *rand.Rand, batchSize int,
+	completeFraction float64) {
+	t1 := time.Now()
+	var tasks []*tasq.Task
+	var err error
+	if batchSize == 1 {
+		var task *tasq.Task
+		task, _, err = client.Pop()
+		if task != nil {
+			tasks = append(tasks, task)
+		}
+	} else {
+		tasks, _, err = client.PopBatch(batchSize)
+	}
+	stats.Add("pop", time.Since(t1), len(tasks), err)
+
+	for _, task := range tasks {
+		if gen.Float64() >= completeFraction {
+			continue
+		}
+		t1 := time.Now()
+		err := client.Completed(task.ID)
+		stats.Add("complete", time.Since(t1), 1, err)
+	}
+}
+
+func repeatString(s string, n int) []string {
+	res := make([]string, n)
+	for i := range res {
+		res[i] = s
+	}
+	return res
+}
+
+// Stats records the latencies of requests of each kind.
+type Stats struct {
+	lock      sync.Mutex
+	latencies map[string][]time.Duration
+	tasks     map[string]int
+	errors    map[string]int
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		latencies: map[string][]time.Duration{},
+		tasks:     map[string]int{},
+		errors:    map[string]int{},
+	}
+}
+
+// Add records a request which affected numTasks tasks.
+func (s *Stats) Add(op string, latency time.Duration, numTasks int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		s.errors[op]++
+		return
+	}
+	s.latencies[op] = append(s.latencies[op], latency)
+	s.tasks[op] += numTasks
+}
+
+// Report prints the throughput and latency percentiles of each kind of
+// request.
+func (s *Stats) Report(duration time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	fmt.Printf("%-9s %10s %10s %8s %10s %10s %10s %10s\n", "op", "requests/s", "tasks/s",
+		"errors", "p50", "p90", "p99", "max")
+	for _, op := range []string{"push", "pop", "complete"} {
+		latencies := s.latencies[op]
+		if len(latencies) == 0 && s.errors[op] == 0 {
+			continue
+		}
+		sort.Slice(latencies, func(i, j int) bool {
+			return latencies[i] < latencies[j]
+		})
+		fmt.Printf(
+			"%-9s %10.1f %10.1f %8d %10s %10s %10s %10s\n",
+			op,
+			float64(len(latencies))/duration.Seconds(),
+			float64(s.tasks[op])/duration.Seconds(),
+			s.errors[op],
+			percentile(latencies, 0.5),
+			percentile(latencies, 0.9),
+			percentile(latencies, 0.99),
+			percentile(latencies, 1),
+		)
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p * float64(len(sorted)-1))
+	return sorted[idx].Round(time.Microsecond)
+}
@@ -0,0 +1,163 @@
+// Command tasq-cli performs administrative operations on a tasq server.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/tasq"
+)
+
+const usage = `Usage: tasq-cli [flags] <command> [args]
+
+Commands:
+  push <contents...>  push one task per argument and print their IDs
+  pop                 pop a task and print it
+  complete <ids...>   mark tasks as completed
+  peek                show the next task that would be popped
+  running [limit]     list in-progress tasks, soonest to expire first
+  counts              show the number of tasks in the context
+  clear               delete all pending and running tasks in the context
+  expire-all          expire all running tasks in the context
+  list                show the counts for every context on the server
+  watch               repeatedly show the counts for the context
+
+Flags:
+`
+
+func main() {
+	var host string
+	var context string
+	var username string
+	var password string
+	var interval time.Duration
+	flag.StringVar(&host, "host", "http://localhost:8080", "server URL")
+	flag.StringVar(&context, "context", "", "tasq context name")
+	flag.StringVar(&username, "username", "", "basic auth username")
+	flag.StringVar(&password, "password", "", "basic auth password")
+	flag.DurationVar(&interval, "interval", time.Second*5, "time between updates for watch")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	client, err := tasq.NewClient(host, context, username, password)
+	essentials.Must(err)
+
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "push":
+		if len(args) == 0 {
+			essentials.Die("push requires at least one argument")
+		}
+		ids, err := client.PushBatch(args)
+		essentials.Must(err)
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+	case "pop":
+		task, retry, err := client.Pop()
+		essentials.Must(err)
+		if task != nil {
+			printJSON(task)
+		} else if retry != nil {
+			fmt.Printf("No tasks available (retry in %.2f seconds)\n", *retry)
+		} else {
+			fmt.Println("Queue is exhausted")
+		}
+	case "complete":
+		if len(args) == 0 {
+			essentials.Die("complete requires at least one task ID")
+		}
+		essentials.Must(client.CompletedBatch(args))
+	case "peek":
+		result, err := client.Peek()
+		essentials.Must(err)
+		if result.Task != nil {
+			printJSON(result.Task)
+		} else if result.Done {
+			fmt.Println("Queue is exhausted")
+		} else {
+			fmt.Printf("No tasks available (retry in %.2f seconds)\n", result.Retry)
+			if result.Next != nil {
+				fmt.Print("Next to expire: ")
+				printJSON(result.Next)
+			}
+		}
+	case "running":
+		var limit int
+		if len(args) > 0 {
+			limit, err = strconv.Atoi(args[0])
+			essentials.Must(err)
+		}
+		tasks, err := client.Running(limit)
+		essentials.Must(err)
+		for _, task := range tasks {
+			expiration := time.Unix(0, task.Expiration*int64(time.Millisecond))
+			fmt.Printf("%s expires=%s attempts=%d contents=%q\n", task.ID,
+				expiration.Format(time.RFC3339), task.Attempts, task.Contents)
+		}
+	case "counts":
+		counts, err := client.QueueCounts()
+		essentials.Must(err)
+		printCounts(counts)
+	case "clear":
+		essentials.Must(client.Clear())
+	case "expire-all":
+		n, err := client.ExpireAll()
+		essentials.Must(err)
+		fmt.Printf("Expired %d tasks\n", n)
+	case "list":
+		names, counts, err := client.AllQueueCounts()
+		essentials.Must(err)
+		if len(names) == 0 {
+			fmt.Println("No active queues.")
+		}
+		for i, name := range names {
+			if name == "" {
+				fmt.Println("---- Default context ----")
+			} else {
+				fmt.Printf("---- Context: %s ----\n", name)
+			}
+			printCounts(counts[i])
+		}
+	case "watch":
+		for {
+			counts, err := client.QueueCounts()
+			essentials.Must(err)
+			fmt.Printf("%s pending=%d running=%d expired=%d backingOff=%d delayed=%d held=%d "+
+				"completed=%d\n", time.Now().Format(time.RFC3339), counts.Pending, counts.Running,
+				counts.Expired, counts.BackingOff, counts.Delayed, counts.Held, counts.Completed)
+			time.Sleep(interval)
+		}
+	default:
+		essentials.Die("unknown command: " + flag.Arg(0))
+	}
+}
+
+func printJSON(obj interface{}) {
+	data, err := json.MarshalIndent(obj, "", "  ")
+	essentials.Must(err)
+	fmt.Println(string(data))
+}
+
+func printCounts(counts *tasq.QueueCounts) {
+	fmt.Printf("    Pending: %d\n", counts.Pending)
+	fmt.Printf("In progress: %d\n", counts.Running)
+	fmt.Printf("    Expired: %d\n", counts.Expired)
+	fmt.Printf("Backing off: %d\n", counts.BackingOff)
+	fmt.Printf("    Delayed: %d\n", counts.Delayed)
+	fmt.Printf("       Held: %d\n", counts.Held)
+	fmt.Printf("  Completed: %d\n", counts.Completed)
+}
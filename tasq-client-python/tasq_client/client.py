@@ -3,7 +3,7 @@ import sys
 import time
 import urllib.parse
 from contextlib import contextmanager
-from dataclasses import dataclass
+from dataclasses import dataclass, fields
 from queue import Empty, Queue
 from threading import Thread
 from typing import Any, Dict, List, Optional, Tuple
@@ -31,6 +31,14 @@ class QueueCounts:
     expired: int
     completed: int
 
+    # Won't be set by servers which are too old to support delaying or holding
+    # tasks.
+    delayed: int = 0
+    held: int = 0
+
+    # Won't be set by servers which are too old to support backoff.
+    backing_off: int = 0
+
     # Won't be set if a time window wasn't specified in the request, or if the
     # server is old enough to not support rate estimation.
     rate: Optional[float] = None
@@ -263,10 +271,17 @@ class TasqClient:
                 "running": int,
                 "expired": int,
                 "completed": int,
-                OptionalKey("minute_rate"): float,
+                OptionalKey("delayed"): int,
+                OptionalKey("held"): int,
+                OptionalKey("backingOff"): int,
+                OptionalKey("rate"): float,
+                OptionalKey("modtime"): int,
             },
         )
-        return QueueCounts(**data)
+        if "backingOff" in data:
+            data["backing_off"] = data.pop("backingOff")
+        known = {f.name for f in fields(QueueCounts)}
+        return QueueCounts(**{k: v for k, v in data.items() if k in known})
 
     def __getstate__(
         self,
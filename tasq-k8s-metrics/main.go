@@ -0,0 +1,241 @@
+// Command tasq-k8s-metrics serves the queue depths and rates of a tasq server
+// through the Kubernetes external metrics API, so that a
+// HorizontalPodAutoscaler can scale workers on a queue's backlog.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/tasq"
+)
+
+const (
+	groupVersion = "external.metrics.k8s.io/v1beta1"
+	apiPrefix    = "/apis/" + groupVersion
+)
+
+// metrics maps each metric name to a function computing it, as a Kubernetes
+// quantity, from a context's counts and autoscaling hint.
+var metrics = map[string]func(*tasq.QueueCounts, *tasq.AutoscaleHint) string{
+	"tasq-pending": func(c *tasq.QueueCounts, h *tasq.AutoscaleHint) string {
+		return strconv.FormatInt(c.Pending, 10)
+	},
+	"tasq-running": func(c *tasq.QueueCounts, h *tasq.AutoscaleHint) string {
+		return strconv.FormatInt(c.Running, 10)
+	},
+	"tasq-expired": func(c *tasq.QueueCounts, h *tasq.AutoscaleHint) string {
+		return strconv.FormatInt(c.Expired, 10)
+	},
+	"tasq-delayed": func(c *tasq.QueueCounts, h *tasq.AutoscaleHint) string {
+		return strconv.FormatInt(c.Delayed, 10)
+	},
+	"tasq-held": func(c *tasq.QueueCounts, h *tasq.AutoscaleHint) string {
+		return strconv.FormatInt(c.Held, 10)
+	},
+	"tasq-remaining": func(c *tasq.QueueCounts, h *tasq.AutoscaleHint) string {
+		return strconv.FormatInt(h.Remaining, 10)
+	},
+	"tasq-rate": func(c *tasq.QueueCounts, h *tasq.AutoscaleHint) string {
+		// Rates are given in thousandths, since quantities are often
+		// fractional.
+		return strconv.FormatInt(int64(math.Round(h.Rate*1000)), 10) + "m"
+	},
+	"tasq-workers": func(c *tasq.QueueCounts, h *tasq.AutoscaleHint) string {
+		return strconv.FormatInt(h.Workers, 10)
+	},
+}
+
+type Adapter struct {
+	Host           string
+	Username       string
+	Password       string
+	DefaultContext string
+
+	lock    sync.Mutex
+	clients map[string]*tasq.Client
+}
+
+func main() {
+	adapter := &Adapter{clients: map[string]*tasq.Client{}}
+	var addr string
+	var certFile string
+	var keyFile string
+	flag.StringVar(&adapter.Host, "host", "", "tasq server URL")
+	flag.StringVar(&adapter.Username, "username", "", "basic auth username")
+	flag.StringVar(&adapter.Password, "password", "", "basic auth password")
+	flag.StringVar(&adapter.DefaultContext, "context", "",
+		"context to use when a metric's selector does not specify one")
+	flag.StringVar(&addr, "addr", ":6443", "address to listen on")
+	flag.StringVar(&certFile, "cert", "", "TLS certificate file (serve plain HTTP if empty)")
+	flag.StringVar(&keyFile, "key", "", "TLS private key file")
+	flag.Parse()
+
+	if adapter.Host == "" {
+		essentials.Die("Must provide -host argument. See -help.")
+	}
+
+	http.HandleFunc(apiPrefix, adapter.ServeResources)
+	http.HandleFunc(apiPrefix+"/", adapter.ServeMetric)
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	log.Printf("serving external metrics on %s", addr)
+	if certFile != "" {
+		essentials.Must(http.ListenAndServeTLS(addr, certFile, keyFile, nil))
+	} else {
+		essentials.Must(http.ListenAndServe(addr, nil))
+	}
+}
+
+// ServeResources lists the available metrics, which Kubernetes uses to
+// discover the API.
+func (a *Adapter) ServeResources(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	resources := []interface{}{}
+	for _, name := range names {
+		resources = append(resources, map[string]interface{}{
+			"name":         name,
+			"singularName": "",
+			"namespaced":   true,
+			"kind":         "ExternalMetricValueList",
+			"verbs":        []string{"get"},
+		})
+	}
+	serveJSON(w, http.StatusOK, map[string]interface{}{
+		"kind":         "APIResourceList",
+		"apiVersion":   "v1",
+		"groupVersion": groupVersion,
+		"resources":    resources,
+	})
+}
+
+// ServeMetric serves a request like
+// /apis/external.metrics.k8s.io/v1beta1/namespaces/NS/METRIC?labelSelector=context%3DNAME.
+//
+// The namespace is ignored, and the context is taken from the "context" label
+// of the selector.
+func (a *Adapter) ServeMetric(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, apiPrefix+"/"), "/")
+	if len(parts) != 3 || parts[0] != "namespaces" {
+		serveStatus(w, http.StatusNotFound, "unknown path: "+r.URL.Path)
+		return
+	}
+	metricName := parts[2]
+	metric, ok := metrics[metricName]
+	if !ok {
+		serveStatus(w, http.StatusNotFound, "unknown metric: "+metricName)
+		return
+	}
+	context, err := a.selectedContext(r.URL.Query().Get("labelSelector"))
+	if err != nil {
+		serveStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	client, err := a.client(context)
+	if err != nil {
+		serveStatus(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	counts, err := client.QueueCounts()
+	if err != nil {
+		serveStatus(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	hint, err := client.Autoscale()
+	if err != nil {
+		serveStatus(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	serveJSON(w, http.StatusOK, map[string]interface{}{
+		"kind":       "ExternalMetricValueList",
+		"apiVersion": groupVersion,
+		"metadata":   map[string]interface{}{},
+		"items": []interface{}{
+			map[string]interface{}{
+				"metricName":   metricName,
+				"metricLabels": map[string]string{"context": context},
+				"timestamp":    time.Now().UTC().Format(time.RFC3339),
+				"value":        metric(counts, hint),
+			},
+		},
+	})
+}
+
+// selectedContext finds the context in a label selector, which may only
+// contain equality requirements, such as "context=foo".
+func (a *Adapter) selectedContext(selector string) (string, error) {
+	context := a.DefaultContext
+	if selector == "" {
+		return context, nil
+	}
+	for _, requirement := range strings.Split(selector, ",") {
+		var key, value string
+		if idx := strings.Index(requirement, "=="); idx != -1 {
+			key, value = requirement[:idx], requirement[idx+2:]
+		} else if idx := strings.Index(requirement, "="); idx != -1 && !strings.HasSuffix(requirement[:idx], "!") {
+			key, value = requirement[:idx], requirement[idx+1:]
+		} else {
+			return "", &selectorError{selector}
+		}
+		if strings.TrimSpace(key) == "context" {
+			context = strings.TrimSpace(value)
+		}
+	}
+	return context, nil
+}
+
+func (a *Adapter) client(context string) (*tasq.Client, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if client, ok := a.clients[context]; ok {
+		return client, nil
+	}
+	client, err := tasq.NewClient(a.Host, context, a.Username, a.Password)
+	if err != nil {
+		return nil, err
+	}
+	a.clients[context] = client
+	return client, nil
+}
+
+type selectorError struct {
+	Selector string
+}
+
+func (s *selectorError) Error() string {
+	return "unsupported label selector (only equality is supported): " + s.Selector
+}
+
+func serveStatus(w http.ResponseWriter, code int, message string) {
+	serveJSON(w, code, map[string]interface{}{
+		"kind":       "Status",
+		"apiVersion": "v1",
+		"metadata":   map[string]interface{}{},
+		"status":     "Failure",
+		"message":    message,
+		"code":       code,
+	})
+}
+
+func serveJSON(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(obj)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// An Alerter periodically checks every context against the alert thresholds
+// in its QueueConfig, and posts to a webhook whenever an alert starts or
+// stops firing.
+//
+// The webhook receives a JSON object with a "text" field, so it can be a
+// Slack incoming webhook, as well as "context", "alert", "firing", and
+// "counts" fields for other consumers.
+type Alerter struct {
+	WebhookURL string
+	Interval   time.Duration
+
+	contexts map[string]*contextAlerts
+}
+
+type contextAlerts struct {
+	firing map[string]bool
+
+	// Used to detect stalls.
+	completed    int64
+	lastProgress time.Time
+}
+
+// An AlertEvent is sent to the webhook.
+type AlertEvent struct {
+	Text    string       `json:"text"`
+	Context string       `json:"context"`
+	Alert   string       `json:"alert"`
+	Firing  bool         `json:"firing"`
+	Counts  *QueueCounts `json:"counts"`
+}
+
+// Loop checks for alerts forever, logging any errors.
+func (a *Alerter) Loop(s *Server) {
+	client := &http.Client{Timeout: time.Minute}
+	for {
+		time.Sleep(a.Interval)
+		for _, event := range a.Check(s.Queues, time.Now()) {
+			logger.Warn("alert", "context", event.Context, "alert", event.Alert,
+				"firing", event.Firing, "text", event.Text)
+			if err := a.send(client, event); err != nil {
+				logger.Error("failed to send alert", "error", err)
+			}
+		}
+	}
+}
+
+// Check evaluates the alerts of every context and returns an event for each
+// alert which started or stopped firing since the last check.
+func (a *Alerter) Check(queues *QueueStateMux, now time.Time) []*AlertEvent {
+	if a.contexts == nil {
+		a.contexts = map[string]*contextAlerts{}
+	}
+	names := []string{}
+	configs := []QueueConfig{}
+	allCounts := []*QueueCounts{}
+	queues.Iterate(func(name string, qs *QueueState) {
+		names = append(names, name)
+		configs = append(configs, qs.Config())
+		allCounts = append(allCounts, qs.Counts(0, false))
+	})
+
+	var events []*AlertEvent
+	seen := map[string]bool{}
+	for i, name := range names {
+		seen[name] = true
+		events = append(events, a.checkContext(name, &configs[i], allCounts[i], now)...)
+	}
+
+	// Contexts which were removed (e.g. after finishing) resolve their alerts.
+	for name, state := range a.contexts {
+		if !seen[name] {
+			for alert, firing := range state.firing {
+				if firing {
+					events = append(events, newAlertEvent(name, alert, false, &QueueCounts{}, ""))
+				}
+			}
+			delete(a.contexts, name)
+		}
+	}
+	return events
+}
+
+func (a *Alerter) checkContext(name string, config *QueueConfig, counts *QueueCounts,
+	now time.Time) []*AlertEvent {
+	state, ok := a.contexts[name]
+	if !ok {
+		state = &contextAlerts{
+			firing:       map[string]bool{},
+			completed:    counts.Completed,
+			lastProgress: now,
+		}
+		a.contexts[name] = state
+	}
+	remaining := counts.Pending + counts.Running + counts.Expired + counts.BackingOff + counts.Delayed
+	if counts.Completed != state.completed || remaining == 0 {
+		state.completed = counts.Completed
+		state.lastProgress = now
+	}
+
+	var events []*AlertEvent
+	update := func(alert string, firing bool, detail string) {
+		if firing != state.firing[alert] {
+			state.firing[alert] = firing
+			events = append(events, newAlertEvent(name, alert, firing, counts, detail))
+		}
+	}
+	update("pending", config.AlertPending > 0 && counts.Pending > config.AlertPending,
+		fmt.Sprintf("%d pending tasks (threshold %d)", counts.Pending, config.AlertPending))
+	update("expired", config.AlertExpired > 0 && counts.Expired > config.AlertExpired,
+		fmt.Sprintf("%d expired tasks (threshold %d)", counts.Expired, config.AlertExpired))
+	stalled := now.Sub(state.lastProgress)
+	update("stalled",
+		config.AlertStall > 0 && stalled.Seconds() >= config.AlertStall,
+		fmt.Sprintf("no tasks completed for %s with %d tasks remaining",
+			stalled.Round(time.Second), remaining))
+	return events
+}
+
+func newAlertEvent(context, alert string, firing bool, counts *QueueCounts,
+	detail string) *AlertEvent {
+	contextName := context
+	if contextName == "" {
+		contextName = "(default)"
+	}
+	var text string
+	if firing {
+		text = fmt.Sprintf("tasq alert in context %s: %s", contextName, detail)
+	} else {
+		text = fmt.Sprintf("tasq alert resolved in context %s: %s", contextName, alert)
+	}
+	return &AlertEvent{
+		Text:    text,
+		Context: context,
+		Alert:   alert,
+		Firing:  firing,
+		Counts:  counts,
+	}
+}
+
+func (a *Alerter) send(client *http.Client, event *AlertEvent) error {
+	if a.WebhookURL == "" {
+		return nil
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "send alert")
+	}
+	resp, err := client.Post(a.WebhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "send alert")
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("send alert: status %d", resp.StatusCode)
+	}
+	return nil
+}
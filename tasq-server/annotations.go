@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// maxAnnotations limits the number of annotations on a single task.
+	maxAnnotations = 16
+
+	// maxAnnotationBytes limits the total size of the keys and values of
+	// the annotations on a single task.
+	maxAnnotationBytes = 4096
+)
+
+// Annotate sets annotations on the identified running task, merging them with
+// its existing annotations, where empty values remove annotations.
+//
+// Annotations are kept when the task expires or is requeued, so they describe
+// the most recent attempt which set them, and are recorded in the completed
+// log.
+//
+// Returns the task's new annotations, or false if the task was not found or
+// the lease did not match.
+func (q *QueueState) Annotate(id, lease string, updates map[string]string) (map[string]string,
+	bool, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	task, ok := q.running.idToTask[id]
+	if !ok || (lease != "" && task.Lease != lease) {
+		return nil, false, nil
+	}
+	merged, err := mergeAnnotations(task.annotations, updates)
+	if err != nil {
+		return nil, true, err
+	}
+	task.annotations = merged
+	q.modified()
+	return copyAnnotations(merged), true, nil
+}
+
+// mergeAnnotations creates a new map with the updates applied to old, without
+// modifying old, so that the maps of tasks may be shared by their copies.
+func mergeAnnotations(old, updates map[string]string) (map[string]string, error) {
+	res := copyAnnotations(old)
+	if res == nil {
+		res = map[string]string{}
+	}
+	for key, value := range updates {
+		if key == "" {
+			return nil, errors.New("annotation keys must not be empty")
+		} else if value == "" {
+			delete(res, key)
+		} else {
+			res[key] = value
+		}
+	}
+	if len(res) > maxAnnotations {
+		return nil, fmt.Errorf("tasks may not have more than %d annotations", maxAnnotations)
+	}
+	var size int
+	for key, value := range res {
+		size += len(key) + len(value)
+	}
+	if size > maxAnnotationBytes {
+		return nil, fmt.Errorf("annotations may not exceed %d bytes per task", maxAnnotationBytes)
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	return res, nil
+}
+
+// copyAnnotations copies a map of annotations, or returns nil if there are
+// none.
+func copyAnnotations(a map[string]string) map[string]string {
+	if len(a) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(a))
+	for key, value := range a {
+		res[key] = value
+	}
+	return res
+}
+
+func (s *Server) ServeAnnotate(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	id := r.URL.Query().Get("id")
+	lease := r.URL.Query().Get("lease")
+	var updates map[string]string
+	if !s.DecodeBody(w, r, &updates) {
+		return
+	}
+	var annotations map[string]string
+	var status bool
+	var annotateErr error
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		annotations, status, annotateErr = qs.Annotate(id, lease, updates)
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	} else if !status {
+		serveMissingTask(w, lease)
+		return
+	} else if annotateErr != nil {
+		serveError(w, annotateErr.Error())
+		return
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	serveObject(w, annotations)
+}
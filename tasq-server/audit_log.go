@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// An AuditLog records operations on queues as JSON lines, making it possible
+// to trace destructive operations after the fact.
+//
+// A nil *AuditLog is valid and discards all entries.
+type AuditLog struct {
+	lock   sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// NewAuditLog creates an AuditLog which appends to the file at path.
+//
+// If path is "-", entries are written to standard output.
+func NewAuditLog(path string) (*AuditLog, error) {
+	if path == "-" {
+		return &AuditLog{w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open audit log")
+	}
+	return &AuditLog{w: f, closer: f}, nil
+}
+
+// Log writes an entry to the log, filling in its time if it is unset.
+//
+// Failures to write are reported to the standard logger rather than returned,
+// since an operation which has already happened cannot be undone.
+func (a *AuditLog) Log(entry *AuditEntry) {
+	if a == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error("failed to encode audit entry", "error", err)
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, err := a.w.Write(append(data, '\n')); err != nil {
+		logger.Error("failed to write audit entry", "error", err)
+	}
+}
+
+// Close closes the underlying file, if there is one.
+func (a *AuditLog) Close() error {
+	if a == nil || a.closer == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.closer.Close()
+}
+
+// An AuditEntry is a single record in an AuditLog.
+type AuditEntry struct {
+	Time      time.Time    `json:"time"`
+	Op        string       `json:"op"`
+	Context   string       `json:"context"`
+	Target    string       `json:"target,omitempty"`
+	User      string       `json:"user,omitempty"`
+	Remote    string       `json:"remote,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+	UserAgent string       `json:"user_agent,omitempty"`
+	IDs       []string     `json:"ids,omitempty"`
+	Group     string       `json:"group,omitempty"`
+	Count     *int         `json:"count,omitempty"`
+	Counts    *QueueCounts `json:"counts,omitempty"`
+}
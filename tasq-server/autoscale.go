@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+)
+
+// defaultDrainTime is the time in which the suggested number of workers
+// should finish the remaining tasks, unless a context sets its drainTime.
+const defaultDrainTime = 5 * time.Minute
+
+// autoscaleRateWindow is the number of seconds over which the completion and
+// push rates are measured for autoscaling hints.
+const autoscaleRateWindow = 60
+
+// latencySmoothing is the weight given to each completed task in the moving
+// average of task latencies.
+const latencySmoothing = 0.05
+
+// An AutoscaleHint suggests a number of workers for a context.
+type AutoscaleHint struct {
+	// Workers is the suggested number of workers.
+	Workers int64 `json:"workers"`
+
+	// Remaining is the number of pending, running, and expired tasks.
+	Remaining int64 `json:"remaining"`
+
+	// Rate is the number of completions per second over the last minute.
+	Rate float64 `json:"rate"`
+
+	// PushRate is the number of pushed tasks per second over the last
+	// minute.
+	PushRate float64 `json:"pushRate"`
+
+	// Latency is the estimated number of seconds each task takes to
+	// complete, if known.
+	Latency *float64 `json:"latency,omitempty"`
+
+	// DrainTime is the number of seconds in which the suggested workers
+	// should finish the remaining tasks.
+	DrainTime float64 `json:"drainTime"`
+}
+
+// Autoscale suggests how many workers are needed to finish the remaining
+// tasks within the drain time, or within the context's configured drain time
+// if drainTime is nil. Tasks which are expected to be pushed during the drain
+// time, at the current push rate, are counted as remaining work.
+//
+// Task latency is measured by a moving average of the time between popping
+// and completing each task. Before any task has been completed, it is
+// estimated from the number of running tasks and the completion rate, and
+// if that is not possible, one worker is suggested per task.
+func (q *QueueState) Autoscale(drainTime *time.Duration) *AutoscaleHint {
+	counts := q.Counts(autoscaleRateWindow, false)
+	q.lock.RLock()
+	latency := q.meanLatency
+	configured := q.config.DrainTime
+	q.lock.RUnlock()
+
+	drain := defaultDrainTime
+	if drainTime != nil {
+		drain = *drainTime
+	} else if configured > 0 {
+		drain = time.Duration(configured * float64(time.Second))
+	}
+
+	remaining := counts.Pending + counts.Running + counts.Expired
+	res := &AutoscaleHint{
+		Remaining: remaining,
+		Rate:      *counts.Rate,
+		PushRate:  *counts.PushRate,
+		DrainTime: drain.Seconds(),
+	}
+	if latency == 0 && res.Rate > 0 && counts.Running > 0 {
+		// By Little's law, the average number of running tasks is the
+		// completion rate times the latency.
+		latency = float64(counts.Running) / res.Rate
+	}
+	if latency > 0 {
+		res.Latency = &latency
+	}
+
+	if remaining == 0 && res.PushRate == 0 {
+		res.Workers = 0
+	} else if latency == 0 || drain <= 0 {
+		res.Workers = remaining
+		if res.Workers == 0 {
+			res.Workers = 1
+		}
+	} else {
+		work := float64(remaining) + res.PushRate*drain.Seconds()
+		workers := math.Ceil(work * latency / drain.Seconds())
+		res.Workers = int64(math.Max(1, math.Min(math.Ceil(work), workers)))
+	}
+	return res
+}
+
+// recordLatency updates the moving average and variance of task latencies
+// with a task that was just completed.
+//
+// The caller must hold the write lock.
+func (q *QueueState) recordLatency(t *Task) {
+	if t.popped.IsZero() {
+		return
+	}
+	latency := time.Since(t.popped).Seconds()
+	if q.meanLatency == 0 {
+		q.meanLatency = latency
+		q.latencyVariance = 0
+	} else {
+		diff := latency - q.meanLatency
+		step := latencySmoothing * diff
+		q.meanLatency += step
+		q.latencyVariance = (1 - latencySmoothing) * (q.latencyVariance + diff*step)
+	}
+}
+
+func (s *Server) ServeAutoscale(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	var drainTime *time.Duration
+	if seconds, err := parseSecondsParam(r, "drainTime"); err != nil {
+		serveError(w, err.Error())
+		return
+	} else if seconds != nil {
+		d := time.Duration(*seconds * float64(time.Second))
+		drainTime = &d
+	}
+	var hint *AutoscaleHint
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		hint = qs.Autoscale(drainTime)
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
+	serveObject(w, hint)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltPendingBucket = []byte("pending")
+	boltPoppedBucket  = []byte("popped")
+	boltCurIDKey      = []byte("cur_id")
+)
+
+// BoltStorage stores the pending tasks of some contexts in a bbolt database.
+//
+// This allows queues to grow larger than memory, and makes pushed tasks
+// durable as soon as they are pushed, at the cost of throughput. Popped tasks
+// are tracked in the database until they are completed, so that they can be
+// re-enqueued if the server restarts without a snapshot of them.
+type BoltStorage struct {
+	DB *bolt.DB
+
+	// Prefix restricts the storage to contexts whose names start with it.
+	Prefix string
+}
+
+// OpenBoltStorage opens or creates a database at the given path.
+func OpenBoltStorage(path, prefix string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "open bolt storage")
+	}
+	return &BoltStorage{DB: db, Prefix: prefix}, nil
+}
+
+// Handles checks if the named context should be stored in b.
+func (b *BoltStorage) Handles(name string) bool {
+	return strings.HasPrefix(name, b.Prefix)
+}
+
+// Names gets the names of all contexts with data in the database.
+func (b *BoltStorage) Names() ([]string, error) {
+	var names []string
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(key []byte, _ *bolt.Bucket) error {
+			names = append(names, decodeBoltBucketName(key))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "list bolt contexts")
+	}
+	return names, nil
+}
+
+// Open gets the pending queue for the named context, creating it if needed.
+func (b *BoltStorage) Open(name string) (*BoltPendingQueue, error) {
+	res := &BoltPendingQueue{db: b.DB, bucket: encodeBoltBucketName(name)}
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bucket, err := res.createBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if data := bucket.Get(boltCurIDKey); data != nil {
+			res.curID = int64(binary.BigEndian.Uint64(data))
+		}
+		res.length = bucket.Bucket(boltPendingBucket).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "open bolt context")
+	}
+	return res, nil
+}
+
+// AttachStorage starts using b for the contexts which it handles.
+//
+// Contexts which only exist in b are created, pending tasks of existing
+// contexts are moved into b, and tasks which were popped from b but are
+// neither running nor delayed (e.g. because they were popped after the last
+// snapshot) are re-enqueued.
+func (q *QueueStateMux) AttachStorage(b *BoltStorage) error {
+	q.saveLock.Lock()
+	defer q.saveLock.Unlock()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	names, err := b.Names()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := q.queues[name]; !ok && b.Handles(name) {
+			q.queues[name] = NewQueueState(q.timeout)
+		}
+	}
+	for name, qs := range q.queues {
+		if !b.Handles(name) {
+			continue
+		}
+		store, err := b.Open(name)
+		if err != nil {
+			return err
+		}
+		qs.usePendingStore(store)
+	}
+	q.Storage = b
+	return nil
+}
+
+func (q *QueueState) usePendingStore(store *BoltPendingQueue) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if mem, ok := q.pending.(*PendingQueue); ok && mem.curID > store.curID {
+		store.curID = mem.curID
+	}
+	q.pending.Iterate(func(t *Task) {
+		store.PushTask(t.DisconnectedCopy())
+	})
+	q.interner = newContentsInterner()
+	delayed := map[string]bool{}
+	q.delayed.Iterate(func(t *Task) {
+		delayed[t.ID] = true
+	})
+	for _, t := range store.Popped() {
+		if _, ok := q.running.idToTask[t.ID]; !ok && !delayed[t.ID] {
+			store.PushTask(t)
+		}
+	}
+	q.pending = store
+}
+
+// A BoltPendingQueue is a PendingStore backed by a bucket in a bbolt
+// database.
+type BoltPendingQueue struct {
+	db     *bolt.DB
+	bucket []byte
+	curID  int64
+	length int
+}
+
+// Encode converts p into a JSON-serializable object.
+//
+// The tasks themselves are not included, since they are already stored in
+// the database.
+func (p *BoltPendingQueue) Encode() *EncodedPendingQueue {
+	return &EncodedPendingQueue{CurID: p.curID}
+}
+
+// AddTask assigns an ID to a new task and enqueues it.
+//
+// Unlike PendingQueue, IDs are not given a random prefix, since the ID
+// counter is stored durably along with the task.
+func (p *BoltPendingQueue) AddTask(task *Task) {
+	task.ID = idGenerator.NewID("", p.curID)
+	task.created = time.Now()
+	p.curID += 1
+	p.update(func(bucket *bolt.Bucket) error {
+		if err := bucket.Put(boltCurIDKey, encodeBoltSequence(uint64(p.curID))); err != nil {
+			return err
+		}
+		return pushBoltTask(bucket, task)
+	})
+	p.length += 1
+}
+
+// PushTask re-enqueues an existing task.
+func (p *BoltPendingQueue) PushTask(t *Task) {
+	p.update(func(bucket *bolt.Bucket) error {
+		if err := bucket.Bucket(boltPoppedBucket).Delete([]byte(t.ID)); err != nil {
+			return err
+		}
+		return pushBoltTask(bucket, t)
+	})
+	p.length += 1
+}
+
+// PopTask gets the next task (in FIFO order), keeping track of it in the
+// database until Finished() is called.
+//
+// Tasks in the database never have required tags, so every worker may pop
+// every task.
+func (p *BoltPendingQueue) PopTask(offered TagSet) *Task {
+	var task *Task
+	p.update(func(bucket *bolt.Bucket) error {
+		cursor := bucket.Bucket(boltPendingBucket).Cursor()
+		key, value := cursor.First()
+		if key == nil {
+			return nil
+		}
+		var err error
+		task, err = decodeBoltTask(value)
+		if err != nil {
+			return err
+		}
+		if err := cursor.Delete(); err != nil {
+			return err
+		}
+		return bucket.Bucket(boltPoppedBucket).Put([]byte(task.ID), value)
+	})
+	if task != nil {
+		p.length -= 1
+	}
+	return task
+}
+
+// PeekTask gets a copy of the next task.
+func (p *BoltPendingQueue) PeekTask(offered TagSet) *Task {
+	var task *Task
+	p.view(func(bucket *bolt.Bucket) error {
+		_, value := bucket.Bucket(boltPendingBucket).Cursor().First()
+		if value == nil {
+			return nil
+		}
+		var err error
+		task, err = decodeBoltTask(value)
+		return err
+	})
+	return task
+}
+
+// Finished deletes the record of a popped task.
+func (p *BoltPendingQueue) Finished(t *Task) {
+	p.update(func(bucket *bolt.Bucket) error {
+		return bucket.Bucket(boltPoppedBucket).Delete([]byte(t.ID))
+	})
+}
+
+// Iterate calls f with every pending task in order.
+func (p *BoltPendingQueue) Iterate(f func(t *Task)) {
+	p.view(func(bucket *bolt.Bucket) error {
+		return bucket.Bucket(boltPendingBucket).ForEach(func(_, value []byte) error {
+			task, err := decodeBoltTask(value)
+			if err != nil {
+				return err
+			}
+			f(task)
+			return nil
+		})
+	})
+}
+
+// Popped gets the tasks which were popped but never finished.
+func (p *BoltPendingQueue) Popped() []*Task {
+	var tasks []*Task
+	p.view(func(bucket *bolt.Bucket) error {
+		return bucket.Bucket(boltPoppedBucket).ForEach(func(_, value []byte) error {
+			task, err := decodeBoltTask(value)
+			if err != nil {
+				return err
+			}
+			tasks = append(tasks, task)
+			return nil
+		})
+	})
+	return tasks
+}
+
+// Len gets the number of queued tasks.
+func (p *BoltPendingQueue) Len() int {
+	return p.length
+}
+
+// Clear deletes all of the pending and popped tasks.
+func (p *BoltPendingQueue) Clear() {
+	p.update(func(bucket *bolt.Bucket) error {
+		for _, name := range [][]byte{boltPendingBucket, boltPoppedBucket} {
+			if err := bucket.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := bucket.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	p.length = 0
+}
+
+func (p *BoltPendingQueue) createBuckets(tx *bolt.Tx) (*bolt.Bucket, error) {
+	bucket, err := tx.CreateBucketIfNotExists(p.bucket)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range [][]byte{boltPendingBucket, boltPoppedBucket} {
+		if _, err := bucket.CreateBucketIfNotExists(name); err != nil {
+			return nil, err
+		}
+	}
+	return bucket, nil
+}
+
+// update runs f in a read-write transaction.
+//
+// Since the queue cannot be left in a consistent state if the database fails,
+// errors are fatal.
+func (p *BoltPendingQueue) update(f func(bucket *bolt.Bucket) error) {
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		return f(tx.Bucket(p.bucket))
+	})
+	if err != nil {
+		logger.Fatal("failed to update bolt storage", "error", err)
+	}
+}
+
+func (p *BoltPendingQueue) view(f func(bucket *bolt.Bucket) error) {
+	err := p.db.View(func(tx *bolt.Tx) error {
+		return f(tx.Bucket(p.bucket))
+	})
+	if err != nil {
+		logger.Fatal("failed to read bolt storage", "error", err)
+	}
+}
+
+func pushBoltTask(bucket *bolt.Bucket, t *Task) error {
+	pending := bucket.Bucket(boltPendingBucket)
+	seq, err := pending.NextSequence()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(t.Encode())
+	if err != nil {
+		return err
+	}
+	return pending.Put(encodeBoltSequence(seq), data)
+}
+
+// decodeBoltTask decodes a task stored by pushBoltTask.
+//
+// Older databases stored tasks with lowercase field names and no metadata,
+// which still decode since field names are matched case-insensitively.
+func decodeBoltTask(data []byte) (*Task, error) {
+	var task EncodedTask
+	if err := json.Unmarshal(data, &task); err != nil {
+		return nil, err
+	}
+	return DecodeTask(&task), nil
+}
+
+func encodeBoltSequence(seq uint64) []byte {
+	var res [8]byte
+	binary.BigEndian.PutUint64(res[:], seq)
+	return res[:]
+}
+
+// Bucket names cannot be empty, but the default context has an empty name.
+func encodeBoltBucketName(name string) []byte {
+	return []byte("context:" + name)
+}
+
+func decodeBoltBucketName(key []byte) string {
+	return strings.TrimPrefix(string(key), "context:")
+}
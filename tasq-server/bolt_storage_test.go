@@ -0,0 +1,104 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltStorage(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "pending.db")
+	storage, err := OpenBoltStorage(dbPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := NewQueueStateMux(time.Minute)
+	if err := mux.AttachStorage(storage); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	mux.Get("ctx", func(qs *QueueState) {
+		ids, _ = qs.PushBatch([]string{"a", "b", "c"}, 0)
+		task, _ := qs.Pop(nil, nil)
+		if task == nil || task.Contents != "a" {
+			t.Fatalf("unexpected task: %v", task)
+		}
+		if !qs.Completed(task.ID, task.Lease) {
+			t.Fatal("failed to complete task")
+		}
+		task, _ = qs.Pop(nil, nil)
+		if task == nil || task.Contents != "b" {
+			t.Fatalf("unexpected task: %v", task)
+		}
+	})
+	if err := storage.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a restart without a snapshot; the popped task "b" should be
+	// re-enqueued after "c".
+	storage, err = OpenBoltStorage(dbPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.DB.Close()
+	mux = NewQueueStateMux(time.Minute)
+	if err := mux.AttachStorage(storage); err != nil {
+		t.Fatal(err)
+	}
+	mux.Get("ctx", func(qs *QueueState) {
+		if counts := qs.Counts(0, false); counts.Pending != 2 || counts.Running != 0 {
+			t.Fatalf("unexpected counts: %v", counts)
+		}
+		for _, expected := range []string{"c", "b"} {
+			task, _ := qs.Pop(nil, nil)
+			if task == nil || task.Contents != expected {
+				t.Fatalf("expected %s but got %v", expected, task)
+			}
+		}
+		id, _ := qs.Push("d", 0)
+		for _, oldID := range ids {
+			if id == oldID {
+				t.Fatalf("reused ID: %s", id)
+			}
+		}
+	})
+}
+
+func TestBoltStorageTaskMetadata(t *testing.T) {
+	storage, err := OpenBoltStorage(filepath.Join(t.TempDir(), "pending.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.DB.Close()
+
+	mux := NewQueueStateMux(time.Minute)
+	if err := mux.AttachStorage(storage); err != nil {
+		t.Fatal(err)
+	}
+	mux.Get("ctx", func(qs *QueueState) {
+		qs.Push("a", 0)
+		task, _ := qs.Pop(nil, nil)
+		if task.created.IsZero() {
+			t.Fatal("missing creation time")
+		}
+		qs.ExpireAll()
+		if n := qs.QueueExpired(); n != 1 {
+			t.Fatalf("expected 1 expired task but got %d", n)
+		}
+
+		// The task now went through the database, which should keep its
+		// creation time and attempt count.
+		popped, _ := qs.Pop(nil, nil)
+		if popped == nil || popped.ID != task.ID {
+			t.Fatalf("unexpected task: %v", popped)
+		}
+		if popped.attempts != 2 {
+			t.Fatalf("expected 2 attempts but got %d", popped.attempts)
+		}
+		if !popped.created.Equal(task.created) {
+			t.Fatalf("creation time changed from %v to %v", task.created, popped.created)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import "net/http"
+
+// A BulkResult is the outcome of a bulk operation on one context.
+type BulkResult struct {
+	Context string `json:"context"`
+
+	// Count is the number of tasks affected by the operation.
+	Count int `json:"count"`
+
+	// Error is set if the operation could not be applied to the context.
+	Error string `json:"error,omitempty"`
+}
+
+// bulkOperation gets the function which applies the named operation to a
+// context and returns the number of affected tasks, or nil if the operation
+// is not supported by /context/bulk.
+func (s *Server) bulkOperation(op string) func(name string) (int, error) {
+	switch op {
+	case "clear":
+		return s.Queues.Clear
+	case "expire_all":
+		return func(name string) (n int, err error) {
+			err = s.Queues.Get(name, func(qs *QueueState) {
+				n = qs.ExpireAll()
+			})
+			return
+		}
+	case "queue_expired":
+		return func(name string) (n int, err error) {
+			err = s.Queues.Get(name, func(qs *QueueState) {
+				n = qs.QueueExpired()
+			})
+			return
+		}
+	}
+	return nil
+}
+
+func (s *Server) ServeBulk(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	op := r.URL.Query().Get("op")
+	apply := s.bulkOperation(op)
+	if apply == nil {
+		serveError(w, "unknown bulk operation: "+op)
+		return
+	}
+	var names []string
+	if !s.DecodeBody(w, r, &names) {
+		return
+	}
+	results := make([]*BulkResult, len(names))
+	for i, name := range names {
+		n, err := apply(name)
+		results[i] = &BulkResult{Context: name, Count: n}
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		s.Audit(r, &AuditEntry{Op: op, Context: name, Count: &n})
+	}
+	serveObject(w, results)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+)
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// contentsChecksum computes the checksum which is recorded for a task when it
+// is pushed: the CRC-32C of its contents, in big-endian hex.
+func contentsChecksum(contents string) string {
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], crc32.Checksum([]byte(contents), checksumTable))
+	return hex.EncodeToString(data[:])
+}
+
+// checksumValid checks if the task's contents match its checksum.
+//
+// Tasks pushed before checksums were recorded have no checksum, and are
+// always considered valid.
+func (t *Task) checksumValid() bool {
+	return t.Checksum == "" || t.Checksum == contentsChecksum(t.Contents)
+}
+
+// holdCorrupted finds tasks whose contents do not match their checksums, for
+// example after a save file was damaged, and holds the pending and delayed
+// ones so that workers do not pop them.
+//
+// Returns the IDs of all corrupted tasks, including running ones.
+func (q *QueueState) holdCorrupted() []string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var ids []string
+	var pending, delayed []*Task
+	q.pending.Iterate(func(t *Task) {
+		if !t.checksumValid() {
+			pending = append(pending, t)
+		}
+	})
+	q.delayed.Iterate(func(t *Task) {
+		if !t.checksumValid() {
+			delayed = append(delayed, t)
+		}
+	})
+	check := func(t *Task) {
+		if !t.checksumValid() {
+			ids = append(ids, t.ID)
+		}
+	}
+	q.running.Iterate(check)
+	q.held.Iterate(check)
+	q.keys.Iterate(check)
+
+	if mem, ok := q.pending.(*PendingQueue); ok {
+		for _, t := range pending {
+			mem.Remove(t.ID)
+			q.held.PushLast(t)
+		}
+	}
+	for _, t := range delayed {
+		q.delayed.Remove(t)
+		q.held.PushLast(t)
+	}
+	for _, t := range append(pending, delayed...) {
+		ids = append(ids, t.ID)
+	}
+	if len(pending)+len(delayed) > 0 {
+		q.modified()
+	}
+	return ids
+}
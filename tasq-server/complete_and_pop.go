@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// CompleteAndPop marks tasks as completed and then pops a batch of tasks like
+// PopBatch(), without releasing the lock in between.
+//
+// Returns the IDs of the tasks that could not be completed, since they were
+// not in the running queue (with the given leases, if any), along with the
+// results of PopBatchOrdered(), which are copies of the popped tasks.
+func (q *QueueState) CompleteAndPop(refs []LeaseRef, worker string, n, maxBytes int,
+	timeout *time.Duration, offered TagSet, order PopOrder) ([]string, []*Task, *time.Time) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var failures []string
+	for _, ref := range refs {
+		if !q.completedBy(ref.ID, ref.Lease, worker) {
+			failures = append(failures, ref.ID)
+		}
+	}
+	tasks, nextTry := q.popBatch(n, maxBytes, timeout, offered, order)
+	return failures, leasedCopies(tasks), nextTry
+}
+
+func (s *Server) ServeCompleteAndPop(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	timeout, timeoutOk := s.TimeoutParam(w, r)
+	if !timeoutOk {
+		return
+	}
+	n := 1
+	if countStr := r.URL.Query().Get("count"); countStr != "" {
+		var err error
+		n, err = strconv.Atoi(countStr)
+		if err != nil {
+			serveError(w, "invalid 'count' parameter: "+err.Error())
+			return
+		} else if n < 0 {
+			serveError(w, "invalid 'count' requested")
+			return
+		}
+	}
+	maxBytes, err := parseLimit(r.URL.Query().Get("maxBytes"))
+	if err != nil {
+		serveError(w, "invalid 'maxBytes' parameter: "+err.Error())
+		return
+	} else if maxBytes < 0 {
+		serveError(w, "invalid 'maxBytes' requested")
+		return
+	}
+	offered, err := tagsParam(r)
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	order, err := orderParam(r)
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	var refs []LeaseRef
+	if !s.DecodeBody(w, r, &refs) {
+		return
+	}
+
+	var failures, successes []string
+	var tasks []*Task
+	var nextTry *time.Time
+	var notifications []*GroupNotification
+	var timeoutErr error
+	context := r.URL.Query().Get("context")
+	err = s.Queues.Get(context, func(qs *QueueState) {
+		if timeoutErr = qs.CheckTimeout(timeout); timeoutErr != nil {
+			return
+		} else if timeoutErr = qs.CheckOrder(order); timeoutErr != nil {
+			return
+		}
+		var missing []string
+		missing, tasks, nextTry = qs.CompleteAndPop(refs, r.URL.Query().Get("worker"), n, maxBytes,
+			timeout, NewTagSet(offered), order)
+		isMissing := map[string]bool{}
+		for _, id := range missing {
+			isMissing[id] = true
+			if !s.Queues.RecentlyCompleted(context, id) {
+				failures = append(failures, id)
+			}
+		}
+		for _, ref := range refs {
+			if !isMissing[ref.ID] {
+				successes = append(successes, ref.ID)
+			}
+		}
+		s.Queues.NoteCompleted(context, successes...)
+		notifications = qs.TakeGroupNotifications()
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	} else if timeoutErr != nil {
+		serveError(w, timeoutErr.Error())
+		return
+	}
+	s.NotifyGroups(context, notifications)
+	if len(successes) > 0 {
+		s.Audit(r, &AuditEntry{Op: "completed_batch", IDs: successes})
+	}
+
+	result := map[string]interface{}{
+		"done": len(tasks) == 0 && nextTry == nil,
+	}
+	if nextTry != nil {
+		result["retry"] = math.Max(0, time.Until(*nextTry).Seconds())
+	}
+	if tasks == nil {
+		tasks = []*Task{}
+	} else {
+		popped := make([]string, len(tasks))
+		for i, t := range tasks {
+			popped[i] = t.ID
+		}
+		s.Audit(r, &AuditEntry{Op: "pop_batch", IDs: popped})
+	}
+	if failures == nil {
+		failures = []string{}
+	}
+	result["tasks"] = tasks
+	result["failed"] = failures
+	serveObject(w, result)
+}
@@ -0,0 +1,108 @@
+package main
+
+import "time"
+
+// A CompletedRecord describes a task in a context's completed log.
+type CompletedRecord struct {
+	ID       string `json:"id"`
+	Contents string `json:"contents"`
+
+	// Completed is the Unix time in milliseconds when the task was completed.
+	Completed int64 `json:"completed"`
+
+	// Worker is the name given by the worker which completed the task, if
+	// any.
+	Worker string `json:"worker,omitempty"`
+
+	// Duration is the number of seconds between the last time the task was
+	// popped and its completion, if known.
+	Duration float64 `json:"duration,omitempty"`
+
+	Attempts int `json:"attempts"`
+
+	// Annotations are the task's annotations when it was completed.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// CompletedLog gets up to limit of the most recently completed tasks, newest
+// first, or every retained task if limit is zero.
+//
+// If id is non-empty, only records for that task ID are returned.
+func (q *QueueState) CompletedLog(id string, limit int) []*CompletedRecord {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	res := []*CompletedRecord{}
+	log := q.retainedCompleted()
+	for i := len(log) - 1; i >= 0 && (limit == 0 || len(res) < limit); i-- {
+		record := log[i]
+		if id == "" || record.ID == id {
+			copied := *record
+			copied.Annotations = copyAnnotations(record.Annotations)
+			res = append(res, &copied)
+		}
+	}
+	return res
+}
+
+// logCompleted adds a completed task to the log, if the log is enabled.
+//
+// The caller must hold the write lock.
+func (q *QueueState) logCompleted(t *Task, worker string) {
+	if q.config.CompletedLog <= 0 {
+		return
+	}
+	now := time.Now()
+	record := &CompletedRecord{
+		ID:          t.ID,
+		Contents:    t.Contents,
+		Completed:   now.UnixMilli(),
+		Worker:      worker,
+		Attempts:    t.attempts,
+		Annotations: t.annotations,
+	}
+	if !t.popped.IsZero() {
+		record.Duration = now.Sub(t.popped).Seconds()
+	}
+	q.completedLog = append(q.completedLog, record)
+	q.trimCompletedLog()
+}
+
+// trimCompletedLog drops the oldest records beyond the configured size.
+//
+// To avoid copying on every completion, the log may grow to twice its size
+// before it is trimmed.
+func (q *QueueState) trimCompletedLog() {
+	size := q.config.CompletedLog
+	if size <= 0 {
+		q.completedLog = nil
+	} else if len(q.completedLog) >= 2*size {
+		q.completedLog = append([]*CompletedRecord{}, q.completedLog[len(q.completedLog)-size:]...)
+	}
+}
+
+// retainedCompleted gets the records which are currently retained, oldest
+// first.
+func (q *QueueState) retainedCompleted() []*CompletedRecord {
+	if n := q.config.CompletedLog; len(q.completedLog) > n {
+		return q.completedLog[len(q.completedLog)-n:]
+	}
+	return q.completedLog
+}
+
+// RetryCompleted pushes a new task with the contents of a task in the
+// completed log, and returns the ID of the new task.
+//
+// Returns false if the task is not in the log, e.g. because it was never
+// completed or has been pushed out of the log by newer completions.
+func (q *QueueState) RetryCompleted(id string) (string, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	log := q.retainedCompleted()
+	for i := len(log) - 1; i >= 0; i-- {
+		if log[i].ID == id {
+			q.modified()
+			return q.addTask(log[i].Contents, nil), true
+		}
+	}
+	return "", false
+}
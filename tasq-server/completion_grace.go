@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// completionLog remembers recently completed tasks, so that a duplicate
+// completion (e.g. from a worker whose copy of the task expired and was
+// re-popped and completed by another worker) can be treated as a success.
+type completionLog struct {
+	lock    sync.Mutex
+	times   map[completionKey]time.Time
+	entries []completionEntry
+}
+
+type completionKey struct {
+	Context string
+	ID      string
+}
+
+type completionEntry struct {
+	Key  completionKey
+	Time time.Time
+}
+
+// NoteCompleted records that tasks were completed, if q.CompletionGrace is
+// non-zero.
+func (q *QueueStateMux) NoteCompleted(context string, ids ...string) {
+	if q.CompletionGrace == 0 || len(ids) == 0 {
+		return
+	}
+	l := &q.completions
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	l.prune(now.Add(-q.CompletionGrace))
+	if l.times == nil {
+		l.times = map[completionKey]time.Time{}
+	}
+	for _, id := range ids {
+		key := completionKey{Context: context, ID: id}
+		l.times[key] = now
+		l.entries = append(l.entries, completionEntry{Key: key, Time: now})
+	}
+}
+
+// RecentlyCompleted checks if a task was completed within the last
+// q.CompletionGrace.
+func (q *QueueStateMux) RecentlyCompleted(context, id string) bool {
+	if q.CompletionGrace == 0 {
+		return false
+	}
+	l := &q.completions
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	t, ok := l.times[completionKey{Context: context, ID: id}]
+	return ok && time.Now().Sub(t) <= q.CompletionGrace
+}
+
+// prune forgets completions from before the cutoff.
+func (l *completionLog) prune(cutoff time.Time) {
+	n := 0
+	for n < len(l.entries) && l.entries[n].Time.Before(cutoff) {
+		e := l.entries[n]
+		if l.times[e.Key].Equal(e.Time) {
+			delete(l.times, e.Key)
+		}
+		n++
+	}
+	// The underlying array is reclaimed once append() reallocates it.
+	l.entries = l.entries[n:]
+}
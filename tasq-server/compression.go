@@ -0,0 +1,92 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// CompressionHandler wraps h to gzip responses for clients that accept it,
+// and to decompress request bodies sent with a gzip Content-Encoding.
+//
+// Responses which are already compressed, such as zip snapshots, are passed
+// through unchanged.
+func CompressionHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+			body, err := gzip.NewReader(r.Body)
+			if err != nil {
+				serveError(w, "invalid gzip request body: "+err.Error())
+				return
+			}
+			defer body.Close()
+			r.Body = body
+			r.ContentLength = -1
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+		}
+		if !acceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.EqualFold(strings.TrimSpace(strings.Split(enc, ";")[0]), "gzip") {
+			return true
+		}
+	}
+	return false
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	started bool
+	gz      *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	g.start()
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !g.started && g.Header().Get("Content-Type") == "" {
+		// Sniff the uncompressed data, since the server would otherwise
+		// sniff the compressed data.
+		g.Header().Set("Content-Type", http.DetectContentType(data))
+	}
+	g.start()
+	if g.gz != nil {
+		return g.gz.Write(data)
+	}
+	return g.ResponseWriter.Write(data)
+}
+
+// Close flushes the compressed stream, if one was started.
+func (g *gzipResponseWriter) Close() error {
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
+func (g *gzipResponseWriter) start() {
+	if g.started {
+		return
+	}
+	g.started = true
+	header := g.Header()
+	header.Add("Vary", "Accept-Encoding")
+	if header.Get("Content-Encoding") != "" || strings.Contains(header.Get("Content-Type"), "zip") {
+		return
+	}
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxBackoffSeconds prevents backoff delays from overflowing a time.Duration.
+const maxBackoffSeconds = 1e8
+
+// QueueConfig stores per-context settings which are configured through the
+// API and saved along with the queue.
+type QueueConfig struct {
+	// Backoff, if non-zero, is the number of seconds that a task must wait
+	// after expiring for the first time before it can be popped again. The
+	// delay doubles each time the task expires.
+	Backoff float64 `json:"backoff,omitempty"`
+
+	// MaxBackoff, if non-zero, limits the delay imposed by Backoff.
+	MaxBackoff float64 `json:"maxBackoff,omitempty"`
+
+	// AlertPending, if non-zero, triggers an alert while more than this many
+	// tasks are pending.
+	AlertPending int64 `json:"alertPending,omitempty"`
+
+	// AlertExpired, if non-zero, triggers an alert while more than this many
+	// tasks are expired.
+	AlertExpired int64 `json:"alertExpired,omitempty"`
+
+	// AlertStall, if non-zero, triggers an alert when no tasks have been
+	// completed for this many seconds even though tasks remain.
+	AlertStall float64 `json:"alertStall,omitempty"`
+
+	// CompletedLog, if non-zero, is the number of recently completed tasks
+	// to remember.
+	CompletedLog int `json:"completedLog,omitempty"`
+
+	// Timeout, if non-zero, is the number of seconds before popped tasks
+	// expire when the worker does not request a timeout, overriding the
+	// server's default.
+	Timeout float64 `json:"timeout,omitempty"`
+
+	// MaxTimeout, if non-zero, is the longest timeout in seconds that
+	// workers may request when popping tasks or sending keepalives.
+	MaxTimeout float64 `json:"maxTimeout,omitempty"`
+
+	// Weight, if non-zero, is the share of tasks which /task/pop_any takes
+	// from this context relative to other contexts. The default is 1.
+	Weight int64 `json:"weight,omitempty"`
+
+	// DrainTime, if non-zero, is the number of seconds in which /autoscale
+	// suggests finishing the remaining tasks.
+	DrainTime float64 `json:"drainTime,omitempty"`
+
+	// Order, if non-empty, is the default PopOrder of pops from the
+	// context, such as "lifo" to pop the newest pending tasks first.
+	Order string `json:"order,omitempty"`
+
+	// StuckAttempts, if non-zero, overrides the number of attempts after
+	// which a running task is reported as stuck by /task/stuck.
+	StuckAttempts int64 `json:"stuckAttempts,omitempty"`
+
+	// StuckDeviations, if non-zero, overrides the number of standard
+	// deviations above the mean latency after which the total running time
+	// of a task is reported as stuck by /task/stuck.
+	StuckDeviations float64 `json:"stuckDeviations,omitempty"`
+}
+
+// SchedulingWeight gets the weight used by /task/pop_any.
+func (q *QueueConfig) SchedulingWeight() int64 {
+	if q.Weight <= 0 {
+		return 1
+	}
+	return q.Weight
+}
+
+// CheckTimeout returns an error if a requested task timeout is longer than
+// MaxTimeout.
+func (q *QueueConfig) CheckTimeout(timeout *time.Duration) error {
+	if timeout != nil && q.MaxTimeout > 0 && timeout.Seconds() > q.MaxTimeout {
+		return fmt.Errorf("timeout must be at most %g seconds in this context", q.MaxTimeout)
+	}
+	return nil
+}
+
+// BackoffDelay gets the delay before an expired task can be popped again,
+// given the number of times it has been popped.
+func (q *QueueConfig) BackoffDelay(attempts int) time.Duration {
+	if q.Backoff <= 0 || attempts < 1 {
+		return 0
+	}
+	seconds := q.Backoff
+	for i := 1; i < attempts; i++ {
+		seconds *= 2
+		if (q.MaxBackoff > 0 && seconds >= q.MaxBackoff) || seconds > maxBackoffSeconds {
+			break
+		}
+	}
+	if q.MaxBackoff > 0 && seconds > q.MaxBackoff {
+		seconds = q.MaxBackoff
+	}
+	if seconds > maxBackoffSeconds {
+		seconds = maxBackoffSeconds
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Config gets a copy of the queue's configuration.
+func (q *QueueState) Config() QueueConfig {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return q.config
+}
+
+// UpdateConfig atomically modifies the queue's configuration with f and
+// returns a copy of the result.
+//
+// If f returns an error, the configuration is left unchanged, and the error
+// is returned along with the existing configuration.
+func (q *QueueState) UpdateConfig(f func(c *QueueConfig) error) (QueueConfig, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	config := q.config
+	if err := f(&config); err != nil {
+		return q.config, err
+	}
+	if err := q.CheckOrder(PopOrder(config.Order)); err != nil {
+		return q.config, err
+	}
+	q.config = config
+	q.trimCompletedLog()
+	q.modified()
+	return q.config, nil
+}
+
+// CheckTimeout returns an error if a requested task timeout is not allowed by
+// the queue's configuration.
+func (q *QueueState) CheckTimeout(timeout *time.Duration) error {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return q.config.CheckTimeout(timeout)
+}
+
+// leaseTimeout gets the timeout for newly popped tasks, given the timeout
+// requested by the worker, if any.
+func (q *QueueState) leaseTimeout(requested *time.Duration) *time.Duration {
+	if requested == nil && q.config.Timeout > 0 {
+		timeout := time.Duration(q.config.Timeout * float64(time.Second))
+		return &timeout
+	}
+	return requested
+}
+
+// backoff is passed to the RunningQueue to delay expired tasks.
+func (q *QueueState) backoff(attempts int) time.Duration {
+	return q.config.BackoffDelay(attempts)
+}
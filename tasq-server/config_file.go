@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// envPrefix is prepended to flag names to get environment variable names,
+// e.g. TASQ_AUTH_USERNAME for -auth-username.
+const envPrefix = "TASQ_"
+
+// contextsKey is the key in config files which holds per-context settings.
+const contextsKey = "contexts"
+
+// FlagEnvName gets the environment variable which sets the named flag.
+func FlagEnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// FlagSources sets flags which were not passed on the command line from
+// environment variables and from a JSON config file, so that command line
+// arguments take precedence over environment variables, which take
+// precedence over the config file.
+//
+// The config file is a JSON object whose keys are flag names, with string,
+// number, or boolean values. It may also have a "contexts" key mapping
+// context names to settings, as accepted by /context/config.
+type FlagSources struct {
+	FlagSet *flag.FlagSet
+
+	// ConfigPath is the path to the config file, or "" for none.
+	ConfigPath string
+
+	// fixed contains the flags which were set on the command line or through
+	// environment variables, which the config file cannot change.
+	fixed map[string]bool
+}
+
+// LoadFlagSources applies environment variables and the config file to the
+// flags of fs which were not set on the command line, and returns the
+// per-context settings from the config file, so that they can be applied once
+// the queues are loaded.
+//
+// The config file path is read from configPath after environment variables
+// are applied, so it may itself come from an environment variable.
+func LoadFlagSources(fs *flag.FlagSet, configPath *string) (*FlagSources,
+	map[string]json.RawMessage, error) {
+	f := &FlagSources{FlagSet: fs, fixed: map[string]bool{}}
+	fs.Visit(func(fl *flag.Flag) {
+		f.fixed[fl.Name] = true
+	})
+
+	var envErr error
+	fs.VisitAll(func(fl *flag.Flag) {
+		if f.fixed[fl.Name] || envErr != nil {
+			return
+		}
+		if value, ok := os.LookupEnv(FlagEnvName(fl.Name)); ok {
+			if err := fs.Set(fl.Name, value); err != nil {
+				envErr = fmt.Errorf("invalid value for %s: %s", FlagEnvName(fl.Name), err)
+			}
+			f.fixed[fl.Name] = true
+		}
+	})
+	if envErr != nil {
+		return nil, nil, envErr
+	}
+
+	f.ConfigPath = *configPath
+	_, contexts, err := f.Reload(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, contexts, nil
+}
+
+// Reload reads the config file again and updates the flags from it. Flags
+// which were removed from the file are reset to their defaults.
+//
+// After the flags are updated, validate is called (if non-nil) to check them.
+// If the config file or validate fails, every flag is restored to its
+// previous value.
+//
+// Returns the names of the flags whose values changed, along with the
+// per-context settings in the file.
+func (f *FlagSources) Reload(validate func() error) ([]string, map[string]json.RawMessage, error) {
+	if f.ConfigPath == "" {
+		return nil, nil, nil
+	}
+	data, err := ioutil.ReadFile(f.ConfigPath)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read config file")
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, nil, errors.Wrap(err, "parse config file")
+	}
+
+	var contexts map[string]json.RawMessage
+	if raw, ok := obj[contextsKey]; ok {
+		if err := json.Unmarshal(raw, &contexts); err != nil {
+			return nil, nil, errors.Wrap(err, "parse config file: contexts")
+		}
+		delete(obj, contextsKey)
+	}
+
+	// Sort keys so that errors are deterministic.
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		if f.FlagSet.Lookup(key) == nil {
+			return nil, nil, fmt.Errorf("config file: unknown flag: %s", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	oldValues := map[string]string{}
+	f.FlagSet.VisitAll(func(fl *flag.Flag) {
+		oldValues[fl.Name] = fl.Value.String()
+	})
+	restore := func() {
+		for name, value := range oldValues {
+			f.FlagSet.Set(name, value)
+		}
+	}
+
+	f.FlagSet.VisitAll(func(fl *flag.Flag) {
+		if _, ok := obj[fl.Name]; !ok && !f.fixed[fl.Name] {
+			fl.Value.Set(fl.DefValue)
+		}
+	})
+	for _, key := range keys {
+		if f.fixed[key] {
+			continue
+		}
+		value, err := configFlagValue(obj[key])
+		if err == nil {
+			err = f.FlagSet.Set(key, value)
+		}
+		if err != nil {
+			restore()
+			return nil, nil, fmt.Errorf("config file: invalid value for %s: %s", key, err)
+		}
+	}
+	if validate != nil {
+		if err := validate(); err != nil {
+			restore()
+			return nil, nil, err
+		}
+	}
+
+	var changed []string
+	f.FlagSet.VisitAll(func(fl *flag.Flag) {
+		if fl.Value.String() != oldValues[fl.Name] {
+			changed = append(changed, fl.Name)
+		}
+	})
+	return changed, contexts, nil
+}
+
+func configFlagValue(raw json.RawMessage) (string, error) {
+	var str string
+	if err := json.Unmarshal(raw, &str); err == nil {
+		return str, nil
+	}
+	var number json.Number
+	if err := json.Unmarshal(raw, &number); err == nil {
+		return number.String(), nil
+	}
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return fmt.Sprint(b), nil
+	}
+	return "", errors.New("expected a string, number, or boolean")
+}
+
+// ApplyContextConfigs updates the settings of contexts from a config file.
+//
+// Only the settings which are specified are changed, so other settings (e.g.
+// from the save file) are kept.
+func (s *Server) ApplyContextConfigs(contexts map[string]json.RawMessage) error {
+	names := make([]string, 0, len(contexts))
+	for name := range contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var configErr error
+		err := s.Queues.Get(name, func(qs *QueueState) {
+			_, configErr = qs.UpdateConfig(func(c *QueueConfig) error {
+				decoder := json.NewDecoder(bytes.NewReader(contexts[name]))
+				decoder.DisallowUnknownFields()
+				if err := decoder.Decode(c); err != nil {
+					return err
+				}
+				return s.ValidateConfig(c)
+			})
+		})
+		if err == nil {
+			err = configErr
+		}
+		if err != nil {
+			return errors.Wrap(err, "config file: context "+strconv.Quote(name))
+		}
+	}
+	return nil
+}
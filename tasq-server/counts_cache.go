@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCountsCacheTTL is the default for -counts-cache-ttl.
+const DefaultCountsCacheTTL = time.Second
+
+// cachedCounts is a result of QueueState.Counts() for a given version of the
+// queue.
+type cachedCounts struct {
+	version        int64
+	computed       time.Time
+	rateWindow     int
+	includeModtime bool
+	counts         *QueueCounts
+}
+
+// CachedCounts is like Counts(), but reuses the previous result if the queue
+// has not been modified since it was computed, and it was computed less than
+// ttl ago.
+//
+// The ttl bounds the staleness of counts which change over time without
+// modifications, such as the number of expired tasks and the rate.
+//
+// A cache hit does not lock the queue, so polling the counts of many idle
+// queues does not contend with workers. The result is shared between callers
+// and must not be modified.
+func (q *QueueState) CachedCounts(rateWindow int, includeModtime bool,
+	ttl time.Duration) *QueueCounts {
+	version := atomic.LoadInt64(&q.version)
+	if cached, ok := q.countsCache.Load().(*cachedCounts); ok &&
+		cached.version == version &&
+		cached.rateWindow == rateWindow &&
+		cached.includeModtime == includeModtime &&
+		time.Since(cached.computed) < ttl {
+		return cached.counts
+	}
+	now := time.Now()
+	counts := q.Counts(rateWindow, includeModtime)
+	q.countsCache.Store(&cachedCounts{
+		version:        version,
+		computed:       now,
+		rateWindow:     rateWindow,
+		includeModtime: includeModtime,
+		counts:         counts,
+	})
+	return counts
+}
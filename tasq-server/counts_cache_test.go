@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCachedCounts(t *testing.T) {
+	q := NewQueueState(time.Minute)
+	q.Push("a", 0)
+
+	first := q.CachedCounts(0, false, time.Hour)
+	if first.Pending != 1 {
+		t.Fatalf("unexpected counts: %+v", first)
+	}
+	if q.CachedCounts(0, false, time.Hour) != first {
+		t.Error("counts were not cached")
+	}
+
+	// Different arguments are not served from the cache.
+	if withModtime := q.CachedCounts(0, true, time.Hour); withModtime == first {
+		t.Error("cached counts ignored includeModtime")
+	} else if withModtime.LastModified == nil {
+		t.Error("expected modtime")
+	}
+	if withRate := q.CachedCounts(60, false, time.Hour); withRate.Rate == nil {
+		t.Error("cached counts ignored the rate window")
+	}
+
+	// Modifications invalidate the cache.
+	q.CachedCounts(0, false, time.Hour)
+	task, _ := q.Pop(nil, nil)
+	if counts := q.CachedCounts(0, false, time.Hour); counts.Pending != 0 || counts.Running != 1 {
+		t.Errorf("stale counts after pop: %+v", counts)
+	}
+	q.Completed(task.ID, "")
+	if counts := q.CachedCounts(0, false, time.Hour); counts.Running != 0 || counts.Completed != 1 {
+		t.Errorf("stale counts after completion: %+v", counts)
+	}
+
+	// Expired entries are recomputed even without modifications.
+	cached := q.CachedCounts(0, false, time.Hour)
+	if q.CachedCounts(0, false, 0) == cached {
+		t.Error("cached counts outlived their ttl")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxRemovedContexts limits the number of removed contexts remembered for
+// CountsDelta(). Cursors older than the forgotten removals get a full listing.
+const maxRemovedContexts = 10000
+
+// modificationCounter is incremented every time any queue is modified, giving
+// QueueState.version a global order that cursors can refer to.
+var modificationCounter int64
+
+// cursorEpoch identifies this process in cursors, since modificationCounter
+// starts over when the server restarts.
+var cursorEpoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// A CountsDelta lists the contexts whose counts may have changed since a
+// cursor from a previous CountsDelta.
+type CountsDelta struct {
+	// Cursor should be passed to the next request.
+	Cursor string `json:"cursor"`
+
+	// Reset is true if the cursor was missing, or too old to compute a delta,
+	// in which case every matching context is listed and the caller should
+	// forget any contexts which are not.
+	Reset bool `json:"reset,omitempty"`
+
+	Names   []string       `json:"names"`
+	Counts  []*QueueCounts `json:"counts"`
+	Removed []string       `json:"removed"`
+}
+
+// CountsDelta lists the counts of the contexts matching the wildcard pattern
+// which were modified since the given cursor, along with the matching
+// contexts which were removed.
+//
+// Counts which only change as time passes, as tasks expire or delays end,
+// are not reported until the context is next modified.
+func (q *QueueStateMux) CountsDelta(pattern, cursor string, rateWindow int) *CountsDelta {
+	since, ok := parseCountsCursor(cursor)
+
+	// The cursor is read before listing, so that modifications made while
+	// listing are reported (perhaps again) next time.
+	res := &CountsDelta{
+		Cursor:  cursorEpoch + "." + strconv.FormatInt(atomic.LoadInt64(&modificationCounter), 10),
+		Names:   []string{},
+		Counts:  []*QueueCounts{},
+		Removed: []string{},
+	}
+
+	q.lock.RLock()
+	if !ok || since < q.removedFloor {
+		res.Reset = true
+		since = 0
+	} else {
+		for name, version := range q.removed {
+			if version > since && matchWildcard(pattern, name) {
+				res.Removed = append(res.Removed, name)
+			}
+		}
+	}
+	q.lock.RUnlock()
+
+	q.Iterate(func(name string, qs *QueueState) {
+		if !matchWildcard(pattern, name) {
+			return
+		}
+		if counts, version := qs.versionedCounts(rateWindow); version > since || res.Reset {
+			res.Names = append(res.Names, name)
+			res.Counts = append(res.Counts, counts)
+		}
+	})
+	return res
+}
+
+// forget records the removal of a queue for CountsDelta().
+//
+// The caller must hold the write lock.
+func (q *QueueStateMux) forget(name string, qs *QueueState) {
+	if atomic.LoadInt64(&qs.version) == 0 {
+		// The queue was never modified, so it was never reported.
+		return
+	}
+	if q.removed == nil {
+		q.removed = map[string]int64{}
+	}
+	q.removed[name] = atomic.AddInt64(&modificationCounter, 1)
+	for len(q.removed) > maxRemovedContexts {
+		oldestName, oldest := "", int64(-1)
+		for name, version := range q.removed {
+			if oldest == -1 || version < oldest {
+				oldestName, oldest = name, version
+			}
+		}
+		delete(q.removed, oldestName)
+		q.removedFloor = oldest
+	}
+}
+
+// versionedCounts gets the counts of the queue along with its version.
+func (q *QueueState) versionedCounts(rateWindow int) (*QueueCounts, int64) {
+	counts := q.Counts(rateWindow, false)
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return counts, q.version
+}
+
+// parseCountsCursor gets the version from a cursor, or returns false if the
+// cursor is empty, invalid, or from a different process.
+func parseCountsCursor(cursor string) (int64, bool) {
+	parts := strings.Split(cursor, ".")
+	if len(parts) != 2 || parts[0] != cursorEpoch {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return version, true
+}
+
+// matchWildcard checks if name matches pattern, where each '*' in the pattern
+// matches any sequence of characters.
+func matchWildcard(pattern, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		idx := strings.Index(name, part)
+		if idx == -1 {
+			return false
+		}
+		name = name[idx+len(part):]
+	}
+	return strings.HasSuffix(name, parts[len(parts)-1])
+}
+
+func (s *Server) ServeCountsDelta(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	var rateWindow int
+	if s := r.URL.Query().Get("window"); s != "" {
+		var err error
+		rateWindow, err = strconv.Atoi(s)
+		if err != nil {
+			serveError(w, err.Error())
+			return
+		}
+	}
+	pattern := "*"
+	if values, ok := r.URL.Query()["context"]; ok {
+		pattern = values[0]
+	}
+	serveObject(w, s.Queues.CountsDelta(pattern, r.URL.Query().Get("since"), rateWindow))
+}
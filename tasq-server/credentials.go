@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Credentials are a username and password accepted for basic auth.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// ParseCredentials parses a comma-separated list of username:password pairs,
+// as passed to -auth-credentials. Passwords may contain colons but not commas.
+func ParseCredentials(s string) ([]Credentials, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var res []Credentials
+	for _, pair := range strings.Split(s, ",") {
+		idx := strings.Index(pair, ":")
+		if idx < 0 {
+			return nil, errors.New("credentials must be of the form username:password")
+		}
+		res = append(res, Credentials{Username: pair[:idx], Password: pair[idx+1:]})
+	}
+	return res, nil
+}
+
+// acceptedCredentials lists the credentials accepted by BasicAuth, starting
+// with AuthUsername and AuthPassword (if set). Authentication is disabled if
+// the list is empty.
+func (s *Server) acceptedCredentials() []Credentials {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	var res []Credentials
+	if s.AuthUsername != "" || s.AuthPassword != "" {
+		res = append(res, Credentials{Username: s.AuthUsername, Password: s.AuthPassword})
+	}
+	return append(res, s.AuthCredentials...)
+}
+
+// ServeCredentials lists the usernames which may authenticate with a GET
+// request, or replaces the accepted credentials with a POSTed JSON array of
+// Credentials.
+//
+// To rotate credentials without downtime, POST both the old and new
+// credentials, update the clients, and then POST only the new credentials.
+// Changes last until the next reload or restart.
+func (s *Server) ServeCredentials(w http.ResponseWriter, r *http.Request) {
+	if !s.AdminAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		usernames := []string{}
+		for _, c := range s.acceptedCredentials() {
+			usernames = append(usernames, c.Username)
+		}
+		serveObject(w, usernames)
+		return
+	}
+
+	var creds []Credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		serveError(w, "invalid credentials: "+err.Error())
+		return
+	} else if len(creds) == 0 {
+		serveError(w, "at least one pair of credentials must be provided")
+		return
+	}
+	for _, c := range creds {
+		if c.Username == "" && c.Password == "" {
+			serveError(w, "credentials must not be empty")
+			return
+		}
+	}
+	s.UpdateSettings(func() {
+		s.AuthUsername = creds[0].Username
+		s.AuthPassword = creds[0].Password
+		s.AuthCredentials = creds[1:]
+	})
+	logger.Info("updated credentials", "count", len(creds))
+	n := len(creds)
+	s.Audit(r, &AuditEntry{Op: "set_credentials", Count: &n})
+	serveObject(w, true)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// CSRFHeader is the request header in which browsers must send the token from
+// /csrf_token to use endpoints which modify the queues.
+const CSRFHeader = "X-CSRF-Token"
+
+// CSRFToken gets the server's CSRF token, creating it on first use.
+//
+// The token only protects against other websites, which cannot read it, so a
+// single random token is shared by every user until the server restarts.
+func (s *Server) CSRFToken() string {
+	s.csrfOnce.Do(func() {
+		var data [16]byte
+		if _, err := rand.Read(data[:]); err != nil {
+			panic(err)
+		}
+		s.csrfToken = hex.EncodeToString(data[:])
+	})
+	return s.csrfToken
+}
+
+// RequireCSRF wraps the handler of an endpoint which modifies the queues, so
+// that requests made by browsers on behalf of other websites are rejected,
+// even if the browser has cached the user's basic auth credentials.
+//
+// A request is allowed if it is POSTed with the CSRF token in CSRFHeader. A
+// request without the header is only allowed if it has neither an Origin nor
+// a Sec-Fetch-Site header, which browsers send. Other clients, such as
+// workers, do not send these headers, so they do not need the token. This
+// does not check the method of such requests; routes which must be POSTed
+// are restricted by the Router.
+func (s *Server) RequireCSRF(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.csrfAllowed(r) {
+			h(w, r)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "requests from browsers must be POSTed with a valid " + CSRFHeader +
+				" header; reload the page and try again",
+		})
+	}
+}
+
+func (s *Server) csrfAllowed(r *http.Request) bool {
+	if token := r.Header.Get(CSRFHeader); token != "" {
+		return r.Method == http.MethodPost &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRFToken())) == 1
+	}
+	return r.Header.Get("Origin") == "" && r.Header.Get("Sec-Fetch-Site") == ""
+}
+
+func (s *Server) ServeCSRFToken(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	w.Header().Set("cache-control", "no-store")
+	serveObject(w, s.CSRFToken())
+}
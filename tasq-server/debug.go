@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServeDebug serves CPU, heap, and other runtime profiles under debug/pprof/,
+// in the same format as net/http/pprof, so that they can be read by
+// "go tool pprof".
+//
+// The net/http/pprof package itself is not used because it registers its
+// handlers on http.DefaultServeMux without any authentication.
+func (s *Server) ServeDebug(w http.ResponseWriter, r *http.Request) {
+	if !s.AdminAuth(w, r) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, s.PathPrefix+"debug/pprof/")
+	switch name {
+	case "":
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "Available profiles (pass ?debug=1 for text output):")
+		for _, p := range pprof.Profiles() {
+			fmt.Fprintf(w, "%s (%d)\n", p.Name(), p.Count())
+		}
+		fmt.Fprintln(w, "profile (CPU profile; pass ?seconds=N)")
+		fmt.Fprintln(w, "trace (execution trace; pass ?seconds=N)")
+	case "profile", "trace":
+		duration, err := parseDebugSeconds(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("content-type", "application/octet-stream")
+		w.Header().Set("content-disposition", `attachment; filename="`+name+`"`)
+		if name == "profile" {
+			err = pprof.StartCPUProfile(w)
+		} else {
+			err = trace.Start(w)
+		}
+		if err != nil {
+			w.Header().Del("content-disposition")
+			http.Error(w, "could not start profiling: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		select {
+		case <-time.After(duration):
+		case <-r.Context().Done():
+		}
+		if name == "profile" {
+			pprof.StopCPUProfile()
+		} else {
+			trace.Stop()
+		}
+	default:
+		profile := pprof.Lookup(name)
+		if profile == nil {
+			http.NotFound(w, r)
+			return
+		}
+		debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+		if name == "heap" && r.URL.Query().Get("gc") != "" {
+			runtime.GC()
+		}
+		if debug != 0 {
+			w.Header().Set("content-type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("content-type", "application/octet-stream")
+			w.Header().Set("content-disposition", `attachment; filename="`+name+`"`)
+		}
+		profile.WriteTo(w, debug)
+	}
+}
+
+func parseDebugSeconds(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("seconds")
+	if value == "" {
+		return time.Second * 30, nil
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds <= 0 || seconds > 3600 {
+		return 0, fmt.Errorf("invalid 'seconds' parameter: %s", value)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import "time"
+
+// Requeue removes a task from the running queue and puts it back into the
+// pending queue once the delay has passed. Until then, the task is delayed
+// and cannot be popped.
+//
+// If lease is non-empty, it must match the lease given to the task when it was
+// most recently popped. Returns false if the task was not found.
+func (q *QueueState) Requeue(id, lease string, delay time.Duration) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	task := q.running.Completed(id, lease)
+	if task == nil {
+		return false
+	}
+	task.progress = nil
+	task.endAttempt(time.Now())
+	if delay <= 0 {
+		q.pending.PushTask(task)
+	} else {
+		task.expiration = time.Now().Add(delay)
+		q.delayed.PushByExpiration(task)
+	}
+	q.modified()
+	return true
+}
+
+// promoteDelayed moves delayed tasks whose delay has passed into the pending
+// queue.
+//
+// This must be called with the write lock held.
+func (q *QueueState) promoteDelayed() {
+	now := time.Now()
+	for {
+		task := q.delayed.PeekFirst()
+		if task == nil || task.expiration.After(now) {
+			return
+		}
+		q.delayed.PopFirst()
+		q.pending.PushTask(task)
+	}
+}
+
+// peekDelayed gets a copy of the first delayed task whose delay has passed
+// and whose required tags are offered.
+func (q *QueueState) peekDelayed(offered TagSet) *Task {
+	now := time.Now()
+	for i := 0; i < q.delayed.Len(); i++ {
+		task := q.delayed.At(i)
+		if task.expiration.After(now) {
+			break
+		} else if offered.Matches(task) {
+			return task.DisconnectedCopy()
+		}
+	}
+	return nil
+}
+
+// numDelayedDue counts the delayed tasks which can be moved into the pending
+// queue.
+func (q *QueueState) numDelayedDue() int {
+	now := time.Now()
+	n := 0
+	for n < q.delayed.Len() && !q.delayed.At(n).expiration.After(now) {
+		n++
+	}
+	return n
+}
+
+// nextAvailable gets the earlier of nextTry and the time when the next delayed
+// task can be popped.
+func (q *QueueState) nextAvailable(nextTry *time.Time) *time.Time {
+	task := q.delayed.PeekFirst()
+	if task != nil && (nextTry == nil || task.expiration.Before(*nextTry)) {
+		t := task.expiration
+		return &t
+	}
+	return nextTry
+}
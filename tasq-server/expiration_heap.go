@@ -0,0 +1,169 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// An expirationHeap is a binary min-heap of running tasks, ordered by
+// expiration and then by the order in which they were scheduled.
+//
+// Each task stores its index in the heap, so that it can be removed or
+// rescheduled in O(log n) time.
+type expirationHeap []*Task
+
+func (e expirationHeap) Len() int {
+	return len(e)
+}
+
+func (e expirationHeap) Less(i, j int) bool {
+	return expiresBefore(e[i], e[j])
+}
+
+func (e expirationHeap) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+	e[i].heapIndex = i
+	e[j].heapIndex = j
+}
+
+func (e *expirationHeap) Push(x interface{}) {
+	t := x.(*Task)
+	t.heapIndex = len(*e)
+	*e = append(*e, t)
+}
+
+func (e *expirationHeap) Pop() interface{} {
+	old := *e
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*e = old[:len(old)-1]
+	t.heapIndex = -1
+	return t
+}
+
+// Add inserts a task into the heap.
+func (e *expirationHeap) Add(t *Task) {
+	heap.Push(e, t)
+}
+
+// Remove deletes a task from the heap.
+func (e *expirationHeap) Remove(t *Task) {
+	if t.heapIndex < 0 || t.heapIndex >= len(*e) || (*e)[t.heapIndex] != t {
+		panic("task not in heap")
+	}
+	heap.Remove(e, t.heapIndex)
+}
+
+// Fix restores the heap order after a task's expiration has changed.
+func (e *expirationHeap) Fix(t *Task) {
+	heap.Fix(e, t.heapIndex)
+}
+
+// Reorder restores the heap order after the expirations of many tasks have
+// changed.
+func (e *expirationHeap) Reorder() {
+	heap.Init(e)
+}
+
+// Peek gets the task which expires first, or nil if the heap is empty.
+func (e expirationHeap) Peek() *Task {
+	if len(e) == 0 {
+		return nil
+	}
+	return e[0]
+}
+
+// Visit calls f on tasks in heap order, starting at the root, and skips the
+// subtree below each task for which f returns false.
+//
+// Since no task expires before its parent, this can efficiently visit every
+// task which expires before some time.
+func (e expirationHeap) Visit(f func(t *Task) bool) {
+	var visit func(i int)
+	visit = func(i int) {
+		if i < len(e) && f(e[i]) {
+			visit(2*i + 1)
+			visit(2*i + 2)
+		}
+	}
+	visit(0)
+}
+
+// CountExpired counts the tasks which expire no later than now.
+func (e expirationHeap) CountExpired(now time.Time) int {
+	var n int
+	e.Visit(func(t *Task) bool {
+		if t.expiration.After(now) {
+			return false
+		}
+		n++
+		return true
+	})
+	return n
+}
+
+// Sorted gets the first limit tasks to expire in order, or every task if
+// limit is zero.
+//
+// This takes O(limit*log(limit)) time, without modifying the heap.
+func (e expirationHeap) Sorted(limit int) []*Task {
+	if limit == 0 || limit >= len(e) {
+		res := append([]*Task{}, e...)
+		sort.Slice(res, func(i, j int) bool {
+			return expiresBefore(res[i], res[j])
+		})
+		return res
+	}
+	res := make([]*Task, 0, limit)
+	frontier := &heapFrontier{tasks: e}
+	if len(e) > 0 {
+		heap.Push(frontier, 0)
+	}
+	for len(res) < limit && frontier.Len() > 0 {
+		i := heap.Pop(frontier).(int)
+		res = append(res, e[i])
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < len(e) {
+				heap.Push(frontier, child)
+			}
+		}
+	}
+	return res
+}
+
+// heapFrontier is a heap of indices into an expirationHeap, used to visit
+// the tasks of the expirationHeap in order.
+type heapFrontier struct {
+	tasks   expirationHeap
+	indices []int
+}
+
+func (h *heapFrontier) Len() int {
+	return len(h.indices)
+}
+
+func (h *heapFrontier) Less(i, j int) bool {
+	return h.tasks.Less(h.indices[i], h.indices[j])
+}
+
+func (h *heapFrontier) Swap(i, j int) {
+	h.indices[i], h.indices[j] = h.indices[j], h.indices[i]
+}
+
+func (h *heapFrontier) Push(x interface{}) {
+	h.indices = append(h.indices, x.(int))
+}
+
+func (h *heapFrontier) Pop() interface{} {
+	res := h.indices[len(h.indices)-1]
+	h.indices = h.indices[:len(h.indices)-1]
+	return res
+}
+
+func expiresBefore(t1, t2 *Task) bool {
+	if t1.expiration.Equal(t2.expiration) {
+		return t1.seq < t2.seq
+	}
+	return t1.expiration.Before(t2.expiration)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpirationHeap(t *testing.T) {
+	rng := rand.New(rand.NewSource(1337))
+	base := time.Now()
+	var heap expirationHeap
+	var model []*Task
+	var nextSeq int64
+
+	sortedModel := func() []*Task {
+		res := append([]*Task{}, model...)
+		sort.Slice(res, func(i, j int) bool {
+			return expiresBefore(res[i], res[j])
+		})
+		return res
+	}
+	removeModel := func(task *Task) {
+		for i, x := range model {
+			if x == task {
+				model = append(model[:i], model[i+1:]...)
+				return
+			}
+		}
+		t.Fatal("task not in model")
+	}
+
+	for i := 0; i < 2000; i++ {
+		switch op := rng.Intn(4); {
+		case op == 0 || len(model) == 0:
+			// Few distinct expirations, so that ties are common.
+			task := &Task{
+				ID:         strconv.Itoa(i),
+				expiration: base.Add(time.Duration(rng.Intn(10)) * time.Second),
+				seq:        nextSeq,
+			}
+			nextSeq++
+			heap.Add(task)
+			model = append(model, task)
+		case op == 1:
+			task := model[rng.Intn(len(model))]
+			heap.Remove(task)
+			removeModel(task)
+			if task.heapIndex != -1 {
+				t.Fatal("removed task kept its heap index")
+			}
+		case op == 2:
+			task := model[rng.Intn(len(model))]
+			task.expiration = base.Add(time.Duration(rng.Intn(10)) * time.Second)
+			heap.Fix(task)
+		case op == 3:
+			task := heap.Peek()
+			if expected := sortedModel()[0]; task != expected {
+				t.Fatalf("step %d: expected peek %s but got %s", i, expected.ID, task.ID)
+			}
+		}
+
+		if heap.Len() != len(model) {
+			t.Fatalf("step %d: expected length %d but got %d", i, len(model), heap.Len())
+		}
+		for j, task := range heap {
+			if task.heapIndex != j {
+				t.Fatalf("step %d: task at index %d has heap index %d", i, j, task.heapIndex)
+			}
+		}
+		expected := sortedModel()
+		limit := rng.Intn(len(model) + 2)
+		actual := heap.Sorted(limit)
+		if limit != 0 && limit < len(expected) {
+			expected = expected[:limit]
+		}
+		if len(actual) != len(expected) {
+			t.Fatalf("step %d: expected %d sorted tasks but got %d", i, len(expected), len(actual))
+		}
+		for j, task := range actual {
+			if task != expected[j] {
+				t.Fatalf("step %d: sorted task %d should be %s but got %s", i, j, expected[j].ID, task.ID)
+			}
+		}
+		now := base.Add(time.Duration(rng.Intn(11)) * time.Second)
+		var numExpired int
+		for _, task := range model {
+			if !task.expiration.After(now) {
+				numExpired++
+			}
+		}
+		if n := heap.CountExpired(now); n != numExpired {
+			t.Fatalf("step %d: expected %d expired but got %d", i, numExpired, n)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SetupFollowLoop puts the server in standby mode and starts mirroring the
+// state of a primary server in the background.
+func (s *Server) SetupFollowLoop(primary string, timeout, interval time.Duration,
+	maxFailures int) {
+	atomic.StoreInt32(&s.standby, 1)
+	go s.FollowLoop(primary, timeout, interval, maxFailures)
+}
+
+// FollowLoop mirrors the state of a primary server by periodically fetching
+// its snapshot.
+//
+// Once maxFailures consecutive fetches fail, the server leaves standby mode
+// using the most recently fetched state, and FollowLoop returns. Until a
+// fetch has succeeded, the server stays in standby mode however many fetches
+// fail, since taking over with an empty state would lose every task.
+//
+// The primary is not fenced: if it is still running but unreachable from the
+// standby, both servers will serve requests, so the primary must be stopped
+// (or cut off from clients) before the standby takes over.
+func (s *Server) FollowLoop(primary string, timeout, interval time.Duration,
+	maxFailures int) {
+	logger.Info("following primary server", "primary", primary)
+	synced := false
+	failures := 0
+	for !synced || failures < maxFailures {
+		mux, err := s.fetchSnapshot(primary, timeout)
+		if err == nil {
+			err = s.Queues.ReplaceAll(mux)
+		}
+		if err != nil {
+			failures++
+			if synced {
+				logger.Warn("failed to fetch snapshot", "failures", failures,
+					"maxFailures", maxFailures, "error", err)
+			} else {
+				logger.Warn("failed to fetch snapshot; staying in standby until the first fetch succeeds",
+					"failures", failures, "error", err)
+			}
+		} else {
+			synced = true
+			failures = 0
+		}
+		time.Sleep(interval)
+	}
+	logger.Warn("primary server is unresponsive; taking over", "primary", primary)
+	atomic.StoreInt32(&s.standby, 0)
+}
+
+func (s *Server) fetchSnapshot(primary string, timeout time.Duration) (*QueueStateMux, error) {
+	const context = "fetch snapshot"
+	if !strings.HasSuffix(primary, "/") {
+		primary += "/"
+	}
+	req, err := http.NewRequest("GET", primary+"snapshot", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, context)
+	}
+	if username, password := s.adminCredentials(); username != "" || password != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, context)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(context + ": unexpected status: " + resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, context)
+	}
+	if IsEncryptedSnapshot(data) {
+		if s.SaveCipher == nil {
+			return nil, errors.New(context + ": snapshot is encrypted, but no save key was provided")
+		}
+		if data, err = s.SaveCipher.Decrypt(data); err != nil {
+			return nil, errors.Wrap(err, context)
+		}
+	}
+	return DeserializeQueueStateMux(timeout, bytes.NewReader(data), int64(len(data)))
+}
+
+// StandbyHandler wraps h to refuse requests, other than health checks, while
+// the server is following a primary server.
+func (s *Server) StandbyHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&s.standby) != 0 && !s.isHealthCheck(r) {
+			serveUnavailable(w, "server is a standby")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ServeSnapshot serves the state of every queue to a standby server.
+//
+// Since the snapshot contains every task, it requires the admin credentials,
+// and it is encrypted like the save file if a save key is set.
+func (s *Server) ServeSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !s.AdminAuth(w, r) {
+		return
+	}
+	if s.SaveCipher != nil {
+		w.Header().Set("content-type", "application/octet-stream")
+	} else {
+		w.Header().Set("content-type", "application/zip")
+	}
+	w.Header().Set("cache-control", "no-store")
+	if err := writeSaveFile(w, s.Queues, s.SaveCipher); err != nil {
+		logger.Error("failed to serve snapshot", "error", err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// repairEncodedQueueState fixes problems in a queue from a save file which
+// would otherwise crash the server or break the invariants of the queue,
+// such as tasks with duplicate IDs or groups whose counts do not match their
+// tasks.
+//
+// Returns a description of each problem which was repaired.
+func repairEncodedQueueState(e *EncodedQueueState) []string {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if e.Pending == nil {
+		report("missing pending queue")
+		e.Pending = &EncodedPendingQueue{}
+	}
+	if e.Running == nil {
+		report("missing running queue")
+		e.Running = &EncodedRunningQueue{}
+	}
+	if e.Completed < 0 {
+		report("negative completion count %d", e.Completed)
+		e.Completed = 0
+	}
+
+	// Running tasks are checked first, so that the copy of a duplicated task
+	// which a worker may be running is the one that is kept.
+	seen := map[string]bool{}
+	filter := func(kind string, tasks []EncodedTask) []EncodedTask {
+		res := tasks[:0]
+		for _, t := range tasks {
+			if t.ContentsRef != nil && (*t.ContentsRef < 0 || *t.ContentsRef >= len(e.Contents)) {
+				report("%s task %q refers to missing contents; removed", kind, t.ID)
+			} else if t.ID == "" {
+				report("%s task has no ID; removed", kind)
+			} else if seen[t.ID] {
+				report("%s task %q has a duplicate ID; removed", kind, t.ID)
+			} else {
+				seen[t.ID] = true
+				res = append(res, t)
+			}
+		}
+		return res
+	}
+	e.Running.Deque = filter("running", e.Running.Deque)
+	e.Pending.Deque = filter("pending", e.Pending.Deque)
+	e.Delayed = filter("delayed", e.Delayed)
+	e.Held = filter("held", e.Held)
+	e.Waiting = filter("waiting", e.Waiting)
+
+	running := e.Running.Deque[:0]
+	for _, t := range e.Running.Deque {
+		if t.Lease == "" {
+			report("running task %q has no lease; moved to pending", t.ID)
+			t.Expiration = time.Time{}
+			t.Reserved = false
+			e.Pending.Deque = append(e.Pending.Deque, t)
+		} else {
+			running = append(running, t)
+		}
+	}
+	e.Running.Deque = running
+
+	waiting := e.Waiting[:0]
+	for _, t := range e.Waiting {
+		if t.OrderingKey == "" {
+			report("waiting task %q has no ordering key; moved to pending", t.ID)
+			e.Pending.Deque = append(e.Pending.Deque, t)
+		} else {
+			waiting = append(waiting, t)
+		}
+	}
+	e.Waiting = waiting
+
+	// Only one task per ordering key may be outside of the waiting list. The
+	// others are put at the front of the waiting list, in order.
+	claimed := map[string]bool{}
+	var extra []EncodedTask
+	claim := func(kind string, tasks []EncodedTask) []EncodedTask {
+		res := tasks[:0]
+		for _, t := range tasks {
+			if t.OrderingKey != "" && claimed[t.OrderingKey] {
+				report("%s task %q has the same ordering key as another task; moved to waiting",
+					kind, t.ID)
+				t.Expiration = time.Time{}
+				t.Lease = ""
+				t.Reserved = false
+				extra = append(extra, t)
+				continue
+			}
+			if t.OrderingKey != "" {
+				claimed[t.OrderingKey] = true
+			}
+			res = append(res, t)
+		}
+		return res
+	}
+	e.Running.Deque = claim("running", e.Running.Deque)
+	e.Pending.Deque = claim("pending", e.Pending.Deque)
+	e.Delayed = claim("delayed", e.Delayed)
+	if len(extra) > 0 {
+		e.Waiting = append(extra, e.Waiting...)
+	}
+
+	remaining := map[string]int64{}
+	for _, deque := range [][]EncodedTask{e.Pending.Deque, e.Running.Deque, e.Delayed, e.Held, e.Waiting} {
+		for _, t := range deque {
+			if t.Group != "" {
+				remaining[t.Group]++
+			}
+		}
+	}
+	for name, n := range remaining {
+		if e.Groups[name] == nil {
+			report("group %q of %d tasks is missing; recreated", name, n)
+			if e.Groups == nil {
+				e.Groups = map[string]*TaskGroup{}
+			}
+			e.Groups[name] = &TaskGroup{Total: n}
+		}
+	}
+	names := make([]string, 0, len(e.Groups))
+	for name := range e.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g := e.Groups[name]
+		if g == nil {
+			report("group %q is empty; removed", name)
+			delete(e.Groups, name)
+			continue
+		}
+		if g.Total-g.Completed != remaining[name] {
+			report("group %q has %d remaining tasks, but counts %d of %d completed; total set to %d",
+				name, remaining[name], g.Completed, g.Total, g.Completed+remaining[name])
+			g.Total = g.Completed + remaining[name]
+		}
+		if remaining[name] > 0 && g.Finished != 0 {
+			report("group %q has remaining tasks, but is marked finished; marked unfinished", name)
+			g.Finished = 0
+		} else if remaining[name] == 0 && g.Finished == 0 {
+			report("group %q has no remaining tasks, but is not marked finished; marked finished "+
+				"without running its barrier or callback", name)
+			g.Finished = time.Now().UnixMilli()
+		}
+	}
+
+	return problems
+}
+
+// FsckSaveFile checks every context in a save file, reporting the problems it
+// finds rather than failing on the first one.
+//
+// It returns the problems along with the repaired state, in which entries
+// that could not be read at all are left out.
+func FsckSaveFile(timeout time.Duration, path string, c *SnapshotCipher) ([]string,
+	*QueueStateMux, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if IsEncryptedSnapshot(data) {
+		if c == nil {
+			return nil, nil, fmt.Errorf("save file is encrypted, but no save key was provided")
+		}
+		data, err = c.Decrypt(data)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	zf, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var problems []string
+	res := NewQueueStateMux(timeout)
+
+	// The retention of the server is unknown, so the trash is kept as is and
+	// purged by the server once the repaired file is loaded.
+	res.TrashRetention = math.MaxInt64
+	for _, file := range zf.File {
+		var state ContextState
+		r, err := file.Open()
+		if err == nil {
+			err = json.NewDecoder(r).Decode(&state)
+			r.Close()
+		}
+		if err == nil && state.Encoded == nil {
+			err = fmt.Errorf("no queue state")
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("entry %s: cannot be read; removed: %s",
+				file.Name, err))
+			continue
+		}
+		prefix := fmt.Sprintf("context %q: ", state.Name)
+		if state.Deleted != nil {
+			prefix = fmt.Sprintf("trashed context %q: ", state.Name)
+			if _, ok := res.trash[state.Name]; ok {
+				problems = append(problems, prefix+"duplicate trash in entry "+file.Name+"; removed")
+				continue
+			}
+		} else if _, ok := res.queues[state.Name]; ok {
+			problems = append(problems, prefix+"duplicate context in entry "+file.Name+"; removed")
+			continue
+		}
+		for _, p := range repairEncodedQueueState(state.Encoded) {
+			problems = append(problems, prefix+p)
+		}
+		qs := DecodeQueueState(state.Encoded)
+		if ids := qs.holdCorrupted(); len(ids) > 0 {
+			problems = append(problems, fmt.Sprintf(prefix+"%d tasks do not match their "+
+				"checksums; pending tasks were held", len(ids)))
+		}
+		if state.Deleted != nil {
+			res.trash[state.Name] = &TrashedQueue{State: qs, Deleted: *state.Deleted}
+		} else {
+			res.queues[state.Name] = qs
+		}
+	}
+	return problems, res, nil
+}
+
+// runFsck implements the -fsck flag, printing the problems in the save file
+// and writing the repaired state to outPath if it is non-empty.
+//
+// Returns the exit code for the process, which is non-zero if the save file
+// has problems that were not written to outPath.
+func runFsck(timeout time.Duration, path, outPath string, c *SnapshotCipher) int {
+	problems, mux, err := FsckSaveFile(timeout, path, c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to read save file:", err)
+		return 1
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("%s: %d contexts, %d problems\n", path, len(mux.queues), len(problems))
+	if outPath == "" {
+		if len(problems) > 0 {
+			return 1
+		}
+		return 0
+	}
+	f, err := os.Create(outPath)
+	if err == nil {
+		err = writeSaveFile(f, mux, c)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to write repaired save file:", err)
+		return 1
+	}
+	fmt.Println("wrote repaired save file to", outPath)
+	return 0
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// generationLayout is the format of the timestamp which is appended to
+// SavePath to name a generation. In UTC, it sorts chronologically.
+const generationLayout = "20060102T150405.000Z"
+
+// A SaveGeneration is a timestamped copy of the save file, kept so that the
+// state can be restored from before the latest save.
+type SaveGeneration struct {
+	Name  string `json:"name"`
+	Time  int64  `json:"time"`
+	Bytes int64  `json:"bytes"`
+}
+
+// SaveGenerations lists the generations of the save file, from oldest to
+// newest.
+func (s *Server) SaveGenerations() ([]*SaveGeneration, error) {
+	if s.SavePath == "" {
+		return nil, nil
+	}
+	paths, err := filepath.Glob(s.SavePath + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var res []*SaveGeneration
+	for _, path := range paths {
+		stamp := strings.TrimPrefix(path, s.SavePath+".")
+		t, err := time.Parse(generationLayout, stamp)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		res = append(res, &SaveGeneration{
+			Name:  filepath.Base(path),
+			Time:  t.UnixMilli(),
+			Bytes: info.Size(),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Time < res[j].Time
+	})
+	return res, nil
+}
+
+// keepGeneration copies the save file into a new generation, and then
+// deletes the oldest generations beyond s.KeepSaves.
+//
+// The copy is a hard link when possible, since the save file is replaced
+// rather than modified by the next save.
+func (s *Server) keepGeneration(saveTime time.Time) error {
+	path := s.SavePath + "." + saveTime.UTC().Format(generationLayout)
+	if err := os.Link(s.SavePath, path); err != nil {
+		if err := copyFile(s.SavePath, path); err != nil {
+			return err
+		}
+	}
+	generations, err := s.SaveGenerations()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(s.SavePath)
+	for len(generations) > s.KeepSaves {
+		if err := os.Remove(filepath.Join(dir, generations[0].Name)); err != nil {
+			return err
+		}
+		generations = generations[1:]
+	}
+	return nil
+}
+
+// generationPath gets the path of the named generation, or "" if there is no
+// such generation.
+func (s *Server) generationPath(name string) (string, error) {
+	generations, err := s.SaveGenerations()
+	if err != nil {
+		return "", err
+	}
+	for _, g := range generations {
+		if g.Name == name {
+			return filepath.Join(filepath.Dir(s.SavePath), name), nil
+		}
+	}
+	return "", nil
+}
+
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		os.Remove(dst)
+		return err
+	}
+	return w.Close()
+}
+
+func (s *Server) ServeGenerations(w http.ResponseWriter, r *http.Request) {
+	if !s.AdminAuth(w, r) {
+		return
+	}
+	generations, err := s.SaveGenerations()
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	if generations == nil {
+		generations = []*SaveGeneration{}
+	}
+	serveObject(w, generations)
+}
+
+// ServeRestoreGeneration replaces the entire state with the named generation
+// of the save file.
+func (s *Server) ServeRestoreGeneration(w http.ResponseWriter, r *http.Request) {
+	if !s.AdminAuth(w, r) {
+		return
+	}
+	name := r.FormValue("name")
+	path, err := s.generationPath(name)
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	} else if path == "" {
+		serveError(w, "no such generation: "+name)
+		return
+	}
+	mux, err := LoadSaveFile(s.Queues.Timeout(), path, s.SaveCipher)
+	if err != nil {
+		serveError(w, "failed to load generation: "+err.Error())
+		return
+	}
+	if err := s.Queues.ReplaceAll(mux); err != nil {
+		serveError(w, "failed to restore generation: "+err.Error())
+		return
+	}
+	logger.Warn("restored state from generation", "path", path)
+	s.Audit(r, &AuditEntry{Op: "restore_generation"})
+	serveObject(w, true)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// maxFinishedGroups is the number of finished groups which are remembered by
+// each context, so that their status can still be queried.
+const maxFinishedGroups = 1000
+
+// groupCallbackTimeout limits the time spent delivering each group callback.
+const groupCallbackTimeout = 10 * time.Second
+
+// A TaskGroup tracks the tasks which were pushed to a group, so that an action
+// can be taken once all of them are completed.
+type TaskGroup struct {
+	Total     int64 `json:"total"`
+	Completed int64 `json:"completed"`
+
+	// Finished is the Unix time in milliseconds when the last task in the
+	// group was completed, or 0 if the group has tasks remaining.
+	Finished int64 `json:"finished,omitempty"`
+
+	// Barrier, if non-empty, is pushed as a new task when the group finishes.
+	Barrier string `json:"barrier,omitempty"`
+
+	// Callback, if non-empty, is a URL which is sent a POST request when the
+	// group finishes.
+	Callback string `json:"callback,omitempty"`
+}
+
+// GroupStatus describes the tasks in a group.
+type GroupStatus struct {
+	TaskGroup
+	Pending int64 `json:"pending"`
+	Running int64 `json:"running"`
+	Delayed int64 `json:"delayed"`
+}
+
+// A GroupNotification is a callback which should be sent for a finished
+// group.
+type GroupNotification struct {
+	Callback  string
+	Group     string
+	Total     int64
+	Completed int64
+	Finished  int64
+}
+
+type groupTracker struct {
+	groups map[string]*TaskGroup
+
+	// finished lists finished groups, oldest first, so that the oldest can be
+	// forgotten. A group may appear more than once if tasks were pushed to it
+	// after it finished.
+	finished []string
+
+	notifications []*GroupNotification
+}
+
+func newGroupTracker() *groupTracker {
+	return &groupTracker{groups: map[string]*TaskGroup{}}
+}
+
+func decodeGroupTracker(groups map[string]*TaskGroup) *groupTracker {
+	res := newGroupTracker()
+	for name, g := range groups {
+		res.groups[name] = g
+		if g.Finished != 0 {
+			res.finished = append(res.finished, name)
+		}
+	}
+	sort.Slice(res.finished, func(i, j int) bool {
+		return res.groups[res.finished[i]].Finished < res.groups[res.finished[j]].Finished
+	})
+	return res
+}
+
+// Encode copies the groups into a JSON-serializable object, or returns nil if
+// there are no groups.
+func (g *groupTracker) Encode() map[string]*TaskGroup {
+	if len(g.groups) == 0 {
+		return nil
+	}
+	res := make(map[string]*TaskGroup, len(g.groups))
+	for name, group := range g.groups {
+		copied := *group
+		res[name] = &copied
+	}
+	return res
+}
+
+func (g *groupTracker) Len() int {
+	return len(g.groups)
+}
+
+// GroupStatus gets the status of the named group, or returns false if no
+// tasks have been pushed to the group (or it has been forgotten).
+func (q *QueueState) GroupStatus(name string) (*GroupStatus, bool) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	group, ok := q.groups.groups[name]
+	if !ok {
+		return nil, false
+	}
+	res := &GroupStatus{TaskGroup: *group}
+	q.running.Iterate(func(t *Task) {
+		if t.group == name {
+			res.Running++
+		}
+	})
+	q.delayed.Iterate(func(t *Task) {
+		if t.group == name {
+			res.Delayed++
+		}
+	})
+	res.Pending = group.Total - group.Completed - res.Running - res.Delayed
+	return res, true
+}
+
+// OnGroupComplete sets the barrier task and callback URL for the named group,
+// replacing any previous ones. Either may be empty.
+//
+// If the group has already finished, the barrier is pushed immediately, and
+// the callback is returned by the next TakeGroupNotifications().
+//
+// Returns false if no tasks have been pushed to the group.
+func (q *QueueState) OnGroupComplete(name, barrier, callback string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	group, ok := q.groups.groups[name]
+	if !ok {
+		return false
+	}
+	group.Barrier = barrier
+	group.Callback = callback
+	if group.Finished != 0 {
+		q.groupFinished(name, group)
+	}
+	q.modified()
+	return true
+}
+
+// TakeGroupNotifications returns and clears the callbacks for groups which
+// have finished since the last call.
+func (q *QueueState) TakeGroupNotifications() []*GroupNotification {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	res := q.groups.notifications
+	q.groups.notifications = nil
+	return res
+}
+
+// addToGroup records that n tasks were pushed to a group.
+//
+// The caller must hold the write lock.
+func (q *QueueState) addToGroup(name string, n int) {
+	if name == "" {
+		return
+	}
+	group, ok := q.groups.groups[name]
+	if !ok {
+		group = &TaskGroup{}
+		q.groups.groups[name] = group
+	}
+	group.Total += int64(n)
+	group.Finished = 0
+}
+
+// completeInGroup records the completion of a task, finishing its group if it
+// was the last one.
+//
+// The caller must hold the write lock.
+func (q *QueueState) completeInGroup(t *Task) {
+	group, ok := q.groups.groups[t.group]
+	if !ok {
+		return
+	}
+	group.Completed++
+	if group.Completed >= group.Total {
+		group.Finished = time.Now().UnixMilli()
+		q.groups.finished = append(q.groups.finished, t.group)
+		q.groupFinished(t.group, group)
+		q.trimFinishedGroups()
+	}
+}
+
+// groupFinished pushes the barrier task and queues the callback of a finished
+// group. Each of these happens only once.
+//
+// The caller must hold the write lock.
+func (q *QueueState) groupFinished(name string, group *TaskGroup) {
+	if group.Barrier != "" {
+		q.addTask(group.Barrier, nil)
+		group.Barrier = ""
+	}
+	if group.Callback != "" {
+		q.groups.notifications = append(q.groups.notifications, &GroupNotification{
+			Callback:  group.Callback,
+			Group:     name,
+			Total:     group.Total,
+			Completed: group.Completed,
+			Finished:  group.Finished,
+		})
+		group.Callback = ""
+	}
+}
+
+// trimFinishedGroups forgets the oldest finished groups beyond
+// maxFinishedGroups.
+//
+// The caller must hold the write lock.
+func (q *QueueState) trimFinishedGroups() {
+	g := q.groups
+	for len(g.finished) > maxFinishedGroups {
+		name := g.finished[0]
+		g.finished = g.finished[1:]
+		if group, ok := g.groups[name]; ok && group.Finished != 0 {
+			delete(g.groups, name)
+		}
+	}
+}
+
+func (s *Server) ServeGroupStatus(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	var status *GroupStatus
+	var ok bool
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		status, ok = qs.GroupStatus(r.URL.Query().Get("id"))
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
+	if !ok {
+		serveError(w, "no tasks have been pushed to the group")
+		return
+	}
+	serveObject(w, status)
+}
+
+func (s *Server) ServeGroupOnComplete(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	id := r.FormValue("id")
+	callback := r.FormValue("callback")
+	if callback != "" {
+		u, err := url.Parse(callback)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			serveError(w, "invalid `callback` parameter: expected an http or https URL")
+			return
+		}
+	}
+	var ok bool
+	var notifications []*GroupNotification
+	context := r.URL.Query().Get("context")
+	err := s.Queues.Get(context, func(qs *QueueState) {
+		ok = qs.OnGroupComplete(id, r.FormValue("push"), callback)
+		notifications = qs.TakeGroupNotifications()
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
+	s.NotifyGroups(context, notifications)
+	if !ok {
+		serveError(w, "no tasks have been pushed to the group")
+		return
+	}
+	s.Audit(r, &AuditEntry{Op: "group_on_complete", Group: id})
+	serveObject(w, true)
+}
+
+// NotifyGroups sends the callbacks for finished groups in the background.
+func (s *Server) NotifyGroups(context string, notifications []*GroupNotification) {
+	for _, n := range notifications {
+		go s.notifyGroup(context, n)
+	}
+}
+
+func (s *Server) notifyGroup(context string, n *GroupNotification) {
+	body, err := json.Marshal(map[string]interface{}{
+		"context":   context,
+		"group":     n.Group,
+		"total":     n.Total,
+		"completed": n.Completed,
+		"finished":  n.Finished,
+	})
+	if err != nil {
+		panic(err)
+	}
+	client := &http.Client{Timeout: groupCallbackTimeout}
+	resp, err := client.Post(n.Callback, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			logger.Warn("group callback failed", "context", context, "group", n.Group,
+				"status", resp.Status)
+		}
+	} else {
+		logger.Warn("group callback failed", "context", context, "group", n.Group,
+			"error", err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// ServeHealthz reports that the server is running, even while it is starting
+// or in standby mode, for use as a liveness probe.
+func (s *Server) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	serveObject(w, true)
+}
+
+// ServeReadyz reports whether the server is ready to handle requests, for
+// use as a readiness probe. It fails with a 503 status while the server is
+// loading its state or is a standby.
+func (s *Server) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		serveUnavailable(w, "server is starting")
+	} else if atomic.LoadInt32(&s.standby) != 0 {
+		serveUnavailable(w, "server is a standby")
+	} else {
+		serveObject(w, true)
+	}
+}
+
+// MarkReady allows the server to handle requests once its state is loaded.
+func (s *Server) MarkReady() {
+	atomic.StoreInt32(&s.ready, 1)
+}
+
+// StartupHandler wraps h to refuse requests, other than health checks, until
+// MarkReady is called.
+func (s *Server) StartupHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&s.ready) == 0 && !s.isHealthCheck(r) {
+			serveUnavailable(w, "server is starting")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) isHealthCheck(r *http.Request) bool {
+	return r.URL.Path == s.PathPrefix+"healthz" || r.URL.Path == s.PathPrefix+"readyz"
+}
+
+func serveUnavailable(w http.ResponseWriter, message string) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": message})
+}
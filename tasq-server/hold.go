@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Hold moves a pending or running task aside, so that it is skipped by pops
+// until Unhold() is called for it. A running task loses its lease, so that
+// its worker can no longer complete it.
+//
+// Returns false if no pending or running task had the given ID. Tasks which
+// are delayed, or waiting for their ordering key, are not pending.
+func (q *QueueState) Hold(id string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	mem, ok := q.pending.(*PendingQueue)
+	if !ok {
+		return false
+	}
+	q.promoteDelayed()
+	task := mem.Remove(id)
+	if task == nil {
+		task = q.running.Completed(id, "")
+		if task == nil {
+			return false
+		}
+		task.endAttempt(time.Now())
+		task.Lease = ""
+		task.expiration = time.Time{}
+		task.progress = nil
+		task.reserved = false
+	}
+	q.held.PushLast(task)
+	q.modified()
+	return true
+}
+
+// Unhold puts a held task back at the end of the pending queue.
+//
+// Returns false if no held task had the given ID.
+func (q *QueueState) Unhold(id string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i := 0; i < q.held.Len(); i++ {
+		if task := q.held.At(i); task.ID == id {
+			q.held.removeAt(i)
+			q.pending.PushTask(task)
+			q.modified()
+			return true
+		}
+	}
+	return false
+}
+
+// Held lists the held tasks in the order they were held.
+func (q *QueueState) Held() []*Task {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	res := []*Task{}
+	q.held.Iterate(func(t *Task) {
+		res = append(res, t.DisconnectedCopy())
+	})
+	return res
+}
+
+// Remove deletes the pending task with the given ID, returning nil if it was
+// not found.
+//
+// This scans every pending task, so it should only be used for rare
+// operations.
+func (p *PendingQueue) Remove(id string) *Task {
+	for _, deque := range p.deques() {
+		for i := 0; i < deque.Len(); i++ {
+			t := deque.At(i)
+			if t.ID != id {
+				continue
+			}
+			deque.removeAt(i)
+			return p.popFrom(deque, t)
+		}
+	}
+	return nil
+}
+
+func (s *Server) ServeHoldTask(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	id := r.FormValue("id")
+	var ok, inMemory bool
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		if inMemory = qs.InMemory(); inMemory {
+			ok = qs.Hold(id)
+		}
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	} else if !inMemory {
+		serveError(w, "holds are not supported for disk-backed contexts")
+		return
+	}
+	if ok {
+		s.Audit(r, &AuditEntry{Op: "hold", IDs: []string{id}})
+		serveObject(w, true)
+	} else {
+		serveError(w, "there was no pending or in-progress task with the specified `id`")
+	}
+}
+
+func (s *Server) ServeUnholdTask(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	id := r.FormValue("id")
+	var ok bool
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		ok = qs.Unhold(id)
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
+	if ok {
+		s.Audit(r, &AuditEntry{Op: "unhold", IDs: []string{id}})
+		serveObject(w, true)
+	} else {
+		serveError(w, "there was no held task with the specified `id`")
+	}
+}
+
+func (s *Server) ServeHeldTasks(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	var tasks []*Task
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		tasks = qs.Held()
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
+	serveObject(w, tasks)
+}
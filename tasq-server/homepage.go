@@ -1,9 +1,22 @@
 package main
 
-const Homepage = `<!doctype html>
+import "html/template"
+
+// homepageTemplate renders the embedded homepage, injecting the server's
+// -path-prefix so that the page can find the API.
+var homepageTemplate = template.Must(template.New("homepage").Parse(homepageSource))
+
+// homepageData is passed to homepageTemplate.
+type homepageData struct {
+	PathPrefix string
+}
+
+const homepageSource = `<!doctype html>
 <html>
 	<head>
 		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1">
+		<meta name="color-scheme" content="light dark">
 		<style type="text/css">
 			html, body {
 				background-color: #f0f0f0;
@@ -105,6 +118,28 @@ const Homepage = `<!doctype html>
 				font-family: monospace;
 			}
 
+			.counts-item-select {
+				position: absolute;
+				right: 10px;
+				top: 10px;
+				margin: 0;
+				cursor: pointer;
+			}
+
+			#refresh-box {
+				color: #555;
+			}
+
+			#refresh-box select {
+				margin: 0 5px;
+			}
+
+			#bulk-box {
+				position: sticky;
+				top: 0;
+				z-index: 1;
+			}
+
 			.counts-item-collapser::after {
 				content: '▼';
 			}
@@ -215,8 +250,10 @@ const Homepage = `<!doctype html>
 
 			@media screen and (max-width: 620px) {
 				.overlay-pane {
-					width: calc(100% - 40px);
-					left: 20px;
+					width: calc(100% - 20px);
+					left: 10px;
+					top: 10px;
+					height: calc(100% - 20px);
 				}
 			}
 
@@ -229,9 +266,142 @@ const Homepage = `<!doctype html>
 				border: 1px solid #d5d5d5;
 				box-sizing: border-box;
 			}
+
+			/* Small screens, e.g. phones during on-call. */
+			@media screen and (max-width: 620px) {
+				.counts-item-name {
+					padding: 0 25px;
+					overflow-wrap: anywhere;
+				}
+
+				.counts-item-table td, .stats-table td {
+					overflow-wrap: anywhere;
+				}
+
+				.counts-item-action {
+					margin: 3px;
+					padding: 8px 10px;
+					font-size: 1em;
+				}
+
+				.counts-item-select {
+					width: 20px;
+					height: 20px;
+					top: 8px;
+				}
+
+				.add-task-field label, .add-task-field input {
+					display: block;
+					width: 100%;
+					box-sizing: border-box;
+					text-align: left;
+				}
+
+				.add-task-field input {
+					font-size: 16px;
+				}
+
+				.overlay-textbox {
+					font-size: 12px;
+				}
+			}
+
+			.stuck-list {
+				height: calc(100% - 72px);
+				margin: 10px;
+				overflow-y: auto;
+				text-align: left;
+			}
+
+			.stuck-item {
+				padding: 5px 0;
+				border-bottom: 1px solid #d5d5d5;
+			}
+
+			.stuck-item-description {
+				overflow-wrap: anywhere;
+			}
+
+			@media (prefers-color-scheme: dark) {
+				html, body {
+					background-color: #181818;
+					color: #ddd;
+				}
+
+				.panel, .overlay-pane {
+					background-color: #242424;
+					border-color: #3a3a3a;
+				}
+
+				.counts-item-name, .stats-name {
+					border-bottom-color: #3a3a3a;
+				}
+
+				.counts-item-collapser, #refresh-box {
+					color: #aaa;
+				}
+
+				.counts-item-action, .overlay-close-button {
+					background-color: #555;
+					color: #eee;
+				}
+
+				.counts-item-action:hover, .overlay-close-button:hover {
+					background-color: #666;
+				}
+
+				.counts-item-action-destructive {
+					background-color: #a94444;
+				}
+
+				.counts-item-action-destructive:hover {
+					background-color: #c05050;
+				}
+
+				#error-box {
+					color: #ff7070;
+				}
+
+				.overlay-container {
+					background-color: rgba(0, 0, 0, 0.7);
+				}
+
+				.overlay-textbox, input:not([type=checkbox]), select {
+					background-color: #1c1c1c;
+					color: #ddd;
+					border: 1px solid #3a3a3a;
+				}
+
+				.stuck-item {
+					border-bottom-color: #3a3a3a;
+				}
+			}
 		</style>
 	</head>
 	<body>
+		<div id="refresh-box" class="width-sizing panel">
+			<label>
+				Auto-refresh:
+				<select id="refresh-interval" onchange="setRefreshInterval(parseInt(this.value))">
+					<option value="0">Off</option>
+					<option value="5">Every 5 seconds</option>
+					<option value="10">Every 10 seconds</option>
+					<option value="30">Every 30 seconds</option>
+					<option value="60">Every minute</option>
+				</select>
+			</label>
+			<span id="last-refreshed"></span>
+		</div>
+		<div id="bulk-box" class="width-sizing panel hidden">
+			<span id="bulk-count"></span>
+			<div>
+				<button class="counts-item-action" onclick="selectAll()">Select All</button>
+				<button class="counts-item-action" onclick="clearSelection()">Select None</button>
+				<button class="counts-item-action counts-item-action-destructive" onclick="bulkAction('expire_all')">Expire All</button>
+				<button class="counts-item-action" onclick="bulkAction('queue_expired')">Queue Expired</button>
+				<button class="counts-item-action counts-item-action-destructive" onclick="bulkAction('clear')">Delete</button>
+			</div>
+		</div>
 		<ol id="counts-list" class="width-sizing counts-loading"></ol>
 		<div id="empty-box" class="width-sizing panel hidden">
 			There are no active queues.
@@ -249,6 +419,10 @@ const Homepage = `<!doctype html>
 			</div>
 			<input id="add-task-button" type="submit" value="Add task">
 		</form>
+		<div id="trash-box" class="width-sizing panel hidden">
+			<label class="stats-name">Recently deleted</label>
+			<table id="trash-table" class="stats-table"></table>
+		</div>
 		<li id="stats-box" class="width-sizing panel">
 			<label class="stats-name">System stats</label>
 			<table class="stats-table">
@@ -288,6 +462,12 @@ const Homepage = `<!doctype html>
 				<button class="overlay-close-button" onclick="closeTextOverlay()">Close</button>
 			</div>
 		</div>
+		<div id="stuck-overlay-container" class="overlay-container overlay-container-hidden" onclick="closeStuckOverlay()">
+			<div class="overlay-pane" onclick="event.stopPropagation()">
+				<div id="stuck-list" class="stuck-list"></div>
+				<button class="overlay-close-button" onclick="closeStuckOverlay()">Close</button>
+			</div>
+		</div>
 
 		<script type="text/javascript">
 		<!--
@@ -295,29 +475,88 @@ const Homepage = `<!doctype html>
 		const emptyBox = document.getElementById('empty-box');
 		const errorBox = document.getElementById('error-box');
 
+		// The server's -path-prefix, injected when the page is rendered.
+		const pathPrefix = {{.PathPrefix}};
+
+		// API paths are resolved against the prefix when the page is served
+		// from it, with or without a trailing slash. Behind a reverse proxy
+		// which rewrites paths, the prefix seen by the browser is different,
+		// so API paths are resolved relative to the page instead.
+		const apiBase = (window.location.pathname === pathPrefix ||
+			window.location.pathname + '/' === pathPrefix) ? pathPrefix : '';
+
+		async function apiFetch(path) {
+			return await checkResponse(await fetch(apiBase + path, {credentials: 'same-origin'}));
+		}
+
+		// Requests which modify the queues must be POSTed with the server's
+		// CSRF token. If body is undefined, the request has no body.
+		async function apiPost(path, body) {
+			const headers = {'X-CSRF-Token': await csrfToken()};
+			const options = {method: 'POST', credentials: 'same-origin', headers: headers};
+			if (body !== undefined) {
+				headers['Content-Type'] = 'application/json';
+				options.body = JSON.stringify(body);
+			}
+			return await checkResponse(await fetch(apiBase + path, options));
+		}
+
+		let cachedCSRFToken = null;
+
+		async function csrfToken() {
+			if (cachedCSRFToken === null) {
+				const response = await (await apiFetch('csrf_token')).json();
+				cachedCSRFToken = response['data'];
+			}
+			return cachedCSRFToken;
+		}
+
+		function checkResponse(response) {
+			if (response.status === 401) {
+				throw new Error('Not authorized. Reload the page to log in again.');
+			} else if (response.status === 403) {
+				// The server may have restarted with a new token.
+				cachedCSRFToken = null;
+				throw new Error('Request was rejected. Please try again.');
+			}
+			return response;
+		}
+
+		// Names of the contexts which are selected for bulk actions.
+		const selected = new Set();
+
 		function queueNamePrefix() {
 			const urlParams = new URLSearchParams(window.location.search);
 			return urlParams.get('prefix') || '';
 		}
 
-		async function reloadCounts(actionFn) {
-			countsList.classList.add('counts-loading');
-			emptyBox.classList.add('hidden');
-			errorBox.classList.add('hidden');
+		// If quiet is true, the current counts stay visible while loading, so
+		// that periodic refreshes do not flicker.
+		async function reloadCounts(actionFn, quiet) {
+			if (!quiet) {
+				countsList.classList.add('counts-loading');
+			}
 			let result;
 			try {
 				if (actionFn) {
 					await actionFn();
 				}
-				result = await (await fetch('/counts?all=1&window=60&includeModtime=1')).json();
+				result = await (await apiFetch('counts?all=1&window=60&includeModtime=1')).json();
 			} catch (e) {
 				errorBox.textContent = '' + e;
 				errorBox.classList.remove('hidden');
+				if (!quiet) {
+					countsList.innerHTML = '';
+				}
 				return false;
 			} finally {
-				countsList.innerHTML = '';
 				countsList.classList.remove('counts-loading');
 			}
+			countsList.innerHTML = '';
+			emptyBox.classList.add('hidden');
+			errorBox.classList.add('hidden');
+			lastRefreshed = new Date();
+			updateLastRefreshed();
 
 			const prefix = queueNamePrefix();
 
@@ -338,18 +577,25 @@ const Homepage = `<!doctype html>
 			localStorage['collapsed'] = JSON.stringify(
 				collapsed.filter((x) => allNames.includes(x)),
 			);
+			Array.from(selected).forEach((name) => {
+				if (!allNames.includes(name) || !name.startsWith(prefix)) {
+					selected.delete(name);
+				}
+			});
+			updateBulkBox();
 
 			if (numDisplayed === 0) {
 				emptyBox.classList.remove('hidden');
 			}
 
 			await reloadStats();
+			await reloadTrash();
 
 			return true;
 		}
 
 		async function reloadStats() {
-			const response = await (await fetch('/stats')).json();
+			const response = await (await apiFetch('stats')).json();
 			const stats = response['data'];
 			[
 				['stats-field-uptime', Math.round(stats.uptime) + ' seconds'],
@@ -365,6 +611,38 @@ const Homepage = `<!doctype html>
 			});
 		}
 
+		async function reloadTrash() {
+			const response = await (await apiFetch('context/trash')).json();
+			const trash = response['data'];
+			const trashBox = document.getElementById('trash-box');
+			const trashTable = document.getElementById('trash-table');
+			trashTable.innerHTML = '';
+			trash.forEach((item) => {
+				const row = document.createElement('tr');
+				const nameCol = document.createElement('td');
+				nameCol.className = 'stats-field-name';
+				nameCol.textContent = (item.name || 'Default context') + ':';
+				const infoCol = document.createElement('td');
+				const numTasks = item.counts.pending + item.counts.running;
+				infoCol.textContent = numTasks + ' tasks, deleted ' + relativeTimeSince(item.deleted);
+				const actionCol = document.createElement('td');
+				const restoreButton = document.createElement('button');
+				restoreButton.className = 'counts-item-action';
+				restoreButton.textContent = 'Restore';
+				restoreButton.addEventListener('click', () => restoreContext(item.name));
+				actionCol.appendChild(restoreButton);
+				row.appendChild(nameCol);
+				row.appendChild(infoCol);
+				row.appendChild(actionCol);
+				trashTable.appendChild(row);
+			});
+			if (trash.length === 0) {
+				trashBox.classList.add('hidden');
+			} else {
+				trashBox.classList.remove('hidden');
+			}
+		}
+
 		function addCountsToList(name, counts, collapsed) {
 			const elem = document.createElement('li');
 			elem.className = 'counts-item panel';
@@ -377,6 +655,22 @@ const Homepage = `<!doctype html>
 			collapser.addEventListener('click', () => toggleCollapse(elem, name));
 			elem.appendChild(collapser);
 
+			const selectBox = document.createElement('input');
+			selectBox.type = 'checkbox';
+			selectBox.className = 'counts-item-select';
+			selectBox.title = 'Select for bulk actions';
+			selectBox.dataset.name = name;
+			selectBox.checked = selected.has(name);
+			selectBox.addEventListener('change', () => {
+				if (selectBox.checked) {
+					selected.add(name);
+				} else {
+					selected.delete(name);
+				}
+				updateBulkBox();
+			});
+			elem.appendChild(selectBox);
+
 			const nameLabel = document.createElement('label');
 			nameLabel.className = 'counts-item-name';
 			nameLabel.textContent = name || 'Default context';
@@ -389,9 +683,18 @@ const Homepage = `<!doctype html>
 				['pending', 'Pending'],
 				['running', 'In progress'],
 				['expired', 'Expired'],
+				['backingOff', 'Backing off'],
+				['delayed', 'Delayed'],
+				['held', 'Held'],
+				['stuck', 'Stuck'],
 				['completed', 'Completed'],
 				['rate', 'Tasks/sec'],
+				['eta', 'Time remaining'],
+				['expiredFraction', 'Attempts expired'],
 				['modtime', 'Last modified'],
+				['lastPushed', 'Last push'],
+				['lastPopped', 'Last pop'],
+				['lastCompleted', 'Last completion'],
 			];
 			const fieldTable = document.createElement('table');
 			fieldTable.className = 'counts-item-table';
@@ -405,8 +708,16 @@ const Homepage = `<!doctype html>
 				const dataCol = document.createElement('td');
 				if (fieldId === 'rate') {
 					dataCol.textContent = counts[fieldId].toFixed(3);
+				} else if (fieldId === 'eta') {
+					dataCol.textContent = formatDuration(counts[fieldId]);
+				} else if (fieldId === 'expiredFraction') {
+					const frac = counts[fieldId];
+					dataCol.textContent = typeof frac === 'number' ? (frac * 100).toFixed(1) + '%' : '-';
 				} else if (fieldId == 'modtime') {
 					dataCol.textContent = relativeTimeSince(counts[fieldId]);
+				} else if (fieldId.startsWith('last')) {
+					const timestamp = counts[fieldId];
+					dataCol.textContent = typeof timestamp === 'number' ? relativeTimeSince(timestamp) : 'never';
 				} else {
 					dataCol.textContent = '' + counts[fieldId];
 				}
@@ -422,6 +733,7 @@ const Homepage = `<!doctype html>
 
 			[
 				['Peek', peekTask],
+				['Stuck', showStuckTasks],
 				['Push', pushTaskPrompt],
 				['Expire All', expireAll],
 				['Delete', deleteContext],
@@ -442,6 +754,21 @@ const Homepage = `<!doctype html>
 			countsList.appendChild(elem);
 		}
 
+		function formatDuration(seconds) {
+			if (typeof seconds !== 'number') {
+				return '-';
+			}
+			const hours = Math.floor(seconds / 3600);
+			const minutes = Math.floor((seconds % 3600) / 60);
+			if (hours > 0) {
+				return 'about ' + hours + 'h' + minutes + 'm';
+			} else if (minutes > 0) {
+				return 'about ' + minutes + 'm';
+			} else {
+				return 'about ' + Math.round(seconds) + 's';
+			}
+		}
+
 		function relativeTimeSince(timestamp) {
 			const now = Date.now();
 			const since = Math.max(0, now - timestamp) / 1000;
@@ -489,19 +816,81 @@ const Homepage = `<!doctype html>
 			localStorage['collapsed'] = JSON.stringify(collapsed);
 		}
 
+		function updateBulkBox() {
+			const bulkBox = document.getElementById('bulk-box');
+			if (selected.size === 0) {
+				bulkBox.classList.add('hidden');
+			} else {
+				bulkBox.classList.remove('hidden');
+				const noun = selected.size === 1 ? ' context' : ' contexts';
+				document.getElementById('bulk-count').textContent = selected.size + noun + ' selected';
+			}
+		}
+
+		function setAllSelected(checked) {
+			Array.from(countsList.getElementsByClassName('counts-item-select')).forEach((box) => {
+				box.checked = checked;
+				if (checked) {
+					selected.add(box.dataset.name);
+				} else {
+					selected.delete(box.dataset.name);
+				}
+			});
+			updateBulkBox();
+		}
+
+		function selectAll() {
+			setAllSelected(true);
+		}
+
+		function clearSelection() {
+			setAllSelected(false);
+		}
+
+		function bulkAction(op) {
+			const names = Array.from(selected);
+			const descriptions = {
+				'expire_all': 'Expire all running tasks in',
+				'queue_expired': 'Move expired tasks back into the queue in',
+				'clear': 'Really delete',
+			};
+			const message = descriptions[op] + ' ' + names.length + ' queue(s):\n' +
+				names.map((x) => x || 'Default context').join('\n');
+			if (!confirm(message)) {
+				return;
+			}
+			reloadCounts(async () => {
+				const response = await (await apiPost('context/bulk?op=' + op, names)).json();
+				if (response['error']) {
+					throw new Error(response['error']);
+				}
+				const failures = response['data'].filter((x) => x.error);
+				if (failures.length > 0) {
+					alert(failures.map((x) => (x.context || 'Default context') + ': ' + x.error).join('\n'));
+				}
+				if (op === 'clear') {
+					selected.clear();
+				}
+			});
+		}
+
 		function deleteContext(name) {
 			if (confirm('Really delete queue with name: "' + name + '"?')) {
-				reloadCounts(() => fetch('/task/clear?context=' + encodeURIComponent(name)));				
+				reloadCounts(() => apiPost('task/clear?context=' + encodeURIComponent(name)));
 			}
 		}
 
+		function restoreContext(name) {
+			reloadCounts(() => apiPost('context/restore?context=' + encodeURIComponent(name)));
+		}
+
 		function expireAll(name) {
-			reloadCounts(() => fetch('/task/expire_all?context=' + encodeURIComponent(name)));
+			reloadCounts(() => apiPost('task/expire_all?context=' + encodeURIComponent(name)));
 		}
 
 		async function peekTask(name) {
 			try {
-				const response = await fetch('/task/peek?context=' + encodeURIComponent(name));
+				const response = await apiFetch('task/peek?context=' + encodeURIComponent(name));
 				showTextOverlay(JSON.stringify(await response.json(), null, 2));
 			} catch (e) {
 				alert(e);
@@ -516,9 +905,9 @@ const Homepage = `<!doctype html>
 			try {
 				let value = null;
 				await reloadCounts(async () => {
-					const pushURL = '/task/push?context=' + encodeURIComponent(name) +
+					const pushURL = 'task/push?context=' + encodeURIComponent(name) +
 						'&contents=' + encodeURIComponent(contents);
-					const resp = await fetch(pushURL)
+					const resp = await apiPost(pushURL);
 					value = await resp.text();
 				});
 			} catch (e) {
@@ -532,7 +921,7 @@ const Homepage = `<!doctype html>
 			const contentsField = document.getElementById('add-task-contents');
 			const contents = contentsField.value;
 			reloadCounts(() => {
-				return fetch('/task/push?context=' + encodeURIComponent(context) + '&contents=' +
+				return apiPost('task/push?context=' + encodeURIComponent(context) + '&contents=' +
 					encodeURIComponent(contents));
 			}).then((success) => {
 				if (success) {
@@ -553,7 +942,131 @@ const Homepage = `<!doctype html>
 			container.classList.add('overlay-container-hidden');
 		}
 
-		reloadCounts(null);
+		// Lists the stuck tasks of a context, with buttons to expire each task
+		// so that another worker retries it, or to hold it for investigation.
+		async function showStuckTasks(name) {
+			let tasks;
+			try {
+				const response = await (await apiFetch('task/stuck?context=' + encodeURIComponent(name))).json();
+				if (response['error']) {
+					throw new Error(response['error']);
+				}
+				tasks = response['data'];
+			} catch (e) {
+				alert(e);
+				return;
+			}
+			const list = document.getElementById('stuck-list');
+			list.innerHTML = '';
+			if (tasks.length === 0) {
+				list.textContent = 'No tasks are stuck.';
+			}
+			tasks.forEach((task) => {
+				const item = document.createElement('div');
+				item.className = 'stuck-item';
+				const description = document.createElement('div');
+				description.className = 'stuck-item-description';
+				description.textContent = task['id'] + ': ' + task['attempts'] + ' attempt(s), running for ' +
+					formatDuration(task['runningTime']) + ' (' + task['reasons'].join(', ') + ')';
+				description.title = task['contents'];
+				item.appendChild(description);
+				[
+					['Expire', 'task/expire'],
+					['Hold', 'task/hold'],
+				].forEach((action) => {
+					const [actionName, path] = action;
+					const actionButton = document.createElement('button');
+					actionButton.className = 'counts-item-action counts-item-action-destructive';
+					actionButton.textContent = actionName;
+					actionButton.addEventListener('click', async () => {
+						const url = path + '?context=' + encodeURIComponent(name) +
+							'&id=' + encodeURIComponent(task['id']);
+						const success = await reloadCounts(async () => {
+							const response = await (await apiPost(url)).json();
+							if (response['error']) {
+								throw new Error(response['error']);
+							}
+						});
+						if (success !== false) {
+							showStuckTasks(name);
+						}
+					});
+					item.appendChild(actionButton);
+				});
+				list.appendChild(item);
+			});
+			document.getElementById('stuck-overlay-container').classList.remove('overlay-container-hidden');
+		}
+
+		function closeStuckOverlay() {
+			const container = document.getElementById('stuck-overlay-container');
+			container.classList.add('overlay-container-hidden');
+		}
+
+		// The auto-refresh interval in seconds, or 0 if it is disabled. The
+		// refresh URL parameter takes precedence over the saved setting.
+		let refreshInterval = Math.max(0, parseInt(
+			new URLSearchParams(window.location.search).get('refresh') ||
+			localStorage['refreshInterval'] || '0',
+		) || 0);
+		let refreshTimer = null;
+		let lastRefreshed = null;
+
+		function setRefreshInterval(seconds) {
+			refreshInterval = seconds;
+			localStorage['refreshInterval'] = '' + seconds;
+			scheduleRefresh();
+		}
+
+		function scheduleRefresh() {
+			if (refreshTimer !== null) {
+				clearTimeout(refreshTimer);
+				refreshTimer = null;
+			}
+			if (refreshInterval <= 0 || document.hidden) {
+				return;
+			}
+			refreshTimer = setTimeout(async () => {
+				refreshTimer = null;
+				await reloadCounts(null, true);
+				scheduleRefresh();
+			}, refreshInterval * 1000);
+		}
+
+		function updateLastRefreshed() {
+			const label = document.getElementById('last-refreshed');
+			if (lastRefreshed) {
+				label.textContent = 'Last refreshed ' + relativeTimeSince(lastRefreshed.getTime());
+			}
+		}
+
+		// Pause refreshing while the tab is hidden, and catch up as soon as it
+		// is visible again.
+		document.addEventListener('visibilitychange', () => {
+			if (document.hidden) {
+				scheduleRefresh();
+			} else if (refreshInterval > 0) {
+				const elapsed = lastRefreshed ? (Date.now() - lastRefreshed.getTime()) / 1000 : Infinity;
+				if (elapsed >= refreshInterval) {
+					reloadCounts(null, true).then(scheduleRefresh);
+				} else {
+					scheduleRefresh();
+				}
+			}
+		});
+
+		setInterval(updateLastRefreshed, 1000);
+
+		const intervalSelect = document.getElementById('refresh-interval');
+		if (!Array.from(intervalSelect.options).some((x) => parseInt(x.value) === refreshInterval)) {
+			const option = document.createElement('option');
+			option.value = '' + refreshInterval;
+			option.textContent = 'Every ' + refreshInterval + ' seconds';
+			intervalSelect.appendChild(option);
+		}
+		intervalSelect.value = '' + refreshInterval;
+
+		reloadCounts(null).then(scheduleRefresh);
 		-->
 		</script>
 	</body>
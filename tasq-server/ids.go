@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// An IDGenerator creates the IDs of new tasks.
+//
+// IDs are only ever compared for equality, so any format may be used as long
+// as IDs are unique within a context.
+type IDGenerator interface {
+	// NewID creates an ID for a new task, given the random prefix and the
+	// counter of the task's pending queue.
+	NewID(prefix string, counter int64) string
+}
+
+// idGenerator is used by every pending queue to create task IDs. It is set
+// by the -id-format flag.
+var idGenerator IDGenerator = SequentialIDs{}
+
+// NewIDGenerator creates an IDGenerator for the -id-format flag.
+//
+// The "time" format uses randomBytes random bytes per ID, so that shorter IDs
+// can be traded for a higher chance of collisions.
+func NewIDGenerator(format string, randomBytes int) (IDGenerator, error) {
+	switch format {
+	case "sequential":
+		return SequentialIDs{}, nil
+	case "uuid":
+		return UUIDv7s{}, nil
+	case "time":
+		if randomBytes < 4 || randomBytes > 32 {
+			return nil, fmt.Errorf("random bytes must be between 4 and 32, got %d", randomBytes)
+		}
+		return &TimeOrderedIDs{RandomBytes: randomBytes}, nil
+	default:
+		return nil, fmt.Errorf("unknown ID format: %q", format)
+	}
+}
+
+// SequentialIDs creates IDs from the queue's counter in hex, after the
+// queue's prefix (e.g. "1a2b3c4d-1f").
+//
+// These IDs are compact, but reveal how many tasks have been pushed.
+type SequentialIDs struct{}
+
+func (s SequentialIDs) NewID(prefix string, counter int64) string {
+	return prefix + strconv.FormatInt(counter, 16)
+}
+
+// UUIDv7s creates version 7 UUIDs, which begin with the creation time in
+// milliseconds followed by random bits.
+type UUIDv7s struct{}
+
+func (u UUIDv7s) NewID(prefix string, counter int64) string {
+	var data [16]byte
+	putTimestamp(data[:6])
+	readRandom(data[6:])
+	data[6] = 0x70 | (data[6] & 0x0f)
+	data[8] = 0x80 | (data[8] & 0x3f)
+	s := hex.EncodeToString(data[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// TimeOrderedIDs creates IDs like UUIDv7s, without the dashes or version
+// bits, and with a configurable number of random bytes.
+type TimeOrderedIDs struct {
+	RandomBytes int
+}
+
+func (t *TimeOrderedIDs) NewID(prefix string, counter int64) string {
+	data := make([]byte, 6+t.RandomBytes)
+	putTimestamp(data[:6])
+	readRandom(data[6:])
+	return hex.EncodeToString(data)
+}
+
+// putTimestamp writes the current Unix time in milliseconds as a 48-bit
+// big-endian integer, so that IDs sort by creation time.
+func putTimestamp(dst []byte) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	copy(dst, buf[2:])
+}
+
+func readRandom(dst []byte) {
+	if _, err := rand.Read(dst); err != nil {
+		panic(err)
+	}
+}
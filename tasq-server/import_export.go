@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+)
+
+// ExportedTask is one line of the newline-delimited JSON used by /task/export
+// and /task/import.
+type ExportedTask struct {
+	ID       string `json:"id,omitempty"`
+	Contents string `json:"contents"`
+
+	Group       string   `json:"group,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	OrderingKey string   `json:"orderingKey,omitempty"`
+	Producer    string   `json:"producer,omitempty"`
+
+	// Delay is the number of seconds left before a delayed task can be
+	// popped.
+	Delay float64 `json:"delay,omitempty"`
+
+	// Held is true if the task was set aside by /task/hold.
+	Held bool `json:"held,omitempty"`
+}
+
+// options converts the routing fields of the task into PushOptions, validating
+// them like the fields of a PushRequest.
+func (e *ExportedTask) options() (*PushOptions, error) {
+	req := PushRequest{
+		Group:       e.Group,
+		Tags:        e.Tags,
+		OrderingKey: e.OrderingKey,
+		Producer:    e.Producer,
+		Delay:       e.Delay,
+	}
+	return req.options()
+}
+
+// ExportTasks gets every task which is not in progress, in the order they
+// will be popped: the pending tasks, followed by the tasks waiting for their
+// ordering keys, the delayed tasks, and the held tasks.
+func (q *QueueState) ExportTasks(now time.Time) []ExportedTask {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	res := make([]ExportedTask, 0, q.pending.Len()+q.keys.Len()+q.delayed.Len()+q.held.Len())
+	var delayed, held bool
+	add := func(t *Task) {
+		e := ExportedTask{
+			ID:          t.ID,
+			Contents:    t.Contents,
+			Group:       t.group,
+			Tags:        t.tags,
+			OrderingKey: t.orderingKey,
+			Producer:    t.producer,
+			Held:        held,
+		}
+		if delayed {
+			e.Delay = math.Max(0, t.expiration.Sub(now).Seconds())
+		}
+		res = append(res, e)
+	}
+	q.pending.Iterate(add)
+	q.keys.Iterate(add)
+	delayed = true
+	q.delayed.Iterate(add)
+	delayed, held = false, true
+	q.held.Iterate(add)
+	return res
+}
+
+// ImportTasks pushes exported tasks with their routing fields, putting each
+// one back in the state it was exported from, and returns the new IDs.
+//
+// If any of the tasks cannot be pushed to this context, an error is returned
+// and none of them are pushed.
+func (q *QueueState) ImportTasks(tasks []ExportedTask) ([]string, error) {
+	opts := make([]*PushOptions, len(tasks))
+	for i, t := range tasks {
+		o, err := t.options()
+		if err != nil {
+			return nil, err
+		} else if err := checkPushOptions(q, o); err != nil {
+			return nil, err
+		} else if t.Held && !q.InMemory() {
+			return nil, errors.New("holds are not supported for disk-backed contexts")
+		}
+		opts[i] = o
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	ids := make([]string, len(tasks))
+	for i, t := range tasks {
+		if t.Held {
+			task := q.newPushedTask(t.Contents, opts[i])
+			q.pending.(*PendingQueue).AssignID(task)
+			q.held.PushLast(task)
+			ids[i] = task.ID
+		} else {
+			ids[i] = q.addTask(t.Contents, opts[i])
+		}
+		q.addToGroup(t.Group, 1)
+	}
+	if len(tasks) > 0 {
+		q.modified()
+	}
+	return ids, nil
+}
+
+// ServeExport streams the tasks of a context which are not in progress as
+// newline-delimited JSON.
+//
+// The tasks are copied before writing the response, so that a slow client
+// does not hold up the queue.
+func (s *Server) ServeExport(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	var tasks []ExportedTask
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		tasks = qs.ExportTasks(time.Now())
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
+	w.Header().Set("content-type", "application/x-ndjson")
+	bufWriter := bufio.NewWriter(w)
+	enc := json.NewEncoder(bufWriter)
+	for _, t := range tasks {
+		if err := enc.Encode(t); err != nil {
+			return
+		}
+	}
+	bufWriter.Flush()
+}
+
+// ServeImport pushes tasks from a newline-delimited JSON body in the format
+// produced by ServeExport, keeping their routing fields and states. The IDs
+// of imported tasks are ignored, since new IDs are assigned to the pushed
+// tasks.
+//
+// Like /task/push_batch without a limit, the tasks are pushed in chunks as
+// they are decoded, and the queues are only locked to push each chunk.
+func (s *Server) ServeImport(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	context := r.URL.Query().Get("context")
+	var ids []string
+	decodeErr := decodeTaskLines(s.limitBody(w, r), pushBatchChunkSize, func(chunk []ExportedTask) error {
+		var importErr error
+		err := s.Queues.Get(context, func(qs *QueueState) {
+			var chunkIDs []string
+			chunkIDs, importErr = qs.ImportTasks(chunk)
+			ids = append(ids, chunkIDs...)
+		})
+		if err != nil {
+			return err
+		}
+		return importErr
+	})
+	if ce, ok := decodeErr.(*ContextError); ok && len(ids) == 0 {
+		serveContextError(w, ce)
+		return
+	}
+	if len(ids) > 0 {
+		s.Audit(r, &AuditEntry{Op: "import", IDs: ids})
+	}
+	if decodeErr != nil {
+		msg := s.bodyErrorMessage(decodeErr)
+		if len(ids) > 0 {
+			msg = fmt.Sprintf("%s (after importing %d tasks)", msg, len(ids))
+		}
+		serveError(w, msg)
+		return
+	}
+	serveObject(w, len(ids))
+}
+
+// decodeTaskLines reads ExportedTasks from r, passing them to f in chunks of
+// at most chunkSize.
+//
+// If f returns an error, decoding stops and the error is returned.
+func decodeTaskLines(r io.Reader, chunkSize int, f func([]ExportedTask) error) error {
+	dec := json.NewDecoder(r)
+	chunk := make([]ExportedTask, 0, chunkSize)
+	for {
+		var t ExportedTask
+		if err := dec.Decode(&t); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		chunk = append(chunk, t)
+		if len(chunk) == chunkSize {
+			if err := f(chunk); err != nil {
+				return err
+			}
+			chunk = make([]ExportedTask, 0, chunkSize)
+		}
+	}
+	if len(chunk) > 0 {
+		return f(chunk)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	s := newTestServer()
+	router := s.Router(true)
+
+	s.Queues.Get("src", func(qs *QueueState) {
+		qs.PushTasks([]string{"plain"}, 0, nil)
+		qs.PushTasks([]string{"tagged"}, 0, &PushOptions{
+			Group:    "g",
+			Tags:     []string{"gpu"},
+			Producer: "p",
+		})
+		qs.PushTasks([]string{"keyed1", "keyed2"}, 0, &PushOptions{OrderingKey: "k"})
+		qs.PushTasks([]string{"delayed"}, 0, &PushOptions{Delay: time.Hour})
+		ids, _ := qs.PushBatch([]string{"held"}, 0)
+		if !qs.Hold(ids[0]) {
+			t.Fatal("failed to hold task")
+		}
+	})
+
+	exportTasks := func(context string) []ExportedTask {
+		var res []ExportedTask
+		s.Queues.Get(context, func(qs *QueueState) {
+			res = qs.ExportTasks(time.Now())
+		})
+		for i := range res {
+			res[i].ID = ""
+			if res[i].Delay > 0 {
+				res[i].Delay = 1
+			}
+		}
+		return res
+	}
+	expected := []ExportedTask{
+		{Contents: "plain"},
+		{Contents: "tagged", Group: "g", Tags: []string{"gpu"}, Producer: "p"},
+		{Contents: "keyed1", OrderingKey: "k"},
+		{Contents: "keyed2", OrderingKey: "k"},
+		{Contents: "delayed", Delay: 1},
+		{Contents: "held", Held: true},
+	}
+	if actual := exportTasks("src"); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %v but got %v", expected, actual)
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/task/export?context=src", nil))
+	res := testRequest(t, router, http.MethodPost, "/task/import?context=dst",
+		bytes.NewReader(rec.Body.Bytes()))
+	if res["data"] != float64(len(expected)) {
+		t.Fatalf("unexpected response: %v", res)
+	}
+	if actual := exportTasks("dst"); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %v but got %v", expected, actual)
+	}
+
+	var counts *QueueCounts
+	var group *TaskGroup
+	s.Queues.Get("dst", func(qs *QueueState) {
+		counts = qs.Counts(0, false)
+		group = qs.groups.groups["g"]
+	})
+	if counts.Delayed != 1 || counts.Held != 1 {
+		t.Errorf("unexpected counts: %+v", counts)
+	}
+	if group == nil || group.Total != 1 {
+		t.Errorf("unexpected group: %+v", group)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+// A contentsInterner deduplicates the contents of tasks, so that many tasks
+// with identical contents share a single copy in memory.
+//
+// Each interned string is reference counted, and is forgotten once every task
+// using it has been released. A task must be released when it leaves the
+// queue for good, which only happens when it is completed: other removals
+// (clearing, extracting to the trash, or moving tasks to a disk-backed store)
+// replace the whole interner instead. A missed release keeps the string in
+// memory until the interner is replaced, while releasing a string which was
+// never interned (e.g. by a task stored on disk) is ignored.
+type contentsInterner struct {
+	entries map[string]*internedContents
+}
+
+type internedContents struct {
+	value string
+	refs  int
+}
+
+func newContentsInterner() *contentsInterner {
+	return &contentsInterner{entries: map[string]*internedContents{}}
+}
+
+// Intern returns a shared copy of s and increments its reference count.
+func (c *contentsInterner) Intern(s string) string {
+	if e, ok := c.entries[s]; ok {
+		e.refs++
+		return e.value
+	}
+	c.entries[s] = &internedContents{value: s, refs: 1}
+	return s
+}
+
+// Release decrements the reference count of s.
+func (c *contentsInterner) Release(s string) {
+	if e, ok := c.entries[s]; ok {
+		e.refs--
+		if e.refs <= 0 {
+			delete(c.entries, s)
+		}
+	}
+}
+
+// dedupeContents moves the contents of tasks which share their contents with
+// another task into e.Contents, replacing them with references.
+//
+// This way, the size of a snapshot scales with the number of unique contents.
+func (e *EncodedQueueState) dedupeContents() {
+	counts := map[string]int{}
+	deques := [][]EncodedTask{e.Pending.Deque, e.Running.Deque, e.Delayed, e.Held, e.Waiting}
+	for _, deque := range deques {
+		for _, t := range deque {
+			counts[t.Contents]++
+		}
+	}
+	indices := map[string]int{}
+	for _, deque := range deques {
+		for i, t := range deque {
+			if counts[t.Contents] < 2 {
+				continue
+			}
+			idx, ok := indices[t.Contents]
+			if !ok {
+				idx = len(e.Contents)
+				indices[t.Contents] = idx
+				e.Contents = append(e.Contents, t.Contents)
+			}
+			deque[i].Contents = ""
+			deque[i].ContentsRef = &idx
+		}
+	}
+}
+
+// expandContents reverses dedupeContents, so that every task has its contents
+// set directly. Tasks which shared contents will share the same string.
+func (e *EncodedQueueState) expandContents() {
+	if len(e.Contents) == 0 {
+		return
+	}
+	for _, deque := range [][]EncodedTask{e.Pending.Deque, e.Running.Deque, e.Delayed, e.Held, e.Waiting} {
+		for i, t := range deque {
+			if t.ContentsRef != nil {
+				deque[i].Contents = e.Contents[*t.ContentsRef]
+				deque[i].ContentsRef = nil
+			}
+		}
+	}
+	e.Contents = nil
+}
@@ -54,25 +54,61 @@ func WriteJSONObject(w io.Writer, obj map[string]interface{}) error {
 	return nil
 }
 
+// A JSONObject is a map which is written with WriteJSONObject, so that
+// JSONWriter values inside of it are streamed.
+type JSONObject map[string]interface{}
+
+func (j JSONObject) WriteJSON(w io.Writer) error {
+	return WriteJSONObject(w, j)
+}
+
 type EncodedTaskList []EncodedTask
 
 func (e EncodedTaskList) WriteJSON(w io.Writer) error {
-	encodedStream := make(chan []byte, 32)
+	return writeJSONArray(w, len(e), func(i int) interface{} {
+		return e[i]
+	})
+}
+
+// A TaskList is a list of tasks returned to a worker, which is encoded
+// incrementally instead of as one large buffer.
+//
+// Since the tasks are encoded in the background without holding the queue's
+// lock, they must be copies, such as the results of PopBatch().
+type TaskList []*Task
+
+func (t TaskList) WriteJSON(w io.Writer) error {
+	return writeJSONArray(w, len(t), func(i int) interface{} {
+		return t[i]
+	})
+}
+
+// writeJSONArray writes a JSON array of n elements, encoding elements in the
+// background while earlier ones are written.
+//
+// If an element cannot be encoded, the error is returned and the array is
+// left incomplete.
+func writeJSONArray(w io.Writer, n int, elem func(i int) interface{}) error {
+	type encodedElem struct {
+		data []byte
+		err  error
+	}
+	encodedStream := make(chan encodedElem, 32)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	go func() {
 		defer close(encodedStream)
-		for _, t := range e {
-			data, err := json.Marshal(t)
-			if err != nil {
-				panic(err)
-			}
+		for i := 0; i < n; i++ {
+			data, err := json.Marshal(elem(i))
 			select {
-			case encodedStream <- data:
+			case encodedStream <- encodedElem{data: data, err: err}:
 			case <-ctx.Done():
 				return
 			}
+			if err != nil {
+				return
+			}
 		}
 	}()
 
@@ -81,6 +117,9 @@ func (e EncodedTaskList) WriteJSON(w io.Writer) error {
 		return err
 	}
 	for encoded := range encodedStream {
+		if encoded.err != nil {
+			return encoded.err
+		}
 		if first {
 			first = false
 		} else {
@@ -88,7 +127,7 @@ func (e EncodedTaskList) WriteJSON(w io.Writer) error {
 				return err
 			}
 		}
-		if _, err := w.Write(encoded); err != nil {
+		if _, err := w.Write(encoded.data); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestWriteJSONArrayError(t *testing.T) {
+	values := []float64{1, math.NaN(), 2}
+	var buf bytes.Buffer
+	err := writeJSONArray(&buf, len(values), func(i int) interface{} {
+		return values[i]
+	})
+	if err == nil {
+		t.Fatal("expected an error for NaN")
+	}
+
+	buf.Reset()
+	err = writeJSONArray(&buf, 2, func(i int) interface{} {
+		return values[i*2]
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if buf.String() != "[1,2]" {
+		t.Fatalf("unexpected output: %s", buf.String())
+	}
+}
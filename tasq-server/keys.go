@@ -0,0 +1,123 @@
+package main
+
+import "sort"
+
+// A keyTracker holds back tasks with ordering keys, so that at most one task
+// per key can be popped at a time.
+//
+// The oldest unfinished task with each key is kept in the usual structures
+// (pending, running, or delayed) and claims the key. Later tasks with the key
+// wait here, in the order they were pushed, until the claiming task is
+// completed.
+type keyTracker struct {
+	// waiting maps every claimed key to the tasks waiting for it, which may
+	// be an empty deque.
+	waiting    map[string]*TaskDeque
+	numWaiting int
+}
+
+func newKeyTracker() *keyTracker {
+	return &keyTracker{waiting: map[string]*TaskDeque{}}
+}
+
+// decodeKeyTracker rebuilds the claimed keys of a decoded queue from its
+// tasks, followed by the waiting tasks from EncodedQueueState.Waiting.
+func decodeKeyTracker(q *QueueState, waiting []EncodedTask) *keyTracker {
+	res := newKeyTracker()
+	claim := func(t *Task) {
+		if t.orderingKey != "" {
+			res.waiting[t.orderingKey] = &TaskDeque{}
+		}
+	}
+	q.pending.Iterate(claim)
+	q.running.Iterate(claim)
+	q.delayed.Iterate(claim)
+	q.held.Iterate(claim)
+	decodeTasks(waiting, func(t *Task) {
+		if deque, ok := res.waiting[t.orderingKey]; ok {
+			deque.PushLast(t)
+			res.numWaiting++
+		} else {
+			// The claiming task is missing, e.g. from a hand-edited save
+			// file, so this task claims the key instead.
+			res.waiting[t.orderingKey] = &TaskDeque{}
+			q.pending.PushTask(t)
+		}
+	})
+	return res
+}
+
+// Encode lists the waiting tasks, grouped by key.
+func (k *keyTracker) Encode() []EncodedTask {
+	if k.numWaiting == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(k.waiting))
+	for key, deque := range k.waiting {
+		if deque.Len() > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	res := make([]EncodedTask, 0, k.numWaiting)
+	for _, key := range keys {
+		res = append(res, k.waiting[key].Encode()...)
+	}
+	return res
+}
+
+// Iterate calls f with every waiting task, grouped by key.
+func (k *keyTracker) Iterate(f func(t *Task)) {
+	keys := make([]string, 0, len(k.waiting))
+	for key := range k.waiting {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		k.waiting[key].Iterate(f)
+	}
+}
+
+// Len gets the number of waiting tasks.
+func (k *keyTracker) Len() int {
+	return k.numWaiting
+}
+
+// addKeyedTask adds a new task with an ordering key, either to the pending
+// queue if no other task has claimed the key, or to the end of the key's
+// waiting tasks.
+//
+// The caller must hold the write lock, and the pending tasks must be stored in
+// memory.
+func (q *QueueState) addKeyedTask(t *Task) {
+	deque, ok := q.keys.waiting[t.orderingKey]
+	if !ok {
+		q.keys.waiting[t.orderingKey] = &TaskDeque{}
+		q.pending.AddTask(t)
+		return
+	}
+	q.pending.(*PendingQueue).AssignID(t)
+	deque.PushLast(t)
+	q.keys.numWaiting++
+}
+
+// releaseKey is called when a task is completed, moving the next task waiting
+// for its ordering key (if any) into the pending queue.
+//
+// The caller must hold the write lock.
+func (q *QueueState) releaseKey(t *Task) {
+	if t.orderingKey == "" {
+		return
+	}
+	deque, ok := q.keys.waiting[t.orderingKey]
+	if !ok {
+		return
+	}
+	next := deque.PopFirst()
+	if next == nil {
+		delete(q.keys.waiting, t.orderingKey)
+		return
+	}
+	q.keys.numWaiting--
+	q.pending.PushTask(next)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// limitListener wraps a net.Listener to limit the number of simultaneously
+// open connections. Once the limit is reached, Accept() blocks until an
+// existing connection is closed.
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+// LimitListener creates a listener which accepts at most n simultaneous
+// connections from l.
+func LimitListener(l net.Listener, n int) net.Listener {
+	return &limitListener{Listener: l, sem: make(chan struct{}, n)}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.sem <- struct{}{}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitListenerConn{Conn: conn, release: func() { <-l.sem }}, nil
+}
+
+type limitListenerConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (l *limitListenerConn) Close() error {
+	err := l.Conn.Close()
+	l.releaseOnce.Do(l.release)
+	return err
+}
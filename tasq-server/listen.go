@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Listen creates a listener for the -addr flag, which is either a TCP
+// address like ":8080" or a Unix domain socket like "unix:/path/to.sock".
+//
+// If the process was started by systemd socket activation, the activated
+// socket is used instead of addr.
+//
+// If a Unix socket file is left over from a previous run, it is removed
+// before listening. Other files at the socket path are left alone.
+func Listen(addr string) (net.Listener, error) {
+	if listener, err := SystemdListener(); listener != nil || err != nil {
+		if listener != nil {
+			logger.Info("using systemd socket", "addr", listener.Addr().String())
+		}
+		return listener, err
+	}
+	return ListenAddr(addr)
+}
+
+// ListenAddr is like Listen, but never uses systemd socket activation, e.g.
+// for the -admin-addr flag.
+func ListenAddr(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Wrap(err, "remove stale socket")
+		}
+	}
+	return net.Listen("unix", path)
+}
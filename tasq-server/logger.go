@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A LogLevel indicates the severity of a log message.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// ParseLogLevel parses a level name, such as "info".
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, x := range logLevelNames {
+		if strings.EqualFold(name, x) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level: %s", name)
+}
+
+func (l LogLevel) String() string {
+	if l < 0 || int(l) >= len(logLevelNames) {
+		return "unknown"
+	}
+	return logLevelNames[l]
+}
+
+// A Logger writes leveled log messages with key-value fields, either as text
+// or as one JSON object per line.
+type Logger struct {
+	Level LogLevel
+	JSON  bool
+
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// logger is used for all of the server's logs.
+var logger = NewLogger(os.Stderr, LevelInfo, false)
+
+// NewLogger creates a Logger which writes to w.
+func NewLogger(w io.Writer, level LogLevel, jsonFormat bool) *Logger {
+	return &Logger{Level: level, JSON: jsonFormat, w: w}
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.Log(LevelDebug, msg, fields...)
+}
+
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.Log(LevelInfo, msg, fields...)
+}
+
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	l.Log(LevelWarn, msg, fields...)
+}
+
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.Log(LevelError, msg, fields...)
+}
+
+// Fatal logs an error and exits the program.
+func (l *Logger) Fatal(msg string, fields ...interface{}) {
+	l.Log(LevelError, msg, fields...)
+	os.Exit(1)
+}
+
+// Log writes a message if level is at least l.Level.
+//
+// The fields alternate between string keys and values.
+func (l *Logger) Log(level LogLevel, msg string, fields ...interface{}) {
+	if level < l.Level {
+		return
+	}
+	now := time.Now()
+	var buf bytes.Buffer
+	if l.JSON {
+		obj := map[string]interface{}{
+			"time":  now.Format(time.RFC3339Nano),
+			"level": level.String(),
+			"msg":   msg,
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			obj[fmt.Sprint(fields[i])] = logFieldValue(fields[i+1])
+		}
+		data, err := json.Marshal(obj)
+		if err != nil {
+			data, _ = json.Marshal(map[string]interface{}{
+				"time":  obj["time"],
+				"level": obj["level"],
+				"msg":   msg,
+				"error": "failed to encode log fields: " + err.Error(),
+			})
+		}
+		buf.Write(data)
+	} else {
+		buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+		buf.WriteString(strings.ToUpper(level.String()))
+		buf.WriteByte(' ')
+		buf.WriteString(msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			value := fmt.Sprint(logFieldValue(fields[i+1]))
+			if value == "" || strings.ContainsAny(value, " =\"\n") {
+				value = strconv.Quote(value)
+			}
+			fmt.Fprintf(&buf, " %v=%s", fields[i], value)
+		}
+	}
+	buf.WriteByte('\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.w.Write(buf.Bytes())
+}
+
+func logFieldValue(x interface{}) interface{} {
+	switch x := x.(type) {
+	case error:
+		return x.Error()
+	case time.Duration:
+		return x.String()
+	}
+	return x
+}
+
+// RequestLogHandler wraps h to log every request at the debug level.
+func RequestLogHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if logger.Level > LevelDebug {
+			h.ServeHTTP(w, r)
+			return
+		}
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		t1 := time.Now()
+		h.ServeHTTP(sw, r)
+		logger.Debug("request", "method", r.Method, "path", r.URL.Path,
+			"context", r.URL.Query().Get("context"), "status", sw.status,
+			"duration", time.Now().Sub(t1), "remote", r.RemoteAddr,
+			"request_id", r.Header.Get(RequestIDHeader), "user_agent", r.UserAgent())
+	})
+}
+
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusResponseWriter) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/subtle"
 	"encoding/json"
@@ -8,14 +9,17 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/unixpickle/essentials"
@@ -23,66 +27,436 @@ import (
 
 func main() {
 	var addr string
+	var adminAddr string
 	var pathPrefix string
 	var authUsername string
+	var authCredentials string
 	var authPassword string
+	var readOnlyUsername string
+	var readOnlyPassword string
+	var adminUsername string
+	var adminPassword string
 	var savePath string
 	var saveInterval time.Duration
+	var keepSaves int
+	var restoreFrom string
+	var fsck bool
+	var fsckOutput string
 	var timeout time.Duration
-	flag.StringVar(&addr, "addr", ":8080", "address to listen on")
+	var minTimeout time.Duration
+	var maxTimeout time.Duration
+	var completionGrace time.Duration
+	var auditLogPath string
+	var trashRetention time.Duration
+	var maxContexts int
+	var maxContextLength int
+	var contextPattern string
+	var idleTTL time.Duration
+	var pendingDBPath string
+	var pendingDBPrefix string
+	var consistentSaves bool
+	var followURL string
+	var followInterval time.Duration
+	var failoverAfter int
+	var idleTimeout time.Duration
+	var readTimeout time.Duration
+	var maxConns int
+	var readHeaderTimeout time.Duration
+	var maxBodySize int64
+	var webRoot string
+	var metricsPushURL string
+	var metricsPushInterval time.Duration
+	var metricsPushAuth string
+	var alertWebhook string
+	var alertInterval time.Duration
+	var stuckInterval time.Duration
+	var logFormat string
+	var logLevel string
+	var idFormat string
+	var idRandomBytes int
+	var saveKey string
+	var saveKeyCommand string
+	var countsCacheTTL time.Duration
+	var configPath string
+	flag.StringVar(&configPath, "config", "",
+		"if specified, path to a JSON file of flag values and per-context settings")
+	flag.StringVar(&addr, "addr", ":8080",
+		"address to listen on, or unix:/path/to.sock for a Unix domain socket")
+	flag.StringVar(&adminAddr, "admin-addr", "",
+		"if specified, serve admin endpoints (e.g. clearing queues) only on this address, such as localhost:8081")
 	flag.StringVar(&pathPrefix, "path-prefix", "/", "prefix for URL paths")
 	flag.StringVar(&authUsername, "auth-username", "", "username for basic auth")
 	flag.StringVar(&authPassword, "auth-password", "", "password for basic auth")
+	flag.StringVar(&authCredentials, "auth-credentials", "",
+		"comma-separated username:password pairs accepted in addition to -auth-username")
+	flag.StringVar(&readOnlyUsername, "readonly-username", "",
+		"username for basic auth which may only view queues, e.g. for dashboards")
+	flag.StringVar(&readOnlyPassword, "readonly-password", "", "password for -readonly-username")
+	flag.StringVar(&adminUsername, "admin-username", "",
+		"username for debug endpoints, which are disabled unless admin credentials are set")
+	flag.StringVar(&adminPassword, "admin-password", "", "password for debug endpoints")
 	flag.StringVar(&savePath, "save-path", "", "if specified, path to periodically save state to")
 	flag.DurationVar(&timeout, "timeout", time.Minute*15, "timeout of individual tasks")
+	flag.DurationVar(&minTimeout, "min-timeout", 0,
+		"if non-zero, reject requests for task timeouts shorter than this")
+	flag.DurationVar(&maxTimeout, "max-timeout", 0,
+		"if non-zero, reject requests for task timeouts longer than this")
+	flag.DurationVar(&completionGrace, "completion-grace", 0,
+		"if non-zero, report repeated completions of a task within this time as successful")
 	flag.DurationVar(&saveInterval, "save-interval", time.Minute*5, "time between saves")
+	flag.IntVar(&keepSaves, "keep-saves", 0,
+		"if non-zero, number of timestamped copies of the save file to keep")
+	flag.StringVar(&restoreFrom, "restore-from", "",
+		"if specified, load state from this file (e.g. a copy kept by -keep-saves) instead of -save-path")
+	flag.BoolVar(&fsck, "fsck", false,
+		"check the save file (or -restore-from) for problems and exit instead of serving")
+	flag.StringVar(&fsckOutput, "fsck-output", "",
+		"with -fsck, path to write a repaired copy of the save file to")
+	flag.StringVar(&auditLogPath, "audit-log", "",
+		"if specified, path to append a JSON audit log to ('-' for stdout)")
+	flag.DurationVar(&trashRetention, "trash-retention", 0,
+		"if non-zero, keep cleared queues around for this long so they can be restored")
+	flag.IntVar(&maxContexts, "max-contexts", 0, "if non-zero, the maximum number of contexts")
+	flag.IntVar(&maxContextLength, "max-context-length", 0,
+		"if non-zero, the maximum length of a context name")
+	flag.StringVar(&contextPattern, "context-pattern", "",
+		"if specified, a regular expression which new context names must fully match")
+	flag.DurationVar(&idleTTL, "idle-ttl", 0,
+		"if non-zero, remove contexts with no pending or running tasks after this long without changes")
+	flag.StringVar(&pendingDBPath, "pending-db", "",
+		"if specified, path to a database for storing pending tasks on disk")
+	flag.StringVar(&pendingDBPrefix, "pending-db-prefix", "",
+		"if specified, only store contexts with this prefix in the pending task database")
+	flag.BoolVar(&consistentSaves, "consistent-save", false,
+		"block all queues while saving state, rather than one queue at a time")
+	flag.StringVar(&followURL, "follow", "",
+		"if specified, run as a standby which mirrors the server at this URL until it fails")
+	flag.DurationVar(&followInterval, "follow-interval", time.Second*10,
+		"time between snapshots fetched from the primary server")
+	flag.IntVar(&failoverAfter, "failover-after", 3,
+		"number of consecutive failed snapshot fetches after which a standby takes over")
+	flag.DurationVar(&idleTimeout, "idle-timeout", time.Minute*2,
+		"time after which idle keep-alive connections are closed")
+	flag.DurationVar(&readTimeout, "read-timeout", 0,
+		"if non-zero, the maximum time to read a request, including its body")
+	flag.IntVar(&maxConns, "max-conns", 0,
+		"if non-zero, the maximum number of simultaneous connections")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", time.Second*10,
+		"if non-zero, the maximum time to read the headers of a request")
+	flag.Int64Var(&maxBodySize, "max-body-size", 1<<26,
+		"if non-zero, the maximum size in bytes of a (decompressed) JSON request body")
+	flag.StringVar(&webRoot, "web-root", "",
+		"if specified, serve the homepage (index.html) and static/ files from this directory")
+	flag.StringVar(&metricsPushURL, "metrics-push-url", "",
+		"if specified, periodically push per-context metrics to this InfluxDB line protocol endpoint")
+	flag.DurationVar(&metricsPushInterval, "metrics-push-interval", time.Second*10,
+		"time between metrics pushes")
+	flag.StringVar(&metricsPushAuth, "metrics-push-auth", "",
+		"Authorization header for metrics pushes, e.g. 'Token XYZ'")
+	flag.StringVar(&alertWebhook, "alert-webhook", "",
+		"if specified, post alerts to this URL (e.g. a Slack incoming webhook)")
+	flag.DurationVar(&alertInterval, "alert-interval", time.Second*30,
+		"time between checks of each context's alert thresholds")
+	flag.DurationVar(&stuckInterval, "stuck-interval", time.Minute,
+		"time between checks for stuck tasks, or 0 to disable them")
+	flag.StringVar(&logFormat, "log-format", "text", "log format: 'text' or 'json'")
+	flag.StringVar(&logLevel, "log-level", "info",
+		"minimum level of logged messages: 'debug' (including every request), 'info', 'warn', or 'error'")
+	flag.StringVar(&idFormat, "id-format", "sequential",
+		"format of new task IDs: 'sequential', 'uuid' (UUIDv7), or 'time' (time-ordered hex)")
+	flag.IntVar(&idRandomBytes, "id-random-bytes", 8,
+		"number of random bytes in each ID with -id-format=time")
+	flag.StringVar(&saveKey, "save-key", "",
+		"hex or base64 AES key to encrypt the save file with (default $"+SaveKeyEnvVar+")")
+	flag.StringVar(&saveKeyCommand, "save-key-command", "",
+		"shell command which prints the save file key, e.g. to decrypt it with a KMS")
+	flag.DurationVar(&countsCacheTTL, "counts-cache-ttl", DefaultCountsCacheTTL,
+		"longest time to reuse the counts of an unmodified context for /counts?all=1")
 	flag.Parse()
+	flagSources, contextConfigs, err := LoadFlagSources(flag.CommandLine, &configPath)
+	if err != nil {
+		essentials.Die(err)
+	}
+
+	checkFlags := func() error {
+		if minTimeout > timeout {
+			return errors.New("-timeout must not be less than -min-timeout")
+		}
+		if maxTimeout != 0 && maxTimeout < timeout {
+			return errors.New("-timeout must not be greater than -max-timeout")
+		}
+		if keepSaves < 0 {
+			return errors.New("-keep-saves must not be negative")
+		}
+		if _, err := ParseCredentials(authCredentials); err != nil {
+			return errors.New("invalid -auth-credentials: " + err.Error())
+		}
+		_, err := compileContextPattern(contextPattern)
+		return err
+	}
+	if err := checkFlags(); err != nil {
+		essentials.Die(err)
+	}
+
+	level, err := ParseLogLevel(logLevel)
+	if err != nil {
+		essentials.Die(err)
+	}
+	if logFormat != "text" && logFormat != "json" {
+		essentials.Die("unknown log format:", logFormat)
+	}
+	logger = NewLogger(os.Stderr, level, logFormat == "json")
+
+	idGenerator, err = NewIDGenerator(idFormat, idRandomBytes)
+	if err != nil {
+		essentials.Die(err)
+	}
 
 	if !strings.HasSuffix(pathPrefix, "/") || !strings.HasPrefix(pathPrefix, "/") {
 		essentials.Die("path prefix must start and end with a '/' character")
 	}
+	namePattern, _ := compileContextPattern(contextPattern)
+	if followURL != "" && pendingDBPath != "" {
+		essentials.Die("-follow cannot be used with -pending-db")
+	}
+
+	var saveCipher *SnapshotCipher
+	if key, err := LoadSaveKey(saveKey, saveKeyCommand); err != nil {
+		essentials.Die(err)
+	} else if key != nil {
+		saveCipher, err = NewSnapshotCipher(key)
+		if err != nil {
+			essentials.Die(err)
+		}
+	}
+	if fsck {
+		fsckPath := restoreFrom
+		if fsckPath == "" {
+			fsckPath = savePath
+		}
+		if fsckPath == "" {
+			essentials.Die("-fsck requires -save-path or -restore-from")
+		}
+		os.Exit(runFsck(timeout, fsckPath, fsckOutput, saveCipher))
+	}
 
 	s := &Server{
-		PathPrefix:   pathPrefix,
-		AuthUsername: authUsername,
-		AuthPassword: authPassword,
-		SavePath:     savePath,
-		SaveInterval: saveInterval,
-		StartTime:    time.Now(),
-		Queues:       NewQueueStateMux(timeout),
-	}
-	http.HandleFunc(pathPrefix, s.ServeIndex)
-	http.HandleFunc(pathPrefix+"summary", s.ServeSummary)
-	http.HandleFunc(pathPrefix+"counts", s.ServeCounts)
-	http.HandleFunc(pathPrefix+"stats", s.ServeStats)
-	http.HandleFunc(pathPrefix+"task/push", s.ServePushTask)
-	http.HandleFunc(pathPrefix+"task/push_batch", s.ServePushBatch)
-	http.HandleFunc(pathPrefix+"task/pop", s.ServePopTask)
-	http.HandleFunc(pathPrefix+"task/pop_batch", s.ServePopBatch)
-	http.HandleFunc(pathPrefix+"task/peek", s.ServePeekTask)
-	http.HandleFunc(pathPrefix+"task/completed", s.ServeCompletedTask)
-	http.HandleFunc(pathPrefix+"task/completed_batch", s.ServeCompletedBatch)
-	http.HandleFunc(pathPrefix+"task/keepalive", s.ServeKeepalive)
-	http.HandleFunc(pathPrefix+"task/clear", s.ServeClearTasks)
-	http.HandleFunc(pathPrefix+"task/expire_all", s.ServeExpireTasks)
-	http.HandleFunc(pathPrefix+"task/queue_expired", s.ServeQueueExpired)
-	s.SetupSaveLoop(timeout)
-	essentials.Must(http.ListenAndServe(addr, nil))
+		PathPrefix:    pathPrefix,
+		AuthUsername:  authUsername,
+		AuthPassword:  authPassword,
+		AdminUsername: adminUsername,
+		AdminPassword: adminPassword,
+		SavePath:      savePath,
+		SaveInterval:  saveInterval,
+		KeepSaves:     keepSaves,
+		SaveCipher:    saveCipher,
+		WebRoot:       webRoot,
+		MaxBodySize:   maxBodySize,
+		MinTimeout:    minTimeout,
+		MaxTimeout:    maxTimeout,
+		StartTime:     time.Now(),
+		Queues:        NewQueueStateMux(timeout),
+		Metrics:       NewRequestMetrics(),
+	}
+	s.AuthCredentials, _ = ParseCredentials(authCredentials)
+	s.ReadOnlyUsername = readOnlyUsername
+	s.ReadOnlyPassword = readOnlyPassword
+	if auditLogPath != "" {
+		var err error
+		s.AuditLog, err = NewAuditLog(auditLogPath)
+		essentials.Must(err)
+	}
+	newServer := func(addr string, router *Router) *http.Server {
+		handler := s.StandbyHandler(router)
+		handler = s.StartupHandler(handler)
+		handler = s.Metrics.Handler(router, handler)
+		handler = RequestLogHandler(handler)
+		handler = RequestIDHandler(handler)
+		handler = CompressionHandler(handler)
+		return &http.Server{
+			Addr:              addr,
+			Handler:           handler,
+			IdleTimeout:       idleTimeout,
+			ReadTimeout:       readTimeout,
+			ReadHeaderTimeout: readHeaderTimeout,
+		}
+	}
+
+	// Start listening right away, so that health checks can tell that the
+	// server is starting while a large save file is loaded.
+	server := newServer(addr, s.Router(adminAddr == ""))
+	listener, err := Listen(addr)
+	essentials.Must(err)
+	if maxConns != 0 {
+		listener = LimitListener(listener, maxConns)
+	}
+	go func() {
+		essentials.Must(server.Serve(listener))
+	}()
+	if adminAddr != "" {
+		adminServer := newServer(adminAddr, s.Router(true))
+		adminListener, err := ListenAddr(adminAddr)
+		essentials.Must(err)
+		logger.Info("serving admin endpoints", "addr", adminListener.Addr().String())
+		go func() {
+			essentials.Must(adminServer.Serve(adminListener))
+		}()
+	}
+
+	s.SetupSaveLoop(timeout, restoreFrom)
+	if pendingDBPath != "" {
+		storage, err := OpenBoltStorage(pendingDBPath, pendingDBPrefix)
+		essentials.Must(err)
+		essentials.Must(s.Queues.AttachStorage(storage))
+	}
+	s.CountsCacheTTL = countsCacheTTL
+	s.Queues.TrashRetention = trashRetention
+	s.Queues.MaxContexts = maxContexts
+	s.Queues.MaxNameLength = maxContextLength
+	s.Queues.NamePattern = namePattern
+	s.Queues.IdleTTL = idleTTL
+	s.Queues.CompletionGrace = completionGrace
+	s.Queues.ConsistentSnapshots = consistentSaves
+	if idleTTL != 0 {
+		go s.IdleLoop()
+	}
+	if metricsPushURL != "" {
+		pusher := &MetricsPusher{
+			URL:           metricsPushURL,
+			Interval:      metricsPushInterval,
+			Authorization: metricsPushAuth,
+		}
+		go pusher.Loop(s)
+	}
+	alerter := &Alerter{WebhookURL: alertWebhook, Interval: alertInterval}
+	go alerter.Loop(s)
+	s.StuckInterval = stuckInterval
+	if stuckInterval != 0 {
+		go s.StuckLoop()
+	}
+	if err := s.ApplyContextConfigs(contextConfigs); err != nil {
+		essentials.Die(err)
+	}
+	if followURL != "" {
+		s.SetupFollowLoop(followURL, timeout, followInterval, failoverAfter)
+	}
+
+	var reloadLock sync.Mutex
+	s.Reload = func() error {
+		reloadLock.Lock()
+		defer reloadLock.Unlock()
+		if flagSources.ConfigPath == "" {
+			return errors.New("no config file was specified with -config")
+		}
+		changed, contexts, err := flagSources.Reload(checkFlags)
+		if err != nil {
+			return err
+		}
+		for _, name := range changed {
+			if !reloadableFlags[name] {
+				logger.Warn("flag changed in config file, but requires a restart", "flag", name)
+			}
+		}
+		pattern, _ := compileContextPattern(contextPattern)
+		extraCredentials, _ := ParseCredentials(authCredentials)
+		s.UpdateSettings(func() {
+			s.AuthUsername = authUsername
+			s.AuthPassword = authPassword
+			s.AuthCredentials = extraCredentials
+			s.ReadOnlyUsername = readOnlyUsername
+			s.ReadOnlyPassword = readOnlyPassword
+			s.AdminUsername = adminUsername
+			s.AdminPassword = adminPassword
+			s.MinTimeout = minTimeout
+			s.MaxTimeout = maxTimeout
+		})
+		s.Queues.SetLimits(maxContexts, maxContextLength, pattern)
+		return s.ApplyContextConfigs(contexts)
+	}
+	go s.ReloadOnSignal()
+
+	s.MarkReady()
+	logger.Info("ready", "addr", listener.Addr().String())
+	if err := SystemdNotify("READY=1"); err != nil {
+		logger.Warn("failed to notify systemd", "error", err)
+	}
+	select {}
 }
 
 type Server struct {
-	PathPrefix   string
+	PathPrefix string
+
+	// Settings which may be changed with UpdateSettings while the server is
+	// running.
+	settingsLock sync.RWMutex
 	AuthUsername string
 	AuthPassword string
+
+	// AuthCredentials are accepted in addition to AuthUsername and
+	// AuthPassword, e.g. while rotating credentials.
+	AuthCredentials []Credentials
+
+	// Credentials which are only accepted by endpoints that do not modify
+	// the queues. See AllowReadOnly.
+	ReadOnlyUsername string
+	ReadOnlyPassword string
+
+	// Credentials for debugging endpoints.
+	AdminUsername string
+	AdminPassword string
+
+	// MinTimeout, if non-zero, is the shortest timeout that requests may ask
+	// for, so that tasks are not re-popped while workers are still starting.
+	MinTimeout time.Duration
+
+	// MaxTimeout, if non-zero, is the longest timeout that requests may ask
+	// for, either when popping tasks or in a context's configuration.
+	MaxTimeout time.Duration
+
 	Queues       *QueueStateMux
 	SavePath     string
 	SaveInterval time.Duration
+	SaveCipher   *SnapshotCipher
+
+	// KeepSaves, if non-zero, is the number of timestamped copies of the
+	// save file to keep alongside it.
+	KeepSaves int
+
+	AuditLog    *AuditLog
+	Metrics     *RequestMetrics
+	WebRoot     string
+	MaxBodySize int64
+
+	// CountsCacheTTL is the longest time for which the counts of an
+	// unmodified context are reused by /counts?all=1.
+	CountsCacheTTL time.Duration
 
 	StartTime time.Time
 
+	// StuckInterval is the time between checks for stuck tasks, which count
+	// and log them.
+	StuckInterval time.Duration
+
+	// Reload, if non-nil, reloads the config file. It is called on SIGHUP
+	// and by /admin/reload.
+	Reload func() error
+
 	SaveStatsLock    sync.RWMutex
 	LastSave         time.Time
 	LastSaveDuration time.Duration
+	saveLock         sync.Mutex
+	saveManifest     *SaveManifest
+	savedFile        os.FileInfo
+
+	standby int32
+	ready   int32
+
+	fairScheduler fairScheduler
+	quiescer      quiescer
+	stuck         stuckDetector
+
+	csrfOnce  sync.Once
+	csrfToken string
 }
 
 func (s *Server) ServeIndex(w http.ResponseWriter, r *http.Request) {
@@ -90,8 +464,7 @@ func (s *Server) ServeIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if r.URL.Path == s.PathPrefix || r.URL.Path+"/" == s.PathPrefix {
-		w.Header().Set("content-type", "text/html")
-		w.Write([]byte(Homepage))
+		s.serveHomepage(w, r)
 	} else {
 		w.Header().Set("content-type", "text/html")
 		w.WriteHeader(http.StatusNotFound)
@@ -103,10 +476,24 @@ func (s *Server) ServeSummary(w http.ResponseWriter, r *http.Request) {
 	if !s.BasicAuth(w, r) {
 		return
 	}
+	prefix := r.URL.Query().Get("prefix")
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "text":
+	case "json":
+		s.serveSummaryJSON(w, r, prefix)
+		return
+	default:
+		serveError(w, "unknown format: "+format)
+		return
+	}
+
 	w.Header().Set("content-type", "text/plain")
 	found := false
 	buf := bytes.NewBuffer(nil)
 	s.Queues.Iterate(func(name string, qs *QueueState) {
+		if !strings.HasPrefix(name, prefix) {
+			return
+		}
 		found = true
 		if name == "" {
 			fmt.Fprint(buf, "---- Default context ----\n")
@@ -117,6 +504,9 @@ func (s *Server) ServeSummary(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(buf, "    Pending: %d\n", counts.Pending)
 		fmt.Fprintf(buf, "In progress: %d\n", counts.Running)
 		fmt.Fprintf(buf, "    Expired: %d\n", counts.Expired)
+		fmt.Fprintf(buf, "Backing off: %d\n", counts.BackingOff)
+		fmt.Fprintf(buf, "    Delayed: %d\n", counts.Delayed)
+		fmt.Fprintf(buf, "       Held: %d\n", counts.Held)
 		fmt.Fprintf(buf, "  Completed: %d\n", counts.Completed)
 	})
 	if !found {
@@ -125,6 +515,34 @@ func (s *Server) ServeSummary(w http.ResponseWriter, r *http.Request) {
 	w.Write(buf.Bytes())
 }
 
+// serveSummaryJSON serves the names and counts of the contexts starting with
+// prefix, in order, for /summary?format=json.
+func (s *Server) serveSummaryJSON(w http.ResponseWriter, r *http.Request, prefix string) {
+	var rateWindow int
+	if s := r.URL.Query().Get("window"); s != "" {
+		var err error
+		rateWindow, err = strconv.Atoi(s)
+		if err != nil {
+			serveError(w, err.Error())
+			return
+		}
+	}
+	type contextSummary struct {
+		Name   string       `json:"name"`
+		Counts *QueueCounts `json:"counts"`
+	}
+	summaries := []contextSummary{}
+	s.Queues.Iterate(func(name string, qs *QueueState) {
+		if strings.HasPrefix(name, prefix) {
+			summaries = append(summaries, contextSummary{
+				Name:   name,
+				Counts: qs.Counts(rateWindow, true),
+			})
+		}
+	})
+	serveObject(w, summaries)
+}
+
 func (s *Server) ServeCounts(w http.ResponseWriter, r *http.Request) {
 	if !s.BasicAuth(w, r) {
 		return
@@ -141,24 +559,53 @@ func (s *Server) ServeCounts(w http.ResponseWriter, r *http.Request) {
 	}
 
 	includeModtime := r.URL.Query().Get("includeModtime") == "1"
+	cacheTTL := s.CountsCacheTTL
+	if r.URL.Query().Get("fresh") == "1" {
+		cacheTTL = 0
+	}
 
-	if r.URL.Query().Get("all") == "1" {
+	aggregate := r.URL.Query().Get("aggregate") == "1"
+	if r.URL.Query().Get("all") == "1" || aggregate {
+		prefix := r.URL.Query().Get("prefix")
 		allNames := []string{}
 		allCounts := []*QueueCounts{}
 		s.Queues.Iterate(func(name string, qs *QueueState) {
+			if !strings.HasPrefix(name, prefix) {
+				return
+			}
 			allNames = append(allNames, name)
-			allCounts = append(allCounts, qs.Counts(rateWindow, includeModtime))
+			allCounts = append(allCounts, qs.CachedCounts(rateWindow, includeModtime, cacheTTL))
 		})
-		serveObject(w, map[string]interface{}{
+		result := map[string]interface{}{
 			"names":  allNames,
 			"counts": allCounts,
-		})
+		}
+		if aggregate {
+			total := &QueueCounts{}
+			if rateWindow > 0 {
+				total.Rate = new(float64)
+				total.PushRate = new(float64)
+				total.PopRate = new(float64)
+				total.ExpireRate = new(float64)
+			}
+			for _, c := range allCounts {
+				total.Add(c)
+			}
+			total.UpdateETA()
+			total.UpdateExpiredFraction()
+			result["total"] = total
+		}
+		serveObject(w, result)
 		return
 	}
 	var obj interface{}
-	s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
 		obj = qs.Counts(rateWindow, includeModtime)
 	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
 	serveObject(w, obj)
 }
 
@@ -185,7 +632,8 @@ func (s *Server) ServeStats(w http.ResponseWriter, r *http.Request) {
 			"sys":        m.Sys,
 			"lastGC":     float64(time.Now().UnixNano()-int64(m.LastGC)) / 1000000000.0,
 		},
-		"save": saveStats,
+		"save":     saveStats,
+		"requests": s.Metrics.Summary(),
 	})
 }
 
@@ -193,21 +641,44 @@ func (s *Server) ServePushTask(w http.ResponseWriter, r *http.Request) {
 	if !s.BasicAuth(w, r) {
 		return
 	}
+	if isJSONBody(r) {
+		s.servePushJSON(w, r)
+		return
+	}
 	contents := r.FormValue("contents")
 	limit, err := parseLimit(r.FormValue("limit"))
 	if err != nil {
 		serveError(w, err.Error())
 		return
 	}
+	opts, err := pushOptions(r.Form)
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
 	if contents == "" {
 		serveError(w, "must specify non-empty `contents` parameter")
 	} else {
 		var obj interface{}
-		s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
-			if id, ok := qs.Push(contents, limit); ok {
-				obj = id
+		var pushErr error
+		err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+			if pushErr = checkPushOptions(qs, opts); pushErr != nil {
+				return
+			}
+			if ids, ok := qs.PushTasks([]string{contents}, limit, opts); ok {
+				obj = ids[0]
 			}
 		})
+		if err != nil {
+			serveContextError(w, err)
+			return
+		} else if pushErr != nil {
+			serveError(w, pushErr.Error())
+			return
+		}
+		if id, ok := obj.(string); ok {
+			s.Audit(r, &AuditEntry{Op: "push", IDs: []string{id}, Group: opts.Group})
+		}
 		serveObject(w, obj)
 	}
 }
@@ -216,27 +687,97 @@ func (s *Server) ServePushBatch(w http.ResponseWriter, r *http.Request) {
 	if !s.BasicAuth(w, r) {
 		return
 	}
-	data, err := io.ReadAll(r.Body)
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
 	if err != nil {
+		serveError(w, err.Error())
 		return
 	}
-	var contents []string
-	if err := json.Unmarshal(data, &contents); err != nil {
+	opts, err := pushOptions(r.URL.Query())
+	if err != nil {
 		serveError(w, err.Error())
-	} else {
-		limit, err := parseLimit(r.URL.Query().Get("limit"))
+		return
+	}
+	if limit == 0 {
+		s.streamPushBatch(w, r, opts)
+		return
+	}
+
+	// The limit applies to the batch as a whole, so it must be decoded
+	// before any of it is pushed.
+	var contents []string
+	if s.DecodeBody(w, r, &contents) {
+		var ids []string
+		var pushErr error
+		err = s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+			if pushErr = checkPushOptions(qs, opts); pushErr == nil {
+				ids, _ = qs.PushTasks(contents, limit, opts)
+			}
+		})
 		if err != nil {
-			serveError(w, err.Error())
+			serveContextError(w, err)
+			return
+		} else if pushErr != nil {
+			serveError(w, pushErr.Error())
 			return
 		}
-		var ids []string
-		s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
-			ids, _ = qs.PushBatch(contents, limit)
-		})
+		if len(ids) > 0 {
+			s.Audit(r, &AuditEntry{Op: "push_batch", IDs: ids, Group: opts.Group})
+		}
 		serveObject(w, ids)
 	}
 }
 
+// pushBatchChunkSize is the number of tasks pushed at once while decoding a
+// /task/push_batch request.
+const pushBatchChunkSize = 10000
+
+// streamPushBatch decodes the pushed tasks incrementally and pushes them in
+// chunks of pushBatchChunkSize, so that huge batches never have to be stored
+// in memory all at once.
+//
+// Each chunk is decoded before the queues are locked to push it, so that a
+// slow upload does not hold up other requests.
+//
+// If the body turns out to be invalid, the tasks before the error will
+// already have been pushed, and the error message says how many there were.
+func (s *Server) streamPushBatch(w http.ResponseWriter, r *http.Request, opts *PushOptions) {
+	context := r.URL.Query().Get("context")
+	var pushErr error
+	err := s.Queues.Get(context, func(qs *QueueState) {
+		pushErr = checkPushOptions(qs, opts)
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	} else if pushErr != nil {
+		serveError(w, pushErr.Error())
+		return
+	}
+
+	var ids []string
+	decodeErr := decodeStringArray(s.limitBody(w, r), pushBatchChunkSize, func(chunk []string) error {
+		return s.Queues.Get(context, func(qs *QueueState) {
+			chunkIDs, _ := qs.PushTasks(chunk, 0, opts)
+			ids = append(ids, chunkIDs...)
+		})
+	})
+	if len(ids) > 0 {
+		s.Audit(r, &AuditEntry{Op: "push_batch", IDs: ids, Group: opts.Group})
+	}
+	if decodeErr != nil {
+		msg := s.bodyErrorMessage(decodeErr)
+		if len(ids) > 0 {
+			msg = fmt.Sprintf("%s (after pushing %d tasks)", msg, len(ids))
+		}
+		serveError(w, msg)
+		return
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	serveObject(w, ids)
+}
+
 func (s *Server) ServePopTask(w http.ResponseWriter, r *http.Request) {
 	if !s.BasicAuth(w, r) {
 		return
@@ -246,12 +787,36 @@ func (s *Server) ServePopTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	offered, err := tagsParam(r)
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	order, err := orderParam(r)
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+
 	var task *Task
 	var nextTry *time.Time
-	s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
-		task, nextTry = qs.Pop(timeout)
+	var timeoutErr error
+	err = s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		if timeoutErr = qs.CheckTimeout(timeout); timeoutErr != nil {
+			return
+		} else if timeoutErr = qs.CheckOrder(order); timeoutErr == nil {
+			task, nextTry = qs.PopOrdered(timeout, NewTagSet(offered), order)
+		}
 	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	} else if timeoutErr != nil {
+		serveError(w, timeoutErr.Error())
+		return
+	}
 	if task != nil {
+		s.Audit(r, &AuditEntry{Op: "pop", IDs: []string{task.ID}})
 		serveObject(w, task)
 	} else {
 		if nextTry != nil {
@@ -284,11 +849,43 @@ func (s *Server) ServePopBatch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	maxBytes, err := parseLimit(r.FormValue("maxBytes"))
+	if err != nil {
+		serveError(w, "invalid 'maxBytes' parameter: "+err.Error())
+		return
+	} else if maxBytes < 0 {
+		serveError(w, "invalid 'maxBytes' requested")
+		return
+	}
+
+	offered, err := tagsParam(r)
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	order, err := orderParam(r)
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+
 	var tasks []*Task
 	var nextTry *time.Time
-	s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
-		tasks, nextTry = qs.PopBatch(n, timeout)
+	var timeoutErr error
+	err = s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		if timeoutErr = qs.CheckTimeout(timeout); timeoutErr != nil {
+			return
+		} else if timeoutErr = qs.CheckOrder(order); timeoutErr == nil {
+			tasks, nextTry = qs.PopBatchOrdered(n, maxBytes, timeout, NewTagSet(offered), order)
+		}
 	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	} else if timeoutErr != nil {
+		serveError(w, timeoutErr.Error())
+		return
+	}
 
 	result := map[string]interface{}{
 		"done": len(tasks) == 0 && nextTry == nil,
@@ -297,36 +894,45 @@ func (s *Server) ServePopBatch(w http.ResponseWriter, r *http.Request) {
 		timeout := (*nextTry).Sub(time.Now())
 		result["retry"] = math.Max(0, timeout.Seconds())
 	}
-	if tasks == nil {
-		// Prevent a null value in the JSON field.
-		tasks = []*Task{}
+	if len(tasks) > 0 {
+		ids := make([]string, len(tasks))
+		for i, t := range tasks {
+			ids[i] = t.ID
+		}
+		s.Audit(r, &AuditEntry{Op: "pop_batch", IDs: ids})
 	}
-	result["tasks"] = tasks
+	result["tasks"] = TaskList(tasks)
 
-	serveObject(w, result)
+	serveStreamedObject(w, result)
 }
 
 func (s *Server) ServePeekTask(w http.ResponseWriter, r *http.Request) {
 	if !s.BasicAuth(w, r) {
 		return
 	}
+	offered, err := tagsParam(r)
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
 	var task, nextTask *Task
 	var nextTime *time.Time
-	s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
-		task, nextTask, nextTime = qs.Peek()
+	err = s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		task, nextTask, nextTime = qs.Peek(NewTagSet(offered))
 	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
 	if task != nil {
-		serveObject(w, map[string]interface{}{"contents": task.Contents, "id": task.ID})
+		serveObject(w, peekedTaskObject(task))
 	} else {
 		if nextTask != nil {
 			timeout := (*nextTime).Sub(time.Now())
 			serveObject(w, map[string]interface{}{
 				"done":  false,
 				"retry": math.Max(0, timeout.Seconds()),
-				"next": map[string]interface{}{
-					"contents": nextTask.Contents,
-					"id":       nextTask.ID,
-				},
+				"next":  peekedTaskObject(nextTask),
 			})
 		} else {
 			serveObject(w, map[string]interface{}{"done": true})
@@ -334,42 +940,124 @@ func (s *Server) ServePeekTask(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) ServeCompletedTask(w http.ResponseWriter, r *http.Request) {
+func (s *Server) ServeProgress(w http.ResponseWriter, r *http.Request) {
 	if !s.BasicAuth(w, r) {
 		return
 	}
 	id := r.FormValue("id")
+	lease := r.FormValue("lease")
+	value, err := strconv.ParseFloat(r.FormValue("value"), 64)
+	if err != nil {
+		serveError(w, "invalid 'value' parameter: "+err.Error())
+		return
+	} else if math.IsNaN(value) || math.IsInf(value, 0) {
+		// Such values cannot be encoded as JSON, so they would break saves.
+		serveError(w, "invalid 'value' requested")
+		return
+	}
+	progress := &TaskProgress{
+		Value:   value,
+		Message: r.FormValue("message"),
+		Updated: time.Now().UnixMilli(),
+	}
 	var status bool
-	s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
-		status = qs.Completed(id)
+	err = s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		status = qs.Progress(id, lease, progress)
 	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
 	if status {
 		serveObject(w, true)
 	} else {
-		serveError(w, "there was no in-progress task with the specified `id`")
+		serveMissingTask(w, lease)
 	}
 }
 
-func (s *Server) ServeCompletedBatch(w http.ResponseWriter, r *http.Request) {
+func (s *Server) ServeRunningTasks(w http.ResponseWriter, r *http.Request) {
 	if !s.BasicAuth(w, r) {
 		return
 	}
-	data, err := io.ReadAll(r.Body)
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	} else if limit < 0 {
+		serveError(w, "invalid 'limit' requested")
+		return
+	}
+	var tasks []*RunningTaskInfo
+	err = s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		tasks = qs.Running(limit)
+	})
 	if err != nil {
+		serveContextError(w, err)
 		return
 	}
-	var ids []string
-	if err := json.Unmarshal(data, &ids); err != nil {
-		serveError(w, err.Error())
+	serveObject(w, tasks)
+}
+
+func (s *Server) ServeCompletedTask(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	id := r.FormValue("id")
+	lease := r.FormValue("lease")
+	var status bool
+	var notifications []*GroupNotification
+	context := r.URL.Query().Get("context")
+	err := s.Queues.Get(context, func(qs *QueueState) {
+		status = qs.CompletedBy(id, lease, r.FormValue("worker"))
+		if status {
+			s.Queues.NoteCompleted(context, id)
+			notifications = qs.TakeGroupNotifications()
+		}
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
+	s.NotifyGroups(context, notifications)
+	if status {
+		s.Audit(r, &AuditEntry{Op: "completed", IDs: []string{id}})
+		serveObject(w, true)
+	} else if s.Queues.RecentlyCompleted(context, id) {
+		serveObject(w, true)
 	} else {
-		var failures []string
-		s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		serveMissingTask(w, lease)
+	}
+}
+
+func (s *Server) ServeCompletedBatch(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	var ids []string
+	if s.DecodeBody(w, r, &ids) {
+		var successes, failures []string
+		var notifications []*GroupNotification
+		context := r.URL.Query().Get("context")
+		worker := r.URL.Query().Get("worker")
+		err := s.Queues.Get(context, func(qs *QueueState) {
 			for _, id := range ids {
-				if !qs.Completed(id) {
+				if qs.CompletedBy(id, "", worker) {
+					successes = append(successes, id)
+				} else if !s.Queues.RecentlyCompleted(context, id) {
 					failures = append(failures, id)
 				}
 			}
+			s.Queues.NoteCompleted(context, successes...)
+			notifications = qs.TakeGroupNotifications()
 		})
+		if err != nil {
+			serveContextError(w, err)
+			return
+		}
+		s.NotifyGroups(context, notifications)
+		if len(successes) > 0 {
+			s.Audit(r, &AuditEntry{Op: "completed_batch", IDs: successes})
+		}
 		if len(failures) > 0 {
 			serveError(w, "there were no in-progress tasks with the specified ids: "+
 				strings.Join(failures, ", "))
@@ -379,63 +1067,410 @@ func (s *Server) ServeCompletedBatch(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) ServeKeepalive(w http.ResponseWriter, r *http.Request) {
+func (s *Server) ServeCompletedLog(w http.ResponseWriter, r *http.Request) {
 	if !s.BasicAuth(w, r) {
 		return
 	}
-	timeout, timeoutOk := s.TimeoutParam(w, r)
-	if !timeoutOk {
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		serveError(w, err.Error())
 		return
 	}
-	id := r.FormValue("id")
-
-	var status bool
-	s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
-		status = qs.Keepalive(id, timeout)
+	var records []*CompletedRecord
+	err = s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		records = qs.CompletedLog(r.URL.Query().Get("id"), limit)
 	})
-	if status {
-		serveObject(w, true)
-	} else {
-		serveError(w, "there was no in-progress task with the specified `id`")
-	}
-}
-
-func (s *Server) ServeClearTasks(w http.ResponseWriter, r *http.Request) {
-	if !s.BasicAuth(w, r) {
+	if err != nil {
+		serveContextError(w, err)
 		return
 	}
-	s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
-		qs.Clear()
-	})
-	serveObject(w, true)
+	serveObject(w, records)
 }
 
-func (s *Server) ServeExpireTasks(w http.ResponseWriter, r *http.Request) {
+func (s *Server) ServeRetryCompleted(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	id := r.FormValue("id")
+	var newID string
+	var ok bool
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		newID, ok = qs.RetryCompleted(id)
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
+	if ok {
+		s.Audit(r, &AuditEntry{Op: "retry_completed", IDs: []string{id, newID}})
+		serveObject(w, newID)
+	} else {
+		serveError(w, "task is not in the completed log")
+	}
+}
+
+func (s *Server) ServeKeepalive(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	timeout, timeoutOk := s.TimeoutParam(w, r)
+	if !timeoutOk {
+		return
+	}
+	id := r.FormValue("id")
+	lease := r.FormValue("lease")
+
+	var info *LeaseInfo
+	var timeoutErr error
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		if timeoutErr = qs.CheckTimeout(timeout); timeoutErr == nil {
+			info = qs.Keepalive(id, lease, timeout)
+		}
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	} else if timeoutErr != nil {
+		serveError(w, timeoutErr.Error())
+		return
+	}
+	if info != nil {
+		serveObject(w, info)
+	} else {
+		serveMissingTask(w, lease)
+	}
+}
+
+// A LeaseRef identifies a running task, and optionally its lease, in the body
+// of a batch request.
+type LeaseRef struct {
+	ID    string `json:"id"`
+	Lease string `json:"lease,omitempty"`
+}
+
+// UnmarshalJSON decodes either an object or a plain ID string.
+func (l *LeaseRef) UnmarshalJSON(data []byte) error {
+	var id string
+	if err := json.Unmarshal(data, &id); err == nil {
+		*l = LeaseRef{ID: id}
+		return nil
+	}
+	type rawLeaseRef LeaseRef
+	return json.Unmarshal(data, (*rawLeaseRef)(l))
+}
+
+func (s *Server) ServeKeepaliveBatch(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	timeout, timeoutOk := s.TimeoutParam(w, r)
+	if !timeoutOk {
+		return
+	}
+	var refs []LeaseRef
+	if !s.DecodeBody(w, r, &refs) {
+		return
+	}
+
+	// Tasks which are not in progress get a null result, rather than failing
+	// the whole batch.
+	infos := make([]*LeaseInfo, len(refs))
+	var timeoutErr error
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		if timeoutErr = qs.CheckTimeout(timeout); timeoutErr == nil {
+			for i, ref := range refs {
+				infos[i] = qs.Keepalive(ref.ID, ref.Lease, timeout)
+			}
+		}
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	} else if timeoutErr != nil {
+		serveError(w, timeoutErr.Error())
+		return
+	}
+	serveObject(w, infos)
+}
+
+func (s *Server) ServeRequeue(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	id := r.FormValue("id")
+	lease := r.FormValue("lease")
+	var delay time.Duration
+	if seconds, err := parseSecondsParam(r, "delay"); err != nil {
+		serveError(w, err.Error())
+		return
+	} else if seconds != nil {
+		delay = time.Duration(*seconds * float64(time.Second))
+	}
+
+	var ok bool
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		ok = qs.Requeue(id, lease, delay)
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
+	if ok {
+		s.Audit(r, &AuditEntry{Op: "requeue", IDs: []string{id}})
+		serveObject(w, true)
+	} else {
+		serveMissingTask(w, lease)
+	}
+}
+
+func (s *Server) ServeClearTasks(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	n, err := s.Queues.Clear(r.URL.Query().Get("context"))
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
+	s.Audit(r, &AuditEntry{Op: "clear", Count: &n})
+	serveObject(w, true)
+}
+
+func (s *Server) ServeExpireTasks(w http.ResponseWriter, r *http.Request) {
 	if !s.BasicAuth(w, r) {
 		return
 	}
 	var n int
-	s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
 		n = qs.ExpireAll()
 	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
+	s.Audit(r, &AuditEntry{Op: "expire_all", Count: &n})
 	serveObject(w, n)
 }
 
+func (s *Server) ServeExpireTask(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	id := r.FormValue("id")
+	var ok bool
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		ok = qs.Expire(id)
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
+	if ok {
+		s.Audit(r, &AuditEntry{Op: "expire", IDs: []string{id}})
+		serveObject(w, true)
+	} else {
+		serveMissingTask(w, "")
+	}
+}
+
 func (s *Server) ServeQueueExpired(w http.ResponseWriter, r *http.Request) {
 	if !s.BasicAuth(w, r) {
 		return
 	}
 	var n int
-	s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
 		n = qs.QueueExpired()
 	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
+	s.Audit(r, &AuditEntry{Op: "queue_expired", Count: &n})
 	serveObject(w, n)
 }
 
+func (s *Server) ServeTrash(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	serveObject(w, s.Queues.Trash())
+}
+
+func (s *Server) ServeRestore(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	n, ok := s.Queues.Restore(r.URL.Query().Get("context"))
+	if ok {
+		s.Audit(r, &AuditEntry{Op: "restore", Count: &n})
+		serveObject(w, n)
+	} else {
+		serveError(w, "there was no trashed queue to restore into an empty context")
+	}
+}
+
+func (s *Server) ServeConfig(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	backoff, err := parseSecondsParam(r, "backoff")
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	maxBackoff, err := parseSecondsParam(r, "maxBackoff")
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	alertPending, err := parseCountParam(r, "alertPending")
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	alertExpired, err := parseCountParam(r, "alertExpired")
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	alertStall, err := parseSecondsParam(r, "alertStall")
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	completedLog, err := parseCountParam(r, "completedLog")
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	weight, err := parseCountParam(r, "weight")
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	drainTime, err := parseSecondsParam(r, "drainTime")
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	timeout, err := parseSecondsParam(r, "timeout")
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	maxTimeout, err := parseSecondsParam(r, "maxTimeout")
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	stuckAttempts, err := parseCountParam(r, "stuckAttempts")
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	stuckDeviations, err := parseSecondsParam(r, "stuckDeviations")
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	order, setOrder := r.Form["order"]
+	update := backoff != nil || maxBackoff != nil || alertPending != nil ||
+		alertExpired != nil || alertStall != nil || completedLog != nil ||
+		timeout != nil || maxTimeout != nil || weight != nil || drainTime != nil ||
+		setOrder || stuckAttempts != nil || stuckDeviations != nil
+	if update && r.Method != http.MethodPost {
+		// GET requests may use the read-only credentials.
+		serveError(w, "settings must be changed with POST")
+		return
+	}
+
+	var config QueueConfig
+	var configErr error
+	err = s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		if !update {
+			config = qs.Config()
+			return
+		}
+		config, configErr = qs.UpdateConfig(func(c *QueueConfig) error {
+			if backoff != nil {
+				c.Backoff = *backoff
+			}
+			if maxBackoff != nil {
+				c.MaxBackoff = *maxBackoff
+			}
+			if alertPending != nil {
+				c.AlertPending = *alertPending
+			}
+			if alertExpired != nil {
+				c.AlertExpired = *alertExpired
+			}
+			if alertStall != nil {
+				c.AlertStall = *alertStall
+			}
+			if completedLog != nil {
+				c.CompletedLog = int(*completedLog)
+			}
+			if timeout != nil {
+				c.Timeout = *timeout
+			}
+			if maxTimeout != nil {
+				c.MaxTimeout = *maxTimeout
+			}
+			if weight != nil {
+				c.Weight = *weight
+			}
+			if drainTime != nil {
+				c.DrainTime = *drainTime
+			}
+			if setOrder {
+				c.Order = order[0]
+			}
+			if stuckAttempts != nil {
+				c.StuckAttempts = *stuckAttempts
+			}
+			if stuckDeviations != nil {
+				c.StuckDeviations = *stuckDeviations
+			}
+			return s.ValidateConfig(c)
+		})
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	} else if configErr != nil {
+		serveError(w, configErr.Error())
+		return
+	}
+	if update {
+		s.Audit(r, &AuditEntry{Op: "config"})
+	}
+	serveObject(w, config)
+}
+
 func (s *Server) BasicAuth(w http.ResponseWriter, r *http.Request) bool {
-	if s.AuthUsername == "" && s.AuthPassword == "" {
+	accepted := s.acceptedCredentials()
+	if len(accepted) == 0 {
 		return true
 	}
+	if readOnlyAllowed(r) {
+		accepted = append(accepted, s.readOnlyCredentials()...)
+	}
+	return checkBasicAuth(w, r, accepted...)
+}
+
+// AdminAuth checks for the admin credentials, which are required for
+// debugging endpoints. Unlike BasicAuth, this always fails if no admin
+// credentials are configured.
+func (s *Server) AdminAuth(w http.ResponseWriter, r *http.Request) bool {
+	username, password := s.adminCredentials()
+	if username == "" && password == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	return checkBasicAuth(w, r, Credentials{Username: username, Password: password})
+}
+
+func checkBasicAuth(w http.ResponseWriter, r *http.Request, accepted ...Credentials) bool {
 	username, password, ok := r.BasicAuth()
 	if !ok {
 		w.Header().Set("www-authenticate", `Basic realm="restricted", charset="UTF-8"`)
@@ -444,8 +1479,14 @@ func (s *Server) BasicAuth(w http.ResponseWriter, r *http.Request) bool {
 		w.Write([]byte(`{"error": "basic auth must be provided"}`))
 		return false
 	}
-	if subtle.ConstantTimeCompare([]byte(username), []byte(s.AuthUsername)) == 1 &&
-		subtle.ConstantTimeCompare([]byte(password), []byte(s.AuthPassword)) == 1 {
+	var match int
+	for _, c := range accepted {
+		// Check every pair, so that the time taken does not reveal which
+		// pair matched.
+		match |= subtle.ConstantTimeCompare([]byte(username), []byte(c.Username)) &
+			subtle.ConstantTimeCompare([]byte(password), []byte(c.Password))
+	}
+	if match == 1 {
 		return true
 	} else {
 		w.Header().Set("www-authenticate", `Basic realm="restricted", charset="UTF-8"`)
@@ -456,15 +1497,31 @@ func (s *Server) BasicAuth(w http.ResponseWriter, r *http.Request) bool {
 	}
 }
 
+// Audit records an operation in the audit log, filling in the context, user,
+// and remote address of the entry from the request.
+func (s *Server) Audit(r *http.Request, entry *AuditEntry) {
+	if s.AuditLog == nil {
+		return
+	}
+	if entry.Context == "" {
+		entry.Context = r.URL.Query().Get("context")
+	}
+	entry.User, _, _ = r.BasicAuth()
+	entry.Remote = r.RemoteAddr
+	entry.RequestID = r.Header.Get(RequestIDHeader)
+	entry.UserAgent = r.UserAgent()
+	s.AuditLog.Log(entry)
+}
+
 func (s *Server) TimeoutParam(w http.ResponseWriter, r *http.Request) (*time.Duration, bool) {
-	timeoutStr := r.URL.Query().Get("timeout")
+	timeoutStr := r.FormValue("timeout")
 	if timeoutStr == "" {
 		return nil, true
 	}
 	parsed, err := strconv.ParseFloat(timeoutStr, 64)
 	duration := time.Millisecond * time.Duration(parsed*1000)
-	if err == nil && duration <= 0.0 {
-		err = errors.New("timeout must be at least one millisecond")
+	if err == nil {
+		err = s.checkTimeout(duration)
 	}
 	if err != nil {
 		w.Header().Set("www-authenticate", `Basic realm="restricted", charset="UTF-8"`)
@@ -477,48 +1534,217 @@ func (s *Server) TimeoutParam(w http.ResponseWriter, r *http.Request) (*time.Dur
 	return &duration, true
 }
 
-func (s *Server) SetupSaveLoop(timeout time.Duration) {
-	if s.SavePath == "" {
-		return
+// checkTimeout returns an error if a task timeout is outside of the bounds
+// allowed by the server.
+func (s *Server) checkTimeout(timeout time.Duration) error {
+	minTimeout, maxTimeout := s.timeoutBounds()
+	if timeout <= 0 {
+		return errors.New("timeout must be at least one millisecond")
+	} else if timeout < minTimeout {
+		return fmt.Errorf("timeout must be at least %s", minTimeout)
+	} else if maxTimeout != 0 && timeout > maxTimeout {
+		return fmt.Errorf("timeout must be at most %s", maxTimeout)
+	}
+	return nil
+}
+
+// ValidateConfig checks that a context's settings are consistent with each
+// other and with the server's limits.
+func (s *Server) ValidateConfig(c *QueueConfig) error {
+	if c.Backoff < 0 || c.MaxBackoff < 0 || c.AlertPending < 0 || c.AlertExpired < 0 ||
+		c.AlertStall < 0 || c.CompletedLog < 0 || c.Timeout < 0 || c.MaxTimeout < 0 ||
+		c.Weight < 0 || c.DrainTime < 0 || c.StuckAttempts < 0 || c.StuckDeviations < 0 {
+		return errors.New("settings must not be negative")
+	}
+	if _, err := ParsePopOrder(c.Order); err != nil {
+		return err
+	}
+	if c.Timeout > 0 {
+		if err := s.checkTimeout(time.Duration(c.Timeout * float64(time.Second))); err != nil {
+			return err
+		}
+		if c.MaxTimeout > 0 && c.Timeout > c.MaxTimeout {
+			return errors.New("timeout must not be greater than maxTimeout")
+		}
 	}
-	if _, err := os.Stat(s.SavePath); err == nil {
-		log.Printf("Loading state from: %s", s.SavePath)
-		s.Queues, err = ReadQueueStateMux(timeout, s.SavePath)
+	return nil
+}
+
+// compileContextPattern compiles the -context-pattern flag, or returns nil if
+// it is empty.
+func compileContextPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	res, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid context pattern: %s", err)
+	}
+	return res, nil
+}
+
+// SetupSaveLoop loads the save file, or restoreFrom if it is non-empty, and
+// starts saving the state periodically.
+func (s *Server) SetupSaveLoop(timeout time.Duration, restoreFrom string) {
+	loadPath := restoreFrom
+	if loadPath == "" {
+		if s.SavePath == "" {
+			return
+		}
+		loadPath = s.SavePath
+	}
+	if _, err := os.Stat(loadPath); err == nil || restoreFrom != "" {
+		logger.Info("loading state", "path", loadPath)
+		s.Queues, err = LoadSaveFile(timeout, loadPath, s.SaveCipher)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal("failed to load state", "path", loadPath, "error", err)
 		} else {
-			log.Printf("Loaded state from: %s", s.SavePath)
+			logger.Info("loaded state", "path", loadPath)
 		}
 	}
+	if s.SavePath == "" {
+		return
+	}
 	s.LastSave = time.Now()
 	s.LastSaveDuration = 0
 	go s.SaveLoop()
 }
 
+// SaveLoop saves the state every SaveInterval, or immediately when the process
+// receives SIGUSR1.
 func (s *Server) SaveLoop() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
 	for {
-		time.Sleep(s.SaveInterval)
-		log.Printf("Saving state to: %s", s.SavePath)
-		tmpPath := s.SavePath + ".tmp"
-		w, err := os.Create(tmpPath)
+		select {
+		case <-time.After(s.SaveInterval):
+		case <-signals:
+			logger.Info("saving state early", "trigger", "SIGUSR1")
+		}
+		logger.Debug("saving state", "path", s.SavePath)
+		result, err := s.Save()
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal("failed to save state", "path", s.SavePath, "error", err)
 		}
-		t1 := time.Now()
-		err = s.Queues.Serialize(w)
-		w.Close()
+		logger.Info("saved state", "path", s.SavePath, "duration", result.Duration,
+			"copied", result.Copied)
+	}
+}
+
+// IdleLoop periodically removes idle queues, archiving their final counts to
+// the audit log.
+func (s *Server) IdleLoop() {
+	interval := s.Queues.IdleTTL / 10
+	if interval < time.Second {
+		interval = time.Second
+	} else if interval > time.Minute {
+		interval = time.Minute
+	}
+	for {
+		time.Sleep(interval)
+		names, counts := s.Queues.RemoveIdle()
+		for i, name := range names {
+			s.AuditLog.Log(&AuditEntry{Op: "remove_idle", Context: name, Counts: counts[i]})
+		}
+		if len(names) > 0 {
+			logger.Info("removed idle contexts", "count", len(names))
+		}
+	}
+}
+
+// maxSeconds is the largest number of seconds which fits in a
+// time.Duration.
+const maxSeconds = float64(math.MaxInt64 / int64(time.Second))
+
+// parseSecondsParam parses an optional, non-negative number of seconds.
+func parseSecondsParam(r *http.Request, name string) (*float64, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return nil, nil
+	}
+	seconds, err := parseSeconds(name, value)
+	if err != nil {
+		return nil, err
+	}
+	return &seconds, nil
+}
+
+// parseSeconds parses a non-negative number of seconds, rejecting NaN and
+// values too large to convert to a time.Duration.
+func parseSeconds(name, value string) (float64, error) {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, errors.New("invalid '" + name + "' parameter: " + err.Error())
+	} else if !validSeconds(seconds) {
+		return 0, errors.New("invalid '" + name + "' requested")
+	}
+	return seconds, nil
+}
+
+// validSeconds checks that a number of seconds is non-negative, finite, and
+// can be converted to a time.Duration.
+func validSeconds(seconds float64) bool {
+	return !math.IsNaN(seconds) && seconds >= 0 && seconds <= maxSeconds
+}
+
+// pushOptions parses the options shared by the tasks in a push request.
+func pushOptions(values url.Values) (*PushOptions, error) {
+	tags, err := parseTags(values.Get("tags"))
+	if err != nil {
+		return nil, errors.New("invalid 'tags' parameter: " + err.Error())
+	}
+	var delay time.Duration
+	if delayStr := values.Get("delay"); delayStr != "" {
+		seconds, err := parseSeconds("delay", delayStr)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		os.Rename(tmpPath, s.SavePath)
+		delay = time.Duration(seconds * float64(time.Second))
+	}
+	return &PushOptions{
+		Group:       values.Get("group"),
+		Tags:        tags,
+		OrderingKey: values.Get("orderingKey"),
+		Delay:       delay,
+		Producer:    values.Get("producer"),
+	}, nil
+}
 
-		s.SaveStatsLock.Lock()
-		s.LastSave = time.Now()
-		s.LastSaveDuration = s.LastSave.Sub(t1)
-		s.SaveStatsLock.Unlock()
+// checkPushOptions returns an error if the options cannot be used for the
+// queue.
+func checkPushOptions(qs *QueueState, opts *PushOptions) error {
+	if len(opts.Tags) > 0 && !qs.InMemory() {
+		return errors.New("tags are not supported for disk-backed contexts")
+	}
+	if opts.OrderingKey != "" && !qs.InMemory() {
+		return errors.New("ordering keys are not supported for disk-backed contexts")
+	}
+	if opts.Producer != "" && !qs.InMemory() {
+		return errors.New("producers are not supported for disk-backed contexts")
+	}
+	if opts.Delay > 0 {
+		if !qs.InMemory() {
+			return errors.New("delayed pushes are not supported for disk-backed contexts")
+		} else if opts.OrderingKey != "" {
+			return errors.New("delayed pushes cannot be used with ordering keys")
+		}
+	}
+	return nil
+}
 
-		log.Printf("Saved state to: %s", s.SavePath)
+// parseCountParam parses an optional, non-negative integer.
+func parseCountParam(r *http.Request, name string) (*int64, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return nil, nil
 	}
+	count, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid '" + name + "' parameter: " + err.Error())
+	} else if count < 0 {
+		return nil, errors.New("invalid '" + name + "' requested")
+	}
+	return &count, nil
 }
 
 func parseLimit(limit string) (int, error) {
@@ -532,12 +1758,144 @@ func parseLimit(limit string) (int, error) {
 	return value, nil
 }
 
+// DecodeBody decodes a JSON request body into obj, or serves an error and
+// returns false if the body is invalid or larger than s.MaxBodySize.
+func (s *Server) DecodeBody(w http.ResponseWriter, r *http.Request, obj interface{}) bool {
+	if err := json.NewDecoder(s.limitBody(w, r)).Decode(obj); err != nil {
+		serveError(w, s.bodyErrorMessage(err))
+		return false
+	}
+	return true
+}
+
+func (s *Server) limitBody(w http.ResponseWriter, r *http.Request) io.Reader {
+	if s.MaxBodySize != 0 {
+		return &bodyLimitReader{
+			r:         http.MaxBytesReader(w, r.Body, s.MaxBodySize),
+			remaining: s.MaxBodySize,
+		}
+	}
+	return r.Body
+}
+
+func (s *Server) bodyErrorMessage(err error) string {
+	if err == errBodyTooLarge {
+		return fmt.Sprintf("request body exceeds %d bytes", s.MaxBodySize)
+	}
+	return err.Error()
+}
+
+// errBodyTooLarge is returned while reading a body from limitBody once the
+// body exceeds s.MaxBodySize.
+var errBodyTooLarge = errors.New("request body too large")
+
+// A bodyLimitReader replaces the error from an http.MaxBytesReader with
+// errBodyTooLarge once the limit is reached.
+//
+// Go 1.14 has no http.MaxBytesError, and the JSON decoder passes read errors
+// through unchanged, so this lets callers identify oversized bodies without
+// matching the error message.
+type bodyLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (b *bodyLimitReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.remaining -= int64(n)
+	if err != nil && err != io.EOF && b.remaining <= 0 {
+		err = errBodyTooLarge
+	}
+	return n, err
+}
+
+// decodeStringArray reads a JSON array of strings from r, passing the strings
+// to f in chunks of at most chunkSize.
+//
+// If f returns an error, decoding stops and the error is returned.
+func decodeStringArray(r io.Reader, chunkSize int, f func([]string) error) error {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('[') {
+		return errors.New("expected a JSON array")
+	}
+	chunk := make([]string, 0, chunkSize)
+	for dec.More() {
+		var x string
+		if err := dec.Decode(&x); err != nil {
+			return err
+		}
+		chunk = append(chunk, x)
+		if len(chunk) == chunkSize {
+			if err := f(chunk); err != nil {
+				return err
+			}
+			chunk = make([]string, 0, chunkSize)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	if len(chunk) > 0 {
+		return f(chunk)
+	}
+	return nil
+}
+
 func serveObject(w http.ResponseWriter, obj interface{}) {
 	w.Header().Set("content-type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"data": obj})
 }
 
+// serveStreamedObject is like serveObject, but streams JSONWriter values in
+// the object rather than encoding the entire response in memory.
+func serveStreamedObject(w http.ResponseWriter, obj map[string]interface{}) {
+	w.Header().Set("content-type", "application/json")
+	bufWriter := bufio.NewWriter(w)
+	if err := WriteJSONObject(bufWriter, map[string]interface{}{"data": JSONObject(obj)}); err != nil {
+		logger.Error("failed to encode response", "error", err)
+		return
+	}
+	bufWriter.WriteString("\n")
+	bufWriter.Flush()
+}
+
 func serveError(w http.ResponseWriter, err string) {
+	if m, ok := w.(*metricsResponseWriter); ok {
+		m.markError()
+	}
 	w.Header().Set("content-type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"error": err})
 }
+
+func serveContextError(w http.ResponseWriter, err error) {
+	if ce, ok := err.(*ContextError); ok {
+		if m, ok := w.(*metricsResponseWriter); ok {
+			m.markError()
+		}
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": ce.Message, "code": ce.Code})
+	} else {
+		serveError(w, err.Error())
+	}
+}
+
+func peekedTaskObject(t *Task) map[string]interface{} {
+	res := map[string]interface{}{"contents": t.Contents, "id": t.ID}
+	if t.progress != nil {
+		res["progress"] = t.progress
+	}
+	if t.annotations != nil {
+		res["annotations"] = copyAnnotations(t.annotations)
+	}
+	return res
+}
+
+func serveMissingTask(w http.ResponseWriter, lease string) {
+	if lease != "" {
+		serveError(w, "there was no in-progress task with the specified `id` and `lease`")
+	} else {
+		serveError(w, "there was no in-progress task with the specified `id`")
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer creates a Server without credentials, like one started with
+// the default flags.
+func newTestServer() *Server {
+	return &Server{
+		PathPrefix: "/",
+		StartTime:  time.Now(),
+		Queues:     NewQueueStateMux(time.Minute),
+		Metrics:    NewRequestMetrics(),
+	}
+}
+
+// testRequest sends a request to h and decodes its JSON response, marking the
+// test as failed and returning nil if the response is not a JSON object.
+//
+// Unlike t.Fatal, this may be called from other goroutines.
+func testRequest(t *testing.T, h http.Handler, method, path string,
+	body io.Reader) map[string]interface{} {
+	req := httptest.NewRequest(method, path, body)
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var res map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Errorf("%s %s: invalid response %q: %s", method, path, rec.Body.String(), err)
+		return nil
+	}
+	return res
+}
+
+func TestStreamPushBatch(t *testing.T) {
+	s := newTestServer()
+	router := s.Router(true)
+
+	res := testRequest(t, router, http.MethodPost, "/task/push_batch?context=a",
+		strings.NewReader(`["x", "y", "z"]`))
+	if ids, ok := res["data"].([]interface{}); !ok || len(ids) != 3 {
+		t.Fatalf("unexpected response: %v", res)
+	}
+	res = testRequest(t, router, http.MethodPost, "/task/push_batch?context=a",
+		strings.NewReader(`["x", 3]`))
+	if _, ok := res["error"]; !ok {
+		t.Fatalf("expected an error but got: %v", res)
+	}
+
+	s.MaxBodySize = 10
+	res = testRequest(t, router, http.MethodPost, "/task/push_batch?context=a",
+		strings.NewReader(`["xxxxxxxx", "yyyyyyyy"]`))
+	if msg, _ := res["error"].(string); !strings.Contains(msg, "exceeds 10 bytes") {
+		t.Fatalf("expected a body size error but got: %v", res)
+	}
+}
+
+func TestStreamPushBatchSlowUpload(t *testing.T) {
+	s := newTestServer()
+	router := s.Router(true)
+	testRequest(t, router, http.MethodPost, "/task/push?context=other&contents=x", nil)
+
+	// Start an upload which stalls partway through the body.
+	body, bodyWriter := io.Pipe()
+	uploadDone := make(chan map[string]interface{})
+	go func() {
+		uploadDone <- testRequest(t, router, http.MethodPost, "/task/push_batch?context=slow", body)
+	}()
+	bodyWriter.Write([]byte(`["a",`))
+
+	// Operations which lock every context, and requests queued behind them,
+	// must not wait for the upload.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := s.Queues.Rename("other", "renamed"); err != nil {
+			t.Error(err)
+		}
+		testRequest(t, router, http.MethodPost, "/task/push?context=third&contents=x", nil)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requests were blocked by a slow upload")
+	}
+
+	bodyWriter.Write([]byte(`"b"]`))
+	bodyWriter.Close()
+	if ids, ok := (<-uploadDone)["data"].([]interface{}); !ok || len(ids) != 2 {
+		t.Fatal("slow upload failed")
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	s := newTestServer()
+	s.AdminUsername = "admin"
+	s.AdminPassword = "secret"
+
+	expected := []string{
+		"task/clear", "task/expire_all", "task/queue_expired", "task/import",
+		"context/bulk", "task/expire", "task/hold", "task/unhold",
+		"task/retry_completed", "context/restore", "context/rename",
+		"context/clone", "context/config", "admin/reload", "admin/save",
+		"admin/snapshot/download", "admin/generations",
+		"admin/restore_generation", "admin/quiesce", "admin/resume",
+		"admin/credentials", "snapshot",
+	}
+	expectedSet := map[string]bool{}
+	for _, path := range expected {
+		expectedSet[path] = true
+	}
+	for _, route := range s.Routes() {
+		if route.Admin != expectedSet[route.Path] {
+			t.Errorf("route %s: expected Admin to be %v", route.Path, expectedSet[route.Path])
+		}
+	}
+
+	public := s.Router(false)
+	admin := s.Router(true)
+	for _, path := range append(expected, "debug/pprof/") {
+		rec := httptest.NewRecorder()
+		public.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/"+path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("public %s: expected status 404 but got %d", path, rec.Code)
+		}
+		rec = httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/"+path, nil))
+		if rec.Code == http.StatusNotFound {
+			t.Errorf("admin %s: unexpected status 404", path)
+		}
+	}
+
+	// Worker-facing endpoints are served on both addresses.
+	res := testRequest(t, public, http.MethodPost, "/task/push?contents=x", nil)
+	if _, ok := res["data"]; !ok {
+		t.Errorf("unexpected push response: %v", res)
+	}
+}
+
+func TestFollowLoopNeverSynced(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer primary.Close()
+
+	s := newTestServer()
+	s.SetupFollowLoop(primary.URL, time.Minute, time.Millisecond, 2)
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&s.standby) == 0 {
+		t.Fatal("standby took over without ever fetching a snapshot")
+	}
+}
+
+func TestRouteMethods(t *testing.T) {
+	s := newTestServer()
+	router := s.Router(true)
+	for _, route := range s.Routes() {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+route.Path, nil))
+		allowGet := route.ReadOnly || route.Public || route.AllowGet || route.ReadOnlyGet
+		if !allowGet && rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s: expected status 405 but got %d", route.Path, rec.Code)
+		} else if allowGet && rec.Code == http.StatusMethodNotAllowed {
+			t.Errorf("GET %s: unexpected status 405", route.Path)
+		}
+	}
+}
+
+func TestReadOnlyCredentials(t *testing.T) {
+	s := newTestServer()
+	s.AuthUsername, s.AuthPassword = "worker", "secret1"
+	s.ReadOnlyUsername, s.ReadOnlyPassword = "viewer", "secret2"
+	s.AdminUsername, s.AdminPassword = "admin", "secret3"
+	router := s.Router(true)
+
+	for _, route := range s.Routes() {
+		if route.Public {
+			continue
+		}
+		method := http.MethodPost
+		if route.ReadOnly {
+			method = http.MethodGet
+		}
+		req := httptest.NewRequest(method, "/"+route.Path+"?contents=x", nil)
+		req.SetBasicAuth("viewer", "secret2")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if route.ReadOnly && rec.Code == http.StatusUnauthorized {
+			t.Errorf("%s: read-only credentials were rejected", route.Path)
+		} else if !route.ReadOnly && rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: read-only credentials were accepted with status %d", route.Path, rec.Code)
+		}
+	}
+
+	var counts *QueueCounts
+	s.Queues.Get("", func(qs *QueueState) {
+		counts = qs.Counts(0, false)
+	})
+	if counts.Pending != 0 {
+		t.Fatalf("read-only credentials pushed %d tasks", counts.Pending)
+	}
+
+	// Settings can be read, but not changed, with the read-only credentials.
+	for _, path := range []string{"/context/config", "/context/config?backoff=3"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.SetBasicAuth("viewer", "secret2")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: unexpected status %d", path, rec.Code)
+		}
+		refused := !strings.Contains(rec.Body.String(), `"data"`)
+		if refused != strings.Contains(path, "backoff") {
+			t.Fatalf("GET %s: unexpected response %s", path, rec.Body.String())
+		}
+	}
+	var config QueueConfig
+	s.Queues.Get("", func(qs *QueueState) {
+		config = qs.Config()
+	})
+	if config.Backoff != 0 {
+		t.Fatal("read-only credentials changed the settings")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/task/push?contents=x", nil)
+	req.SetBasicAuth("worker", "secret1")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `"data"`) {
+		t.Fatalf("push with regular credentials failed: %s", rec.Body.String())
+	}
+}
+
+func TestQuiesce(t *testing.T) {
+	s := newTestServer()
+	s.AdminUsername, s.AdminPassword = "admin", "secret"
+	router := s.Router(true)
+	adminRequest := func(path string) map[string]interface{} {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.SetBasicAuth("admin", "secret")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var res map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: invalid response %q", path, rec.Body.String())
+		}
+		return res
+	}
+
+	// Quiesce and resume explicitly.
+	if res := adminRequest("/admin/quiesce?timeout=60"); res["data"] == nil {
+		t.Fatalf("failed to quiesce: %v", res)
+	}
+	pushed := make(chan struct{})
+	go func() {
+		testRequest(t, router, http.MethodPost, "/task/push?contents=x", nil)
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push was not blocked while quiesced")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if res := testRequest(t, router, http.MethodGet, "/counts", nil); res["data"] == nil {
+		t.Fatalf("read-only request failed while quiesced: %v", res)
+	}
+	res := adminRequest("/admin/resume")
+	if data, _ := res["data"].(map[string]interface{}); data["resumed"] != true || data["unchanged"] != true {
+		t.Fatalf("unexpected resume result: %v", res)
+	}
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push was not unblocked by resuming")
+	}
+
+	// Quiesce until the timeout passes.
+	adminRequest("/admin/quiesce?timeout=0.2")
+	start := time.Now()
+	testRequest(t, router, http.MethodPost, "/task/push?contents=y", nil)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("push was only blocked for %s", elapsed)
+	}
+	res = adminRequest("/admin/resume")
+	if data, _ := res["data"].(map[string]interface{}); data["resumed"] != false {
+		t.Fatalf("unexpected resume result after timeout: %v", res)
+	}
+}
+
+func TestQuiesceJoined(t *testing.T) {
+	var q quiescer
+	if _, started, err := q.Quiesce(time.Hour); err != nil || !started {
+		t.Fatalf("unexpected result: %v, %v", started, err)
+	}
+	if _, started, err := q.Quiesce(time.Hour); err != nil || started {
+		t.Fatalf("unexpected result for second quiesce: %v, %v", started, err)
+	}
+	if !q.Resume() || q.Resume() {
+		t.Fatal("unexpected resume results")
+	}
+
+	// A stale timer or failed quiesce does not end a later quiesce.
+	q.Quiesce(time.Hour)
+	q.lock.Lock()
+	first := q.resumed
+	q.lock.Unlock()
+	q.Resume()
+	q.Quiesce(time.Hour)
+	if q.resume(first) {
+		t.Fatal("resumed a later quiesce")
+	}
+	if !q.Resume() {
+		t.Fatal("failed to resume")
+	}
+}
+
+func TestHomepagePathPrefix(t *testing.T) {
+	s := newTestServer()
+	s.PathPrefix = "/tasq/"
+	router := s.Router(true)
+	for _, path := range []string{"/tasq/", "/tasq"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", path, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), `const pathPrefix = "/tasq/";`) {
+			t.Fatalf("%s: path prefix was not injected", path)
+		}
+	}
+}
+
+func TestPopWithGet(t *testing.T) {
+	s := newTestServer()
+	router := s.Router(true)
+	testRequest(t, router, http.MethodPost, "/task/push?contents=x", nil)
+	res := testRequest(t, router, http.MethodGet, "/task/pop", nil)
+	if data, _ := res["data"].(map[string]interface{}); data["contents"] != "x" {
+		t.Fatalf("unexpected pop response: %v", res)
+	}
+
+	// Browsers still cannot be tricked into popping with GET.
+	req := httptest.NewRequest(http.MethodGet, "/task/pop", nil)
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403 but got %d", rec.Code)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A MetricsPusher periodically sends the counts of every context to an
+// InfluxDB-compatible write endpoint using the line protocol.
+type MetricsPusher struct {
+	// URL is the write endpoint, such as
+	// http://localhost:8086/api/v2/write?org=o&bucket=b&precision=ns.
+	URL string
+
+	// Interval is the time between pushes, which is also the window over
+	// which completion rates are measured.
+	Interval time.Duration
+
+	// Authorization, if non-empty, is sent as the Authorization header, e.g.
+	// "Token XYZ" for InfluxDB 2.
+	Authorization string
+}
+
+// Loop pushes metrics for s forever, logging any errors.
+func (m *MetricsPusher) Loop(s *Server) {
+	client := &http.Client{Timeout: m.Interval}
+	for {
+		time.Sleep(m.Interval)
+		if err := m.push(client, s); err != nil {
+			logger.Error("failed to push metrics", "error", err)
+		}
+	}
+}
+
+func (m *MetricsPusher) push(client *http.Client, s *Server) error {
+	var buf bytes.Buffer
+	m.writeLines(&buf, s.Queues, time.Now())
+	if buf.Len() == 0 {
+		return nil
+	}
+	req, err := http.NewRequest("POST", m.URL, &buf)
+	if err != nil {
+		return errors.Wrap(err, "push metrics")
+	}
+	req.Header.Set("content-type", "text/plain; charset=utf-8")
+	if m.Authorization != "" {
+		req.Header.Set("authorization", m.Authorization)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "push metrics")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("push metrics: status %d: %s", resp.StatusCode,
+			strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// writeLines writes one line per context. The default context has no
+// context tag.
+func (m *MetricsPusher) writeLines(w io.Writer, queues *QueueStateMux, now time.Time) {
+	window := int(m.Interval / time.Second)
+	if window < 1 {
+		window = 1
+	} else if window > DefaultRateTrackerBins {
+		window = DefaultRateTrackerBins
+	}
+	queues.Iterate(func(name string, qs *QueueState) {
+		counts := qs.Counts(window, false)
+		measurement := "tasq"
+		if name != "" {
+			measurement += ",context=" + escapeTagValue(name)
+		}
+		fmt.Fprintf(w, "%s pending=%di,running=%di,expired=%di,backingOff=%di,delayed=%di,"+
+			"held=%di,completed=%di", measurement, counts.Pending, counts.Running, counts.Expired,
+			counts.BackingOff, counts.Delayed, counts.Held, counts.Completed)
+		if counts.Rate != nil {
+			fmt.Fprintf(w, ",rate=%g", *counts.Rate)
+		}
+		fmt.Fprintf(w, " %d\n", now.UnixNano())
+	})
+}
+
+var tagValueEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `,
+	"\n", `\n`)
+
+func escapeTagValue(s string) string {
+	return tagValueEscaper.Replace(s)
+}
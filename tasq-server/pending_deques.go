@@ -0,0 +1,186 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// A producerDeque holds the pending tasks of one producer which require one
+// set of tags, in the order they were pushed.
+type producerDeque struct {
+	TaskDeque
+	producer string
+
+	// oldestIndex and newestIndex are the deque's positions in the heaps
+	// of its tagGroup.
+	oldestIndex int
+	newestIndex int
+}
+
+// A tagGroup holds the pending tasks which require one set of tags, in a
+// separate deque for each producer.
+//
+// The deques are indexed by their first and last tasks, so that the oldest or
+// newest task in the group can be found without looking at every producer.
+type tagGroup struct {
+	tags   []string
+	deques map[string]*producerDeque
+
+	// producers lists the producers with tasks in the group, sorted by name,
+	// for popping in fair order.
+	producers []string
+
+	oldest dequeHeap
+	newest dequeHeap
+}
+
+func newTagGroup(tags []string) *tagGroup {
+	return &tagGroup{
+		tags:   tags,
+		deques: map[string]*producerDeque{},
+		newest: dequeHeap{newest: true},
+	}
+}
+
+// Push adds a task to the end of its producer's deque, creating the deque if
+// necessary.
+//
+// Tasks must be pushed in order of seq.
+func (g *tagGroup) Push(t *Task) {
+	d, ok := g.deques[t.producer]
+	if !ok {
+		d = &producerDeque{producer: t.producer}
+		d.PushLast(t)
+		g.deques[t.producer] = d
+		i := sort.SearchStrings(g.producers, t.producer)
+		g.producers = append(g.producers, "")
+		copy(g.producers[i+1:], g.producers[i:])
+		g.producers[i] = t.producer
+		heap.Push(&g.oldest, d)
+		heap.Push(&g.newest, d)
+		return
+	}
+	d.PushLast(t)
+	heap.Fix(&g.newest, d.newestIndex)
+}
+
+// Removed updates the index after tasks were removed from d, deleting the
+// deque once it is empty.
+func (g *tagGroup) Removed(d *producerDeque) {
+	if d.Len() > 0 {
+		heap.Fix(&g.oldest, d.oldestIndex)
+		heap.Fix(&g.newest, d.newestIndex)
+		return
+	}
+	heap.Remove(&g.oldest, d.oldestIndex)
+	heap.Remove(&g.newest, d.newestIndex)
+	delete(g.deques, d.producer)
+	i := sort.SearchStrings(g.producers, d.producer)
+	g.producers = append(g.producers[:i], g.producers[i+1:]...)
+}
+
+// Empty checks if the group has no tasks.
+func (g *tagGroup) Empty() bool {
+	return len(g.deques) == 0
+}
+
+// A dequeHeap is a binary heap of the deques in a tagGroup, which is either
+// a min-heap by the seq of their first tasks, or a max-heap by the seq of
+// their last tasks if newest is set.
+type dequeHeap struct {
+	deques []*producerDeque
+	newest bool
+}
+
+func (d *dequeHeap) Len() int {
+	return len(d.deques)
+}
+
+func (d *dequeHeap) Less(i, j int) bool {
+	if d.newest {
+		return d.deques[i].PeekLast().seq > d.deques[j].PeekLast().seq
+	}
+	return d.deques[i].PeekFirst().seq < d.deques[j].PeekFirst().seq
+}
+
+func (d *dequeHeap) Swap(i, j int) {
+	d.deques[i], d.deques[j] = d.deques[j], d.deques[i]
+	d.setIndex(i)
+	d.setIndex(j)
+}
+
+func (d *dequeHeap) Push(x interface{}) {
+	d.deques = append(d.deques, x.(*producerDeque))
+	d.setIndex(len(d.deques) - 1)
+}
+
+func (d *dequeHeap) Pop() interface{} {
+	old := d.deques
+	res := old[len(old)-1]
+	old[len(old)-1] = nil
+	d.deques = old[:len(old)-1]
+	return res
+}
+
+func (d *dequeHeap) setIndex(i int) {
+	if d.newest {
+		d.deques[i].newestIndex = i
+	} else {
+		d.deques[i].oldestIndex = i
+	}
+}
+
+// Peek gets the deque with the oldest first task (or the newest last task),
+// or nil if the heap is empty.
+func (d *dequeHeap) Peek() *producerDeque {
+	if len(d.deques) == 0 {
+		return nil
+	}
+	return d.deques[0]
+}
+
+// A dequeMerger iterates over the tasks of several deques in order of seq.
+type dequeMerger struct {
+	deques    []*producerDeque
+	positions []int
+}
+
+func (d *dequeMerger) Len() int {
+	return len(d.deques)
+}
+
+func (d *dequeMerger) Less(i, j int) bool {
+	return d.deques[i].At(d.positions[i]).seq < d.deques[j].At(d.positions[j]).seq
+}
+
+func (d *dequeMerger) Swap(i, j int) {
+	d.deques[i], d.deques[j] = d.deques[j], d.deques[i]
+	d.positions[i], d.positions[j] = d.positions[j], d.positions[i]
+}
+
+func (d *dequeMerger) Push(x interface{}) {
+	panic("deques cannot be added while merging")
+}
+
+func (d *dequeMerger) Pop() interface{} {
+	n := len(d.deques) - 1
+	d.deques = d.deques[:n]
+	d.positions = d.positions[:n]
+	return nil
+}
+
+// Iterate calls f with every task in order, taking O(log n) time per task
+// for n deques.
+func (d *dequeMerger) Iterate(f func(t *Task)) {
+	d.positions = make([]int, len(d.deques))
+	heap.Init(d)
+	for len(d.deques) > 0 {
+		f(d.deques[0].At(d.positions[0]))
+		d.positions[0]++
+		if d.positions[0] == d.deques[0].Len() {
+			heap.Pop(d)
+		} else {
+			heap.Fix(d, 0)
+		}
+	}
+}
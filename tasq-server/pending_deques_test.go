@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestPendingQueueIndex(t *testing.T) {
+	rng := rand.New(rand.NewSource(1339))
+	p := NewPendingQueue()
+	var model []*Task
+	var lastProducer string
+
+	tagSets := [][]string{nil, {"gpu"}, {"gpu", "ssd"}}
+	offers := []TagSet{nil, {"gpu": true}, {"gpu": true, "ssd": true}}
+
+	removeModel := func(task *Task) {
+		for i, x := range model {
+			if x == task {
+				model = append(model[:i], model[i+1:]...)
+				return
+			}
+		}
+		t.Fatal("task not in model")
+	}
+	// fairModel finds the task PopFairTask should return by looking at every
+	// task, like the original implementation.
+	fairModel := func(offered TagSet) *Task {
+		oldest := map[string]*Task{}
+		for _, task := range model {
+			if _, ok := oldest[task.producer]; !ok && offered.Matches(task) {
+				oldest[task.producer] = task
+			}
+		}
+		var next, first *Task
+		for producer, task := range oldest {
+			if producer > lastProducer && (next == nil || producer < next.producer) {
+				next = task
+			}
+			if first == nil || producer < first.producer {
+				first = task
+			}
+		}
+		if next != nil {
+			return next
+		}
+		return first
+	}
+
+	for i := 0; i < 5000; i++ {
+		offered := offers[rng.Intn(len(offers))]
+		var expected, actual *Task
+		switch op := rng.Intn(6); {
+		case op <= 1 || len(model) == 0:
+			task := &Task{ID: strconv.Itoa(i), tags: tagSets[rng.Intn(len(tagSets))]}
+			if rng.Intn(4) != 0 {
+				// Many short-lived producers.
+				task.producer = "p" + strconv.Itoa(rng.Intn(i/10+1))
+			}
+			p.PushTask(task)
+			model = append(model, task)
+			continue
+		case op == 2:
+			for _, task := range model {
+				if offered.Matches(task) {
+					expected = task
+					break
+				}
+			}
+			actual = p.PopTask(offered)
+		case op == 3:
+			for j := len(model) - 1; j >= 0; j-- {
+				if offered.Matches(model[j]) {
+					expected = model[j]
+					break
+				}
+			}
+			actual = p.PopNewestTask(offered)
+		case op == 4:
+			expected = fairModel(offered)
+			actual = p.PopFairTask(offered)
+			if actual != nil {
+				lastProducer = actual.producer
+			}
+		case op == 5:
+			expected = model[rng.Intn(len(model))]
+			actual = p.Remove(expected.ID)
+		}
+		if actual != expected {
+			t.Fatalf("step %d: expected task %v but got %v", i, expected, actual)
+		}
+		if actual != nil {
+			removeModel(actual)
+		}
+
+		if p.Len() != len(model) {
+			t.Fatalf("step %d: expected length %d but got %d", i, len(model), p.Len())
+		}
+		var j int
+		p.Iterate(func(task *Task) {
+			if j >= len(model) || task != model[j] {
+				t.Fatalf("step %d: task %d is out of order", i, j)
+			}
+			j++
+		})
+		for _, group := range p.groups {
+			if group.Empty() {
+				t.Fatalf("step %d: empty group was kept", i)
+			}
+			if len(group.producers) != len(group.deques) {
+				t.Fatalf("step %d: group lists %d producers for %d deques", i,
+					len(group.producers), len(group.deques))
+			}
+			for _, deque := range group.deques {
+				if deque.Len() == 0 {
+					t.Fatalf("step %d: empty deque was kept", i)
+				}
+			}
+		}
+	}
+}
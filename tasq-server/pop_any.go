@@ -0,0 +1,143 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSchedulerPrefixes limits the memory used by a fairScheduler when
+// clients use many different prefixes.
+const maxSchedulerPrefixes = 1000
+
+// A fairScheduler chooses which context to pop from next for /task/pop_any,
+// using smooth weighted round-robin: every time a task is popped, each
+// candidate context gains credit equal to its weight, and the chosen context
+// gives up credit equal to the total weight.
+//
+// Credit is tracked separately for each prefix, since different prefixes
+// select different sets of candidates.
+type fairScheduler struct {
+	lock   sync.Mutex
+	credit map[string]map[string]int64
+}
+
+// Order sorts the candidate contexts for the prefix by the order in which
+// they should be tried, most deserving first, and returns their indices.
+func (f *fairScheduler) Order(prefix string, names []string, weights []int64) []int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	credit := f.credit[prefix]
+	order := make([]int, len(names))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		return credit[names[a]]+weights[a] > credit[names[b]]+weights[b]
+	})
+	return order
+}
+
+// Served updates the credit of the candidates after a task was popped from
+// names[chosen]. The contexts in empty had no tasks available, so they lose
+// their credit rather than saving it up for later.
+func (f *fairScheduler) Served(prefix string, names []string, weights []int64, chosen int,
+	empty []int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.credit == nil || len(f.credit) >= maxSchedulerPrefixes {
+		f.credit = map[string]map[string]int64{}
+	}
+	isEmpty := map[int]bool{}
+	for _, i := range empty {
+		isEmpty[i] = true
+	}
+	oldCredit := f.credit[prefix]
+	newCredit := map[string]int64{}
+	var total int64
+	for i, name := range names {
+		if !isEmpty[i] {
+			total += weights[i]
+			newCredit[name] = oldCredit[name] + weights[i]
+		}
+	}
+	newCredit[names[chosen]] -= total
+	f.credit[prefix] = newCredit
+}
+
+// ServePopAny pops a task from any context whose name starts with the given
+// prefix, sharing tasks between the contexts in proportion to their weights.
+func (s *Server) ServePopAny(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	timeout, timeoutOk := s.TimeoutParam(w, r)
+	if !timeoutOk {
+		return
+	}
+	prefix := r.FormValue("prefix")
+	tags, err := tagsParam(r)
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	offered := NewTagSet(tags)
+
+	var names []string
+	var weights []int64
+	s.Queues.Iterate(func(name string, qs *QueueState) {
+		if strings.HasPrefix(name, prefix) {
+			config := qs.Config()
+			names = append(names, name)
+			weights = append(weights, config.SchedulingWeight())
+		}
+	})
+
+	var empty []int
+	var nextTry *time.Time
+	for _, i := range s.fairScheduler.Order(prefix, names, weights) {
+		var task *Task
+		var taskNextTry *time.Time
+		var timeoutErr error
+		err := s.Queues.Get(names[i], func(qs *QueueState) {
+			if timeoutErr = qs.CheckTimeout(timeout); timeoutErr == nil {
+				task, taskNextTry = qs.Pop(timeout, offered)
+			}
+		})
+		if err != nil {
+			serveContextError(w, err)
+			return
+		} else if timeoutErr != nil {
+			serveError(w, timeoutErr.Error())
+			return
+		}
+		if task != nil {
+			s.fairScheduler.Served(prefix, names, weights, i, empty)
+			s.Audit(r, &AuditEntry{Op: "pop", Context: names[i], IDs: []string{task.ID}})
+			serveObject(w, map[string]interface{}{
+				"context":  names[i],
+				"id":       task.ID,
+				"contents": task.Contents,
+				"lease":    task.Lease,
+				"checksum": task.Checksum,
+			})
+			return
+		}
+		empty = append(empty, i)
+		if taskNextTry != nil && (nextTry == nil || taskNextTry.Before(*nextTry)) {
+			nextTry = taskNextTry
+		}
+	}
+	if nextTry != nil {
+		serveObject(w, map[string]interface{}{
+			"done":  false,
+			"retry": math.Max(0, time.Until(*nextTry).Seconds()),
+		})
+	} else {
+		serveObject(w, map[string]interface{}{"done": true})
+	}
+}
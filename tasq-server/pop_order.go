@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// A PopOrder determines which pending task is popped first.
+type PopOrder string
+
+const (
+	// OrderDefault uses the order from the context's configuration, which
+	// is FIFO unless configured otherwise.
+	OrderDefault PopOrder = ""
+
+	// OrderFIFO pops the oldest pending task first.
+	OrderFIFO PopOrder = "fifo"
+
+	// OrderLIFO pops the newest pending task first. It may only be used if
+	// InMemory() is true.
+	OrderLIFO PopOrder = "lifo"
+
+	// OrderFair takes turns between the producers of the pending tasks,
+	// popping the oldest task of each. It may only be used if InMemory() is
+	// true.
+	OrderFair PopOrder = "fair"
+)
+
+// ParsePopOrder parses an order from a request or a configuration.
+func ParsePopOrder(s string) (PopOrder, error) {
+	switch order := PopOrder(s); order {
+	case OrderDefault, OrderFIFO, OrderLIFO, OrderFair:
+		return order, nil
+	}
+	return "", errors.New("order must be fifo, lifo, or fair")
+}
+
+// orderParam parses the optional 'order' parameter of pop requests.
+func orderParam(r *http.Request) (PopOrder, error) {
+	order, err := ParsePopOrder(r.FormValue("order"))
+	if err != nil {
+		return "", errors.New("invalid 'order' parameter: " + err.Error())
+	}
+	return order, nil
+}
+
+// CheckOrder returns an error if the order cannot be used for the queue.
+func (q *QueueState) CheckOrder(order PopOrder) error {
+	if (order == OrderLIFO || order == OrderFair) && !q.InMemory() {
+		return errors.New(string(order) + " order is not supported for disk-backed contexts")
+	}
+	return nil
+}
+
+// pendingOrder gets the functions which pop and peek pending tasks in the
+// given order, falling back to the context's configured order.
+//
+// The caller must hold the lock.
+func (q *QueueState) pendingOrder(order PopOrder) (pop, peek func(offered TagSet) *Task) {
+	if order == OrderDefault {
+		order = PopOrder(q.config.Order)
+	}
+	if mem, ok := q.pending.(*PendingQueue); ok {
+		switch order {
+		case OrderLIFO:
+			return mem.PopNewestTask, mem.PeekNewestTask
+		case OrderFair:
+			return mem.PopFairTask, mem.PeekFairTask
+		}
+	}
+	return q.pending.PopTask, q.pending.PeekTask
+}
+
+// PopNewestTask is like PopTask, but gets the most recently pushed task whose
+// required tags are offered (in LIFO order).
+func (p *PendingQueue) PopNewestTask(offered TagSet) *Task {
+	deque := p.newestDeque(offered)
+	if deque == nil {
+		return nil
+	}
+	return p.popFrom(deque, deque.PopLast())
+}
+
+// PeekNewestTask gets a copy of the next task which would be returned by
+// PopNewestTask().
+func (p *PendingQueue) PeekNewestTask(offered TagSet) *Task {
+	deque := p.newestDeque(offered)
+	if deque == nil {
+		return nil
+	}
+	return deque.PeekLast().DisconnectedCopy()
+}
+
+// newestDeque finds the deque whose last task is the newest that the offered
+// tags satisfy, or returns nil if there is none.
+func (p *PendingQueue) newestDeque(offered TagSet) *producerDeque {
+	var res *producerDeque
+	for _, group := range p.groups {
+		if !offered.Satisfies(group.tags) {
+			continue
+		}
+		deque := group.newest.Peek()
+		if res == nil || deque.PeekLast().seq > res.PeekLast().seq {
+			res = deque
+		}
+	}
+	return res
+}
@@ -0,0 +1,76 @@
+package main
+
+import "sort"
+
+// PopFairTask is like PopTask, but takes turns between the producers of the
+// tasks whose required tags are offered, popping the oldest task of the next
+// producer (in order of name) after the one which was popped from last.
+//
+// Tasks without a producer are treated as if they share one producer.
+func (p *PendingQueue) PopFairTask(offered TagSet) *Task {
+	deque := p.fairDeque(offered)
+	if deque == nil {
+		return nil
+	}
+	t := p.popFrom(deque, deque.PopFirst())
+	p.lastProducer = t.producer
+	return t
+}
+
+// PeekFairTask gets a copy of the next task which would be returned by
+// PopFairTask().
+func (p *PendingQueue) PeekFairTask(offered TagSet) *Task {
+	deque := p.fairDeque(offered)
+	if deque == nil {
+		return nil
+	}
+	return deque.PeekFirst().DisconnectedCopy()
+}
+
+// fairDeque finds the deque from which PopFairTask should pop, or returns nil
+// if the offered tags satisfy no task.
+//
+// Each group lists its producers in order of name, so this only takes
+// logarithmic time in the number of producers.
+func (p *PendingQueue) fairDeque(offered TagSet) *producerDeque {
+	var groups []*tagGroup
+	for _, group := range p.groups {
+		if offered.Satisfies(group.tags) {
+			groups = append(groups, group)
+		}
+	}
+
+	// Take the producer which follows the last one, wrapping around to the
+	// first producer.
+	var next, first string
+	var hasNext, hasFirst bool
+	for _, group := range groups {
+		i := sort.SearchStrings(group.producers, p.lastProducer)
+		if i < len(group.producers) && group.producers[i] == p.lastProducer {
+			i++
+		}
+		if i < len(group.producers) && (!hasNext || group.producers[i] < next) {
+			next, hasNext = group.producers[i], true
+		}
+		if !hasFirst || group.producers[0] < first {
+			first, hasFirst = group.producers[0], true
+		}
+	}
+	if !hasFirst {
+		return nil
+	}
+	producer := first
+	if hasNext {
+		producer = next
+	}
+
+	// Find the producer's oldest task that the offered tags satisfy.
+	var res *producerDeque
+	for _, group := range groups {
+		deque, ok := group.deques[producer]
+		if ok && (res == nil || deque.PeekFirst().seq < res.PeekFirst().seq) {
+			res = deque
+		}
+	}
+	return res
+}
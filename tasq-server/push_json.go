@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A PushRequest is a JSON request body for /task/push, which avoids having to
+// URL-encode large task contents.
+type PushRequest struct {
+	Contents string `json:"contents"`
+
+	// Limit, if non-zero, prevents the push if the queue already has this
+	// many tasks.
+	Limit int `json:"limit"`
+
+	Group       string   `json:"group"`
+	Tags        []string `json:"tags"`
+	OrderingKey string   `json:"orderingKey"`
+	Producer    string   `json:"producer"`
+
+	// Delay is the number of seconds before the task can be popped.
+	Delay float64 `json:"delay"`
+}
+
+// options converts the request into PushOptions, validating the tags.
+func (p *PushRequest) options() (*PushOptions, error) {
+	for _, tag := range p.Tags {
+		if strings.Contains(tag, ",") {
+			return nil, errors.New("invalid 'tags' field: tags may not contain commas")
+		}
+	}
+	tags, err := parseTags(strings.Join(p.Tags, ","))
+	if err != nil {
+		return nil, errors.New("invalid 'tags' field: " + err.Error())
+	}
+	if !validSeconds(p.Delay) {
+		return nil, errors.New("invalid 'delay' field")
+	}
+	return &PushOptions{
+		Group:       p.Group,
+		Tags:        tags,
+		OrderingKey: p.OrderingKey,
+		Delay:       time.Duration(p.Delay * float64(time.Second)),
+		Producer:    p.Producer,
+	}, nil
+}
+
+// A PushResult is the response to a /task/push request with a JSON body.
+type PushResult struct {
+	// Pushed is false if the task was not pushed because of the limit.
+	Pushed bool `json:"pushed"`
+
+	ID       string `json:"id,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+
+	// Available is the Unix time in milliseconds when a delayed task can
+	// be popped.
+	Available *int64 `json:"available,omitempty"`
+}
+
+// isJSONBody checks if a request has a JSON body, rather than form values.
+func isJSONBody(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// servePushJSON implements /task/push for requests with a JSON body.
+func (s *Server) servePushJSON(w http.ResponseWriter, r *http.Request) {
+	var req PushRequest
+	dec := json.NewDecoder(s.limitBody(w, r))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		serveError(w, s.bodyErrorMessage(err))
+		return
+	}
+	if req.Contents == "" {
+		serveError(w, "must specify non-empty `contents` field")
+		return
+	} else if req.Limit < 0 {
+		serveError(w, "invalid 'limit' field")
+		return
+	}
+	opts, err := req.options()
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+
+	result := &PushResult{}
+	var pushErr error
+	err = s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		if pushErr = checkPushOptions(qs, opts); pushErr != nil {
+			return
+		}
+		if ids, ok := qs.PushTasks([]string{req.Contents}, req.Limit, opts); ok {
+			result.Pushed = true
+			result.ID = ids[0]
+		}
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	} else if pushErr != nil {
+		serveError(w, pushErr.Error())
+		return
+	}
+	if result.Pushed {
+		result.Checksum = contentsChecksum(req.Contents)
+		if opts.Delay > 0 {
+			available := time.Now().Add(opts.Delay).UnixMilli()
+			result.Available = &available
+		}
+		s.Audit(r, &AuditEntry{Op: "push", IDs: []string{result.ID}, Group: opts.Group})
+	}
+	serveObject(w, result)
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"archive/zip"
-	"bufio"
 	"encoding/json"
 	"io"
 	"os"
+	"regexp"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -17,22 +18,67 @@ import (
 
 // QueueStateMux manages multiple (named) QueueStates.
 type QueueStateMux struct {
+	// TrashRetention, if non-zero, is the amount of time that cleared queues
+	// are kept around in case they need to be restored.
+	TrashRetention time.Duration
+
+	// MaxContexts, if non-zero, limits the number of queues which may exist
+	// at once.
+	MaxContexts int
+
+	// NamePattern, if non-nil, must match the name of every new queue.
+	NamePattern *regexp.Regexp
+
+	// MaxNameLength, if non-zero, limits the length of new queue names.
+	MaxNameLength int
+
+	// Storage, if non-nil, holds the pending tasks of the contexts which it
+	// handles instead of keeping them in memory.
+	Storage *BoltStorage
+
+	// ConsistentSnapshots, if true, causes Serialize() to block operations
+	// on every queue while encoding, rather than one queue at a time.
+	ConsistentSnapshots bool
+
+	// IdleTTL, if non-zero, is the amount of time after which a queue with no
+	// pending or running tasks is removed by RemoveIdle() if it has not been
+	// modified.
+	IdleTTL time.Duration
+
+	// CompletionGrace, if non-zero, is the amount of time after a task is
+	// completed during which further completions of it are reported as
+	// successful by RecentlyCompleted().
+	CompletionGrace time.Duration
+
 	saveLock sync.RWMutex
-	lock     sync.Mutex
+	lock     sync.RWMutex
 	queues   map[string]*QueueState
-	users    map[string]int
+	trash    map[string]*TrashedQueue
 	timeout  time.Duration
+
+	completions completionLog
+
+	// removed maps the names of removed queues to the version at which they
+	// were removed, for CountsDelta(). Cursors from before removedFloor are
+	// too old to use, since some removals have been forgotten.
+	removed      map[string]int64
+	removedFloor int64
 }
 
 // NewQueueStateMux creates a QueueStateMux with the given task timeout.
 func NewQueueStateMux(timeout time.Duration) *QueueStateMux {
 	return &QueueStateMux{
 		queues:  map[string]*QueueState{},
-		users:   map[string]int{},
+		trash:   map[string]*TrashedQueue{},
 		timeout: timeout,
 	}
 }
 
+// Timeout gets the default task timeout of new queues.
+func (q *QueueStateMux) Timeout() time.Duration {
+	return q.timeout
+}
+
 // DeserializeQueueStateMux reads a file written by QueueStateMux.Serialize().
 func DeserializeQueueStateMux(timeout time.Duration, r io.ReaderAt,
 	size int64) (*QueueStateMux, error) {
@@ -54,9 +100,23 @@ func DeserializeQueueStateMux(timeout time.Duration, r io.ReaderAt,
 		if err != nil {
 			subReader.Close()
 			return nil, errors.Wrap(err, context)
+		} else if dictObj.Encoded == nil {
+			return nil, errors.New(context + ": missing queue state for context " + dictObj.Name)
+		}
+		if problems := repairEncodedQueueState(dictObj.Encoded); len(problems) > 0 {
+			logger.Error("repaired invalid queue state; run with -fsck for details",
+				"context", dictObj.Name, "problems", len(problems))
+		}
+		qs := DecodeQueueState(dictObj.Encoded)
+		if ids := qs.holdCorrupted(); len(ids) > 0 {
+			logger.Error("tasks do not match their checksums; pending tasks were held",
+				"context", dictObj.Name, "ids", ids)
+		}
+		if dictObj.Deleted != nil {
+			res.trash[dictObj.Name] = &TrashedQueue{State: qs, Deleted: *dictObj.Deleted}
+		} else {
+			res.queues[dictObj.Name] = qs
 		}
-		res.queues[dictObj.Name] = DecodeQueueState(dictObj.Encoded)
-		res.users[dictObj.Name] = 0
 	}
 	return res, nil
 }
@@ -81,36 +141,117 @@ func ReadQueueStateMux(timeout time.Duration, path string) (*QueueStateMux, erro
 // Get calls f with a QueueState for the given name. One is created if
 // necessary, and will be destroyed when the queue is cleared.
 //
+// If the queue does not exist and cannot be created, because the name is
+// invalid or there are too many queues, a *ContextError is returned and f is
+// not called.
+//
 // The QueueState should not be accessed outside of f. In particular, f should
 // not store a reference to the QueueState anywhere outside of its scope.
-func (q *QueueStateMux) Get(name string, f func(*QueueState)) {
+func (q *QueueStateMux) Get(name string, f func(*QueueState)) error {
 	q.saveLock.RLock()
 	defer q.saveLock.RUnlock()
-	q.get(name, f)
+	return q.get(name, f)
 }
 
-func (q *QueueStateMux) get(name string, f func(*QueueState)) {
-	q.lock.Lock()
+func (q *QueueStateMux) get(name string, f func(*QueueState)) error {
+	// In the common case, the queue already exists and many goroutines can
+	// look it up at once. The user count is incremented while the read lock
+	// is held, so that the queue cannot be deleted before we start using it.
+	q.lock.RLock()
 	qs, ok := q.queues[name]
+	if ok {
+		atomic.AddInt32(&qs.users, 1)
+	}
+	q.lock.RUnlock()
+
 	if !ok {
-		qs = NewQueueState(q.timeout)
-		q.queues[name] = qs
+		var err error
+		qs, err = q.create(name)
+		if err != nil {
+			return err
+		}
 	}
-	q.users[name]++
-	q.lock.Unlock()
 
 	defer func() {
+		if atomic.AddInt32(&qs.users, -1) != 0 || !qs.Cleared() {
+			return
+		}
 		q.lock.Lock()
 		defer q.lock.Unlock()
-		q.users[name]--
-		if q.users[name] == 0 && qs.Cleared() {
+		if atomic.LoadInt32(&qs.users) == 0 && q.queues[name] == qs && qs.Cleared() {
 			// Garbage collect unused queues.
-			delete(q.users, name)
 			delete(q.queues, name)
+			q.forget(name, qs)
 		}
 	}()
 
 	f(qs)
+	return nil
+}
+
+// create gets or creates the named queue with the write lock held, and
+// increments its user count.
+func (q *QueueStateMux) create(name string) (*QueueState, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	qs, ok := q.queues[name]
+	if !ok {
+		if err := q.checkNewName(name); err != nil {
+			return nil, err
+		}
+		qs = NewQueueState(q.timeout)
+		if q.Storage != nil && q.Storage.Handles(name) {
+			store, err := q.Storage.Open(name)
+			if err != nil {
+				return nil, err
+			}
+			qs.pending = store
+		}
+		q.queues[name] = qs
+	}
+	atomic.AddInt32(&qs.users, 1)
+	return qs, nil
+}
+
+// SetLimits changes MaxContexts, MaxNameLength, and NamePattern while the
+// mux may be in use. Existing queues are not affected.
+func (q *QueueStateMux) SetLimits(maxContexts, maxNameLength int, pattern *regexp.Regexp) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.MaxContexts = maxContexts
+	q.MaxNameLength = maxNameLength
+	q.NamePattern = pattern
+}
+
+func (q *QueueStateMux) checkNewName(name string) error {
+	if err := q.checkName(name); err != nil {
+		return err
+	}
+	if q.MaxContexts > 0 && len(q.queues) >= q.MaxContexts {
+		return &ContextError{
+			Code:    "too_many_contexts",
+			Message: "cannot create more than " + strconv.Itoa(q.MaxContexts) + " contexts",
+		}
+	}
+	return nil
+}
+
+// checkName checks the name of a new queue against q.MaxNameLength and
+// q.NamePattern.
+func (q *QueueStateMux) checkName(name string) error {
+	if q.MaxNameLength > 0 && len(name) > q.MaxNameLength {
+		return &ContextError{
+			Code:    "invalid_context_name",
+			Message: "context name exceeds maximum length of " + strconv.Itoa(q.MaxNameLength),
+		}
+	}
+	if q.NamePattern != nil && !q.NamePattern.MatchString(name) {
+		return &ContextError{
+			Code:    "invalid_context_name",
+			Message: "context name does not match pattern: " + q.NamePattern.String(),
+		}
+	}
+	return nil
 }
 
 // Iterate calls f with every non-empty QueueState in q.
@@ -118,12 +259,12 @@ func (q *QueueStateMux) Iterate(f func(string, *QueueState)) {
 	q.saveLock.RLock()
 	defer q.saveLock.RUnlock()
 
-	q.lock.Lock()
+	q.lock.RLock()
 	names := make([]string, 0, len(q.queues))
 	for name := range q.queues {
 		names = append(names, name)
 	}
-	q.lock.Unlock()
+	q.lock.RUnlock()
 	sort.Strings(names)
 	for _, name := range names {
 		q.get(name, func(qs *QueueState) {
@@ -132,41 +273,63 @@ func (q *QueueStateMux) Iterate(f func(string, *QueueState)) {
 	}
 }
 
-// Serialize writes the contents of the queue to a file, blocking all
-// operations on all queues to make sure cross-queue consistent state.
-func (q *QueueStateMux) Serialize(w io.Writer) error {
+// ReplaceAll atomically replaces every queue in q, and the trash, with those
+// from other, which must not be used afterwards.
+//
+// The state cannot be replaced while q.Storage is set, since the pending tasks
+// of the contexts in the database would not be replaced.
+func (q *QueueStateMux) ReplaceAll(other *QueueStateMux) error {
 	q.saveLock.Lock()
-	var states []ContextState
-	for name, q := range q.queues {
-		states = append(states, ContextState{
-			Name:    name,
-			Encoded: q.Encode(),
-		})
+	defer q.saveLock.Unlock()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.Storage != nil {
+		return errors.New("cannot replace the state while using a pending database")
 	}
-	q.saveLock.Unlock()
-
-	const context = "serialize queue state"
+	q.queues = other.queues
+	q.trash = other.trash
+	q.removed = nil
+	q.removedFloor = atomic.AddInt64(&modificationCounter, 1)
+	return nil
+}
 
-	resultWriter := zip.NewWriter(w)
-	for i, state := range states {
-		rw, err := resultWriter.Create(strconv.Itoa(i) + ".json")
-		if err != nil {
-			return errors.Wrap(err, context)
-		}
-		bufWriter := bufio.NewWriter(rw)
-		if err := state.WriteJSON(bufWriter); err != nil {
-			return errors.Wrap(err, context)
-		}
-		if err := bufWriter.Flush(); err != nil {
-			return errors.Wrap(err, context)
-		}
+// RemoveIdle deletes every queue which has no pending or running tasks and
+// has not been modified for at least q.IdleTTL.
+//
+// Returns the names and final counts of the removed queues.
+func (q *QueueStateMux) RemoveIdle() ([]string, []*QueueCounts) {
+	if q.IdleTTL == 0 {
+		return nil, nil
 	}
+	q.saveLock.RLock()
+	defer q.saveLock.RUnlock()
+	q.lock.Lock()
+	defer q.lock.Unlock()
 
-	if err := resultWriter.Close(); err != nil {
-		return errors.Wrap(err, context)
+	var names []string
+	var counts []*QueueCounts
+	now := time.Now()
+	for name, qs := range q.queues {
+		if atomic.LoadInt32(&qs.users) > 0 || qs.Len() > 0 || now.Sub(qs.LastModified()) < q.IdleTTL {
+			continue
+		}
+		names = append(names, name)
+		counts = append(counts, qs.Counts(0, true))
+		delete(q.queues, name)
+		q.forget(name, qs)
 	}
+	return names, counts
+}
 
-	return nil
+// Serialize writes the contents of the queue to a file.
+//
+// By default, each queue is encoded separately, so other queues can be used
+// while a queue is being encoded. If q.ConsistentSnapshots is set, all
+// operations on all queues are blocked while the queues are encoded, to make
+// sure the state is consistent across queues.
+func (q *QueueStateMux) Serialize(w io.Writer) error {
+	_, err := q.SerializeDiff(w, nil, nil)
+	return err
 }
 
 // QueueState maintains two queues of tasks: a pending queue and a running
@@ -181,23 +344,76 @@ func (q *QueueStateMux) Serialize(w io.Writer) error {
 // Tasks may be marked as completed at any time while they are in the running
 // queue, even if they are expired.
 type QueueState struct {
+	// users is the number of QueueStateMux.Get() calls using the queue, and
+	// is accessed atomically.
+	users int32
+
 	lock    sync.RWMutex
-	pending *PendingQueue
+	pending PendingStore
 	running *RunningQueue
+	delayed *TaskDeque
+	held    *TaskDeque
 
 	completionCounter int64
 	lastModified      time.Time
+
+	// The last times at which tasks were pushed, popped, and completed, or
+	// zero if this has not happened since the queue was created.
+	lastPushed    time.Time
+	lastPopped    time.Time
+	lastCompleted time.Time
+
+	// version is the value of modificationCounter when the queue was last
+	// modified, or zero if it has not been modified since it was loaded.
+	// It is accessed atomically, so that it can be read without the lock.
+	version int64
+
+	// countsCache holds a *cachedCounts from CachedCounts().
+	countsCache atomic.Value
+
+	// allocator allocates new tasks in slabs.
+	allocator taskAllocator
+
+	// Rate trackers for completions, pushes, pops, and expired attempts.
 	rateTracker       *RateTracker
+	pushRateTracker   *RateTracker
+	popRateTracker    *RateTracker
+	expireRateTracker *RateTracker
+
+	meanLatency  float64
+	interner     *contentsInterner
+	config       QueueConfig
+	completedLog []*CompletedRecord
+	groups       *groupTracker
+	keys         *keyTracker
+
+	// latencyVariance is the moving variance of task latencies, which is
+	// used with meanLatency to find stuck tasks.
+	latencyVariance float64
+
+	// numStuck is the number of running tasks found to be stuck by the
+	// last StuckDetector check. It is accessed atomically.
+	numStuck int64
 }
 
 // NewQueueState creates empty queues with the given task timeout.
 func NewQueueState(timeout time.Duration) *QueueState {
-	return &QueueState{
-		pending:      NewPendingQueue(),
-		running:      NewRunningQueue(timeout),
-		lastModified: time.Now(),
-		rateTracker:  NewRateTracker(0),
+	res := &QueueState{
+		pending:           NewPendingQueue(),
+		running:           NewRunningQueue(timeout),
+		delayed:           &TaskDeque{},
+		held:              &TaskDeque{},
+		lastModified:      time.Now(),
+		rateTracker:       NewRateTracker(0),
+		pushRateTracker:   NewRateTracker(0),
+		popRateTracker:    NewRateTracker(0),
+		expireRateTracker: NewRateTracker(0),
+		interner:          newContentsInterner(),
+		groups:            newGroupTracker(),
+		keys:              newKeyTracker(),
 	}
+	res.running.expirations = res.expireRateTracker
+	return res
 }
 
 // DecodeQueueState decodes an object from QueueState.Encode()
@@ -211,27 +427,81 @@ func DecodeQueueState(obj *EncodedQueueState) *QueueState {
 		lastMod = time.Now()
 	}
 
-	return &QueueState{
+	obj.expandContents()
+	res := &QueueState{
 		pending:           DecodePendingQueue(obj.Pending),
 		running:           DecodeRunningQueue(obj.Running),
+		delayed:           DecodeTaskDeque(obj.Delayed),
+		held:              DecodeTaskDeque(obj.Held),
 		completionCounter: obj.Completed,
 		lastModified:      lastMod,
+		lastPushed:        timeOrZero(obj.LastPushed),
+		lastPopped:        timeOrZero(obj.LastPopped),
+		lastCompleted:     timeOrZero(obj.LastCompleted),
 		rateTracker:       DecodeRateTracker(obj.RateTracker),
+		pushRateTracker:   DecodeRateTracker(obj.PushRateTracker),
+		popRateTracker:    DecodeRateTracker(obj.PopRateTracker),
+		expireRateTracker: DecodeRateTracker(obj.ExpireRateTracker),
+		meanLatency:       obj.MeanLatency,
+		latencyVariance:   obj.LatencyVariance,
+		interner:          newContentsInterner(),
+		groups:            decodeGroupTracker(obj.Groups),
+	}
+	res.running.expirations = res.expireRateTracker
+	if obj.Config != nil {
+		res.config = *obj.Config
 	}
+	res.completedLog = obj.CompletedLog
+	internTask := func(t *Task) {
+		t.Contents = res.interner.Intern(t.Contents)
+	}
+	res.pending.Iterate(internTask)
+	res.running.Iterate(internTask)
+	res.delayed.Iterate(internTask)
+	res.held.Iterate(internTask)
+	res.keys = decodeKeyTracker(res, obj.Waiting)
+	res.keys.Iterate(internTask)
+	return res
 }
 
 // Encode converts q into a JSON-serializable object.
+//
+// Tasks with identical contents are deduplicated in the result.
 func (q *QueueState) Encode() *EncodedQueueState {
-	q.lock.Lock()
-	defer q.lock.Unlock()
+	q.lock.RLock()
 	mt := q.lastModified
-	return &EncodedQueueState{
+	var config *QueueConfig
+	if q.config != (QueueConfig{}) {
+		c := q.config
+		config = &c
+	}
+	res := &EncodedQueueState{
+		Config:       config,
 		Pending:      q.pending.Encode(),
 		Running:      q.running.Encode(),
+		Delayed:      q.delayed.Encode(),
+		Held:         q.held.Encode(),
 		Completed:    q.completionCounter,
 		LastModified: &mt,
 		RateTracker:  q.rateTracker.Encode(),
+		MeanLatency:  q.meanLatency,
+		CompletedLog: append([]*CompletedRecord{}, q.retainedCompleted()...),
+		Groups:       q.groups.Encode(),
+		Waiting:      q.keys.Encode(),
+
+		LastPushed:    optionalTime(q.lastPushed),
+		LastPopped:    optionalTime(q.lastPopped),
+		LastCompleted: optionalTime(q.lastCompleted),
+
+		PushRateTracker:   q.pushRateTracker.Encode(),
+		PopRateTracker:    q.popRateTracker.Encode(),
+		ExpireRateTracker: q.expireRateTracker.Encode(),
+
+		LatencyVariance: q.latencyVariance,
 	}
+	q.lock.RUnlock()
+	res.dedupeContents()
+	return res
 }
 
 // Push creates a task and returns the its new ID.
@@ -241,11 +511,11 @@ func (q *QueueState) Encode() *EncodedQueueState {
 func (q *QueueState) Push(contents string, maxSize int) (string, bool) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	if maxSize > 0 && q.pending.Len()+q.running.Len() >= maxSize {
+	if maxSize > 0 && q.numTasks() >= maxSize {
 		return "", false
 	}
 	q.modified()
-	return q.pending.AddTask(contents).ID, true
+	return q.addTask(contents, nil), true
 }
 
 // PushBatch is like Push, except that it pushes multiple tasks at once.
@@ -253,75 +523,231 @@ func (q *QueueState) Push(contents string, maxSize int) (string, bool) {
 // Either all or no tasks will be pushed depending on the maxSize and current
 // queue size.
 func (q *QueueState) PushBatch(contents []string, maxSize int) ([]string, bool) {
+	return q.PushTasks(contents, maxSize, nil)
+}
+
+// PushOptions are settings shared by the tasks in a push.
+type PushOptions struct {
+	// Group, if non-empty, adds the tasks to the named group.
+	Group string
+
+	// Tags are sorted capability tags which a worker must offer to pop the
+	// tasks. They may only be used if InMemory() is true.
+	Tags []string
+
+	// OrderingKey, if non-empty, prevents the tasks from running at the same
+	// time as any other task with the same key, and makes them run in the
+	// order they were pushed. It may only be used if InMemory() is true.
+	OrderingKey string
+
+	// Delay, if positive, keeps the tasks delayed (rather than pending)
+	// until it has passed. It may only be used if InMemory() is true, and
+	// not along with OrderingKey.
+	Delay time.Duration
+
+	// Producer, if non-empty, identifies the submitter of the tasks, so
+	// that pops in OrderFair can take turns between submitters. It may only
+	// be used if InMemory() is true.
+	Producer string
+}
+
+// PushTasks is like PushBatch, but applies the given options (which may be
+// nil) to the tasks.
+func (q *QueueState) PushTasks(contents []string, maxSize int, opts *PushOptions) ([]string, bool) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	if maxSize > 0 && q.pending.Len()+q.running.Len()+len(contents) > maxSize {
+	if maxSize > 0 && q.numTasks()+len(contents) > maxSize {
 		return nil, false
 	}
 	ids := make([]string, len(contents))
 	for i, x := range contents {
-		ids[i] = q.pending.AddTask(x).ID
+		ids[i] = q.addTask(x, opts)
 	}
 	if len(contents) > 0 {
+		if opts != nil {
+			q.addToGroup(opts.Group, len(contents))
+		}
 		q.modified()
 	}
 	return ids, true
 }
 
+// InMemory checks if the pending tasks are stored in memory, which is required
+// for tasks with tags or ordering keys.
+func (q *QueueState) InMemory() bool {
+	_, ok := q.pending.(*PendingQueue)
+	return ok
+}
+
+// addTask creates a pending task and returns its ID.
+//
+// The caller must hold the write lock.
+func (q *QueueState) addTask(contents string, opts *PushOptions) string {
+	t := q.newPushedTask(contents, opts)
+	if t.orderingKey != "" {
+		q.addKeyedTask(t)
+	} else if opts != nil && opts.Delay > 0 {
+		q.pending.(*PendingQueue).AssignID(t)
+		t.expiration = time.Now().Add(opts.Delay)
+		q.delayed.PushByExpiration(t)
+	} else {
+		q.pending.AddTask(t)
+	}
+	return t.ID
+}
+
+// newPushedTask creates a task with the given options and counts it as
+// pushed, leaving it to the caller to add the task to the queue.
+//
+// The caller must hold the write lock.
+func (q *QueueState) newPushedTask(contents string, opts *PushOptions) *Task {
+	t := q.allocator.New()
+	t.Contents = q.intern(contents)
+	t.Checksum = contentsChecksum(contents)
+	if opts != nil {
+		t.group = opts.Group
+		t.tags = opts.Tags
+		t.orderingKey = opts.OrderingKey
+		t.producer = opts.Producer
+	}
+	q.pushRateTracker.Add(1)
+	q.lastPushed = time.Now()
+	return t
+}
+
 // Pop gets a task from the queue, preferring the pending queue and dipping
 // into the expired tasks in the running queue only if necessary.
-func (q *QueueState) Pop(timeout *time.Duration) (*Task, *time.Time) {
+//
+// Only tasks whose required tags are offered may be popped.
+//
+// The result is a copy of the task with its new lease, which is not affected
+// by later changes to the queue.
+func (q *QueueState) Pop(timeout *time.Duration, offered TagSet) (*Task, *time.Time) {
+	return q.PopOrdered(timeout, offered, OrderDefault)
+}
+
+// PopOrdered is like Pop, but pops pending tasks in the given order.
+func (q *QueueState) PopOrdered(timeout *time.Duration, offered TagSet,
+	order PopOrder) (*Task, *time.Time) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	nextPending := q.pending.PopTask()
+	task, nextTry := q.pop(timeout, offered, order)
+	if task != nil {
+		task = task.LeasedCopy()
+	}
+	return task, nextTry
+}
+
+// pop implements PopOrdered() while the caller holds the write lock, returning
+// the popped task itself rather than a copy.
+func (q *QueueState) pop(timeout *time.Duration, offered TagSet, order PopOrder) (*Task, *time.Time) {
+	q.promoteDelayed()
+	popPending, _ := q.pendingOrder(order)
+	nextPending := popPending(offered)
 	if nextPending != nil {
 		q.modified()
-		q.running.StartedTask(nextPending, timeout)
+		q.running.StartedTask(nextPending, q.leaseTimeout(timeout))
+		q.popRateTracker.Add(1)
+		q.lastPopped = time.Now()
 		return nextPending, nil
 	}
 
-	nextExpired, nextTry := q.running.PopExpired()
+	nextExpired, nextTry := q.running.PopExpired(q.backoff, offered.Matches)
 	if nextExpired != nil {
 		q.modified()
-		q.running.StartedTask(nextExpired, timeout)
+		q.running.StartedTask(nextExpired, q.leaseTimeout(timeout))
+		q.popRateTracker.Add(1)
+		q.lastPopped = time.Now()
 		return nextExpired, nil
 	}
 
-	return nil, nextTry
+	return nil, q.unmatchedRetry(q.nextAvailable(nextTry))
 }
 
 // PopBatch atomically pops at most n tasks from the queue.
 //
+// If maxBytes is non-zero, tasks are only added to the batch while the total
+// size of their contents does not exceed maxBytes. The first task is always
+// included, even if it is larger than maxBytes on its own.
+//
 // If fewer than n tasks are returned, the second return value is the time that
-// the next running task will expire, or nil if no tasks were running before
-// PopBatch was called.
-func (q *QueueState) PopBatch(n int, timeout *time.Duration) ([]*Task, *time.Time) {
+// the next running task will expire (or delayed task will become available),
+// or nil if no tasks were running or delayed before PopBatch was called.
+//
+// Only tasks whose required tags are offered may be popped. Like Pop(), the
+// results are copies of the tasks.
+func (q *QueueState) PopBatch(n, maxBytes int, timeout *time.Duration,
+	offered TagSet) ([]*Task, *time.Time) {
+	return q.PopBatchOrdered(n, maxBytes, timeout, offered, OrderDefault)
+}
+
+// PopBatchOrdered is like PopBatch, but pops pending tasks in the given order.
+func (q *QueueState) PopBatchOrdered(n, maxBytes int, timeout *time.Duration,
+	offered TagSet, order PopOrder) ([]*Task, *time.Time) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
+	tasks, nextTry := q.popBatch(n, maxBytes, timeout, offered, order)
+	return leasedCopies(tasks), nextTry
+}
+
+// popBatch implements PopBatchOrdered() while the caller holds the write
+// lock, returning the popped tasks themselves rather than copies.
+func (q *QueueState) popBatch(n, maxBytes int, timeout *time.Duration,
+	offered TagSet, order PopOrder) ([]*Task, *time.Time) {
+	q.promoteDelayed()
+	popPending, peekPending := q.pendingOrder(order)
 
 	var tasks []*Task
+	var numBytes int
+	fits := func(t *Task) bool {
+		return maxBytes == 0 || len(tasks) == 0 || numBytes+len(t.Contents) <= maxBytes
+	}
+
 	for len(tasks) < n {
-		t := q.pending.PopTask()
+		if maxBytes != 0 {
+			if next := peekPending(offered); next == nil || !fits(next) {
+				break
+			}
+		}
+		t := popPending(offered)
 		if t == nil {
 			break
 		}
 		tasks = append(tasks, t)
+		numBytes += len(t.Contents)
 	}
 	var nextTry *time.Time
-	for len(tasks) < n {
+	pendingExhausted := len(tasks) < n && peekPending(offered) == nil
+	for len(tasks) < n && pendingExhausted {
+		if maxBytes != 0 {
+			next, _, expiration := q.running.PeekExpired(q.backoff, offered.Matches)
+			if next == nil {
+				nextTry = expiration
+				break
+			} else if !fits(next) {
+				break
+			}
+		}
 		var t *Task
-		t, nextTry = q.running.PopExpired()
+		t, nextTry = q.running.PopExpired(q.backoff, offered.Matches)
 		if t == nil {
 			break
 		}
 		tasks = append(tasks, t)
+		numBytes += len(t.Contents)
 	}
 
+	timeout = q.leaseTimeout(timeout)
 	for _, t := range tasks {
 		q.running.StartedTask(t, timeout)
 	}
 	if len(tasks) > 0 {
 		q.modified()
+		q.popRateTracker.Add(int64(len(tasks)))
+		q.lastPopped = time.Now()
+	}
+	if len(tasks) < n {
+		nextTry = q.unmatchedRetry(q.nextAvailable(nextTry))
 	}
 
 	return tasks, nextTry
@@ -331,86 +757,342 @@ func (q *QueueState) PopBatch(n int, timeout *time.Duration) ([]*Task, *time.Tim
 //
 // If no task is currently available, Peek returns the next task to expire and
 // the time when it will expire, or nil if no tasks are running.
-func (q *QueueState) Peek() (*Task, *Task, *time.Time) {
-	q.lock.Lock()
-	defer q.lock.Unlock()
-	nextPending := q.pending.PeekTask()
+//
+// Only tasks whose required tags are offered are considered.
+func (q *QueueState) Peek(offered TagSet) (*Task, *Task, *time.Time) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	_, peekPending := q.pendingOrder(OrderDefault)
+	nextPending := peekPending(offered)
 	if nextPending != nil {
 		return nextPending, nil, nil
 	}
-	return q.running.PeekExpired()
+	if nextDelayed := q.peekDelayed(offered); nextDelayed != nil {
+		return nextDelayed, nil, nil
+	}
+	task, next, nextTime := q.running.PeekExpired(q.backoff, offered.Matches)
+	if task == nil {
+		if first := q.delayed.PeekFirst(); first != nil &&
+			(nextTime == nil || first.expiration.Before(*nextTime)) {
+			exp := first.expiration
+			return nil, first.DisconnectedCopy(), &exp
+		}
+	}
+	return task, next, nextTime
 }
 
 // Completed marks the identified task as complete, or returns false if no task
 // with the given ID was in the running queue.
-func (q *QueueState) Completed(id string) bool {
+//
+// If lease is non-empty, it must match the lease given to the task when it was
+// most recently popped.
+func (q *QueueState) Completed(id, lease string) bool {
+	return q.CompletedBy(id, lease, "")
+}
+
+// CompletedBy is like Completed, but records the name of the worker in the
+// completed log.
+func (q *QueueState) CompletedBy(id, lease, worker string) bool {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	res := q.running.Completed(id) != nil
+	return q.completedBy(id, lease, worker)
+}
+
+// completedBy implements CompletedBy() while the caller holds the write lock.
+func (q *QueueState) completedBy(id, lease, worker string) bool {
+	task := q.running.Completed(id, lease)
+	res := task != nil
 	if res {
+		q.logCompleted(task, worker)
+		q.recordLatency(task)
+		q.completeInGroup(task)
+		q.releaseKey(task)
+		q.pending.Finished(task)
+		q.interner.Release(task.Contents)
+		task.release()
 		q.completionCounter += 1
 		q.modified()
 		q.rateTracker.Add(1)
+		q.lastCompleted = time.Now()
 	}
 	return res
 }
 
 // Keepalive restarts the timeout period for the identified task, or returns
-// false if no task with the given ID was in the running queue.
-func (q *QueueState) Keepalive(id string, timeout *time.Duration) bool {
+// nil if no task with the given ID (and lease, if non-empty) was in the
+// running queue.
+//
+// If timeout is nil, the timeout from when the task was popped (or last kept
+// alive with a timeout) is used again.
+func (q *QueueState) Keepalive(id, lease string, timeout *time.Duration) *LeaseInfo {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	success := q.running.Keepalive(id, timeout)
-	if success {
-		q.modified()
+	task := q.running.Keepalive(id, lease, timeout)
+	if task == nil {
+		return nil
+	}
+	q.modified()
+	return &LeaseInfo{
+		Expiration: task.expiration.UnixMilli(),
+		Attempts:   task.attempts,
 	}
-	return success
+}
+
+// Running lists the in-progress tasks (including expired ones) in order of
+// expiration, soonest first.
+//
+// If limit is non-zero, at most limit tasks are listed.
+func (q *QueueState) Running(limit int) []*RunningTaskInfo {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return q.running.List(limit)
+}
+
+// Progress records the progress of the identified task, or returns false if
+// no task with the given ID (and lease, if non-empty) was in the running queue.
+func (q *QueueState) Progress(id, lease string, progress *TaskProgress) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	task, ok := q.running.idToTask[id]
+	if !ok || (lease != "" && task.Lease != lease) {
+		return false
+	}
+	task.progress = progress
+	q.modified()
+	return true
 }
 
 // Counts gets the current number of tasks in each state.
 func (q *QueueState) Counts(rateSeconds int, includeModtime bool) *QueueCounts {
 	q.lock.RLock()
+	if q.running.NeedsSweep() {
+		// Counting expired tasks is only fast once they have been moved to
+		// the expired heap, which requires the write lock.
+		q.lock.RUnlock()
+		q.lock.Lock()
+		q.running.Sweep(time.Now())
+		q.lock.Unlock()
+		q.lock.RLock()
+	}
 	defer q.lock.RUnlock()
+	now := time.Now()
 	runningTotal := q.running.Len()
-	runningExpired := q.running.NumExpired()
-	var rate *float64
+	runningExpired := q.running.NumExpired(now)
+	runningBackingOff := q.running.NumBackingOff(now)
+	var rate, pushRate, popRate, expireRate, latency *float64
 	if rateSeconds > 0 {
-		rateSeconds = essentials.MinInt(rateSeconds, q.rateTracker.HistorySize())
-		r := float64(q.rateTracker.Count(rateSeconds)) / float64(rateSeconds)
-		rate = &r
+		rate = trackerRate(q.rateTracker, rateSeconds)
+		pushRate = trackerRate(q.pushRateTracker, rateSeconds)
+		popRate = trackerRate(q.popRateTracker, rateSeconds)
+		expireRate = trackerRate(q.expireRateTracker, rateSeconds)
+		if q.meanLatency > 0 {
+			l := q.meanLatency
+			latency = &l
+		}
 	}
-	var modtime *int64
+	var modtime, lastPushed, lastPopped, lastCompleted *int64
 	if includeModtime {
 		modtime = new(int64)
 		*modtime = q.lastModified.UnixMilli()
+		lastPushed = optionalMillis(q.lastPushed)
+		lastPopped = optionalMillis(q.lastPopped)
+		lastCompleted = optionalMillis(q.lastCompleted)
 	}
-	return &QueueCounts{
-		Pending:      int64(q.pending.Len()),
-		Running:      int64(runningTotal - runningExpired),
-		Expired:      int64(runningExpired),
-		Completed:    q.completionCounter,
-		LastModified: modtime,
-		Rate:         rate,
+	delayedDue := q.numDelayedDue()
+	counts := &QueueCounts{
+		Pending:       int64(q.pending.Len() + q.keys.Len() + delayedDue),
+		Running:       int64(runningTotal - runningExpired - runningBackingOff),
+		Expired:       int64(runningExpired),
+		BackingOff:    int64(runningBackingOff),
+		Delayed:       int64(q.delayed.Len() - delayedDue),
+		Held:          int64(q.held.Len()),
+		Completed:     q.completionCounter,
+		Stuck:         atomic.LoadInt64(&q.numStuck),
+		LastModified:  modtime,
+		LastPushed:    lastPushed,
+		LastPopped:    lastPopped,
+		LastCompleted: lastCompleted,
+		Rate:          rate,
+		PushRate:      pushRate,
+		PopRate:       popRate,
+		ExpireRate:    expireRate,
+		Latency:       latency,
 	}
+	counts.UpdateETA()
+	counts.UpdateExpiredFraction()
+	return counts
+}
+
+// trackerRate computes the number of events per second in a RateTracker over
+// the last rateSeconds seconds, or the tracker's entire history if it is
+// shorter.
+func trackerRate(rt *RateTracker, rateSeconds int) *float64 {
+	rateSeconds = essentials.MinInt(rateSeconds, rt.HistorySize())
+	r := float64(rt.Count(rateSeconds)) / float64(rateSeconds)
+	return &r
 }
 
 // Clear empties the queues and resets the completion counter.
-func (q *QueueState) Clear() {
+//
+// Returns the number of pending and running tasks that were deleted.
+func (q *QueueState) Clear() int {
 	q.lock.Lock()
 	defer q.lock.Unlock()
+	n := q.numTasks()
 	q.pending.Clear()
 	q.running.Clear()
+	q.delayed = &TaskDeque{}
+	q.held = &TaskDeque{}
+	q.allocator = taskAllocator{}
 	q.completionCounter = 0
+	q.lastPushed = time.Time{}
+	q.lastPopped = time.Time{}
+	q.lastCompleted = time.Time{}
 	q.rateTracker.Reset()
+	q.pushRateTracker.Reset()
+	q.popRateTracker.Reset()
+	q.expireRateTracker.Reset()
+	q.meanLatency = 0
+	q.latencyVariance = 0
+	q.interner = newContentsInterner()
+	q.groups = newGroupTracker()
+	q.keys = newKeyTracker()
+	q.modified()
+	return n
+}
+
+// Extract is like Clear, but rather than discarding the pending and running
+// tasks, it returns them (along with the completion counter and rate history)
+// as a new QueueState.
+//
+// Task IDs in q continue to count up from where they left off, so that the
+// extracted tasks can later be put back with Replace() without collisions.
+func (q *QueueState) Extract() *QueueState {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	res := &QueueState{
+		running:           q.running,
+		delayed:           q.delayed,
+		held:              q.held,
+		completionCounter: q.completionCounter,
+		lastModified:      q.lastModified,
+		lastPushed:        q.lastPushed,
+		lastPopped:        q.lastPopped,
+		lastCompleted:     q.lastCompleted,
+		rateTracker:       q.rateTracker,
+		pushRateTracker:   q.pushRateTracker,
+		popRateTracker:    q.popRateTracker,
+		expireRateTracker: q.expireRateTracker,
+		meanLatency:       q.meanLatency,
+		latencyVariance:   q.latencyVariance,
+		interner:          q.interner,
+		groups:            q.groups,
+		keys:              q.keys,
+	}
+	if mem, ok := q.pending.(*PendingQueue); ok {
+		res.pending = mem
+		q.pending = newPendingQueue(mem.curID, mem.idPrefix)
+	} else {
+		// Other stores keep their own ID counter, so we copy the tasks into
+		// memory and keep using the same store.
+		mem := NewPendingQueue()
+		q.pending.Iterate(func(t *Task) {
+			mem.PushTask(t.DisconnectedCopy())
+		})
+		q.pending.Clear()
+		res.pending = mem
+	}
+	q.running = NewRunningQueue(res.running.timeout)
+	q.delayed = &TaskDeque{}
+	q.held = &TaskDeque{}
+	q.allocator = taskAllocator{}
+	q.completionCounter = 0
+	q.lastPushed = time.Time{}
+	q.lastPopped = time.Time{}
+	q.lastCompleted = time.Time{}
+	q.rateTracker = NewRateTracker(0)
+	q.pushRateTracker = NewRateTracker(0)
+	q.popRateTracker = NewRateTracker(0)
+	q.expireRateTracker = NewRateTracker(0)
+	q.running.expirations = q.expireRateTracker
+	q.meanLatency = 0
+	q.latencyVariance = 0
+	q.interner = newContentsInterner()
+	q.groups = newGroupTracker()
+	q.keys = newKeyTracker()
+	q.modified()
+	return res
+}
+
+// Replace swaps the contents of q with the contents of other, which must not
+// be used afterwards. The pending tasks of other must be stored in memory, as
+// is the case for the result of Extract().
+//
+// Returns false and leaves q unchanged if q contains any pending or running
+// tasks.
+func (q *QueueState) Replace(other *QueueState) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.numTasks() > 0 {
+		return false
+	}
+	if mem, ok := q.pending.(*PendingQueue); ok {
+		otherMem := other.pending.(*PendingQueue)
+		if mem.curID > otherMem.curID {
+			otherMem.curID = mem.curID
+		}
+		otherMem.idPrefix = mem.idPrefix
+		q.pending = otherMem
+	} else {
+		other.pending.Iterate(func(t *Task) {
+			q.pending.PushTask(t.DisconnectedCopy())
+		})
+	}
+	q.running = other.running
+	q.delayed = other.delayed
+	q.held = other.held
+	q.completionCounter = other.completionCounter
+	q.lastPushed = other.lastPushed
+	q.lastPopped = other.lastPopped
+	q.lastCompleted = other.lastCompleted
+	q.rateTracker = other.rateTracker
+	q.pushRateTracker = other.pushRateTracker
+	q.popRateTracker = other.popRateTracker
+	q.expireRateTracker = other.expireRateTracker
+	q.meanLatency = other.meanLatency
+	q.latencyVariance = other.latencyVariance
+	q.interner = other.interner
+	q.groups = other.groups
+	q.keys = other.keys
 	q.modified()
+	return true
+}
+
+// Len gets the total number of pending and running tasks.
+func (q *QueueState) Len() int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return q.numTasks()
+}
+
+// numTasks implements Len() while the caller holds the lock.
+func (q *QueueState) numTasks() int {
+	return q.pending.Len() + q.running.Len() + q.delayed.Len() + q.held.Len() + q.keys.Len()
+}
+
+// LastModified gets the last time the queue was modified.
+func (q *QueueState) LastModified() time.Time {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return q.lastModified
 }
 
 // Cleared returns true if the queue is effectively a fresh object, containing
-// no running tasks and zero completed tasks.
+// no running tasks, zero completed tasks, and the default configuration.
 func (q *QueueState) Cleared() bool {
 	q.lock.RLock()
 	defer q.lock.RUnlock()
-	return q.pending.Len() == 0 && q.running.Len() == 0 && q.completionCounter == 0
+	return q.numTasks() == 0 && q.completionCounter == 0 && q.config == QueueConfig{} && q.groups.Len() == 0
 }
 
 // ExpireAll marks all tasks as expired, allowing them to be immediately popped
@@ -428,6 +1110,19 @@ func (q *QueueState) ExpireAll() int {
 	return n
 }
 
+// Expire marks one running task as expired, like ExpireAll().
+//
+// Returns false if no running task had the given ID.
+func (q *QueueState) Expire(id string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.running.Expire(id) {
+		return false
+	}
+	q.modified()
+	return true
+}
+
 // QueueExpired puts expired tasks from the running queue back into the pending
 // queue.
 func (q *QueueState) QueueExpired() int {
@@ -435,7 +1130,7 @@ func (q *QueueState) QueueExpired() int {
 	defer q.lock.Unlock()
 	n := 0
 	for {
-		task, _ := q.running.PopExpired()
+		task, _ := q.running.PopExpired(nil, nil)
 		if task == nil {
 			break
 		}
@@ -450,140 +1145,419 @@ func (q *QueueState) QueueExpired() int {
 
 func (q *QueueState) modified() {
 	q.lastModified = time.Now()
+	atomic.StoreInt64(&q.version, atomic.AddInt64(&modificationCounter, 1))
+}
+
+// intern deduplicates the contents of a new task.
+//
+// Contents are only interned for tasks stored in memory, since other stores
+// keep their own copy of the contents.
+func (q *QueueState) intern(contents string) string {
+	if _, ok := q.pending.(*PendingQueue); ok {
+		return q.interner.Intern(contents)
+	}
+	return contents
+}
+
+// A PendingStore holds the tasks in a queue which are waiting to be popped.
+//
+// By default, tasks are stored in memory in a *PendingQueue, but some contexts
+// may be stored elsewhere, e.g. in a *BoltPendingQueue.
+type PendingStore interface {
+	Encode() *EncodedPendingQueue
+
+	// AddTask assigns an ID and creation time to a new task and enqueues it.
+	AddTask(t *Task)
+
+	// PushTask re-enqueues an existing task.
+	PushTask(t *Task)
+
+	// PopTask gets the next task (in FIFO order) whose required tags are
+	// offered. Stores which never hold tasks with required tags may ignore
+	// the offered tags.
+	PopTask(offered TagSet) *Task
+
+	// PeekTask gets a copy of the next task that PopTask would return.
+	PeekTask(offered TagSet) *Task
+
+	// Finished is called when a popped task has been completed, so that it
+	// will never be re-enqueued.
+	Finished(t *Task)
+
+	// Iterate calls f with every pending task in order.
+	Iterate(f func(t *Task))
+
+	// Len gets the number of queued tasks.
+	Len() int
+
+	// Clear deletes all of the pending tasks.
+	Clear()
 }
 
 type PendingQueue struct {
-	deque *TaskDeque
+	// groups holds the tasks in a separate tagGroup for each set of
+	// required tags, keyed by tagKey(), so that a worker only needs to look
+	// at the groups it satisfies.
+	groups   map[string]*tagGroup
+	numTasks int
+
+	// lastProducer is the producer of the last task popped in fair order.
+	lastProducer string
+
+	// nextSeq is assigned to the next enqueued task, preserving FIFO order
+	// across deques.
+	nextSeq int64
+
 	curID int64
+
+	// idPrefix is prepended to the IDs of new tasks. It is chosen randomly
+	// every time the queue is created or loaded, so that IDs do not collide
+	// with those of tasks that were created after the last snapshot (or
+	// before the queue was last garbage collected), which workers may still
+	// hold.
+	idPrefix string
 }
 
 func NewPendingQueue() *PendingQueue {
-	return &PendingQueue{deque: &TaskDeque{}}
+	return newPendingQueue(0, newIDPrefix())
 }
 
-// DecodePendingQueue decodes an object from PendingQueue.Encode().
-func DecodePendingQueue(obj *EncodedPendingQueue) *PendingQueue {
+func newPendingQueue(curID int64, idPrefix string) *PendingQueue {
 	return &PendingQueue{
-		deque: DecodeTaskDeque(obj.Deque),
-		curID: obj.CurID,
+		groups:   map[string]*tagGroup{},
+		curID:    curID,
+		idPrefix: idPrefix,
 	}
 }
 
+// DecodePendingQueue decodes an object from PendingQueue.Encode().
+func DecodePendingQueue(obj *EncodedPendingQueue) *PendingQueue {
+	res := newPendingQueue(obj.CurID, newIDPrefix())
+	decodeTasks(obj.Deque, res.PushTask)
+	return res
+}
+
 // Encode converts p into a JSON-serializable object.
 func (p *PendingQueue) Encode() *EncodedPendingQueue {
+	objs := make([]EncodedTask, 0, p.Len())
+	p.Iterate(func(t *Task) {
+		objs = append(objs, t.Encode())
+	})
 	return &EncodedPendingQueue{
-		Deque: p.deque.Encode(),
+		Deque: objs,
 		CurID: p.curID,
 	}
 }
 
-// AddTask creates a new task with the given contents and enqueues it.
-func (p *PendingQueue) AddTask(contents string) *Task {
-	task := &Task{
-		Contents: contents,
-		ID:       strconv.FormatInt(p.curID, 16),
-	}
+// AddTask assigns an ID to a new task and enqueues it.
+func (p *PendingQueue) AddTask(t *Task) {
+	p.AssignID(t)
+	p.PushTask(t)
+}
+
+// AssignID assigns an ID and creation time to a new task without enqueueing
+// it.
+func (p *PendingQueue) AssignID(t *Task) {
+	t.ID = idGenerator.NewID(p.idPrefix, p.curID)
+	t.created = time.Now()
 	p.curID += 1
-	p.deque.PushLast(task)
-	return task
 }
 
 // PushTask re-enqueues an existing task.
 func (p *PendingQueue) PushTask(t *Task) {
-	p.deque.PushLast(t)
+	t.seq = p.nextSeq
+	p.nextSeq++
+	key := tagKey(t.tags)
+	group, ok := p.groups[key]
+	if !ok {
+		group = newTagGroup(t.tags)
+		p.groups[key] = group
+	}
+	group.Push(t)
+	p.numTasks++
+}
+
+// PopTask gets the next task (in FIFO order) which can be popped by a worker
+// offering the given tags.
+func (p *PendingQueue) PopTask(offered TagSet) *Task {
+	deque := p.nextDeque(offered)
+	if deque == nil {
+		return nil
+	}
+	return p.popFrom(deque, deque.PopFirst())
 }
 
-// PopTask gets the next task (in FIFO order).
-func (p *PendingQueue) PopTask() *Task {
-	return p.deque.PopFirst()
+// popFrom updates the index after t was popped from deque, removing the
+// deque and its group once they are empty.
+func (p *PendingQueue) popFrom(deque *producerDeque, t *Task) *Task {
+	key := tagKey(t.tags)
+	group := p.groups[key]
+	group.Removed(deque)
+	if group.Empty() {
+		delete(p.groups, key)
+	}
+	p.numTasks--
+	return t
 }
 
-// PeekTask gets a copy of the next task.
+// PeekTask gets a copy of the next task which would be returned by PopTask().
 //
 // The copy only includes visible metadata. It will have no connection to the
 // queue or the original task.
-func (p *PendingQueue) PeekTask() *Task {
-	t := p.deque.PeekFirst()
-	if t == nil {
+func (p *PendingQueue) PeekTask(offered TagSet) *Task {
+	deque := p.nextDeque(offered)
+	if deque == nil {
 		return nil
 	}
-	return t.DisconnectedCopy()
+	return deque.PeekFirst().DisconnectedCopy()
+}
+
+// nextDeque finds the deque whose first task is the oldest that the offered
+// tags satisfy, or returns nil if there is none.
+func (p *PendingQueue) nextDeque(offered TagSet) *producerDeque {
+	var res *producerDeque
+	for _, group := range p.groups {
+		if !offered.Satisfies(group.tags) {
+			continue
+		}
+		deque := group.oldest.Peek()
+		if res == nil || deque.PeekFirst().seq < res.PeekFirst().seq {
+			res = deque
+		}
+	}
+	return res
+}
+
+// Finished does nothing, since popped tasks are not tracked in memory.
+func (p *PendingQueue) Finished(t *Task) {
+}
+
+// Iterate calls f with every pending task in order.
+func (p *PendingQueue) Iterate(f func(t *Task)) {
+	deques := p.deques()
+	if len(deques) == 1 {
+		deques[0].Iterate(f)
+		return
+	}
+	merger := &dequeMerger{deques: deques}
+	merger.Iterate(f)
+}
+
+// deques lists the deques of every group, in no particular order.
+func (p *PendingQueue) deques() []*producerDeque {
+	var res []*producerDeque
+	for _, group := range p.groups {
+		res = append(res, group.oldest.deques...)
+	}
+	return res
 }
 
 // Len gets the number of queued tasks.
 func (p *PendingQueue) Len() int {
-	return p.deque.Len()
+	return p.numTasks
 }
 
 // Clear deletes all of the pending tasks.
 func (p *PendingQueue) Clear() {
-	p.deque = &TaskDeque{}
+	p.groups = map[string]*tagGroup{}
+	p.numTasks = 0
 }
 
+// A RunningQueue tracks in-progress tasks by ID and by expiration.
+//
+// Tasks are kept in two heaps: one for tasks which have not yet expired, and
+// one for expired tasks. Tasks are moved to the expired heap by Sweep(), so
+// that the number of expired tasks can be found without looking at each of
+// them.
 type RunningQueue struct {
-	idToTask map[string]*Task
-	deque    *TaskDeque
-	timeout  time.Duration
+	idToTask  map[string]*Task
+	unexpired expirationHeap
+	expired   expirationHeap
+	timeout   time.Duration
+
+	// nextSeq orders tasks with the same expiration by when they were
+	// scheduled.
+	nextSeq int64
+
+	// numBackedOff is the number of tasks in the unexpired heap which are
+	// waiting for their backoff delay from PopExpired().
+	numBackedOff int
+
+	// expirations, if non-nil, counts attempts as they are found to have
+	// expired.
+	expirations *RateTracker
 }
 
 func NewRunningQueue(timeout time.Duration) *RunningQueue {
 	return &RunningQueue{
 		idToTask: map[string]*Task{},
-		deque:    &TaskDeque{},
 		timeout:  timeout,
 	}
 }
 
 // DecodeRunningQueue decodes an object from RunningQueue.Encode().
 func DecodeRunningQueue(obj *EncodedRunningQueue) *RunningQueue {
-	deque := DecodeTaskDeque(obj.Deque)
-	idToTask := map[string]*Task{}
-	deque.Iterate(func(t *Task) {
-		idToTask[t.ID] = t
+	res := NewRunningQueue(obj.Timeout)
+	decodeTasks(obj.Deque, func(t *Task) {
+		res.idToTask[t.ID] = t
+		res.add(t)
 	})
-	return &RunningQueue{
-		idToTask: idToTask,
-		deque:    deque,
-		timeout:  obj.Timeout,
-	}
+	return res
 }
 
 // Encode converts the queue into a JSON-serializable object.
+//
+// Tasks are encoded in order of expiration.
 func (r *RunningQueue) Encode() *EncodedRunningQueue {
+	tasks := r.sorted(0)
+	objs := make([]EncodedTask, len(tasks))
+	for i, t := range tasks {
+		objs[i] = t.Encode()
+	}
 	return &EncodedRunningQueue{
-		Deque:   r.deque.Encode(),
+		Deque:   objs,
 		Timeout: r.timeout,
 	}
 }
 
-// StartedTask adds the task to the queue and sets its timeout accordingly.
+// StartedTask adds the task to the queue, gives it a new lease, increments its
+// attempt count, resets its progress, and sets its timeout accordingly.
 func (r *RunningQueue) StartedTask(t *Task, timeout *time.Duration) {
+	now := time.Now()
+	t.endAttempt(now)
+	t.Lease = newLease()
+	t.attempts += 1
+	t.progress = nil
+	t.popped = now
+	t.timeout = 0
+	t.reserved = false
+	r.schedule(t, timeout)
+}
+
+// schedule sets the expiration of the task and adds it to the queue.
+//
+// If timeout is nil, the timeout of the task's previous scheduling is reused,
+// or the queue's default timeout if there was none.
+func (r *RunningQueue) schedule(t *Task, timeout *time.Duration) {
 	r.idToTask[t.ID] = t
-	if timeout == nil {
-		timeout = &r.timeout
+	if timeout != nil {
+		t.timeout = *timeout
+	}
+	duration := t.timeout
+	if duration == 0 {
+		duration = r.timeout
+	}
+	t.expiration = time.Now().Add(duration)
+	t.backedOff = false
+	r.add(t)
+}
+
+// add inserts a task into the unexpired heap after any other tasks with the
+// same expiration.
+func (r *RunningQueue) add(t *Task) {
+	t.seq = r.nextSeq
+	r.nextSeq++
+	r.addUnexpired(t)
+}
+
+// addUnexpired inserts a task into the unexpired heap, keeping its position
+// among tasks with the same expiration.
+func (r *RunningQueue) addUnexpired(t *Task) {
+	if t.backedOff {
+		r.numBackedOff++
+	}
+	r.unexpired.Add(t)
+}
+
+// removeUnexpired deletes a task from the unexpired heap.
+func (r *RunningQueue) removeUnexpired(t *Task) {
+	if t.backedOff {
+		r.numBackedOff--
+	}
+	r.unexpired.Remove(t)
+}
+
+// remove deletes a task from whichever heap contains it.
+func (r *RunningQueue) remove(t *Task) {
+	if t.heapIndex >= 0 && t.heapIndex < len(r.expired) && r.expired[t.heapIndex] == t {
+		r.expired.Remove(t)
+	} else {
+		r.removeUnexpired(t)
+	}
+}
+
+// NeedsSweep checks if any tasks have expired since the last Sweep().
+func (r *RunningQueue) NeedsSweep() bool {
+	next := r.unexpired.Peek()
+	return next != nil && !next.expiration.After(time.Now())
+}
+
+// Sweep moves the tasks which have expired by now into the expired heap.
+//
+// Each task is only moved once per scheduling, so the cost is amortized over
+// the operations which schedule tasks.
+func (r *RunningQueue) Sweep(now time.Time) {
+	for next := r.unexpired.Peek(); next != nil && !next.expiration.After(now); next = r.unexpired.Peek() {
+		r.removeUnexpired(next)
+		r.expired.Add(next)
+		r.countExpiration(next)
+	}
+}
+
+// countExpiration records that a task's attempt has expired, unless it was
+// already recorded before the task was backed off.
+func (r *RunningQueue) countExpiration(t *Task) {
+	if r.expirations != nil && !t.backedOff {
+		r.expirations.Add(1)
 	}
-	t.expiration = time.Now().Add(*timeout)
-	r.deque.PushByExpiration(t)
 }
 
 // PopExpired removes the first timed out task from the queue and returns it.
 //
+// If backoff is non-nil, it is called with the attempt count of each expired
+// task the first time the task is encountered after expiring. If the delay it
+// returns has not yet passed since the task expired, the task's expiration is
+// pushed back by the delay instead of returning it.
+//
+// If match is non-nil, expired tasks for which it returns false are skipped.
+//
 // If no tasks are timed out, the second return argument specifies the next
 // time when a task is set to expire (if there is one).
-func (r *RunningQueue) PopExpired() (*Task, *time.Time) {
-	task := r.deque.PeekFirst()
-	if task == nil {
-		return nil, nil
-	}
+func (r *RunningQueue) PopExpired(backoff func(attempts int) time.Duration,
+	match func(t *Task) bool) (*Task, *time.Time) {
 	now := time.Now()
-	if task.expiration.After(now) {
-		exp := task.expiration
-		return nil, &exp
-	} else {
-		r.deque.Remove(task)
+	r.Sweep(now)
+
+	// Skipped tasks are removed while searching, and then put back.
+	var skipped []*Task
+	defer func() {
+		for _, t := range skipped {
+			r.expired.Add(t)
+		}
+	}()
+
+	for task := r.expired.Peek(); task != nil; task = r.expired.Peek() {
+		r.expired.Remove(task)
+		if match != nil && !match(task) {
+			skipped = append(skipped, task)
+			continue
+		}
+		if backoff != nil && !task.backedOff {
+			task.backedOff = true
+			if available := task.expiration.Add(backoff(task.attempts)); available.After(now) {
+				task.expiration = available
+				r.addUnexpired(task)
+				continue
+			}
+		}
 		delete(r.idToTask, task.ID)
 		return task, nil
 	}
+	if next := r.unexpired.Peek(); next != nil {
+		exp := next.expiration
+		return nil, &exp
+	}
+	return nil, nil
 }
 
 // PeekExpired returns a copy of the first timed out task or the next task that
@@ -596,99 +1570,426 @@ func (r *RunningQueue) PopExpired() (*Task, *time.Time) {
 //
 // The returned tasks only include visible metadata. They will have no
 // connection to the queue or the original task.
-func (r *RunningQueue) PeekExpired() (*Task, *Task, *time.Time) {
-	task := r.deque.PeekFirst()
-	if task == nil {
-		return nil, nil, nil
-	}
+//
+// The backoff and match arguments are treated like in PopExpired(), but the
+// queue is not modified.
+func (r *RunningQueue) PeekExpired(backoff func(attempts int) time.Duration,
+	match func(t *Task) bool) (*Task, *Task, *time.Time) {
 	now := time.Now()
-	if task.expiration.After(now) {
-		exp := task.expiration
-		return nil, task.DisconnectedCopy(), &exp
-	} else {
-		return task.DisconnectedCopy(), nil, nil
+	var first, next *Task
+	var nextTime time.Time
+	visit := func(task *Task) bool {
+		if match != nil && !match(task) {
+			return true
+		}
+		available := task.expiration
+		if !available.After(now) && backoff != nil && !task.backedOff {
+			available = available.Add(backoff(task.attempts))
+		}
+		if !available.After(now) {
+			if first == nil || expiresBefore(task, first) {
+				first = task
+			}
+		} else if next == nil || available.Before(nextTime) {
+			next = task
+			nextTime = available
+		}
+		// Tasks below an unexpired task cannot be available sooner.
+		return !task.expiration.After(now)
 	}
+	r.expired.Visit(visit)
+	r.unexpired.Visit(visit)
+	if first != nil {
+		return first.DisconnectedCopy(), nil, nil
+	} else if next == nil {
+		return nil, nil, nil
+	}
+	return nil, next.DisconnectedCopy(), &nextTime
 }
 
 // Completed removes a task from the queue.
 //
 // If the task is no longer in the queue, for example if it was removed with
-// PopExpired(), this returns nil.
-func (r *RunningQueue) Completed(id string) *Task {
+// PopExpired(), or if lease is non-empty and does not match the task's lease,
+// this returns nil.
+func (r *RunningQueue) Completed(id, lease string) *Task {
 	task, ok := r.idToTask[id]
-	if !ok {
+	if !ok || (lease != "" && task.Lease != lease) {
 		return nil
 	}
-	r.deque.Remove(task)
+	r.remove(task)
 	delete(r.idToTask, id)
 	return task
 }
 
 // Keepalive restarts the timeout period for the identified task.
 //
-// Returns true if the task was found, or false otherwise.
-func (r *RunningQueue) Keepalive(id string, timeout *time.Duration) bool {
+// Returns the task if it was found (with a matching lease, if lease is
+// non-empty), or nil otherwise.
+func (r *RunningQueue) Keepalive(id, lease string, timeout *time.Duration) *Task {
 	task, ok := r.idToTask[id]
-	if !ok {
-		return false
+	if !ok || (lease != "" && task.Lease != lease) {
+		return nil
+	}
+	r.remove(task)
+	r.schedule(task, timeout)
+	return task
+}
+
+// List describes the first limit tasks to expire, or every task if limit is
+// zero.
+func (r *RunningQueue) List(limit int) []*RunningTaskInfo {
+	res := []*RunningTaskInfo{}
+	for _, t := range r.sorted(limit) {
+		res = append(res, &RunningTaskInfo{
+			ID:          t.ID,
+			Contents:    t.Contents,
+			Expiration:  t.expiration.UnixMilli(),
+			Created:     unixMilliOrZero(t.created),
+			Attempts:    t.attempts,
+			Progress:    t.progress.Copy(),
+			Annotations: copyAnnotations(t.annotations),
+			Reserved:    t.reserved,
+			Tags:        t.tags,
+			OrderingKey: t.orderingKey,
+			Producer:    t.producer,
+		})
+	}
+	return res
+}
+
+// sorted gets the first limit tasks to expire in order, or every task if
+// limit is zero.
+func (r *RunningQueue) sorted(limit int) []*Task {
+	expired := r.expired.Sorted(limit)
+	unexpired := r.unexpired.Sorted(limit)
+	res := make([]*Task, 0, len(expired)+len(unexpired))
+	for len(expired) > 0 || len(unexpired) > 0 {
+		if limit != 0 && len(res) == limit {
+			break
+		}
+		if len(unexpired) == 0 || (len(expired) > 0 && expiresBefore(expired[0], unexpired[0])) {
+			res = append(res, expired[0])
+			expired = expired[1:]
+		} else {
+			res = append(res, unexpired[0])
+			unexpired = unexpired[1:]
+		}
+	}
+	return res
+}
+
+// Iterate calls f on every running task, in no particular order.
+func (r *RunningQueue) Iterate(f func(t *Task)) {
+	for _, t := range r.expired {
+		f(t)
+	}
+	for _, t := range r.unexpired {
+		f(t)
 	}
-	r.deque.Remove(task)
-	r.StartedTask(task, timeout)
-	return true
 }
 
 // Len gets the number of tasks in the queue.
 func (r *RunningQueue) Len() int {
-	return r.deque.Len()
+	return r.expired.Len() + r.unexpired.Len()
 }
 
-// NumExpired gets the number of expired tasks.
-func (r *RunningQueue) NumExpired() int {
-	now := time.Now()
-	task := r.deque.first
-	n := 0
-	for task != nil && !task.expiration.After(now) {
-		n++
-		task = task.queueNext
-	}
+// NumExpired gets the number of tasks which are expired at time now.
+//
+// This only needs to look at the tasks which expired since the last Sweep().
+func (r *RunningQueue) NumExpired(now time.Time) int {
+	return r.expired.Len() + r.unexpired.CountExpired(now)
+}
+
+// NumBackingOff gets the number of expired tasks which are still waiting for
+// their backoff delay at time now, and so cannot be popped yet.
+//
+// Like NumExpired(), this only needs to look at the tasks which expired since
+// the last Sweep().
+func (r *RunningQueue) NumBackingOff(now time.Time) int {
+	n := r.numBackedOff
+	r.unexpired.Visit(func(t *Task) bool {
+		if t.expiration.After(now) {
+			return false
+		}
+		if t.backedOff {
+			n--
+		}
+		return true
+	})
 	return n
 }
 
-// ExpireAll changes the timeout for all tasks to be before now.
+// ExpireAll changes the timeout for all tasks to be before now, and ends
+// their current attempts.
+//
+// Every task gets the same expiration, so the tasks will be popped in the
+// order they were scheduled.
 func (r *RunningQueue) ExpireAll() int {
-	n := 0
-	for _, task := range r.idToTask {
-		n += 1
+	now := time.Now()
+	for _, task := range r.unexpired {
+		r.expired = append(r.expired, task)
+		r.countExpiration(task)
+	}
+	r.unexpired = nil
+	r.numBackedOff = 0
+	for i, task := range r.expired {
+		task.endAttempt(now)
 		task.expiration = time.Time{}
+		task.heapIndex = i
 	}
-	return n
+	r.expired.Reorder()
+	return len(r.expired)
+}
+
+// Expire changes the timeout for one task to be before now, like
+// ExpireAll(), so that it can be popped again immediately.
+//
+// Returns false if no running task had the given ID.
+func (r *RunningQueue) Expire(id string) bool {
+	task, ok := r.idToTask[id]
+	if !ok {
+		return false
+	}
+	r.remove(task)
+	task.endAttempt(time.Now())
+	task.expiration = time.Time{}
+	r.expired.Add(task)
+	r.countExpiration(task)
+	return true
 }
 
 // Clear deletes all of the running tasks.
 func (r *RunningQueue) Clear() {
 	r.idToTask = map[string]*Task{}
-	r.deque = &TaskDeque{}
+	r.expired = nil
+	r.unexpired = nil
+	r.numBackedOff = 0
 }
 
 type QueueCounts struct {
 	Pending      int64    `json:"pending"`
 	Running      int64    `json:"running"`
 	Expired      int64    `json:"expired"`
+	Delayed      int64    `json:"delayed"`
+	Held         int64    `json:"held"`
 	Completed    int64    `json:"completed"`
 	LastModified *int64   `json:"modtime,omitempty"`
 	Rate         *float64 `json:"rate,omitempty"`
+
+	// BackingOff is the number of expired tasks which are waiting for the
+	// context's backoff delay before they can be popped again. They are not
+	// counted as running or expired.
+	BackingOff int64 `json:"backingOff"`
+
+	// LastPushed, LastPopped, and LastCompleted are the Unix times in
+	// milliseconds when a task was last pushed, popped, and completed. Like
+	// LastModified, they are only set if requested, and are left unset if
+	// the event has not happened since the context was created or cleared.
+	LastPushed    *int64 `json:"lastPushed,omitempty"`
+	LastPopped    *int64 `json:"lastPopped,omitempty"`
+	LastCompleted *int64 `json:"lastCompleted,omitempty"`
+
+	PushRate *float64 `json:"pushRate,omitempty"`
+	PopRate  *float64 `json:"popRate,omitempty"`
+	ETA      *float64 `json:"eta,omitempty"`
+
+	// ExpireRate is the number of attempts per second which expired instead
+	// of being completed, and ExpiredFraction is the fraction of finished
+	// attempts which expired.
+	ExpireRate      *float64 `json:"expireRate,omitempty"`
+	ExpiredFraction *float64 `json:"expiredFraction,omitempty"`
+
+	// Latency is the moving average of the time between popping and
+	// completing each task. It is not included in aggregated totals.
+	Latency *float64 `json:"latency,omitempty"`
+
+	// Stuck is the number of running tasks which the last periodic check
+	// found to be stuck, as listed by /task/stuck.
+	Stuck int64 `json:"stuck"`
+}
+
+// UpdateETA estimates the number of seconds until all pending and running
+// tasks are completed, based on the completion rate minus the rate at which
+// new tasks are being pushed.
+//
+// The ETA is left unset if the rate is unknown, or if tasks are not being
+// completed faster than they are pushed.
+func (q *QueueCounts) UpdateETA() {
+	q.ETA = nil
+	if q.Rate == nil {
+		return
+	}
+	drainRate := *q.Rate
+	if q.PushRate != nil {
+		drainRate -= *q.PushRate
+	}
+	if drainRate > 0 {
+		eta := float64(q.Pending+q.Running+q.Expired+q.BackingOff+q.Delayed) / drainRate
+		q.ETA = &eta
+	}
+}
+
+// UpdateExpiredFraction computes the fraction of finished attempts which
+// expired rather than being completed, based on the completion and expiration
+// rates.
+//
+// The fraction is left unset if no attempts have finished.
+func (q *QueueCounts) UpdateExpiredFraction() {
+	q.ExpiredFraction = nil
+	if q.Rate == nil || q.ExpireRate == nil {
+		return
+	}
+	if total := *q.Rate + *q.ExpireRate; total > 0 {
+		frac := *q.ExpireRate / total
+		q.ExpiredFraction = &frac
+	}
+}
+
+// Add accumulates the counts from other into q.
+//
+// Rates are summed, and the latest modification time is kept. Latencies are
+// not accumulated, and derived fields like the ETA should be updated
+// afterwards.
+func (q *QueueCounts) Add(other *QueueCounts) {
+	q.Pending += other.Pending
+	q.Running += other.Running
+	q.Expired += other.Expired
+	q.BackingOff += other.BackingOff
+	q.Delayed += other.Delayed
+	q.Held += other.Held
+	q.Completed += other.Completed
+	q.Stuck += other.Stuck
+	addLatest(&q.LastModified, other.LastModified)
+	addLatest(&q.LastPushed, other.LastPushed)
+	addLatest(&q.LastPopped, other.LastPopped)
+	addLatest(&q.LastCompleted, other.LastCompleted)
+	addRate(&q.Rate, other.Rate)
+	addRate(&q.PushRate, other.PushRate)
+	addRate(&q.PopRate, other.PopRate)
+	addRate(&q.ExpireRate, other.ExpireRate)
+}
+
+func addLatest(dst **int64, src *int64) {
+	if src != nil && (*dst == nil || **dst < *src) {
+		t := *src
+		*dst = &t
+	}
+}
+
+func addRate(dst **float64, src *float64) {
+	if src != nil {
+		if *dst == nil {
+			*dst = new(float64)
+		}
+		**dst += *src
+	}
+}
+
+// A ContextError indicates that a context could not be used.
+type ContextError struct {
+	Code    string
+	Message string
+}
+
+func (c *ContextError) Error() string {
+	return c.Message
+}
+
+// LeaseInfo describes a running task after a keepalive.
+type LeaseInfo struct {
+	// Expiration is the Unix time in milliseconds when the task will expire.
+	Expiration int64 `json:"expiration"`
+
+	// Attempts is the number of times the task has been popped.
+	Attempts int `json:"attempts"`
+}
+
+// RunningTaskInfo describes an in-progress task.
+type RunningTaskInfo struct {
+	ID       string `json:"id"`
+	Contents string `json:"contents"`
+
+	// Expiration is the Unix time in milliseconds when the task will expire
+	// (or expired).
+	Expiration int64 `json:"expiration"`
+
+	// Created is the Unix time in milliseconds when the task was pushed, or
+	// zero if unknown (e.g. for tasks loaded from old save files).
+	Created int64 `json:"created,omitempty"`
+
+	// Attempts is the number of times the task has been popped.
+	Attempts int `json:"attempts"`
+
+	Progress *TaskProgress `json:"progress,omitempty"`
+
+	// Annotations are the metadata attached to the task with
+	// /task/annotate, if any.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Reserved is true if the task was reserved with /task/reserve and has
+	// not yet been accepted.
+	Reserved bool `json:"reserved,omitempty"`
+
+	// Tags are the capability tags required by the task, if any.
+	Tags []string `json:"tags,omitempty"`
+
+	// OrderingKey is the task's ordering key, if any.
+	OrderingKey string `json:"orderingKey,omitempty"`
+
+	// Producer is the producer which pushed the task, if any.
+	Producer string `json:"producer,omitempty"`
+}
+
+// optionalTime converts the zero time to nil, for fields which are omitted
+// when unset.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func timeOrZero(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+func optionalMillis(t time.Time) *int64 {
+	if t.IsZero() {
+		return nil
+	}
+	ms := t.UnixMilli()
+	return &ms
+}
+
+func unixMilliOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
 }
 
 type ContextState struct {
 	Name    string
 	Encoded *EncodedQueueState
+
+	// Deleted is set for queues in the trash, and is the time when the
+	// queue was cleared.
+	Deleted *time.Time `json:",omitempty"`
 }
 
 func (c *ContextState) WriteJSON(w io.Writer) error {
-	return WriteJSONObject(w, map[string]interface{}{
+	obj := map[string]interface{}{
 		"Name":    c.Name,
 		"Encoded": c.Encoded,
-	})
+	}
+	if c.Deleted != nil {
+		obj["Deleted"] = c.Deleted
+	}
+	return WriteJSONObject(w, obj)
 }
 
 type EncodedQueueState struct {
@@ -697,17 +1998,109 @@ type EncodedQueueState struct {
 	Completed    int64
 	LastModified *time.Time
 	RateTracker  *EncodedRateTracker
+
+	// PushRateTracker and PopRateTracker measure the rates at which tasks
+	// are pushed and popped, like RateTracker does for completions.
+	PushRateTracker *EncodedRateTracker `json:",omitempty"`
+	PopRateTracker  *EncodedRateTracker `json:",omitempty"`
+
+	// ExpireRateTracker measures the rate at which running tasks expire.
+	ExpireRateTracker *EncodedRateTracker `json:",omitempty"`
+
+	// Delayed stores requeued tasks, where each expiration is the time when
+	// the task will be moved back into the pending queue.
+	Delayed []EncodedTask `json:",omitempty"`
+
+	// Held stores pending tasks which were set aside by /task/hold.
+	Held []EncodedTask `json:",omitempty"`
+
+	Config *QueueConfig `json:",omitempty"`
+
+	// MeanLatency is the moving average of task latencies in seconds, used
+	// for autoscaling hints.
+	MeanLatency float64 `json:",omitempty"`
+
+	// LatencyVariance is the moving variance of task latencies.
+	LatencyVariance float64 `json:",omitempty"`
+
+	// Contents stores task contents which are shared by multiple tasks, and
+	// is referenced by EncodedTask.ContentsRef.
+	Contents []string `json:",omitempty"`
+
+	CompletedLog []*CompletedRecord `json:",omitempty"`
+
+	Groups map[string]*TaskGroup `json:",omitempty"`
+
+	// Waiting stores the tasks held back by their ordering keys until the
+	// oldest task with the same key is completed.
+	Waiting []EncodedTask `json:",omitempty"`
+
+	LastPushed    *time.Time `json:",omitempty"`
+	LastPopped    *time.Time `json:",omitempty"`
+	LastCompleted *time.Time `json:",omitempty"`
+}
+
+// Empty checks if the encoded queue has no tasks and no completions.
+func (e *EncodedQueueState) Empty() bool {
+	return len(e.Pending.Deque) == 0 && len(e.Running.Deque) == 0 && len(e.Delayed) == 0 &&
+		len(e.Held) == 0 && len(e.Waiting) == 0 && e.Completed == 0 && e.Config == nil
 }
 
 func (e *EncodedQueueState) WriteJSON(w io.Writer) error {
 	t := e.LastModified
-	return WriteJSONObject(w, map[string]interface{}{
+	obj := map[string]interface{}{
 		"Pending":      e.Pending,
 		"Running":      e.Running,
 		"Completed":    e.Completed,
 		"LastModified": &t,
 		"RateTracker":  e.RateTracker,
-	})
+	}
+	if e.PushRateTracker != nil {
+		obj["PushRateTracker"] = e.PushRateTracker
+	}
+	if e.PopRateTracker != nil {
+		obj["PopRateTracker"] = e.PopRateTracker
+	}
+	if e.ExpireRateTracker != nil {
+		obj["ExpireRateTracker"] = e.ExpireRateTracker
+	}
+	if len(e.Delayed) > 0 {
+		obj["Delayed"] = EncodedTaskList(e.Delayed)
+	}
+	if len(e.Held) > 0 {
+		obj["Held"] = EncodedTaskList(e.Held)
+	}
+	if e.Config != nil {
+		obj["Config"] = e.Config
+	}
+	if e.MeanLatency != 0 {
+		obj["MeanLatency"] = e.MeanLatency
+	}
+	if e.LatencyVariance != 0 {
+		obj["LatencyVariance"] = e.LatencyVariance
+	}
+	if len(e.Contents) > 0 {
+		obj["Contents"] = e.Contents
+	}
+	if len(e.CompletedLog) > 0 {
+		obj["CompletedLog"] = e.CompletedLog
+	}
+	if len(e.Groups) > 0 {
+		obj["Groups"] = e.Groups
+	}
+	if len(e.Waiting) > 0 {
+		obj["Waiting"] = EncodedTaskList(e.Waiting)
+	}
+	if e.LastPushed != nil {
+		obj["LastPushed"] = e.LastPushed
+	}
+	if e.LastPopped != nil {
+		obj["LastPopped"] = e.LastPopped
+	}
+	if e.LastCompleted != nil {
+		obj["LastCompleted"] = e.LastCompleted
+	}
+	return WriteJSONObject(w, obj)
 }
 
 type EncodedPendingQueue struct {
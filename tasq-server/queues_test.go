@@ -0,0 +1,494 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueStatePopReturnsCopy(t *testing.T) {
+	q := NewQueueState(time.Minute)
+	q.Push("a", 0)
+	first, _ := q.Pop(nil, nil)
+	lease := first.Lease
+	if !q.Requeue(first.ID, first.Lease, 0) {
+		t.Fatal("failed to requeue task")
+	}
+	second, _ := q.Pop(nil, nil)
+	if second == nil || second.ID != first.ID {
+		t.Fatalf("unexpected task: %v", second)
+	} else if first.Lease != lease || second.Lease == lease {
+		t.Fatal("popped task was changed by a later pop")
+	}
+
+	// Encoding popped tasks while they are popped again must not race.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				q.Requeue(first.ID, "", 0)
+				tasks, _ := q.PopBatch(1, 0, nil, nil)
+				if _, err := json.Marshal(TaskList(tasks)); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRunningQueueExpiration(t *testing.T) {
+	rng := rand.New(rand.NewSource(1338))
+	r := NewRunningQueue(time.Hour)
+	expired := -time.Second
+
+	// Backoff delays either end immediately or outlast the test.
+	backoff := func(attempts int) time.Duration {
+		if rng.Intn(2) == 0 {
+			return 0
+		}
+		return time.Hour
+	}
+
+	checkCounts := func(step int) {
+		now := time.Now()
+		var numExpired, numBackingOff int
+		for _, task := range r.idToTask {
+			if !task.expiration.After(now) {
+				numExpired++
+			} else if task.backedOff {
+				numBackingOff++
+			}
+		}
+		if r.Len() != len(r.idToTask) {
+			t.Fatalf("step %d: expected length %d but got %d", step, len(r.idToTask), r.Len())
+		}
+		if n := r.NumExpired(now); n != numExpired {
+			t.Fatalf("step %d: expected %d expired but got %d", step, numExpired, n)
+		}
+		if n := r.NumBackingOff(now); n != numBackingOff {
+			t.Fatalf("step %d: expected %d backing off but got %d", step, numBackingOff, n)
+		}
+		sorted := r.sorted(0)
+		for i := 1; i < len(sorted); i++ {
+			if expiresBefore(sorted[i], sorted[i-1]) {
+				t.Fatalf("step %d: running tasks are out of order", step)
+			}
+		}
+	}
+	randomID := func() string {
+		ids := make([]string, 0, len(r.idToTask))
+		for id := range r.idToTask {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return ids[rng.Intn(len(ids))]
+	}
+
+	for i := 0; i < 1000; i++ {
+		switch op := rng.Intn(7); {
+		case op == 0 || len(r.idToTask) == 0:
+			task := &Task{ID: strconv.Itoa(i)}
+			if rng.Intn(2) == 0 {
+				r.StartedTask(task, &expired)
+			} else {
+				r.StartedTask(task, nil)
+			}
+		case op == 1:
+			id := randomID()
+			if task := r.Completed(id, ""); task == nil || task.ID != id {
+				t.Fatalf("step %d: failed to remove task %s", i, id)
+			}
+		case op == 2:
+			// A keepalive moves an expired task back to the unexpired heap.
+			if r.Keepalive(randomID(), "", nil) == nil {
+				t.Fatalf("step %d: keepalive failed", i)
+			}
+		case op == 3:
+			if r.Keepalive(randomID(), "", &expired) == nil {
+				t.Fatalf("step %d: keepalive failed", i)
+			}
+		case op == 4:
+			if !r.Expire(randomID()) {
+				t.Fatalf("step %d: expire failed", i)
+			}
+		case op == 5:
+			r.Sweep(time.Now())
+		case op == 6:
+			if rng.Intn(10) == 0 {
+				if n := r.ExpireAll(); n != len(r.idToTask) {
+					t.Fatalf("step %d: expired %d of %d tasks", i, n, len(r.idToTask))
+				}
+			} else if task, _ := r.PopExpired(backoff, nil); task != nil {
+				if !task.expiration.Before(time.Now()) {
+					t.Fatalf("step %d: popped an unexpired task", i)
+				}
+			}
+		}
+		checkCounts(i)
+	}
+}
+
+func TestQueueStateOrderingKeys(t *testing.T) {
+	q := NewQueueState(time.Minute)
+	q.PushTasks([]string{"k1", "k2"}, 0, &PushOptions{OrderingKey: "k"})
+	q.PushTasks([]string{"other"}, 0, &PushOptions{OrderingKey: "j"})
+	q.Push("plain", 0)
+
+	popContents := func() string {
+		task, _ := q.Pop(nil, nil)
+		if task == nil {
+			return ""
+		}
+		return task.Contents
+	}
+	first, _ := q.Pop(nil, nil)
+	if first == nil || first.Contents != "k1" {
+		t.Fatalf("unexpected first task: %v", first)
+	}
+	if c1, c2, c3 := popContents(), popContents(), popContents(); c1 != "other" || c2 != "plain" || c3 != "" {
+		t.Fatalf("unexpected tasks while k1 is running: %q, %q, %q", c1, c2, c3)
+	}
+
+	// An expired task keeps its key, so it is popped again before the next
+	// task with the key.
+	if !q.Expire(first.ID) {
+		t.Fatal("failed to expire task")
+	}
+	retry, _ := q.Pop(nil, nil)
+	if retry == nil || retry.ID != first.ID {
+		t.Fatalf("expected k1 to be retried, but got %v", retry)
+	}
+	if c := popContents(); c != "" {
+		t.Fatalf("popped %q while k1 is running", c)
+	}
+
+	if !q.Completed(retry.ID, retry.Lease) {
+		t.Fatal("failed to complete task")
+	}
+	if c := popContents(); c != "k2" {
+		t.Fatalf("expected k2 after completing k1, but got %q", c)
+	}
+
+	// A held task keeps its key, even after the state is saved and loaded.
+	q = NewQueueState(time.Minute)
+	ids, _ := q.PushTasks([]string{"k1", "k2"}, 0, &PushOptions{OrderingKey: "k"})
+	if !q.Hold(ids[0]) {
+		t.Fatal("failed to hold task")
+	}
+	q = DecodeQueueState(q.Encode())
+	if c := popContents(); c != "" {
+		t.Fatalf("popped %q while k1 is held", c)
+	}
+	if !q.Unhold(ids[0]) {
+		t.Fatal("failed to unhold task")
+	}
+	if c1, c2 := popContents(), popContents(); c1 != "k1" || c2 != "" {
+		t.Fatalf("unexpected tasks after unholding k1: %q, %q", c1, c2)
+	}
+}
+
+func TestQueueStateTags(t *testing.T) {
+	q := NewQueueState(time.Minute)
+	q.PushTasks([]string{"gpu"}, 0, &PushOptions{Tags: []string{"gpu"}})
+	q.PushTasks([]string{"gpu-ssd"}, 0, &PushOptions{Tags: []string{"gpu", "ssd"}})
+	q.Push("plain", 0)
+
+	popContents := func(offered TagSet) string {
+		task, _ := q.Pop(nil, offered)
+		if task == nil {
+			return ""
+		}
+		q.Completed(task.ID, task.Lease)
+		return task.Contents
+	}
+	if c := popContents(nil); c != "plain" {
+		t.Fatalf("expected the untagged task, but got %q", c)
+	}
+	if c := popContents(TagSet{"ssd": true}); c != "" {
+		t.Fatalf("popped %q without offering every required tag", c)
+	}
+	if c := popContents(TagSet{"ssd": true, "gpu": true, "tpu": true}); c != "gpu" {
+		t.Fatalf("expected the oldest matching task, but got %q", c)
+	}
+	if c := popContents(TagSet{"gpu": true}); c != "" {
+		t.Fatalf("popped %q without offering every required tag", c)
+	}
+	if task, _ := q.Pop(nil, TagSet{"gpu": true, "ssd": true}); task == nil || task.Contents != "gpu-ssd" {
+		t.Fatalf("expected the remaining task, but got %v", task)
+	}
+
+	// Expired tasks are also only popped by workers offering their tags.
+	if n := q.ExpireAll(); n != 1 {
+		t.Fatalf("expected to expire 1 task, but expired %d", n)
+	}
+	if c := popContents(TagSet{"gpu": true}); c != "" {
+		t.Fatalf("popped expired task %q without offering every required tag", c)
+	}
+	if c := popContents(TagSet{"gpu": true, "ssd": true}); c != "gpu-ssd" {
+		t.Fatalf("expected the expired task, but got %q", c)
+	}
+}
+
+func TestQueueStateDoneWithHeld(t *testing.T) {
+	q := NewQueueState(time.Minute)
+	ids, _ := q.PushTasks([]string{"a", "b"}, 0, &PushOptions{OrderingKey: "k"})
+	q.PushTasks([]string{"gpu"}, 0, &PushOptions{Tags: []string{"gpu"}})
+	if !q.Hold(ids[0]) {
+		t.Fatal("failed to hold task")
+	}
+
+	// A worker which cannot pop the tagged task must keep retrying.
+	if task, nextTry := q.Pop(nil, nil); task != nil || nextTry == nil {
+		t.Fatalf("expected a retry, but got %v, %v", task, nextTry)
+	}
+	task, _ := q.Pop(nil, TagSet{"gpu": true})
+	q.Completed(task.ID, task.Lease)
+
+	// The held task, and the task waiting for its key, cannot be popped.
+	if task, nextTry := q.Pop(nil, nil); task != nil || nextTry != nil {
+		t.Fatalf("expected the queue to be done, but got %v, %v", task, nextTry)
+	}
+	if !q.Unhold(ids[0]) {
+		t.Fatal("failed to unhold task")
+	}
+	if task, _ := q.Pop(nil, nil); task == nil || task.ID != ids[0] {
+		t.Fatalf("expected the unheld task, but got %v", task)
+	}
+}
+
+func TestQueueStateReserve(t *testing.T) {
+	q := NewQueueState(time.Minute)
+	q.Push("a", 0)
+	q.Push("b", 0)
+
+	reserved, _ := q.Reserve(time.Minute, nil)
+	if reserved == nil || reserved.Contents != "a" {
+		t.Fatalf("unexpected reserved task: %v", reserved)
+	} else if running := q.running.List(0); len(running) != 1 || !running[0].Reserved {
+		t.Fatal("task is not marked as reserved")
+	}
+	if q.Accept(reserved.ID, "wrong", nil) != nil {
+		t.Fatal("accepted a reservation with the wrong lease")
+	}
+	if !q.Reject(reserved.ID, reserved.Lease) {
+		t.Fatal("failed to reject reservation")
+	}
+	if q.Reject(reserved.ID, reserved.Lease) {
+		t.Fatal("rejected a reservation twice")
+	}
+
+	// A rejected task goes to the end of the queue without counting as an
+	// attempt.
+	next, _ := q.Reserve(time.Minute, nil)
+	if next == nil || next.Contents != "b" {
+		t.Fatalf("expected b after rejecting a, but got %v", next)
+	}
+	again, _ := q.Reserve(time.Minute, nil)
+	if again == nil || again.ID != reserved.ID || again.attempts != 1 {
+		t.Fatalf("unexpected task after rejection: %v", again)
+	}
+
+	info := q.Accept(again.ID, again.Lease, nil)
+	if info == nil || info.Attempts != 1 {
+		t.Fatalf("unexpected lease info: %v", info)
+	}
+	if q.Accept(again.ID, again.Lease, nil) != nil {
+		t.Fatal("accepted a task twice")
+	}
+	if q.Reject(again.ID, again.Lease) {
+		t.Fatal("rejected an accepted task")
+	}
+	if !q.Completed(again.ID, again.Lease) {
+		t.Fatal("failed to complete accepted task")
+	}
+}
+
+func TestQueueStateLIFO(t *testing.T) {
+	q := NewQueueState(time.Minute)
+	q.Push("u1", 0)
+	q.PushTasks([]string{"t1"}, 0, &PushOptions{Tags: []string{"gpu"}})
+	q.Push("u2", 0)
+	q.Push("u3", 0)
+
+	popContents := func(offered TagSet, order PopOrder) string {
+		task, _ := q.PopOrdered(nil, offered, order)
+		if task == nil {
+			return ""
+		}
+		return task.Contents
+	}
+	if c := popContents(nil, OrderLIFO); c != "u3" {
+		t.Fatalf("expected the newest task, but got %q", c)
+	}
+	if c := popContents(nil, OrderFIFO); c != "u1" {
+		t.Fatalf("expected the oldest task, but got %q", c)
+	}
+	if c := popContents(TagSet{"gpu": true}, OrderLIFO); c != "u2" {
+		t.Fatalf("expected the newest task, but got %q", c)
+	}
+	if c := popContents(nil, OrderLIFO); c != "" {
+		t.Fatalf("popped %q without offering its tags", c)
+	}
+
+	// The context's configured order applies by default.
+	q.Push("u4", 0)
+	q.Push("u5", 0)
+	q.config.Order = string(OrderLIFO)
+	if c := popContents(TagSet{"gpu": true}, OrderDefault); c != "u5" {
+		t.Fatalf("expected the newest task, but got %q", c)
+	}
+	if c := popContents(TagSet{"gpu": true}, OrderDefault); c != "u4" {
+		t.Fatalf("expected the newest task, but got %q", c)
+	}
+	if c := popContents(TagSet{"gpu": true}, OrderDefault); c != "t1" {
+		t.Fatalf("expected the tagged task, but got %q", c)
+	}
+}
+
+func TestQueueStateFairOrder(t *testing.T) {
+	q := NewQueueState(time.Minute)
+	q.PushTasks([]string{"a1", "a2", "a3"}, 0, &PushOptions{Producer: "a"})
+	q.PushTasks([]string{"b1"}, 0, &PushOptions{Producer: "b"})
+	q.PushTasks([]string{"c1", "c2"}, 0, &PushOptions{Producer: "c", Tags: []string{"gpu"}})
+	q.Push("n1", 0)
+
+	var popped []string
+	for {
+		task, _ := q.PopOrdered(nil, TagSet{"gpu": true}, OrderFair)
+		if task == nil {
+			break
+		}
+		popped = append(popped, task.Contents)
+	}
+
+	// Producers take turns in order of name, starting after the empty
+	// producer shared by tasks without one, and each producer's tasks are
+	// popped in the order they were pushed.
+	expected := []string{"a1", "b1", "c1", "n1", "a2", "c2", "a3"}
+	if strings.Join(popped, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v but got %v", expected, popped)
+	}
+}
+
+func TestQueueStateInterner(t *testing.T) {
+	q := NewQueueState(time.Minute)
+	ids, _ := q.PushBatch([]string{"same", "same", "other"}, 0)
+	if !q.Hold(ids[2]) {
+		t.Fatal("failed to hold task")
+	}
+	if n := len(q.interner.entries); n != 2 {
+		t.Fatalf("expected 2 interned strings, but got %d", n)
+	}
+	for i := 0; i < 2; i++ {
+		task, _ := q.Pop(nil, nil)
+		q.Completed(task.ID, task.Lease)
+	}
+	if n := len(q.interner.entries); n != 1 {
+		t.Fatalf("expected 1 interned string, but got %d", n)
+	}
+
+	// Held tasks are interned again when decoded.
+	data, err := json.Marshal(q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obj EncodedQueueState
+	if err := json.Unmarshal(data, &obj); err != nil {
+		t.Fatal(err)
+	}
+	decoded := DecodeQueueState(&obj)
+	if !decoded.Unhold(ids[2]) {
+		t.Fatal("failed to unhold task")
+	}
+	task, _ := decoded.Pop(nil, nil)
+	decoded.Completed(task.ID, task.Lease)
+	if n := len(decoded.interner.entries); n != 0 {
+		t.Fatalf("expected no interned strings, but got %d", n)
+	}
+}
+
+func TestQueueStateReleasesCompleted(t *testing.T) {
+	q := NewQueueState(time.Minute)
+	q.PushBatch([]string{"a", "b"}, 0)
+	first, _ := q.Pop(nil, nil)
+	second, _ := q.Pop(nil, nil)
+	q.Annotate(first.ID, first.Lease, map[string]string{"k": "v"})
+	task := q.running.idToTask[first.ID]
+	if !q.Completed(first.ID, first.Lease) {
+		t.Fatal("failed to complete task")
+	}
+
+	// The finished task shares a slab with the running one, so it must not
+	// keep its contents or annotations alive.
+	if task.Contents != "" || task.annotations != nil {
+		t.Fatalf("completed task was not released: %v", task)
+	}
+	if first.Contents != "a" {
+		t.Fatal("popped copy was changed")
+	}
+	if running := q.running.idToTask[second.ID]; running == nil || running.Contents != "b" {
+		t.Fatal("running task was changed")
+	}
+}
+
+func BenchmarkQueueStatePush(b *testing.B) {
+	q := NewQueueState(time.Minute)
+	contents := strings.Repeat("x", 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.Push(contents, 0)
+	}
+}
+
+func BenchmarkQueueStatePushPopComplete(b *testing.B) {
+	q := NewQueueState(time.Minute)
+	contents := strings.Repeat("x", 64)
+	for i := 0; i < 10000; i++ {
+		q.Push(contents, 0)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.Push(contents, 0)
+		task, _ := q.Pop(nil, nil)
+		if !q.Completed(task.ID, task.Lease) {
+			b.Fatal("failed to complete task")
+		}
+	}
+}
+
+func BenchmarkQueueStatePopBatch(b *testing.B) {
+	q := NewQueueState(time.Minute)
+	contents := strings.Repeat("x", 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < 100; j++ {
+			q.Push(contents, 0)
+		}
+		b.StartTimer()
+		tasks, _ := q.PopBatch(100, 0, nil, nil)
+		for _, t := range tasks {
+			q.Completed(t.ID, t.Lease)
+		}
+	}
+}
+
+func BenchmarkQueueStateCountsManyRunning(b *testing.B) {
+	q := NewQueueState(time.Minute)
+	for i := 0; i < 10000; i++ {
+		q.Push("x", 0)
+		q.Pop(nil, nil)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.Counts(0, false)
+	}
+}
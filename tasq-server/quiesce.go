@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultQuiesceTimeout and maxQuiesceTimeout bound the time after which
+	// a quiesced server resumes by itself, in case the backup agent never
+	// calls /admin/resume.
+	defaultQuiesceTimeout = time.Minute
+	maxQuiesceTimeout     = time.Hour
+
+	// quiesceDrainTimeout limits the time that /admin/quiesce waits for
+	// requests which were already modifying the queues to finish.
+	quiesceDrainTimeout = 30 * time.Second
+)
+
+// A quiescer blocks requests which modify the queues while an external backup
+// is taken, and keeps track of the requests which are already in progress.
+type quiescer struct {
+	lock     sync.Mutex
+	inflight int
+
+	// resumed is non-nil while quiesced, and is closed when resuming.
+	resumed chan struct{}
+
+	// drained, if non-nil, is closed once inflight reaches zero.
+	drained chan struct{}
+
+	timer  *time.Timer
+	marker int64
+}
+
+// enter waits until the server is not quiesced, and then registers a request
+// which may modify the queues. It must be followed by a call to exit.
+func (q *quiescer) enter() {
+	for {
+		q.lock.Lock()
+		resumed := q.resumed
+		if resumed == nil {
+			q.inflight++
+			q.lock.Unlock()
+			return
+		}
+		q.lock.Unlock()
+		<-resumed
+	}
+}
+
+func (q *quiescer) exit() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.inflight--
+	if q.inflight == 0 && q.drained != nil {
+		close(q.drained)
+		q.drained = nil
+	}
+}
+
+// Quiesce blocks new modifications until Resume is called or the timeout
+// passes, and waits for modifications in progress to finish. If already
+// quiesced, the timeout is restarted.
+//
+// Returns the value of the global modification counter once the queues have
+// stopped changing, and whether this call started the quiesce (rather than
+// joining one which was already in effect).
+//
+// If the modifications in progress do not finish in time, an error is
+// returned, and the server is resumed if this call started the quiesce, so
+// that a quiesce held by another caller is not cut short.
+//
+// Only requests are blocked: as time passes, running tasks still expire and
+// delayed tasks still become due (though they are only moved into the
+// pending queue by a later pop), and background loops such as -idle-ttl may
+// still remove contexts.
+func (q *quiescer) Quiesce(timeout time.Duration) (int64, bool, error) {
+	q.lock.Lock()
+	started := q.resumed == nil
+	if started {
+		q.resumed = make(chan struct{})
+		resumed := q.resumed
+		q.timer = time.AfterFunc(timeout, func() {
+			if q.resume(resumed) {
+				logger.Warn("resuming after quiesce timeout", "timeout", timeout)
+			}
+		})
+	} else {
+		q.timer.Reset(timeout)
+	}
+	resumed := q.resumed
+	if q.inflight > 0 && q.drained == nil {
+		q.drained = make(chan struct{})
+	}
+	drained := q.drained
+	q.lock.Unlock()
+
+	if drained != nil {
+		select {
+		case <-drained:
+		case <-time.After(quiesceDrainTimeout):
+			if started {
+				q.resume(resumed)
+			}
+			return 0, started, errors.New("timed out waiting for requests in progress to finish")
+		}
+	}
+
+	marker := atomic.LoadInt64(&modificationCounter)
+	q.lock.Lock()
+	q.marker = marker
+	q.lock.Unlock()
+	return marker, started, nil
+}
+
+// Resume unblocks modifications, returning false if the server was not
+// quiesced.
+func (q *quiescer) Resume() bool {
+	return q.resume(nil)
+}
+
+// resume is like Resume, but if resumed is non-nil, it only resumes the
+// quiesce which created that channel, and not a later one.
+func (q *quiescer) resume(resumed chan struct{}) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.resumed == nil || (resumed != nil && q.resumed != resumed) {
+		return false
+	}
+	close(q.resumed)
+	q.resumed = nil
+	q.timer.Stop()
+	return true
+}
+
+// Marker gets the modification counter recorded by the last Quiesce().
+func (q *quiescer) Marker() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.marker
+}
+
+// BlockWhileQuiesced wraps the handler of an endpoint which modifies the
+// queues, so that requests wait while the server is quiesced.
+func (s *Server) BlockWhileQuiesced(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.quiescer.enter()
+		defer s.quiescer.exit()
+		h(w, r)
+	}
+}
+
+// A QuiesceResult describes the state of a quiesced server, so that backup
+// tools can check that the state did not change during a backup.
+type QuiesceResult struct {
+	// Marker is the global modification counter while quiesced. Resuming
+	// reports whether it has changed since.
+	Marker int64 `json:"marker"`
+
+	// Versions maps each context to its modification counter.
+	Versions map[string]int64 `json:"versions"`
+
+	// Deadline is the Unix time in milliseconds when the server will resume
+	// by itself.
+	Deadline int64 `json:"deadline"`
+
+	// Save describes the save which was performed after quiescing, if the
+	// server has a save path.
+	Save *SaveResult `json:"save,omitempty"`
+}
+
+func (s *Server) ServeQuiesce(w http.ResponseWriter, r *http.Request) {
+	if !s.AdminAuth(w, r) {
+		return
+	}
+	timeout := defaultQuiesceTimeout
+	if seconds, err := parseSecondsParam(r, "timeout"); err != nil {
+		serveError(w, err.Error())
+		return
+	} else if seconds != nil {
+		timeout = time.Duration(*seconds * float64(time.Second))
+		if timeout <= 0 || timeout > maxQuiesceTimeout {
+			serveError(w, "invalid 'timeout' requested")
+			return
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	marker, started, err := s.quiescer.Quiesce(timeout)
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+	logger.Info("quiesced", "timeout", timeout)
+	s.Audit(r, &AuditEntry{Op: "quiesce"})
+
+	result := &QuiesceResult{
+		Marker:   marker,
+		Versions: map[string]int64{},
+		Deadline: deadline.UnixMilli(),
+	}
+	s.Queues.Iterate(func(name string, qs *QueueState) {
+		result.Versions[name] = atomic.LoadInt64(&qs.version)
+	})
+	if s.SavePath != "" {
+		result.Save, err = s.Save()
+		if err != nil {
+			if started {
+				s.quiescer.Resume()
+			}
+			logger.Error("failed to save state", "path", s.SavePath, "error", err)
+			serveError(w, "failed to save state: "+err.Error())
+			return
+		}
+	}
+	serveObject(w, result)
+}
+
+func (s *Server) ServeResume(w http.ResponseWriter, r *http.Request) {
+	if !s.AdminAuth(w, r) {
+		return
+	}
+	// The counter is read before resuming, so that requests which were
+	// waiting do not count as changes made while quiesced.
+	marker := atomic.LoadInt64(&modificationCounter)
+	resumed := s.quiescer.Resume()
+	if resumed {
+		logger.Info("resumed after quiesce")
+		s.Audit(r, &AuditEntry{Op: "resume"})
+	}
+	serveObject(w, map[string]interface{}{
+		"resumed": resumed,
+		"marker":  marker,
+
+		// If the queues changed while quiesced (for example, because the
+		// quiesce timed out), a backup taken meanwhile may be inconsistent.
+		"unchanged": resumed && marker == s.quiescer.Marker(),
+	})
+}
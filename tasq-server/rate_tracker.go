@@ -9,7 +9,14 @@ const DefaultRateTrackerBins = 128
 
 // A RateTracker keeps a sliding window of event counts over the last
 // N seconds.
+//
+// Times are measured in seconds on the tracker's own clock, which starts at
+// the wall time when the tracker is created or decoded, but then advances
+// with the monotonic clock. This way, changes to the wall clock do not
+// corrupt the history.
 type RateTracker struct {
+	anchor       time.Time
+	anchorUnix   int64
 	firstBinTime int64
 	bins         []int64
 }
@@ -22,22 +29,52 @@ func NewRateTracker(historySize int) *RateTracker {
 	if historySize == 0 {
 		historySize = DefaultRateTrackerBins
 	}
-	return &RateTracker{
+	res := &RateTracker{
 		bins: make([]int64, historySize),
 	}
+	res.setAnchor(time.Now())
+	return res
 }
 
 // DecodeRateTracker loads an encoded RateTracker.
 // If the state is empty, a new rate tracker with DefaultRateTrackerBins is
 // created.
+//
+// If the state appears to have been saved in the future, e.g. because it was
+// saved on a machine whose clock was ahead of ours, the history is shifted so
+// that it ends now instead of being discarded.
 func DecodeRateTracker(state *EncodedRateTracker) *RateTracker {
+	return decodeRateTrackerAt(state, time.Now())
+}
+
+func decodeRateTrackerAt(state *EncodedRateTracker, now time.Time) *RateTracker {
 	if state == nil || len(state.Bins) == 0 {
 		return NewRateTracker(DefaultRateTrackerBins)
 	}
-	return &RateTracker{
+	res := &RateTracker{
 		firstBinTime: state.FirstBinTime,
 		bins:         state.Bins,
 	}
+	res.setAnchor(now)
+	savedAt := state.SavedAt
+	if savedAt == 0 {
+		// Saved before SavedAt was recorded.
+		savedAt = state.FirstBinTime + int64(len(state.Bins)) - 1
+	}
+	if skew := savedAt - res.anchorUnix; skew > 0 {
+		res.firstBinTime -= skew
+	}
+	return res
+}
+
+func (r *RateTracker) setAnchor(t time.Time) {
+	r.anchor = t
+	r.anchorUnix = t.Unix()
+}
+
+// now gets the current time in seconds on the tracker's clock.
+func (r *RateTracker) now() int64 {
+	return r.anchorUnix + int64(time.Since(r.anchor)/time.Second)
 }
 
 // Reset zeros out the counters.
@@ -54,7 +91,7 @@ func (r *RateTracker) HistorySize() int {
 
 // Add adds the count n to the current time bin.
 func (r *RateTracker) Add(n int64) {
-	r.AddAt(time.Now().Unix(), n)
+	r.AddAt(r.now(), n)
 }
 
 // AddAt is like Add, but allows the caller to specify the current time.
@@ -66,17 +103,36 @@ func (r *RateTracker) AddAt(curTime, n int64) {
 // Count retrieves the count over the last t seconds.
 // The t argument must be at most the history size passed to NewRateTracker.
 func (r *RateTracker) Count(t int) int64 {
-	return r.CountAt(time.Now().Unix(), t)
+	return r.CountAt(r.now(), t)
 }
 
 // CountAt is like Count, but allows the caller to specify the current time.
 func (r *RateTracker) CountAt(curTime int64, t int) int64 {
-	if t > len(r.bins) {
+	return r.CountRangeAt(curTime, 0, t)
+}
+
+// CountRange retrieves the count over a sub-window of the history, from end
+// seconds ago (exclusive) to start seconds ago (inclusive), where the current
+// second is 1 second ago. For example, CountRange(0, 60) is the same as
+// Count(60), and CountRange(60, 120) is the count over the minute before
+// that.
+//
+// The start argument must be at most the history size.
+func (r *RateTracker) CountRange(end, start int) int64 {
+	return r.CountRangeAt(r.now(), end, start)
+}
+
+// CountRangeAt is like CountRange, but allows the caller to specify the
+// current time.
+func (r *RateTracker) CountRangeAt(curTime int64, end, start int) int64 {
+	if start > len(r.bins) {
 		panic("too many seconds requested")
+	} else if end < 0 || end > start {
+		panic("invalid range")
 	}
 	r.truncateAndShift(curTime)
 	var res int64
-	for i := len(r.bins) - 1; i >= len(r.bins)-t; i-- {
+	for i := len(r.bins) - 1 - end; i >= len(r.bins)-start; i-- {
 		res += r.bins[i]
 	}
 	return res
@@ -85,6 +141,7 @@ func (r *RateTracker) CountAt(curTime int64, t int) int64 {
 func (r *RateTracker) Encode() *EncodedRateTracker {
 	return &EncodedRateTracker{
 		FirstBinTime: r.firstBinTime,
+		SavedAt:      r.now(),
 		Bins:         append([]int64{}, r.bins...),
 	}
 }
@@ -118,5 +175,10 @@ func (r *RateTracker) truncateAndShift(curTime int64) {
 
 type EncodedRateTracker struct {
 	FirstBinTime int64
-	Bins         []int64
+
+	// SavedAt is the time on the tracker's clock when it was encoded, which
+	// is used to detect clock skew when it is decoded.
+	SavedAt int64 `json:",omitempty"`
+
+	Bins []int64
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 )
 
 func TestRateTracker(t *testing.T) {
@@ -52,3 +53,67 @@ func TestRateTracker(t *testing.T) {
 		t.Fatalf("bad count: %d", count)
 	}
 }
+
+func BenchmarkRateTrackerAdd(b *testing.B) {
+	rt := NewRateTracker(0)
+	for i := 0; i < b.N; i++ {
+		rt.AddAt(int64(i/1000), 1)
+	}
+}
+
+func BenchmarkRateTrackerCount(b *testing.B) {
+	rt := NewRateTracker(0)
+	for i := 0; i < DefaultRateTrackerBins; i++ {
+		rt.AddAt(int64(i), int64(i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rt.CountAt(DefaultRateTrackerBins, DefaultRateTrackerBins)
+	}
+}
+
+func TestRateTrackerCountRange(t *testing.T) {
+	rt := NewRateTracker(10)
+	for i := int64(0); i < 10; i++ {
+		rt.AddAt(100+i, i)
+	}
+	if count := rt.CountRangeAt(109, 0, 3); count != 9+8+7 {
+		t.Fatalf("bad count: %d", count)
+	}
+	if count := rt.CountRangeAt(109, 2, 5); count != 7+6+5 {
+		t.Fatalf("bad count: %d", count)
+	}
+	if count := rt.CountRangeAt(109, 4, 4); count != 0 {
+		t.Fatalf("bad count: %d", count)
+	}
+}
+
+func TestRateTrackerDecodeSkew(t *testing.T) {
+	rt := NewRateTracker(10)
+	for i := int64(0); i < 10; i++ {
+		rt.AddAt(1000+i, 1)
+	}
+	encode := func(savedAt int64) *EncodedRateTracker {
+		encoded := rt.Encode()
+		encoded.SavedAt = savedAt
+		return encoded
+	}
+
+	// Loaded on a machine whose clock is 100 seconds behind.
+	decoded := decodeRateTrackerAt(encode(1009), time.Unix(909, 0))
+	if count := decoded.CountAt(909, 10); count != 10 {
+		t.Fatalf("bad count: %d", count)
+	}
+
+	// Loaded 3 seconds later on a machine with the same clock.
+	decoded = decodeRateTrackerAt(encode(1009), time.Unix(1012, 0))
+	if count := decoded.CountAt(1012, 10); count != 7 {
+		t.Fatalf("bad count: %d", count)
+	}
+
+	// Saved before SavedAt was recorded.
+	decoded = decodeRateTrackerAt(encode(0), time.Unix(909, 0))
+	if count := decoded.CountAt(909, 10); count != 10 {
+		t.Fatalf("bad count: %d", count)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+type readOnlyKey struct{}
+
+// AllowReadOnly wraps the handler of an endpoint which does not modify any
+// queues, so that BasicAuth also accepts the read-only credentials for it.
+func AllowReadOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, r.WithContext(context.WithValue(r.Context(), readOnlyKey{}, true)))
+	}
+}
+
+func readOnlyAllowed(r *http.Request) bool {
+	return r.Context().Value(readOnlyKey{}) != nil
+}
+
+// readOnlyCredentials gets the credentials for read-only endpoints, if any.
+func (s *Server) readOnlyCredentials() []Credentials {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	if s.ReadOnlyUsername == "" && s.ReadOnlyPassword == "" {
+		return nil
+	}
+	return []Credentials{{Username: s.ReadOnlyUsername, Password: s.ReadOnlyPassword}}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// reloadableFlags are the flags which take effect when the config file is
+// reloaded. Changes to other flags are ignored until the server restarts.
+var reloadableFlags = map[string]bool{
+	"auth-username":      true,
+	"auth-password":      true,
+	"auth-credentials":   true,
+	"readonly-username":  true,
+	"readonly-password":  true,
+	"admin-username":     true,
+	"admin-password":     true,
+	"min-timeout":        true,
+	"max-timeout":        true,
+	"max-contexts":       true,
+	"max-context-length": true,
+	"context-pattern":    true,
+}
+
+// UpdateSettings calls f to modify the settings of s which may change while
+// the server is running, such as credentials and timeout limits.
+func (s *Server) UpdateSettings(f func()) {
+	s.settingsLock.Lock()
+	defer s.settingsLock.Unlock()
+	f()
+}
+
+// credentials gets the first accepted credentials, which the server uses to
+// authenticate itself to a primary server.
+func (s *Server) credentials() (string, string) {
+	if accepted := s.acceptedCredentials(); len(accepted) > 0 {
+		return accepted[0].Username, accepted[0].Password
+	}
+	return "", ""
+}
+
+func (s *Server) adminCredentials() (string, string) {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	return s.AdminUsername, s.AdminPassword
+}
+
+func (s *Server) timeoutBounds() (time.Duration, time.Duration) {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	return s.MinTimeout, s.MaxTimeout
+}
+
+// ReloadOnSignal calls s.Reload whenever the process receives SIGHUP.
+func (s *Server) ReloadOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		logger.Info("reloading config file", "trigger", "SIGHUP")
+		if err := s.Reload(); err != nil {
+			logger.Error("failed to reload config file", "error", err)
+		}
+	}
+}
+
+// ServeReload reloads the config file, like SIGHUP.
+func (s *Server) ServeReload(w http.ResponseWriter, r *http.Request) {
+	if !s.AdminAuth(w, r) {
+		return
+	}
+	logger.Info("reloading config file", "trigger", "request")
+	if err := s.Reload(); err != nil {
+		logger.Error("failed to reload config file", "error", err)
+		serveError(w, err.Error())
+		return
+	}
+	s.Audit(r, &AuditEntry{Op: "reload"})
+	serveObject(w, true)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Rename moves the queue named from to the name to, keeping all of its tasks
+// (including running ones), counters, and settings.
+//
+// No operations can use either queue while it is renamed. The destination must
+// not exist, unless it is a fresh queue (see QueueState.Cleared()), in which
+// case it is replaced.
+func (q *QueueStateMux) Rename(from, to string) error {
+	q.saveLock.Lock()
+	defer q.saveLock.Unlock()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	qs, err := q.checkCopy(from, to)
+	if err != nil {
+		return err
+	}
+	if _, ok := q.queues[to]; !ok {
+		if err := q.checkName(to); err != nil {
+			return err
+		}
+	}
+	delete(q.queues, from)
+	q.forget(from, qs)
+	q.queues[to] = qs
+	qs.lock.Lock()
+	qs.modified()
+	qs.lock.Unlock()
+	return nil
+}
+
+// Clone creates a copy of the queue named from with the name to, including
+// all of its tasks (including running ones), counters, and settings.
+//
+// Running tasks keep their IDs and leases in the copy, so the same worker can
+// complete a task in both queues. Pending tasks pushed to the copy get IDs
+// with a new prefix, like after a restart.
+//
+// The destination must not exist, unless it is a fresh queue (see
+// QueueState.Cleared()), in which case it is replaced.
+func (q *QueueStateMux) Clone(from, to string) error {
+	q.saveLock.Lock()
+	defer q.saveLock.Unlock()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	qs, err := q.checkCopy(from, to)
+	if err != nil {
+		return err
+	}
+	if _, ok := q.queues[to]; !ok {
+		if err := q.checkNewName(to); err != nil {
+			return err
+		}
+	}
+	clone := DecodeQueueState(qs.Encode())
+	clone.modified()
+	q.queues[to] = clone
+	return nil
+}
+
+// checkCopy gets the source queue for Rename() or Clone(), or returns an error
+// if it cannot be moved or copied to the destination.
+//
+// The caller must hold the write lock.
+func (q *QueueStateMux) checkCopy(from, to string) (*QueueState, error) {
+	if from == to {
+		return nil, &ContextError{
+			Code:    "invalid_context_name",
+			Message: "source and destination contexts must differ",
+		}
+	}
+	if q.Storage != nil && (q.Storage.Handles(from) || q.Storage.Handles(to)) {
+		return nil, &ContextError{
+			Code:    "disk_backed_context",
+			Message: "disk-backed contexts cannot be renamed or cloned",
+		}
+	}
+	qs, ok := q.queues[from]
+	if !ok || qs.Cleared() {
+		return nil, &ContextError{
+			Code:    "unknown_context",
+			Message: "context does not exist: " + strconv.Quote(from),
+		}
+	}
+	if existing, ok := q.queues[to]; ok && !existing.Cleared() {
+		return nil, &ContextError{
+			Code:    "context_exists",
+			Message: "context already exists: " + strconv.Quote(to),
+		}
+	}
+	return qs, nil
+}
+
+func (s *Server) ServeRenameContext(w http.ResponseWriter, r *http.Request) {
+	s.serveCopyContext(w, r, "rename", s.Queues.Rename)
+}
+
+func (s *Server) ServeCloneContext(w http.ResponseWriter, r *http.Request) {
+	s.serveCopyContext(w, r, "clone", s.Queues.Clone)
+}
+
+func (s *Server) serveCopyContext(w http.ResponseWriter, r *http.Request, op string,
+	f func(from, to string) error) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	from := r.FormValue("from")
+	to := r.FormValue("to")
+	if err := f(from, to); err != nil {
+		serveContextError(w, err)
+		return
+	}
+	s.Audit(r, &AuditEntry{Op: op, Context: from, Target: to})
+	serveObject(w, true)
+}
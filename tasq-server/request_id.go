@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestIDHeader identifies a request in the request log, the audit log, and
+// the response, so that problems can be traced back to the client which
+// caused them.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength limits the length of client-supplied request IDs.
+const maxRequestIDLength = 128
+
+// RequestIDHandler wraps h to echo the request ID of each request in the
+// response, generating a new ID if the client did not supply a valid one.
+//
+// The request's header is updated with the generated ID, so that handlers
+// can use it.
+func RequestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = generateRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func generateRequestID() string {
+	var data [8]byte
+	readRandom(data[:])
+	return hex.EncodeToString(data[:])
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the latency histogram
+// bins kept by RequestMetrics. An implicit final bin catches the rest.
+var LatencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// RequestMetrics tracks request counts, latencies, and status codes for each
+// endpoint of the server.
+type RequestMetrics struct {
+	lock      sync.Mutex
+	endpoints map[string]*EndpointMetrics
+}
+
+// NewRequestMetrics creates an empty RequestMetrics.
+func NewRequestMetrics() *RequestMetrics {
+	return &RequestMetrics{endpoints: map[string]*EndpointMetrics{}}
+}
+
+// Handler wraps h to record metrics for every request.
+//
+// Requests are grouped by the route they match in router, so that arbitrary
+// unknown paths do not create new groups.
+func (m *RequestMetrics) Handler(router *Router, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pattern := router.Pattern(r)
+		mw := &metricsResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		t1 := time.Now()
+		h.ServeHTTP(mw, r)
+		m.record(pattern, mw.status, mw.errored, time.Now().Sub(t1))
+	})
+}
+
+// Summary gets a JSON-serializable copy of the metrics, keyed by endpoint.
+func (m *RequestMetrics) Summary() map[string]*EndpointMetrics {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := make(map[string]*EndpointMetrics, len(m.endpoints))
+	for name, em := range m.endpoints {
+		statuses := make(map[string]int64, len(em.Statuses))
+		for k, v := range em.Statuses {
+			statuses[k] = v
+		}
+		res[name] = &EndpointMetrics{
+			Count:        em.Count,
+			Errors:       em.Errors,
+			Statuses:     statuses,
+			TotalLatency: em.TotalLatency,
+			Latency:      append([]int64{}, em.Latency...),
+		}
+	}
+	return res
+}
+
+func (m *RequestMetrics) record(endpoint string, status int, errored bool,
+	latency time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	em, ok := m.endpoints[endpoint]
+	if !ok {
+		em = &EndpointMetrics{
+			Statuses: map[string]int64{},
+			Latency:  make([]int64, len(LatencyBuckets)+1),
+		}
+		m.endpoints[endpoint] = em
+	}
+	em.Count++
+	if errored || status >= 400 {
+		em.Errors++
+	}
+	em.Statuses[strconv.Itoa(status)]++
+	seconds := latency.Seconds()
+	em.TotalLatency += seconds
+	bin := len(LatencyBuckets)
+	for i, bound := range LatencyBuckets {
+		if seconds <= bound {
+			bin = i
+			break
+		}
+	}
+	em.Latency[bin]++
+}
+
+// EndpointMetrics stores the metrics for a single endpoint.
+type EndpointMetrics struct {
+	Count int64 `json:"count"`
+
+	// Errors counts responses with an error status or an error object.
+	Errors int64 `json:"errors"`
+
+	// Statuses maps HTTP status codes to counts.
+	Statuses map[string]int64 `json:"statuses"`
+
+	// TotalLatency is the sum of all request latencies in seconds.
+	TotalLatency float64 `json:"totalLatency"`
+
+	// Latency is a histogram with bins corresponding to LatencyBuckets.
+	Latency []int64 `json:"latency"`
+}
+
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	errored bool
+}
+
+func (m *metricsResponseWriter) WriteHeader(status int) {
+	m.status = status
+	m.ResponseWriter.WriteHeader(status)
+}
+
+// markError is called by serveError, since most errors are served with a
+// 200 status code.
+func (m *metricsResponseWriter) markError() {
+	m.errored = true
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+)
+
+// defaultReservation is how long a reserved task is held for its worker to
+// accept or reject it, if the worker does not specify a window.
+const defaultReservation = 30 * time.Second
+
+// Reserve pops a task like Pop(), but marks it as reserved and only holds it
+// for the given window, during which the worker should call Accept() or
+// Reject().
+func (q *QueueState) Reserve(window time.Duration, offered TagSet) (*Task, *time.Time) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	task, nextTry := q.pop(&window, offered, OrderDefault)
+	if task != nil {
+		task.reserved = true
+		task = task.LeasedCopy()
+	}
+	return task, nextTry
+}
+
+// Accept gives a reserved task a full lease, restarting its timeout period as
+// if it had just been popped with the given timeout.
+//
+// Returns nil if no reserved task with the given ID (and lease, if non-empty)
+// was in the running queue.
+func (q *QueueState) Accept(id, lease string, timeout *time.Duration) *LeaseInfo {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	task, ok := q.running.idToTask[id]
+	if !ok || !task.reserved || (lease != "" && task.Lease != lease) {
+		return nil
+	}
+	task.reserved = false
+	task.timeout = 0
+	q.running.Keepalive(id, lease, q.leaseTimeout(timeout))
+	q.modified()
+	return &LeaseInfo{
+		Expiration: task.expiration.UnixMilli(),
+		Attempts:   task.attempts,
+	}
+}
+
+// Reject puts a reserved task back at the end of the pending queue, without
+// counting the reservation as an attempt.
+//
+// Returns false if no reserved task with the given ID (and lease, if
+// non-empty) was in the running queue.
+func (q *QueueState) Reject(id, lease string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	task, ok := q.running.idToTask[id]
+	if !ok || !task.reserved || (lease != "" && task.Lease != lease) {
+		return false
+	}
+	q.running.Completed(id, lease)
+	task.reserved = false
+	task.attempts--
+	task.popped = time.Time{}
+	q.pending.PushTask(task)
+	q.modified()
+	return true
+}
+
+func (s *Server) ServeReserveTask(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	window := defaultReservation
+	if seconds, err := parseSecondsParam(r, "window"); err != nil {
+		serveError(w, err.Error())
+		return
+	} else if seconds != nil {
+		window = time.Duration(*seconds * float64(time.Second))
+		if window <= 0 {
+			serveError(w, "window must be at least one millisecond")
+			return
+		}
+	}
+	offered, err := tagsParam(r)
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	}
+
+	var task *Task
+	var nextTry *time.Time
+	var timeoutErr error
+	err = s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		if timeoutErr = qs.CheckTimeout(&window); timeoutErr == nil {
+			task, nextTry = qs.Reserve(window, NewTagSet(offered))
+		}
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	} else if timeoutErr != nil {
+		serveError(w, timeoutErr.Error())
+		return
+	}
+	if task != nil {
+		s.Audit(r, &AuditEntry{Op: "reserve", IDs: []string{task.ID}})
+		serveObject(w, task)
+	} else if nextTry != nil {
+		serveObject(w, map[string]interface{}{
+			"done":  false,
+			"retry": math.Max(0, time.Until(*nextTry).Seconds()),
+		})
+	} else {
+		serveObject(w, map[string]interface{}{"done": true})
+	}
+}
+
+func (s *Server) ServeAcceptTask(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	timeout, timeoutOk := s.TimeoutParam(w, r)
+	if !timeoutOk {
+		return
+	}
+	id := r.FormValue("id")
+	lease := r.FormValue("lease")
+
+	var info *LeaseInfo
+	var timeoutErr error
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		if timeoutErr = qs.CheckTimeout(timeout); timeoutErr == nil {
+			info = qs.Accept(id, lease, timeout)
+		}
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	} else if timeoutErr != nil {
+		serveError(w, timeoutErr.Error())
+		return
+	}
+	if info != nil {
+		s.Audit(r, &AuditEntry{Op: "accept", IDs: []string{id}})
+		serveObject(w, info)
+	} else {
+		serveMissingReservation(w, lease)
+	}
+}
+
+func (s *Server) ServeRejectTask(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	id := r.FormValue("id")
+	lease := r.FormValue("lease")
+	var ok bool
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		ok = qs.Reject(id, lease)
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
+	if ok {
+		s.Audit(r, &AuditEntry{Op: "reject", IDs: []string{id}})
+		serveObject(w, true)
+	} else {
+		serveMissingReservation(w, lease)
+	}
+}
+
+func serveMissingReservation(w http.ResponseWriter, lease string) {
+	if lease != "" {
+		serveError(w, "there was no reserved task with the specified `id` and `lease`")
+	} else {
+		serveError(w, "there was no reserved task with the specified `id`")
+	}
+}
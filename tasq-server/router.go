@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A Router dispatches requests under a path prefix to the handler registered
+// for their exact path, checking the request method.
+//
+// Unlike http.ServeMux, paths which are not in canonical form (for example,
+// containing "..", ".", or repeated slashes) are never resolved to a handler,
+// so that requests cannot escape the prefix. Registering the same path twice
+// panics, rather than silently replacing a handler.
+type Router struct {
+	prefix   string
+	exact    map[string]*routerEntry
+	subtrees map[string]*routerEntry
+
+	// NotFound, if non-nil, handles requests for unknown paths under the
+	// prefix.
+	NotFound http.HandlerFunc
+}
+
+type routerEntry struct {
+	handler http.HandlerFunc
+	methods []string
+}
+
+// NewRouter creates a Router for paths under prefix, which must begin and end
+// with a slash.
+func NewRouter(prefix string) *Router {
+	return &Router{
+		prefix:   prefix,
+		exact:    map[string]*routerEntry{},
+		subtrees: map[string]*routerEntry{},
+	}
+}
+
+// Handle registers h for the path relative to the prefix. The empty path
+// refers to the prefix itself, which is also reached without its trailing
+// slash.
+//
+// If methods is non-empty, requests with other methods get a 405 response.
+func (r *Router) Handle(relPath string, methods []string, h http.HandlerFunc) {
+	if _, ok := r.exact[relPath]; ok {
+		panic("duplicate route: " + r.prefix + relPath)
+	}
+	r.exact[relPath] = &routerEntry{handler: h, methods: methods}
+}
+
+// HandleSubtree registers h for every path beginning with relPath, which must
+// end with a slash. Longer subtrees take precedence over shorter ones.
+func (r *Router) HandleSubtree(relPath string, h http.HandlerFunc) {
+	if !strings.HasSuffix(relPath, "/") {
+		panic("subtree route must end with a slash: " + r.prefix + relPath)
+	} else if _, ok := r.subtrees[relPath]; ok {
+		panic("duplicate route: " + r.prefix + relPath)
+	}
+	r.subtrees[relPath] = &routerEntry{handler: h}
+}
+
+// Pattern gets a name for the route which handles the request, or "" if no
+// route does. This is used to group requests, e.g. for metrics, without
+// creating a group for every unknown path.
+func (r *Router) Pattern(req *http.Request) string {
+	relPath, ok := r.relativePath(req.URL.Path)
+	if !ok {
+		return ""
+	}
+	if _, ok := r.exact[relPath]; ok {
+		return r.prefix + relPath
+	}
+	if subtree := r.subtree(relPath); subtree != "" {
+		return r.prefix + subtree
+	}
+	return ""
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	relPath, ok := r.relativePath(req.URL.Path)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	entry, ok := r.exact[relPath]
+	if !ok {
+		if subtree := r.subtree(relPath); subtree != "" {
+			entry = r.subtrees[subtree]
+		}
+	}
+	if entry == nil {
+		if r.NotFound != nil {
+			r.NotFound(w, req)
+		} else {
+			http.NotFound(w, req)
+		}
+		return
+	}
+	if len(entry.methods) > 0 && !entry.allows(req.Method) {
+		w.Header().Set("allow", strings.Join(entry.methods, ", "))
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "method " + req.Method + " not allowed; use " + strings.Join(entry.methods, " or "),
+		})
+		return
+	}
+	entry.handler(w, req)
+}
+
+// relativePath strips the prefix from a request path, returning false if the
+// path is outside of the prefix or is not in canonical form.
+func (r *Router) relativePath(p string) (string, bool) {
+	if p+"/" == r.prefix {
+		return "", true
+	}
+	if !strings.HasPrefix(p, r.prefix) {
+		return "", false
+	}
+	if cleaned := path.Clean(p); cleaned != p && cleaned+"/" != p {
+		return "", false
+	}
+	return p[len(r.prefix):], true
+}
+
+// subtree finds the longest subtree containing relPath, or "" if there is
+// none.
+func (r *Router) subtree(relPath string) string {
+	var matches []string
+	for subtree := range r.subtrees {
+		if strings.HasPrefix(relPath, subtree) {
+			matches = append(matches, subtree)
+		}
+	}
+	if len(matches) == 0 {
+		return ""
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return len(matches[i]) > len(matches[j])
+	})
+	return matches[0]
+}
+
+func (e *routerEntry) allows(method string) bool {
+	for _, m := range e.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
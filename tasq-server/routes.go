@@ -0,0 +1,813 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// A Route describes an API endpoint, both for registering it and for
+// documenting it in /openapi.json.
+type Route struct {
+	// Path is relative to the server's path prefix.
+	Path    string
+	Handler http.HandlerFunc
+	Summary string
+	Params  []*RouteParam
+
+	// Body, if non-empty, describes the request body.
+	Body string
+
+	// BodyType is the type of the request body. If empty, the body is a JSON
+	// array.
+	BodyType string
+
+	// ContentType is the type of successful responses, which defaults to
+	// application/json.
+	ContentType string
+
+	// Public is true for endpoints which do not require authentication.
+	Public bool
+
+	// ReadOnly is true for endpoints which do not modify any queues, which
+	// accept the read-only credentials. Endpoints which are neither ReadOnly
+	// nor Public must be called with POST, so that they cannot be triggered
+	// by following a link or loading an image.
+	ReadOnly bool
+
+	// AllowGet is true for endpoints which are neither ReadOnly nor Public,
+	// but which may still be called with GET: either because they only
+	// change anything when called with POST, or because workers have always
+	// called them with GET, like task/pop. Such GET requests are still
+	// checked by RequireCSRF, so browsers cannot be tricked into making them.
+	AllowGet bool
+
+	// ReadOnlyGet is true for endpoints which only read when called with
+	// GET, and change something when called with POST. GET requests are
+	// handled like ReadOnly endpoints, so the handler must refuse to change
+	// anything unless the request is POSTed.
+	ReadOnlyGet bool
+
+	// Admin is true for endpoints which operators use to manage queues,
+	// rather than workers and producers pushing individual tasks. With
+	// -admin-addr, they are only served on the admin address.
+	Admin bool
+
+	// DuringQuiesce is true for endpoints which are not ReadOnly, but which
+	// do not modify the queues either, so they keep working while the server
+	// is quiesced by /admin/quiesce. Other endpoints which are not ReadOnly
+	// or Public wait until the server resumes.
+	DuringQuiesce bool
+}
+
+// Methods gets the HTTP methods accepted by the route, or nil if any method
+// is accepted.
+func (r *Route) Methods() []string {
+	if r.ReadOnly || r.Public || r.AllowGet || r.ReadOnlyGet {
+		return nil
+	}
+	return []string{http.MethodPost}
+}
+
+// A RouteParam describes a query (or form) parameter of a Route.
+type RouteParam struct {
+	Name        string
+	Type        string
+	Description string
+	Required    bool
+}
+
+var contextParam = &RouteParam{
+	Name:        "context",
+	Type:        "string",
+	Description: "name of the queue; defaults to the default context",
+}
+
+var idParam = &RouteParam{
+	Name:        "id",
+	Type:        "string",
+	Description: "ID of the task",
+	Required:    true,
+}
+
+var leaseParam = &RouteParam{
+	Name:        "lease",
+	Type:        "string",
+	Description: "if specified, only affect the task if it has not been popped again since receiving this lease",
+}
+
+var workerParam = &RouteParam{
+	Name:        "worker",
+	Type:        "string",
+	Description: "name of the worker, recorded in the completed log",
+}
+
+var groupParam = &RouteParam{
+	Name:        "group",
+	Type:        "string",
+	Description: "if specified, add the tasks to this group",
+}
+
+var requiredTagsParam = &RouteParam{
+	Name:        "tags",
+	Type:        "string",
+	Description: "comma-separated capability tags which workers must offer to pop the tasks",
+}
+
+var copyContextParams = []*RouteParam{
+	{Name: "from", Type: "string", Description: "the name of the existing context"},
+	{Name: "to", Type: "string", Description: "the name of the new context"},
+}
+
+var orderingKeyParam = &RouteParam{
+	Name:        "orderingKey",
+	Type:        "string",
+	Description: "if specified, run the tasks one at a time and in order with other tasks with this key",
+}
+
+var producerParam = &RouteParam{
+	Name:        "producer",
+	Type:        "string",
+	Description: "if specified, the submitter of the tasks, which fair pops take turns between",
+}
+
+var pushDelayParam = &RouteParam{
+	Name:        "delay",
+	Type:        "number",
+	Description: "if specified, seconds before the tasks can be popped",
+}
+
+var offeredTagsParam = &RouteParam{
+	Name:        "tags",
+	Type:        "string",
+	Description: "comma-separated capability tags offered by the worker, which must include every tag required by a task to pop it",
+}
+
+var orderParamSpec = &RouteParam{
+	Name:        "order",
+	Type:        "string",
+	Description: "fifo to pop the oldest pending task first, lifo to pop the newest, or fair to take turns between producers; defaults to the context's setting",
+}
+
+var timeoutParam = &RouteParam{
+	Name:        "timeout",
+	Type:        "number",
+	Description: "seconds until the task expires, overriding the server's default",
+}
+
+// Routes lists the API endpoints of the server.
+func (s *Server) Routes() []*Route {
+	return []*Route{
+		{
+			Path:        "summary",
+			Handler:     s.ServeSummary,
+			Summary:     "Get a textual overview of all the queues, or a JSON list of the names and counts of the contexts with format=json.",
+			ContentType: "text/plain",
+			Params: []*RouteParam{
+				{Name: "format", Type: "string", Description: "text (the default) or json"},
+				{Name: "prefix", Type: "string", Description: "only include contexts with this prefix"},
+				{Name: "window", Type: "integer", Description: "with format=json, seconds over which to measure the completion rate"},
+			},
+			ReadOnly: true,
+		},
+		{
+			Path:    "counts",
+			Handler: s.ServeCounts,
+			Summary: "Get the number of tasks in each state.",
+			Params: []*RouteParam{
+				contextParam,
+				{Name: "all", Type: "string", Description: "set to 1 to get the counts of every context"},
+				{Name: "prefix", Type: "string", Description: "with all=1, only include contexts with this prefix"},
+				{Name: "aggregate", Type: "string", Description: "set to 1 to include counts summed across contexts"},
+				{Name: "window", Type: "integer", Description: "seconds over which to measure the completion rate"},
+				{Name: "includeModtime", Type: "string", Description: "set to 1 to include the modification time and the last push, pop, and completion times"},
+				{Name: "fresh", Type: "string", Description: "with all=1, set to 1 to bypass the counts cache"},
+			},
+			ReadOnly: true,
+		},
+		{
+			Path:     "stats",
+			Handler:  s.ServeStats,
+			Summary:  "Get server statistics and per-endpoint request metrics.",
+			ReadOnly: true,
+		},
+		{
+			Path:    "counts/delta",
+			Handler: s.ServeCountsDelta,
+			Summary: "Get the counts of the contexts modified since a cursor.",
+			Params: []*RouteParam{
+				{Name: "context", Type: "string", Description: "context names to include, where * matches anything (default *)"},
+				{Name: "since", Type: "string", Description: "the cursor from the previous response"},
+				{Name: "window", Type: "integer", Description: "seconds over which to measure the completion rate"},
+			},
+			ReadOnly: true,
+		},
+		{
+			Path:    "autoscale",
+			Handler: s.ServeAutoscale,
+			Summary: "Suggest a number of workers for a context.",
+			Params: []*RouteParam{
+				contextParam,
+				{Name: "drainTime", Type: "number", Description: "seconds in which to finish the remaining tasks, overriding the context's setting"},
+			},
+			ReadOnly: true,
+		},
+		{
+			Path:    "task/push",
+			Handler: s.ServePushTask,
+			Summary: "Add a task to the queue and get its ID. The parameters may instead be POSTed as a JSON object with a contents field, in which case the response is an object with the pushed task's id and checksum.",
+			Params: []*RouteParam{
+				contextParam,
+				{Name: "contents", Type: "string", Description: "contents of the task", Required: true},
+				{Name: "limit", Type: "integer", Description: "if non-zero, fail if the queue has this many tasks"},
+				groupParam,
+				requiredTagsParam,
+				orderingKeyParam,
+				pushDelayParam,
+				producerParam,
+			},
+		},
+		{
+			Path:    "task/push_batch",
+			Handler: s.ServePushBatch,
+			Summary: "Add multiple tasks to the queue and get their IDs.",
+			Params: []*RouteParam{
+				contextParam,
+				{Name: "limit", Type: "integer", Description: "if non-zero, fail if the queue would exceed this many tasks"},
+				groupParam,
+				requiredTagsParam,
+				orderingKeyParam,
+				pushDelayParam,
+				producerParam,
+			},
+			Body: "JSON array of task contents",
+		},
+		{
+			Path:     "task/pop",
+			Handler:  s.ServePopTask,
+			Summary:  "Pop a task, or get the number of seconds to wait before retrying.",
+			Params:   []*RouteParam{contextParam, timeoutParam, offeredTagsParam, orderParamSpec},
+			AllowGet: true,
+		},
+		{
+			Path:    "task/pop_batch",
+			Handler: s.ServePopBatch,
+			Summary: "Pop multiple tasks at once.",
+			Params: []*RouteParam{
+				contextParam,
+				timeoutParam,
+				{Name: "count", Type: "integer", Description: "maximum number of tasks to pop", Required: true},
+				{Name: "maxBytes", Type: "integer", Description: "if non-zero, maximum total size of task contents"},
+				offeredTagsParam,
+				orderParamSpec,
+			},
+		},
+		{
+			Path:    "task/pop_any",
+			Handler: s.ServePopAny,
+			Summary: "Pop a task from any context with the given prefix, sharing tasks between contexts by weight.",
+			Params: []*RouteParam{
+				{Name: "prefix", Type: "string", Description: "only pop from contexts whose names start with this prefix"},
+				timeoutParam,
+				offeredTagsParam,
+			},
+			AllowGet: true,
+		},
+		{
+			Path:    "task/reserve",
+			Handler: s.ServeReserveTask,
+			Summary: "Pop a task with a short provisional lease, which must be accepted or rejected.",
+			Params: []*RouteParam{
+				contextParam,
+				{Name: "window", Type: "number", Description: "seconds to hold the reservation; defaults to 30"},
+				offeredTagsParam,
+			},
+			AllowGet: true,
+		},
+		{
+			Path:    "task/accept",
+			Handler: s.ServeAcceptTask,
+			Summary: "Accept a reserved task, giving it a full lease.",
+			Params:  []*RouteParam{contextParam, idParam, leaseParam, timeoutParam},
+		},
+		{
+			Path:    "task/reject",
+			Handler: s.ServeRejectTask,
+			Summary: "Put a reserved task back into the queue without counting an attempt.",
+			Params:  []*RouteParam{contextParam, idParam, leaseParam},
+		},
+		{
+			Path:    "task/hold",
+			Handler: s.ServeHoldTask,
+			Summary: "Set a pending or in-progress task aside so that it is skipped by pops.",
+			Params:  []*RouteParam{contextParam, idParam},
+			Admin:   true,
+		},
+		{
+			Path:    "task/expire",
+			Handler: s.ServeExpireTask,
+			Summary: "Expire an in-progress task so it can be popped again immediately.",
+			Params:  []*RouteParam{contextParam, idParam},
+			Admin:   true,
+		},
+		{
+			Path:    "task/unhold",
+			Handler: s.ServeUnholdTask,
+			Summary: "Put a held task back at the end of the pending queue.",
+			Params:  []*RouteParam{contextParam, idParam},
+			Admin:   true,
+		},
+		{
+			Path:     "task/held",
+			Handler:  s.ServeHeldTasks,
+			Summary:  "List the held tasks.",
+			Params:   []*RouteParam{contextParam},
+			ReadOnly: true,
+		},
+		{
+			Path:    "task/sample",
+			Handler: s.ServeSampleTasks,
+			Summary: "Get a random sample of the tasks in one state.",
+			Params: []*RouteParam{
+				contextParam,
+				{Name: "n", Type: "integer", Description: "maximum number of tasks to sample (default 10)"},
+				{Name: "state", Type: "string", Description: "one of pending (the default), running, expired, delayed, or held"},
+			},
+			ReadOnly: true,
+		},
+		{
+			Path:    "task/search",
+			Handler: s.ServeSearchTasks,
+			Summary: "Find tasks whose contents contain a substring or match a regular expression.",
+			Params: []*RouteParam{
+				contextParam,
+				{Name: "q", Type: "string", Description: "substring (or regular expression) to search for", Required: true},
+				{Name: "regexp", Type: "string", Description: "set to 1 to treat q as a regular expression"},
+				{Name: "state", Type: "string", Description: "if specified, one of pending, running, expired, delayed, or held"},
+				{Name: "limit", Type: "integer", Description: "if non-zero, maximum number of tasks to return"},
+				{Name: "cursor", Type: "integer", Description: "cursor from a previous response, to continue a search"},
+			},
+			ReadOnly: true,
+		},
+		{
+			Path:     "task/peek",
+			Handler:  s.ServePeekTask,
+			Summary:  "Look at the next task that would be popped.",
+			Params:   []*RouteParam{contextParam, offeredTagsParam},
+			ReadOnly: true,
+		},
+		{
+			Path:    "task/running",
+			Handler: s.ServeRunningTasks,
+			Summary: "List in-progress tasks, soonest to expire first.",
+			Params: []*RouteParam{
+				contextParam,
+				{Name: "limit", Type: "integer", Description: "if non-zero, maximum number of tasks to list"},
+			},
+			ReadOnly: true,
+		},
+		{
+			Path:     "task/stuck",
+			Handler:  s.ServeStuckTasks,
+			Summary:  "List in-progress tasks which have been popped too many times or are running for unusually long.",
+			Params:   []*RouteParam{contextParam},
+			ReadOnly: true,
+		},
+		{
+			Path:    "task/completed",
+			Handler: s.ServeCompletedTask,
+			Summary: "Mark an in-progress task as completed.",
+			Params:  []*RouteParam{contextParam, idParam, leaseParam, workerParam},
+		},
+		{
+			Path:    "task/completed_batch",
+			Handler: s.ServeCompletedBatch,
+			Summary: "Mark multiple in-progress tasks as completed.",
+			Params:  []*RouteParam{contextParam, workerParam},
+			Body:    "JSON array of task IDs",
+		},
+		{
+			Path:    "task/complete_and_pop",
+			Handler: s.ServeCompleteAndPop,
+			Summary: "Mark tasks as completed and pop the next batch in one request.",
+			Params: []*RouteParam{
+				contextParam,
+				workerParam,
+				timeoutParam,
+				{Name: "count", Type: "integer", Description: "maximum number of tasks to pop (default 1), or 0 to only complete tasks"},
+				{Name: "maxBytes", Type: "integer", Description: "if non-zero, maximum total size of task contents"},
+				offeredTagsParam,
+				orderParamSpec,
+			},
+			Body: `JSON array of completed task IDs or {"id": ..., "lease": ...} objects`,
+		},
+		{
+			Path:    "task/completed_log",
+			Handler: s.ServeCompletedLog,
+			Summary: "List recently completed tasks, newest first, if the context's completedLog setting is enabled.",
+			Params: []*RouteParam{
+				contextParam,
+				{Name: "id", Type: "string", Description: "if specified, only list completions of this task"},
+				{Name: "limit", Type: "integer", Description: "if non-zero, maximum number of tasks to list"},
+			},
+			ReadOnly: true,
+		},
+		{
+			Path:    "task/keepalive",
+			Handler: s.ServeKeepalive,
+			Summary: "Restart the timeout of an in-progress task.",
+			Params:  []*RouteParam{contextParam, idParam, leaseParam, timeoutParam},
+		},
+		{
+			Path:    "task/keepalive_batch",
+			Handler: s.ServeKeepaliveBatch,
+			Summary: "Restart the timeouts of multiple in-progress tasks.",
+			Params:  []*RouteParam{contextParam, timeoutParam},
+			Body:    `JSON array of {"id": ..., "lease": ...} objects, where lease is optional`,
+		},
+		{
+			Path:    "task/progress",
+			Handler: s.ServeProgress,
+			Summary: "Report the progress of an in-progress task.",
+			Params: []*RouteParam{
+				contextParam,
+				idParam,
+				leaseParam,
+				{Name: "value", Type: "number", Description: "progress value, typically from 0 to 1", Required: true},
+				{Name: "message", Type: "string", Description: "human-readable progress message"},
+			},
+		},
+		{
+			Path:    "task/annotate",
+			Handler: s.ServeAnnotate,
+			Summary: "Attach key-value metadata to an in-progress task, which is shown when listing or peeking the task and kept in the completed log.",
+			Params:  []*RouteParam{contextParam, idParam, leaseParam},
+			Body:    "JSON object mapping annotation keys to string values, where empty values remove annotations",
+		},
+		{
+			Path:    "task/retry_completed",
+			Handler: s.ServeRetryCompleted,
+			Summary: "Push the contents of a task from the completed log as a new task, and get its ID.",
+			Params:  []*RouteParam{contextParam, idParam},
+			Admin:   true,
+		},
+		{
+			Path:    "task/requeue",
+			Handler: s.ServeRequeue,
+			Summary: "Put an in-progress task back into the queue after an optional delay.",
+			Params: []*RouteParam{
+				contextParam,
+				idParam,
+				leaseParam,
+				{Name: "delay", Type: "number", Description: "seconds before the task can be popped again"},
+			},
+		},
+		{
+			Path:        "task/export",
+			Handler:     s.ServeExport,
+			Summary:     "Download the pending tasks as newline-delimited JSON objects with id and contents.",
+			Params:      []*RouteParam{contextParam},
+			ContentType: "application/x-ndjson",
+			ReadOnly:    true,
+		},
+		{
+			Path:     "task/import",
+			Handler:  s.ServeImport,
+			Summary:  "Push tasks from newline-delimited JSON in the format of task/export, and get the number of tasks pushed.",
+			Params:   []*RouteParam{contextParam},
+			Body:     "newline-delimited JSON objects with a contents field",
+			BodyType: "application/x-ndjson",
+			Admin:    true,
+		},
+		{
+			Path:    "task/clear",
+			Handler: s.ServeClearTasks,
+			Summary: "Delete all pending and running tasks.",
+			Params:  []*RouteParam{contextParam},
+			Admin:   true,
+		},
+		{
+			Path:    "task/expire_all",
+			Handler: s.ServeExpireTasks,
+			Summary: "Expire all running tasks so they can be popped again immediately.",
+			Params:  []*RouteParam{contextParam},
+			Admin:   true,
+		},
+		{
+			Path:    "task/queue_expired",
+			Handler: s.ServeQueueExpired,
+			Summary: "Move expired tasks back into the pending queue.",
+			Params:  []*RouteParam{contextParam},
+			Admin:   true,
+		},
+		{
+			Path:    "group/status",
+			Handler: s.ServeGroupStatus,
+			Summary: "Count the pending, running, and completed tasks in a group.",
+			Params: []*RouteParam{
+				contextParam,
+				{Name: "id", Type: "string", Description: "name of the group", Required: true},
+			},
+			ReadOnly: true,
+		},
+		{
+			Path:    "group/on_complete",
+			Handler: s.ServeGroupOnComplete,
+			Summary: "Push a barrier task and/or send a callback once every task in a group is completed.",
+			Params: []*RouteParam{
+				contextParam,
+				{Name: "id", Type: "string", Description: "name of the group", Required: true},
+				{Name: "push", Type: "string", Description: "contents of a task to push when the group is completed"},
+				{Name: "callback", Type: "string", Description: "URL to POST the group's status to when the group is completed"},
+			},
+		},
+		{
+			Path:     "context/trash",
+			Handler:  s.ServeTrash,
+			Summary:  "List recently cleared queues which can be restored.",
+			ReadOnly: true,
+		},
+		{
+			Path:    "context/restore",
+			Handler: s.ServeRestore,
+			Summary: "Restore a cleared queue from the trash.",
+			Params:  []*RouteParam{contextParam},
+			Admin:   true,
+		},
+		{
+			Path:    "context/bulk",
+			Handler: s.ServeBulk,
+			Summary: "Apply clear, expire_all, or queue_expired to several contexts, and get the number of affected tasks (or an error) for each.",
+			Params: []*RouteParam{
+				{Name: "op", Type: "string", Description: "one of clear, expire_all, or queue_expired", Required: true},
+			},
+			Body:  "JSON array of context names",
+			Admin: true,
+		},
+		{
+			Path:    "context/rename",
+			Handler: s.ServeRenameContext,
+			Summary: "Rename a context, keeping its tasks, counters, and settings.",
+			Params:  copyContextParams,
+			Admin:   true,
+		},
+		{
+			Path:    "context/clone",
+			Handler: s.ServeCloneContext,
+			Summary: "Copy a context, including its tasks, counters, and settings.",
+			Params:  copyContextParams,
+			Admin:   true,
+		},
+		{
+			Path:    "context/config",
+			Handler: s.ServeConfig,
+			Summary: "Get the settings of a context, or POST to change them.",
+			Params: []*RouteParam{
+				contextParam,
+				{Name: "backoff", Type: "number", Description: "seconds to delay a task after it first expires"},
+				{Name: "maxBackoff", Type: "number", Description: "if non-zero, maximum backoff in seconds"},
+				{Name: "alertPending", Type: "integer", Description: "if non-zero, alert while more tasks than this are pending"},
+				{Name: "alertExpired", Type: "integer", Description: "if non-zero, alert while more tasks than this are expired"},
+				{Name: "alertStall", Type: "number", Description: "if non-zero, alert when no tasks are completed for this many seconds"},
+				{Name: "completedLog", Type: "integer", Description: "if non-zero, number of recently completed tasks to remember"},
+				{Name: "timeout", Type: "number", Description: "if non-zero, default task timeout in seconds for the context"},
+				{Name: "maxTimeout", Type: "number", Description: "if non-zero, longest task timeout in seconds that workers may request"},
+				{Name: "weight", Type: "integer", Description: "relative share of tasks popped from this context by task/pop_any; defaults to 1"},
+				{Name: "drainTime", Type: "number", Description: "seconds in which autoscale hints should finish the remaining tasks"},
+				{Name: "order", Type: "string", Description: "fifo, lifo, or fair, the order in which pending tasks are popped by default; lifo and fair require an in-memory context"},
+				{Name: "stuckAttempts", Type: "integer", Description: "if non-zero, number of attempts after which task/stuck reports a running task"},
+				{Name: "stuckDeviations", Type: "number", Description: "if non-zero, standard deviations above the mean latency after which task/stuck reports a task's total running time"},
+			},
+			ReadOnlyGet: true,
+			Admin:       true,
+		},
+		{
+			Path:          "snapshot",
+			Handler:       s.ServeSnapshot,
+			Summary:       "Download the state of every queue (encrypted if -save-key is set), as used by standby servers. Requires the admin credentials.",
+			ContentType:   "application/zip",
+			AllowGet:      true,
+			Admin:         true,
+			DuringQuiesce: true,
+		},
+		{
+			Path:          "admin/reload",
+			Handler:       s.ServeReload,
+			Summary:       "Reload the config file, like SIGHUP. Requires the admin credentials.",
+			Admin:         true,
+			DuringQuiesce: true,
+		},
+		{
+			Path:          "admin/save",
+			Handler:       s.ServeSave,
+			Summary:       "Save the state to the save file immediately, returning the duration in seconds and the number of bytes written. Requires the admin credentials.",
+			Admin:         true,
+			DuringQuiesce: true,
+		},
+		{
+			Path:          "admin/snapshot/download",
+			Handler:       s.ServeSnapshotDownload,
+			Summary:       "Download the current state in the format of the save file (encrypted if -save-key is set). Requires the admin credentials.",
+			ContentType:   "application/zip",
+			AllowGet:      true,
+			Admin:         true,
+			DuringQuiesce: true,
+		},
+		{
+			Path:          "admin/generations",
+			Handler:       s.ServeGenerations,
+			Summary:       "List the copies of the save file kept by -keep-saves, from oldest to newest. Requires the admin credentials.",
+			AllowGet:      true,
+			Admin:         true,
+			DuringQuiesce: true,
+		},
+		{
+			Path:    "admin/restore_generation",
+			Handler: s.ServeRestoreGeneration,
+			Summary: "Replace the entire state with a copy of the save file kept by -keep-saves. Requires the admin credentials.",
+			Params: []*RouteParam{
+				{Name: "name", Type: "string", Description: "name of the copy, from admin/generations", Required: true},
+			},
+			Admin: true,
+		},
+		{
+			Path:    "admin/quiesce",
+			Handler: s.ServeQuiesce,
+			Summary: "Block requests which modify the queues until admin/resume or a timeout, and save the state, so that a consistent backup can be taken. Returns modification counters which can be compared after resuming. Requires the admin credentials.",
+			Params: []*RouteParam{
+				{Name: "timeout", Type: "number", Description: "seconds after which to resume automatically; defaults to 60"},
+			},
+			Admin:         true,
+			DuringQuiesce: true,
+		},
+		{
+			Path:          "admin/resume",
+			Handler:       s.ServeResume,
+			Summary:       "Resume after admin/quiesce, reporting whether the queues were unchanged while quiesced. Requires the admin credentials.",
+			Admin:         true,
+			DuringQuiesce: true,
+		},
+		{
+			Path:          "admin/credentials",
+			Handler:       s.ServeCredentials,
+			Summary:       "List the usernames accepted for basic auth, or POST a JSON array of {username, password} objects to replace the accepted credentials until the next reload. Requires the admin credentials.",
+			AllowGet:      true,
+			Admin:         true,
+			DuringQuiesce: true,
+		},
+		{
+			Path:    "healthz",
+			Handler: s.ServeHealthz,
+			Summary: "Check that the server is running, for liveness probes.",
+			Public:  true,
+		},
+		{
+			Path:    "readyz",
+			Handler: s.ServeReadyz,
+			Summary: "Check that the server has loaded its state and is not a standby, for readiness probes. Fails with status 503 otherwise.",
+			Public:  true,
+		},
+		{
+			Path:     "csrf_token",
+			Handler:  s.ServeCSRFToken,
+			Summary:  "Get the token which browsers must send in the X-CSRF-Token header to modify the queues.",
+			ReadOnly: true,
+		},
+		{
+			Path:     "openapi.json",
+			Handler:  s.ServeOpenAPI,
+			Summary:  "Get an OpenAPI description of the API.",
+			ReadOnly: true,
+		},
+	}
+}
+
+// Router creates a Router for the homepage, static files, debug endpoints,
+// and every route in s.Routes().
+//
+// If admin is false, the debug endpoints and the routes marked Admin are left
+// out, for a listener which should only be used by workers.
+func (s *Server) Router(admin bool) *Router {
+	router := NewRouter(s.PathPrefix)
+	router.Handle("", nil, AllowReadOnly(s.ServeIndex))
+	router.NotFound = AllowReadOnly(s.ServeIndex)
+	router.HandleSubtree("static/", AllowReadOnly(s.ServeStatic))
+	if admin {
+		router.HandleSubtree("debug/pprof/", s.ServeDebug)
+	}
+	for _, route := range s.Routes() {
+		if route.Admin && !admin {
+			continue
+		}
+		handler := route.Handler
+		if route.ReadOnly {
+			handler = AllowReadOnly(handler)
+		} else if !route.Public {
+			if !route.DuringQuiesce {
+				handler = s.BlockWhileQuiesced(handler)
+			}
+			handler = s.RequireCSRF(handler)
+			if route.ReadOnlyGet {
+				handler = readOnlyGet(AllowReadOnly(route.Handler), handler)
+			}
+		}
+		router.Handle(route.Path, route.Methods(), handler)
+	}
+	return router
+}
+
+// readOnlyGet uses get for GET and HEAD requests, and other for the rest.
+func readOnlyGet(get, other http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			get(w, r)
+		} else {
+			other(w, r)
+		}
+	}
+}
+
+// ServeOpenAPI serves an OpenAPI 3 description of s.Routes().
+func (s *Server) ServeOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	paths := map[string]interface{}{}
+	for _, route := range s.Routes() {
+		params := []interface{}{}
+		for _, p := range route.Params {
+			params = append(params, map[string]interface{}{
+				"name":        p.Name,
+				"in":          "query",
+				"description": p.Description,
+				"required":    p.Required,
+				"schema":      map[string]interface{}{"type": p.Type},
+			})
+		}
+		contentType := route.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		description := "Success"
+		if contentType == "application/json" && route.Path != "openapi.json" {
+			description = "An object with a `data` field on success, or an `error` field on failure."
+		}
+		op := map[string]interface{}{
+			"summary":    route.Summary,
+			"parameters": params,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": description,
+					"content":     map[string]interface{}{contentType: map[string]interface{}{}},
+				},
+			},
+		}
+		if route.Public {
+			op["security"] = []interface{}{}
+		}
+		item := map[string]interface{}{}
+		if route.Body != "" {
+			content := map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": map[string]interface{}{"type": "array", "items": map[string]interface{}{}},
+				},
+			}
+			if route.BodyType != "" {
+				content = map[string]interface{}{route.BodyType: map[string]interface{}{}}
+			}
+			op["requestBody"] = map[string]interface{}{
+				"description": route.Body,
+				"required":    true,
+				"content":     content,
+			}
+			item["post"] = op
+		} else if route.Methods() != nil {
+			item["post"] = op
+		} else {
+			item["get"] = op
+			item["post"] = op
+		}
+		paths["/"+route.Path] = item
+	}
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "tasq",
+			"version": "1",
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": strings.TrimSuffix(s.PathPrefix, "/")},
+		},
+		"paths": paths,
+	}
+	if username, password := s.credentials(); username != "" || password != "" {
+		doc["components"] = map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"basicAuth": map[string]interface{}{"type": "http", "scheme": "basic"},
+			},
+		}
+		doc["security"] = []interface{}{map[string]interface{}{"basicAuth": []interface{}{}}}
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+}
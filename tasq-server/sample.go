@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// defaultSampleSize is the number of tasks returned by /task/sample when n is
+// not specified.
+const defaultSampleSize = 10
+
+// Sample chooses up to n tasks uniformly at random from the tasks in the given
+// state, which is one of "pending", "running", "expired", "backingOff",
+// "delayed", or "held". States have the same meaning as in Counts(), so
+// pending tasks include tasks waiting for their ordering key and delayed tasks
+// which are due, and running tasks do not include expired ones or ones waiting
+// for their backoff delay.
+//
+// Every task in the state is visited once, using reservoir sampling, so the
+// sample does not require copying the queue.
+//
+// The returned tasks only include visible metadata. They will have no
+// connection to the queue or the original tasks.
+func (q *QueueState) Sample(n int, state string) ([]*Task, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	res := []*Task{}
+	seen := 0
+	visit := func(t *Task) {
+		seen++
+		if len(res) < n {
+			res = append(res, t)
+		} else if i := rand.Intn(seen); i < n {
+			res[i] = t
+		}
+	}
+
+	if err := q.iterateState(state, visit); err != nil {
+		return nil, err
+	}
+
+	for i, t := range res {
+		res[i] = t.DisconnectedCopy()
+	}
+	return res, nil
+}
+
+// iterateState calls f with every task in the given state, as described by
+// Sample(). If state is empty, every pending, running, expired, backing off,
+// delayed, and held task is visited, in that order.
+//
+// The caller must hold the read lock.
+func (q *QueueState) iterateState(state string, f func(t *Task)) error {
+	if state == "" {
+		for _, s := range []string{"pending", "running", "expired", "backingOff", "delayed", "held"} {
+			q.iterateState(s, f)
+		}
+		return nil
+	}
+	now := time.Now()
+	switch state {
+	case "pending":
+		q.pending.Iterate(f)
+		q.keys.Iterate(f)
+		q.delayed.Iterate(func(t *Task) {
+			if !t.expiration.After(now) {
+				f(t)
+			}
+		})
+	case "running", "expired", "backingOff":
+		q.running.Iterate(func(t *Task) {
+			taskState := "expired"
+			if t.expiration.After(now) {
+				taskState = "running"
+				if t.backedOff {
+					taskState = "backingOff"
+				}
+			}
+			if taskState == state {
+				f(t)
+			}
+		})
+	case "delayed":
+		q.delayed.Iterate(func(t *Task) {
+			if t.expiration.After(now) {
+				f(t)
+			}
+		})
+	case "held":
+		q.held.Iterate(f)
+	default:
+		return fmt.Errorf("unknown task state: %s", state)
+	}
+	return nil
+}
+
+func (s *Server) ServeSampleTasks(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	n := defaultSampleSize
+	if nStr := r.URL.Query().Get("n"); nStr != "" {
+		var err error
+		n, err = parseLimit(nStr)
+		if err != nil {
+			serveError(w, err.Error())
+			return
+		} else if n <= 0 {
+			serveError(w, "invalid 'n' requested")
+			return
+		}
+	}
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		state = "pending"
+	}
+	var tasks []*Task
+	var sampleErr error
+	err := s.Queues.Get(r.URL.Query().Get("context"), func(qs *QueueState) {
+		tasks, sampleErr = qs.Sample(n, state)
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	} else if sampleErr != nil {
+		serveError(w, sampleErr.Error())
+		return
+	}
+	serveObject(w, tasks)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// A SaveResult describes a completed save of the state to SavePath.
+type SaveResult struct {
+	// Duration is the time taken to write the save file, in seconds.
+	Duration float64 `json:"duration"`
+
+	// Bytes is the size of the save file.
+	Bytes int64 `json:"bytes"`
+
+	// Copied is the number of contexts which were unchanged since the
+	// previous save, and were copied from the previous save file.
+	Copied int `json:"copied"`
+}
+
+// Save writes the state to SavePath, replacing the previous save file once
+// the new one has been written completely.
+//
+// Saves are serialized, so that a save requested through /admin/save does
+// not race with SaveLoop.
+//
+// Unless the save file is encrypted, contexts which have not been modified
+// since the previous save are copied from the previous save file rather than
+// encoded again.
+func (s *Server) Save() (*SaveResult, error) {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+
+	tmpPath := s.SavePath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	t1 := time.Now()
+	w := &countingWriter{w: f}
+	var manifest *SaveManifest
+	if s.SaveCipher == nil {
+		prevFile, closer := s.previousSave()
+		manifest, err = s.Queues.SerializeDiff(w, s.saveManifest, prevFile)
+		if closer != nil {
+			closer.Close()
+		}
+	} else {
+		err = writeSaveFile(w, s.Queues, s.SaveCipher)
+	}
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, s.SavePath); err != nil {
+		return nil, err
+	}
+	s.saveManifest, s.savedFile = nil, nil
+	if info, err := os.Stat(s.SavePath); err == nil && manifest != nil {
+		s.saveManifest, s.savedFile = manifest, info
+	}
+
+	t2 := time.Now()
+	s.SaveStatsLock.Lock()
+	s.LastSave = t2
+	s.LastSaveDuration = t2.Sub(t1)
+	s.SaveStatsLock.Unlock()
+
+	if s.KeepSaves > 0 {
+		// The save itself succeeded, so a failure to keep a copy of it
+		// should not stop the server.
+		if err := s.keepGeneration(t2); err != nil {
+			logger.Warn("failed to keep save file generation", "path", s.SavePath, "error", err)
+		}
+	}
+
+	result := &SaveResult{Duration: t2.Sub(t1).Seconds(), Bytes: w.n}
+	if manifest != nil {
+		result.Copied = manifest.Copied
+	}
+	return result, nil
+}
+
+// previousSave opens the file written by the previous call to Save(), or
+// returns nil if there is none or it has since been replaced.
+//
+// The caller must hold s.saveLock.
+func (s *Server) previousSave() (*zip.Reader, io.Closer) {
+	if s.saveManifest == nil {
+		return nil, nil
+	}
+	f, err := os.Open(s.SavePath)
+	if err != nil {
+		return nil, nil
+	}
+	info, err := f.Stat()
+	if err != nil || !os.SameFile(info, s.savedFile) || info.Size() != s.savedFile.Size() {
+		f.Close()
+		return nil, nil
+	}
+	zf, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, nil
+	}
+	return zf, f
+}
+
+// ServeSave saves the state immediately, rather than waiting for the next
+// save interval.
+func (s *Server) ServeSave(w http.ResponseWriter, r *http.Request) {
+	if !s.AdminAuth(w, r) {
+		return
+	}
+	if s.SavePath == "" {
+		serveError(w, "no save path is configured")
+		return
+	}
+	logger.Info("saving state early", "trigger", "request")
+	result, err := s.Save()
+	if err != nil {
+		logger.Error("failed to save state", "path", s.SavePath, "error", err)
+		serveError(w, "failed to save state: "+err.Error())
+		return
+	}
+	logger.Info("saved state", "path", s.SavePath, "duration", result.Duration,
+		"copied", result.Copied)
+	s.Audit(r, &AuditEntry{Op: "save"})
+	serveObject(w, result)
+}
+
+// ServeSnapshotDownload streams the current state in the format of a save
+// file, so that backups can be taken without access to the server's disk.
+// If the save file is encrypted, so is the download.
+func (s *Server) ServeSnapshotDownload(w http.ResponseWriter, r *http.Request) {
+	if !s.AdminAuth(w, r) {
+		return
+	}
+	name := "tasq-state.zip"
+	if s.SaveCipher != nil {
+		name = "tasq-state.enc"
+		w.Header().Set("content-type", "application/octet-stream")
+	} else {
+		w.Header().Set("content-type", "application/zip")
+	}
+	w.Header().Set("content-disposition", "attachment; filename=\""+name+"\"")
+	w.Header().Set("cache-control", "no-store")
+	if err := writeSaveFile(w, s.Queues, s.SaveCipher); err != nil {
+		logger.Error("failed to serve snapshot download", "error", err)
+	}
+}
+
+// countingWriter counts the bytes written to an io.Writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
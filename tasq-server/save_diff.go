@@ -0,0 +1,196 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"io"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// A SaveManifest records which version of each queue was written to each
+// entry of a file by SerializeDiff(), so that the next save can copy the
+// entries of unchanged queues instead of encoding them again.
+type SaveManifest struct {
+	// Encoded is the number of queues which were encoded.
+	Encoded int
+
+	// Copied is the number of queues which were copied from the previous
+	// file.
+	Copied int
+
+	entries map[string]*manifestEntry
+}
+
+type manifestEntry struct {
+	queue   *QueueState
+	version int64
+	file    string
+}
+
+// serializedQueue is a queue which is about to be written by SerializeDiff(),
+// either from its encoded state or from an entry of the previous file.
+type serializedQueue struct {
+	name     string
+	queue    *QueueState
+	version  int64
+	state    *ContextState
+	copyFrom *zip.File
+}
+
+// SerializeDiff is like Serialize(), but queues which have not been modified
+// since prev was returned are copied from prevFile, the file written with
+// prev, rather than encoded again. Saving is then much faster when most of
+// the queues are idle.
+//
+// If prev or prevFile is nil, every queue is encoded.
+//
+// The returned manifest can be passed to the next call.
+func (q *QueueStateMux) SerializeDiff(w io.Writer, prev *SaveManifest,
+	prevFile *zip.Reader) (*SaveManifest, error) {
+	prevEntries := map[string]*zip.File{}
+	if prev != nil && prevFile != nil {
+		for _, f := range prevFile.File {
+			prevEntries[f.Name] = f
+		}
+	}
+	reusable := func(name string, qs *QueueState, version int64) *zip.File {
+		if prev == nil {
+			return nil
+		}
+		// Queues are compared by pointer as well as by version, since a
+		// queue which was loaded and never modified has a zero version.
+		entry, ok := prev.entries[name]
+		if !ok || entry.queue != qs || entry.version != version {
+			return nil
+		}
+		return prevEntries[entry.file]
+	}
+
+	var queues []*serializedQueue
+	if q.ConsistentSnapshots {
+		q.saveLock.Lock()
+		for name, qs := range q.queues {
+			// The version is read before encoding, so that a queue which
+			// is modified while it is encoded is encoded again next time.
+			sq := &serializedQueue{name: name, queue: qs, version: atomic.LoadInt64(&qs.version)}
+			if sq.copyFrom = reusable(name, qs, sq.version); sq.copyFrom == nil {
+				sq.state = &ContextState{Name: name, Encoded: qs.Encode()}
+			}
+			queues = append(queues, sq)
+		}
+		q.saveLock.Unlock()
+	} else {
+		q.lock.RLock()
+		listed := make(map[string]*QueueState, len(q.queues))
+		for name, qs := range q.queues {
+			listed[name] = qs
+		}
+		q.lock.RUnlock()
+		for name, qs := range listed {
+			sq := &serializedQueue{name: name, queue: qs, version: atomic.LoadInt64(&qs.version)}
+			if sq.copyFrom = reusable(name, qs, sq.version); sq.copyFrom == nil {
+				encoded := qs.Encode()
+				if encoded.Empty() {
+					// The queue was likely cleared and deleted since we listed it.
+					continue
+				}
+				sq.state = &ContextState{Name: name, Encoded: encoded}
+			}
+			queues = append(queues, sq)
+		}
+	}
+
+	const context = "serialize queue state"
+
+	manifest := &SaveManifest{entries: map[string]*manifestEntry{}}
+	resultWriter := zip.NewWriter(w)
+	for i, sq := range queues {
+		fileName := strconv.Itoa(i) + ".json"
+		if sq.copyFrom != nil {
+			if err := copyZipEntry(resultWriter, sq.copyFrom, fileName); err != nil {
+				return nil, errors.Wrap(err, context)
+			}
+			manifest.Copied++
+		} else {
+			rw, err := resultWriter.Create(fileName)
+			if err != nil {
+				return nil, errors.Wrap(err, context)
+			}
+			bufWriter := bufio.NewWriter(rw)
+			if err := sq.state.WriteJSON(bufWriter); err != nil {
+				return nil, errors.Wrap(err, context)
+			}
+			if err := bufWriter.Flush(); err != nil {
+				return nil, errors.Wrap(err, context)
+			}
+			manifest.Encoded++
+		}
+		manifest.entries[sq.name] = &manifestEntry{
+			queue:   sq.queue,
+			version: sq.version,
+			file:    fileName,
+		}
+	}
+
+	if err := q.serializeTrash(resultWriter); err != nil {
+		return nil, errors.Wrap(err, context)
+	}
+
+	if err := resultWriter.Close(); err != nil {
+		return nil, errors.Wrap(err, context)
+	}
+
+	return manifest, nil
+}
+
+// serializeTrash writes the queues in the trash which have not expired, so
+// that they can still be restored after the file is loaded.
+//
+// The trash is encoded while holding a read lock, since Restore() modifies a
+// trashed queue after taking it out of the trash.
+func (q *QueueStateMux) serializeTrash(w *zip.Writer) error {
+	q.lock.Lock()
+	q.purgeTrash()
+	q.lock.Unlock()
+
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	var i int
+	for name, trashed := range q.trash {
+		rw, err := w.Create("trash-" + strconv.Itoa(i) + ".json")
+		if err != nil {
+			return err
+		}
+		i++
+		deleted := trashed.Deleted
+		state := &ContextState{Name: name, Encoded: trashed.State.Encode(), Deleted: &deleted}
+		bufWriter := bufio.NewWriter(rw)
+		if err := state.WriteJSON(bufWriter); err != nil {
+			return err
+		}
+		if err := bufWriter.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyZipEntry copies the compressed data of an entry into w under a new
+// name, without decompressing it.
+func copyZipEntry(w *zip.Writer, f *zip.File, name string) error {
+	r, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	header := f.FileHeader
+	header.Name = name
+	rw, err := w.CreateRaw(&header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(rw, r)
+	return err
+}
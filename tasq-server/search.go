@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// searchScanLimit is the maximum number of tasks examined by one call to
+// Search(), which bounds the time that a search holds the queue's lock.
+const searchScanLimit = 100000
+
+// A SearchResult is a page of tasks matching a search.
+type SearchResult struct {
+	Tasks []*Task `json:"tasks"`
+
+	// Cursor, if non-nil, can be passed to Search() to continue the search
+	// after the tasks which were examined so far.
+	Cursor *int `json:"cursor,omitempty"`
+}
+
+// Search finds up to limit tasks in the given state (as described by
+// iterateState()) for which match returns true, starting at position cursor
+// in the state's order.
+//
+// At most searchScanLimit tasks are examined. If the search stops before
+// every task has been examined, the result includes a cursor for continuing
+// it. Since the queue may change between calls, a continued search may skip
+// or repeat some tasks.
+//
+// The returned tasks only include visible metadata. They will have no
+// connection to the queue or the original tasks.
+func (q *QueueState) Search(match func(contents string) bool, state string,
+	cursor, limit int) (*SearchResult, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	res := &SearchResult{Tasks: []*Task{}}
+	index := 0
+	err := q.iterateState(state, func(t *Task) {
+		defer func() { index++ }()
+		if index < cursor || res.Cursor != nil {
+			return
+		}
+		if index-cursor >= searchScanLimit || (limit > 0 && len(res.Tasks) >= limit) {
+			next := index
+			res.Cursor = &next
+			return
+		}
+		if match(t.Contents) {
+			res.Tasks = append(res.Tasks, t.DisconnectedCopy())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *Server) ServeSearchTasks(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		serveError(w, err.Error())
+		return
+	} else if limit < 0 {
+		serveError(w, "invalid 'limit' requested")
+		return
+	}
+	var cursor int
+	if s := query.Get("cursor"); s != "" {
+		cursor, err = strconv.Atoi(s)
+		if err != nil || cursor < 0 {
+			serveError(w, "invalid 'cursor' requested")
+			return
+		}
+	}
+
+	q := query.Get("q")
+	match := func(contents string) bool {
+		return strings.Contains(contents, q)
+	}
+	if query.Get("regexp") == "1" {
+		expr, err := regexp.Compile(q)
+		if err != nil {
+			serveError(w, "invalid regular expression: "+err.Error())
+			return
+		}
+		match = expr.MatchString
+	}
+
+	var result *SearchResult
+	var searchErr error
+	err = s.Queues.Get(query.Get("context"), func(qs *QueueState) {
+		result, searchErr = qs.Search(match, query.Get("state"), cursor, limit)
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	} else if searchErr != nil {
+		serveError(w, searchErr.Error())
+		return
+	}
+	serveObject(w, result)
+}
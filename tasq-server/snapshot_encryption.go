@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SaveKeyEnvVar is the environment variable which provides a save file key
+// when neither -save-key nor -save-key-command is passed.
+const SaveKeyEnvVar = "TASQ_SAVE_KEY"
+
+// encryptedSnapshotMagic starts every encrypted save file, and is followed by
+// a random nonce and then the AES-GCM sealed zip file.
+var encryptedSnapshotMagic = []byte("tasq-aes-gcm-1\n")
+
+// A SnapshotCipher encrypts and decrypts save files with AES-GCM.
+type SnapshotCipher struct {
+	aead cipher.AEAD
+}
+
+// NewSnapshotCipher creates a SnapshotCipher from a 16, 24, or 32 byte key,
+// which selects AES-128, AES-192, or AES-256.
+func NewSnapshotCipher(key []byte) (*SnapshotCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "create snapshot cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "create snapshot cipher")
+	}
+	return &SnapshotCipher{aead: aead}, nil
+}
+
+// LoadSaveKey finds the save file key, if any.
+//
+// The key is taken from keyFlag if it is non-empty, or else from the output
+// of keyCommand (which is run with "sh -c", e.g. to decrypt the key with a
+// KMS), or else from the SaveKeyEnvVar environment variable. In each case,
+// the key is hex or base64 encoded.
+//
+// Returns nil if no key is configured.
+func LoadSaveKey(keyFlag, keyCommand string) ([]byte, error) {
+	encoded := keyFlag
+	if encoded == "" && keyCommand != "" {
+		output, err := exec.Command("sh", "-c", keyCommand).Output()
+		if err != nil {
+			return nil, errors.Wrap(err, "run save key command")
+		}
+		encoded = string(output)
+	}
+	if encoded == "" {
+		encoded = os.Getenv(SaveKeyEnvVar)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+	if key, err := hex.DecodeString(encoded); err == nil {
+		return key, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("save key must be hex or base64 encoded")
+	}
+	return key, nil
+}
+
+// Encrypt seals the contents of a save file.
+func (s *SnapshotCipher) Encrypt(plaintext []byte) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	res := append(append([]byte{}, encryptedSnapshotMagic...), nonce...)
+	return s.aead.Seal(res, nonce, plaintext, encryptedSnapshotMagic)
+}
+
+// Decrypt opens a save file created by Encrypt().
+func (s *SnapshotCipher) Decrypt(data []byte) ([]byte, error) {
+	if !IsEncryptedSnapshot(data) {
+		return nil, errors.New("decrypt snapshot: file is not encrypted")
+	}
+	data = data[len(encryptedSnapshotMagic):]
+	if len(data) < s.aead.NonceSize() {
+		return nil, errors.New("decrypt snapshot: file is truncated")
+	}
+	nonce, sealed := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, sealed, encryptedSnapshotMagic)
+	if err != nil {
+		return nil, errors.Wrap(err, "decrypt snapshot")
+	}
+	return plaintext, nil
+}
+
+// IsEncryptedSnapshot checks if the data begins like an encrypted save file.
+func IsEncryptedSnapshot(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedSnapshotMagic)
+}
+
+// LoadSaveFile reads a save file, decrypting it if it is encrypted.
+//
+// Unencrypted save files are loaded even if c is non-nil, so that encryption
+// can be enabled for an existing save file.
+func LoadSaveFile(timeout time.Duration, path string, c *SnapshotCipher) (*QueueStateMux, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(encryptedSnapshotMagic))
+	n, _ := io.ReadFull(f, header)
+	f.Close()
+	if !IsEncryptedSnapshot(header[:n]) {
+		return ReadQueueStateMux(timeout, path)
+	}
+	if c == nil {
+		return nil, errors.New("save file is encrypted, but no save key was provided")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := c.Decrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	return DeserializeQueueStateMux(timeout, bytes.NewReader(plaintext), int64(len(plaintext)))
+}
+
+// writeSaveFile serializes the queues to w, encrypting them if c is non-nil.
+//
+// Encrypted snapshots are buffered in memory, since the authentication tag
+// can only be computed once all of the data is known.
+func writeSaveFile(w io.Writer, queues *QueueStateMux, c *SnapshotCipher) error {
+	if c == nil {
+		return queues.Serialize(w)
+	}
+	var buf bytes.Buffer
+	if err := queues.Serialize(&buf); err != nil {
+		return err
+	}
+	_, err := w.Write(c.Encrypt(buf.Bytes()))
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultStuckAttempts and defaultStuckDeviations are the thresholds for
+	// stuck tasks in contexts which do not configure their own.
+	defaultStuckAttempts   = 5
+	defaultStuckDeviations = 3
+
+	// minStuckLatencyFactor prevents tasks from being flagged in contexts
+	// whose latencies hardly vary, by requiring the running time of a stuck
+	// task to be at least this multiple of the mean latency.
+	minStuckLatencyFactor = 2
+)
+
+// A StuckTask is a running task which has been popped too many times, or has
+// been running for much longer than the context's tasks usually take.
+type StuckTask struct {
+	*RunningTaskInfo
+
+	// RunningTime is the number of seconds the task has spent running,
+	// summed over all of its attempts.
+	RunningTime float64 `json:"runningTime"`
+
+	// Reasons contains "attempts" if the task has reached the attempt
+	// threshold, and "runningTime" if its running time is an outlier.
+	Reasons []string `json:"reasons"`
+
+	// Flagged is the Unix time in milliseconds when the background check
+	// first found the task to be stuck, or zero if it has not yet done so.
+	Flagged int64 `json:"flagged,omitempty"`
+}
+
+// StuckTasks finds the running tasks which are stuck according to the
+// context's thresholds, in order of expiration.
+//
+// A task is stuck if it has been popped at least StuckAttempts times, or if
+// its total running time is more than StuckDeviations standard deviations
+// above the mean latency of completed tasks.
+func (q *QueueState) StuckTasks(now time.Time) []*StuckTask {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	attempts := q.config.StuckAttempts
+	if attempts == 0 {
+		attempts = defaultStuckAttempts
+	}
+	deviations := q.config.StuckDeviations
+	if deviations == 0 {
+		deviations = defaultStuckDeviations
+	}
+	var maxRunningTime float64
+	if q.meanLatency > 0 {
+		maxRunningTime = math.Max(
+			q.meanLatency+deviations*math.Sqrt(q.latencyVariance),
+			q.meanLatency*minStuckLatencyFactor,
+		)
+	}
+
+	res := []*StuckTask{}
+	for _, info := range q.running.List(0) {
+		t := q.running.idToTask[info.ID]
+		runningTime := t.runningTime(now).Seconds()
+		var reasons []string
+		if int64(t.attempts) >= attempts {
+			reasons = append(reasons, "attempts")
+		}
+		if maxRunningTime > 0 && runningTime > maxRunningTime {
+			reasons = append(reasons, "runningTime")
+		}
+		if len(reasons) > 0 {
+			res = append(res, &StuckTask{
+				RunningTaskInfo: info,
+				RunningTime:     runningTime,
+				Reasons:         reasons,
+			})
+		}
+	}
+	return res
+}
+
+// A stuckDetector remembers when each stuck task was first found, so that
+// each one is only logged once.
+type stuckDetector struct {
+	lock sync.Mutex
+
+	// flagged maps contexts to the times their stuck tasks were found.
+	flagged map[string]map[string]time.Time
+}
+
+// Check finds the stuck tasks in every context, updating their counts and
+// logging the tasks which were not stuck at the last check.
+func (d *stuckDetector) Check(queues *QueueStateMux, now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	flagged := map[string]map[string]time.Time{}
+	queues.Iterate(func(name string, qs *QueueState) {
+		stuck := qs.StuckTasks(now)
+		atomic.StoreInt64(&qs.numStuck, int64(len(stuck)))
+		if len(stuck) == 0 {
+			return
+		}
+		prev := d.flagged[name]
+		times := make(map[string]time.Time, len(stuck))
+		for _, t := range stuck {
+			if first, ok := prev[t.ID]; ok {
+				times[t.ID] = first
+				continue
+			}
+			times[t.ID] = now
+			logger.Warn("task is stuck", "context", name, "id", t.ID, "attempts", t.Attempts,
+				"runningTime", time.Duration(t.RunningTime*float64(time.Second)).Round(time.Second),
+				"reasons", t.Reasons)
+		}
+		flagged[name] = times
+	})
+
+	// Tasks which were completed or requeued, and contexts which were
+	// removed, are forgotten.
+	d.flagged = flagged
+}
+
+// Flagged gets the time when a task was first found to be stuck, or the zero
+// time if it was not stuck at the last check.
+func (d *stuckDetector) Flagged(context, id string) time.Time {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.flagged[context][id]
+}
+
+// StuckLoop periodically checks every context for stuck tasks.
+func (s *Server) StuckLoop() {
+	for {
+		time.Sleep(s.StuckInterval)
+		s.stuck.Check(s.Queues, time.Now())
+	}
+}
+
+func (s *Server) ServeStuckTasks(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	context := r.URL.Query().Get("context")
+	var res []*StuckTask
+	err := s.Queues.Get(context, func(qs *QueueState) {
+		res = qs.StuckTasks(time.Now())
+	})
+	if err != nil {
+		serveContextError(w, err)
+		return
+	}
+	for _, t := range res {
+		if flagged := s.stuck.Flagged(context, t.ID); !flagged.IsZero() {
+			t.Flagged = flagged.UnixMilli()
+		}
+	}
+	serveObject(w, res)
+}
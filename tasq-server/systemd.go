@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// systemdListenFD is the first file descriptor passed by systemd socket
+// activation.
+const systemdListenFD = 3
+
+// SystemdListener gets the socket passed to the process by systemd socket
+// activation, or returns nil if there was none.
+//
+// Only the first socket is used, so the .socket unit should specify a single
+// ListenStream.
+func SystemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	numFDs, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || numFDs < 1 {
+		return nil, nil
+	}
+	// Prevent child processes from trying to use the sockets.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(systemdListenFD, "systemd-socket")
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "systemd socket activation")
+	}
+	f.Close()
+	return listener, nil
+}
+
+// SystemdNotify sends a state like "READY=1" to systemd, for services with
+// Type=notify. It does nothing if the process was not started by systemd.
+func SystemdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		// Abstract namespace socket.
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrap(err, "systemd notify")
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return errors.Wrap(err, "systemd notify")
+	}
+	return nil
+}
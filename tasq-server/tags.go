@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxTaskTags limits the number of tags in a single request.
+const maxTaskTags = 32
+
+// unmatchedRetry is the retry time given to workers when tasks remain in the
+// queue, but none of them can be popped with the worker's tags.
+const unmatchedRetry = 5 * time.Second
+
+// A TagSet is the set of capability tags offered by a worker.
+//
+// The nil TagSet offers no tags, so it only matches tasks without required
+// tags.
+type TagSet map[string]bool
+
+// NewTagSet creates a set from a list of tags.
+func NewTagSet(tags []string) TagSet {
+	if len(tags) == 0 {
+		return nil
+	}
+	res := make(TagSet, len(tags))
+	for _, tag := range tags {
+		res[tag] = true
+	}
+	return res
+}
+
+// Satisfies checks if the set contains every required tag.
+func (t TagSet) Satisfies(required []string) bool {
+	for _, tag := range required {
+		if !t[tag] {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches checks if a task can be popped by a worker offering these tags.
+func (t TagSet) Matches(task *Task) bool {
+	return t.Satisfies(task.tags)
+}
+
+// parseTags parses a comma-separated list of tags, returning them sorted and
+// without duplicates.
+func parseTags(value string) ([]string, error) {
+	var res []string
+	seen := map[string]bool{}
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		for _, ch := range tag {
+			if !(ch >= 'a' && ch <= 'z') && !(ch >= 'A' && ch <= 'Z') && !(ch >= '0' && ch <= '9') &&
+				!strings.ContainsRune("-_.:", ch) {
+				return nil, errors.New("invalid tag " + strconv.Quote(tag) + ": tags may only " +
+					"contain letters, digits, and any of -_.:")
+			}
+		}
+		seen[tag] = true
+		res = append(res, tag)
+	}
+	if len(res) > maxTaskTags {
+		return nil, errors.New("too many tags")
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// tagKey identifies a set of sorted tags.
+func tagKey(tags []string) string {
+	return strings.Join(tags, ",")
+}
+
+// unmatchedRetry gets the retry time for a worker which could not pop a task,
+// given the time when the next task will become available (if any).
+//
+// If no task will become available, but the queue is not empty, the worker's
+// tags may not satisfy the remaining tasks, which could still change once
+// other tasks are pushed or requeued, so the worker should retry later.
+//
+// Held tasks, and tasks waiting for an ordering key held by one, are ignored,
+// since they cannot be popped until an operator unholds them, and workers
+// waiting for the queue to be done would otherwise never stop.
+func (q *QueueState) unmatchedRetry(nextTry *time.Time) *time.Time {
+	if nextTry != nil || q.pending.Len()+q.running.Len()+q.delayed.Len() == 0 {
+		return nextTry
+	}
+	t := time.Now().Add(unmatchedRetry)
+	return &t
+}
+
+// tagsParam parses the optional "tags" parameter of a request.
+func tagsParam(r *http.Request) ([]string, error) {
+	tags, err := parseTags(r.FormValue("tags"))
+	if err != nil {
+		return nil, errors.New("invalid 'tags' parameter: " + err.Error())
+	}
+	return tags, nil
+}
@@ -1,178 +1,281 @@
 package main
 
-import "time"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
 
 type Task struct {
 	ID       string `json:"id"`
 	Contents string `json:"contents"`
 
+	// Lease is changed every time the task is popped, so that completions from
+	// workers holding a stale copy of the task can be detected.
+	Lease string `json:"lease,omitempty"`
+
+	// Checksum is the checksum of the contents recorded when the task was
+	// pushed, which workers may use to detect corruption.
+	Checksum string `json:"checksum,omitempty"`
+
 	// For in-progress tasks.
 	expiration time.Time
 
-	queuePrev *Task
-	queueNext *Task
+	// The time when the task was first pushed, or zero if unknown.
+	created time.Time
+
+	// The time when the task was most recently popped, or zero if it has
+	// not been popped since it was requeued or rejected.
+	popped time.Time
+
+	// The total running time of the task's earlier attempts.
+	elapsed time.Duration
+
+	// The number of times the task has been popped.
+	attempts int
+
+	// The timeout requested when the task was popped or kept alive, which
+	// is reused by later keepalives, or zero for the queue's default.
+	timeout time.Duration
+
+	// Set once the expiration of the task has been pushed back by the
+	// queue's backoff after it expired.
+	backedOff bool
+
+	// The most recent progress reported by the worker, if any.
+	progress *TaskProgress
+
+	// Metadata attached by workers with /task/annotate, which is kept
+	// across attempts. The map is replaced rather than modified, so it may
+	// be shared by copies of the task.
+	annotations map[string]string
+
+	// The group which the task was pushed to, if any.
+	group string
+
+	// Sorted capability tags which a worker must offer to pop the task.
+	tags []string
+
+	// Tasks with the same ordering key run one at a time, in order.
+	orderingKey string
+
+	// The producer which pushed the task, if any, which pops in fair order
+	// take turns between.
+	producer string
+
+	// Orders the task among the pending tasks with different tags, or
+	// among the running tasks with the same expiration.
+	seq int64
+
+	// The index of the task in the running queue's heap.
+	heapIndex int
+
+	// Set while the task is reserved by a worker which has not yet accepted
+	// it.
+	reserved bool
 }
 
-func (t *Task) DisconnectedCopy() *Task {
-	return &Task{ID: t.ID, Contents: t.Contents}
-}
-
-type TaskDeque struct {
-	first *Task
-	last  *Task
-	count int
-}
-
-// DecodeTaskDeque inverts TaskDeque.Encode(), converting a serializable
-// object back into a linked list deque.
-func DecodeTaskDeque(obj []EncodedTask) *TaskDeque {
-	res := &TaskDeque{count: len(obj)}
-	for i, et := range obj {
-		task := &Task{ID: et.ID, Contents: et.Contents, expiration: et.Expiration}
-		if i == 0 {
-			res.first = task
-			res.last = task
-		} else {
-			res.last.queueNext = task
-			task.queuePrev = res.last
-			res.last = task
+// endAttempt adds the running time of the current attempt, if any, to the
+// task's elapsed time. An attempt ends when the task is requeued, or once it
+// expires.
+func (t *Task) endAttempt(now time.Time) {
+	t.elapsed = t.runningTime(now)
+	t.popped = time.Time{}
+}
+
+// runningTime gets the total running time of the task's attempts, including
+// the current one.
+func (t *Task) runningTime(now time.Time) time.Duration {
+	res := t.elapsed
+	if !t.popped.IsZero() {
+		end := now
+		if !t.expiration.IsZero() && t.expiration.Before(end) {
+			end = t.expiration
+		}
+		if end.After(t.popped) {
+			res += end.Sub(t.popped)
 		}
 	}
 	return res
 }
 
-// Encode generates a JSON-serializable object for the task sequence.
-// This can be reversed by DecodeTaskDeque.
-func (t *TaskDeque) Encode() []EncodedTask {
-	objs := make([]EncodedTask, 0, t.count)
-	t.Iterate(func(obj *Task) {
-		objs = append(objs, EncodedTask{
-			ID:         obj.ID,
-			Contents:   obj.Contents,
-			Expiration: obj.expiration,
-		})
-	})
-	return objs
-}
-
-func (t *TaskDeque) Len() int {
-	return t.count
-}
-
-func (t *TaskDeque) PushLast(task *Task) {
-	t.count += 1
-	if t.last == nil {
-		t.first = task
-		t.last = task
-		task.queuePrev = nil
-		task.queueNext = nil
-	} else {
-		t.last.queueNext = task
-		task.queuePrev = t.last
-		task.queueNext = nil
-		t.last = task
+// DisconnectedCopy copies the task without any queue state.
+//
+// The lease and expiration are not copied, but the task's history (creation
+// time, attempts, progress, and annotations) is.
+func (t *Task) DisconnectedCopy() *Task {
+	return &Task{
+		ID:          t.ID,
+		Contents:    t.Contents,
+		Checksum:    t.Checksum,
+		created:     t.created,
+		attempts:    t.attempts,
+		elapsed:     t.elapsed,
+		progress:    t.progress.Copy(),
+		annotations: t.annotations,
+		group:       t.group,
+		tags:        t.tags,
+		orderingKey: t.orderingKey,
+		producer:    t.producer,
 	}
 }
 
-func (t *TaskDeque) PushByExpiration(task *Task) {
-	prev := t.last
-	for prev != nil && prev.expiration.After(task.expiration) {
-		prev = prev.queuePrev
-	}
-	if prev == nil {
-		t.PushFirst(task)
-	} else if prev.queueNext == nil {
-		t.PushLast(task)
-	} else {
-		t.count += 1
-		next := prev.queueNext
-		prev.queueNext = task
-		next.queuePrev = task
-		task.queuePrev = prev
-		task.queueNext = next
-	}
+// LeasedCopy is like DisconnectedCopy, but keeps the task's current lease,
+// so that the copy can be returned to the worker which popped the task after
+// the queue's lock is released.
+func (t *Task) LeasedCopy() *Task {
+	res := t.DisconnectedCopy()
+	res.Lease = t.Lease
+	return res
 }
 
-func (t *TaskDeque) PushFirst(task *Task) {
-	t.count += 1
-	if t.first == nil {
-		t.first = task
-		t.last = task
-		task.queuePrev = nil
-		task.queueNext = nil
-	} else {
-		t.first.queuePrev = task
-		task.queueNext = t.first
-		task.queuePrev = nil
-		t.first = task
-	}
+// release drops the task's contents and metadata once it has left the queue.
+//
+// Tasks from a taskAllocator share a slab which stays alive while any of its
+// tasks is still queued, so finished tasks must not keep large contents,
+// progress, or annotations alive.
+func (t *Task) release() {
+	*t = Task{}
 }
 
-func (t *TaskDeque) PopLast() *Task {
-	res := t.last
-	if res != nil {
-		t.Remove(res)
+// leasedCopies calls LeasedCopy() on each task.
+func leasedCopies(tasks []*Task) []*Task {
+	if tasks == nil {
+		return nil
+	}
+	res := make([]*Task, len(tasks))
+	for i, t := range tasks {
+		res[i] = t.LeasedCopy()
 	}
 	return res
 }
 
-func (t *TaskDeque) PopFirst() *Task {
-	res := t.first
-	if res != nil {
-		t.Remove(res)
+// Encode converts the task into a JSON-serializable object.
+func (t *Task) Encode() EncodedTask {
+	return EncodedTask{
+		ID:          t.ID,
+		Contents:    t.Contents,
+		Lease:       t.Lease,
+		Checksum:    t.Checksum,
+		Expiration:  t.expiration,
+		Created:     t.created,
+		Attempts:    t.attempts,
+		BackedOff:   t.backedOff,
+		Progress:    t.progress.Copy(),
+		Annotations: t.annotations,
+		Popped:      optionalTime(t.popped),
+		Elapsed:     t.elapsed,
+		Timeout:     t.timeout,
+		Group:       t.group,
+		Reserved:    t.reserved,
+		Tags:        t.tags,
+		OrderingKey: t.orderingKey,
+		Producer:    t.producer,
 	}
-	return res
 }
 
-func (t *TaskDeque) PeekFirst() *Task {
-	return t.first
+// DecodeTask creates a task from the result of Task.Encode().
+func DecodeTask(et *EncodedTask) *Task {
+	t := et.decode()
+	return &t
 }
 
-func (t *TaskDeque) Remove(task *Task) {
-	if task.queuePrev == nil {
-		if t.first != task {
-			panic("task not in deque")
-		}
-		t.first = task.queueNext
-		task.queueNext = nil
-		if t.first != nil {
-			t.first.queuePrev = nil
-		} else {
-			t.last = nil
-		}
-	} else if task.queueNext == nil {
-		if t.last != task {
-			panic("task not in queue")
-		}
-		t.last = task.queuePrev
-		task.queuePrev = nil
-		if t.last != nil {
-			t.last.queueNext = nil
-		} else {
-			t.first = nil
-		}
-	} else {
-		task.queueNext.queuePrev = task.queuePrev
-		task.queuePrev.queueNext = task.queueNext
-		task.queueNext = nil
-		task.queuePrev = nil
+// decodeTasks decodes many tasks at once, allocating them in slabs, and calls
+// f with each task in order.
+func decodeTasks(objs []EncodedTask, f func(t *Task)) {
+	var alloc taskAllocator
+	for i := range objs {
+		t := alloc.New()
+		*t = objs[i].decode()
+		f(t)
 	}
-	t.count -= 1
-	if task.queueNext != nil || task.queuePrev != nil {
-		panic("pointer unexpectedly preserved")
+}
+
+func (et *EncodedTask) decode() Task {
+	return Task{
+		ID:          et.ID,
+		Contents:    et.Contents,
+		Lease:       et.Lease,
+		Checksum:    et.Checksum,
+		expiration:  et.Expiration,
+		created:     et.Created,
+		attempts:    et.Attempts,
+		backedOff:   et.BackedOff,
+		progress:    et.Progress,
+		annotations: et.Annotations,
+		popped:      timeOrZero(et.Popped),
+		elapsed:     et.Elapsed,
+		timeout:     et.Timeout,
+		group:       et.Group,
+		reserved:    et.Reserved,
+		tags:        et.Tags,
+		orderingKey: et.OrderingKey,
+		producer:    et.Producer,
 	}
 }
 
-func (t *TaskDeque) Iterate(f func(t *Task)) {
-	obj := t.first
-	for obj != nil {
-		f(obj)
-		obj = obj.queueNext
+// TaskProgress is reported by workers while they perform a task.
+type TaskProgress struct {
+	Value   float64 `json:"value"`
+	Message string  `json:"message,omitempty"`
+
+	// Updated is the Unix time in milliseconds when the progress was
+	// reported.
+	Updated int64 `json:"updated"`
+}
+
+// Copy creates a copy of t, or returns nil if t is nil.
+func (t *TaskProgress) Copy() *TaskProgress {
+	if t == nil {
+		return nil
 	}
+	res := *t
+	return &res
 }
 
 type EncodedTask struct {
-	ID         string
-	Contents   string
-	Expiration time.Time
+	ID          string
+	Contents    string
+	Lease       string `json:",omitempty"`
+	Checksum    string `json:",omitempty"`
+	Expiration  time.Time
+	Created     time.Time
+	Attempts    int           `json:",omitempty"`
+	BackedOff   bool          `json:",omitempty"`
+	Progress    *TaskProgress `json:",omitempty"`
+	Timeout     time.Duration `json:",omitempty"`
+	Group       string        `json:",omitempty"`
+	Reserved    bool          `json:",omitempty"`
+	Tags        []string      `json:",omitempty"`
+	OrderingKey string        `json:",omitempty"`
+	Producer    string        `json:",omitempty"`
+
+	// Annotations are the metadata attached with /task/annotate, if any.
+	Annotations map[string]string `json:",omitempty"`
+
+	// Popped is the time when the task was last popped, and Elapsed is the
+	// total running time of its earlier attempts.
+	Popped  *time.Time    `json:",omitempty"`
+	Elapsed time.Duration `json:",omitempty"`
+
+	// ContentsRef, if set, is an index into EncodedQueueState.Contents which
+	// is used instead of Contents.
+	ContentsRef *int `json:",omitempty"`
+}
+
+// newIDPrefix creates a random prefix for task IDs, ending with a separator.
+func newIDPrefix() string {
+	var data [4]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(data[:]) + "-"
+}
+
+func newLease() string {
+	var data [8]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(data[:])
 }
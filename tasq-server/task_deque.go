@@ -0,0 +1,224 @@
+package main
+
+// dequeChunkSize is the number of tasks in each chunk of a TaskDeque.
+const dequeChunkSize = 256
+
+// taskSlabSize is the number of tasks allocated at once by a taskAllocator.
+const taskSlabSize = 64
+
+// A TaskDeque is a double-ended queue of tasks, stored in fixed-size chunks
+// of pointers rather than as a linked list.
+//
+// This keeps the number of allocations and pointers for the garbage collector
+// to follow small even for tens of millions of tasks, and only wastes the
+// unused parts of the first and last chunks. The last chunk grows gradually,
+// so small deques (e.g. for ordering keys) stay small.
+//
+// Removing or inserting tasks in the middle takes time proportional to the
+// distance from the nearest end.
+type TaskDeque struct {
+	// chunks[0][head] is the first task. Every chunk but the last has
+	// dequeChunkSize elements.
+	chunks [][]*Task
+	head   int
+	count  int
+}
+
+// DecodeTaskDeque inverts TaskDeque.Encode(), converting a serializable
+// object back into a deque.
+func DecodeTaskDeque(obj []EncodedTask) *TaskDeque {
+	res := &TaskDeque{}
+	decodeTasks(obj, res.PushLast)
+	return res
+}
+
+// Encode generates a JSON-serializable object for the task sequence.
+// This can be reversed by DecodeTaskDeque.
+func (t *TaskDeque) Encode() []EncodedTask {
+	objs := make([]EncodedTask, 0, t.count)
+	t.Iterate(func(obj *Task) {
+		objs = append(objs, obj.Encode())
+	})
+	return objs
+}
+
+func (t *TaskDeque) Len() int {
+	return t.count
+}
+
+// At gets the task at index i, where 0 is the first task.
+func (t *TaskDeque) At(i int) *Task {
+	pos := t.head + i
+	return t.chunks[pos/dequeChunkSize][pos%dequeChunkSize]
+}
+
+func (t *TaskDeque) set(i int, task *Task) {
+	pos := t.head + i
+	t.chunks[pos/dequeChunkSize][pos%dequeChunkSize] = task
+}
+
+func (t *TaskDeque) PushLast(task *Task) {
+	if len(t.chunks) == 0 || len(t.chunks[len(t.chunks)-1]) == dequeChunkSize {
+		t.chunks = append(t.chunks, make([]*Task, 0, 4))
+	}
+	last := len(t.chunks) - 1
+	t.chunks[last] = append(t.chunks[last], task)
+	t.count++
+}
+
+func (t *TaskDeque) PushFirst(task *Task) {
+	if t.count == 0 {
+		t.PushLast(task)
+		return
+	}
+	if t.head == 0 {
+		chunk := make([]*Task, dequeChunkSize)
+		t.chunks = append([][]*Task{chunk}, t.chunks...)
+		t.head = dequeChunkSize
+	}
+	t.head--
+	t.chunks[0][t.head] = task
+	t.count++
+}
+
+// PushByExpiration inserts the task after every task which does not expire
+// later than it, assuming the deque is sorted by expiration.
+func (t *TaskDeque) PushByExpiration(task *Task) {
+	i := t.count
+	for i > 0 && t.At(i-1).expiration.After(task.expiration) {
+		i--
+	}
+	t.insert(i, task)
+}
+
+func (t *TaskDeque) PopLast() *Task {
+	if t.count == 0 {
+		return nil
+	}
+	last := len(t.chunks) - 1
+	chunk := t.chunks[last]
+	res := chunk[len(chunk)-1]
+	chunk[len(chunk)-1] = nil
+	t.chunks[last] = chunk[:len(chunk)-1]
+	t.count--
+	if t.count == 0 {
+		t.reset()
+	} else if len(t.chunks[last]) == 0 {
+		t.chunks[last] = nil
+		t.chunks = t.chunks[:last]
+	}
+	return res
+}
+
+func (t *TaskDeque) PopFirst() *Task {
+	if t.count == 0 {
+		return nil
+	}
+	res := t.chunks[0][t.head]
+	t.chunks[0][t.head] = nil
+	t.head++
+	t.count--
+	if t.count == 0 {
+		t.reset()
+	} else if t.head == dequeChunkSize {
+		t.chunks[0] = nil
+		t.chunks = t.chunks[1:]
+		t.head = 0
+	}
+	return res
+}
+
+// reset empties the deque, keeping the last chunk for reuse.
+func (t *TaskDeque) reset() {
+	if len(t.chunks) > 0 {
+		chunk := t.chunks[len(t.chunks)-1]
+		t.chunks = append(t.chunks[:0], chunk[:0])
+	}
+	t.head = 0
+}
+
+func (t *TaskDeque) PeekFirst() *Task {
+	if t.count == 0 {
+		return nil
+	}
+	return t.At(0)
+}
+
+// PeekLast gets the most recently pushed task without removing it.
+func (t *TaskDeque) PeekLast() *Task {
+	if t.count == 0 {
+		return nil
+	}
+	return t.At(t.count - 1)
+}
+
+// Remove deletes a task from the deque.
+//
+// This searches for the task from the front of the deque, so it takes time
+// proportional to the task's position.
+func (t *TaskDeque) Remove(task *Task) {
+	for i := 0; i < t.count; i++ {
+		if t.At(i) == task {
+			t.removeAt(i)
+			return
+		}
+	}
+	panic("task not in deque")
+}
+
+func (t *TaskDeque) insert(i int, task *Task) {
+	if i < t.count/2 {
+		t.PushFirst(task)
+		for j := 0; j < i; j++ {
+			t.set(j, t.At(j+1))
+		}
+	} else {
+		t.PushLast(task)
+		for j := t.count - 1; j > i; j-- {
+			t.set(j, t.At(j-1))
+		}
+	}
+	t.set(i, task)
+}
+
+func (t *TaskDeque) removeAt(i int) {
+	if i < t.count/2 {
+		for j := i; j > 0; j-- {
+			t.set(j, t.At(j-1))
+		}
+		t.PopFirst()
+	} else {
+		for j := i; j < t.count-1; j++ {
+			t.set(j, t.At(j+1))
+		}
+		t.PopLast()
+	}
+}
+
+func (t *TaskDeque) Iterate(f func(t *Task)) {
+	for i := 0; i < t.count; i++ {
+		f(t.At(i))
+	}
+}
+
+// A taskAllocator allocates tasks in slabs, reducing the number of separate
+// objects on the heap.
+//
+// A slab is only freed once none of its tasks are referenced, so this works
+// best for tasks which are finished in roughly the order they were created,
+// as is the case for a FIFO queue. Tasks should be released once they leave
+// the queue, so that a slab which is kept alive by one long-running task only
+// holds empty tasks.
+type taskAllocator struct {
+	free []Task
+}
+
+// New allocates an empty task.
+func (t *taskAllocator) New() *Task {
+	if len(t.free) == 0 {
+		t.free = make([]Task, taskSlabSize)
+	}
+	res := &t.free[0]
+	t.free = t.free[1:]
+	return res
+}
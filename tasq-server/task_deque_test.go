@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func BenchmarkTaskDequePushPop(b *testing.B) {
+	d := &TaskDeque{}
+	tasks := make([]Task, 1024)
+	for i := range tasks {
+		d.PushLast(&tasks[i])
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.PushLast(d.PopFirst())
+	}
+}
+
+func BenchmarkTaskDequePushByExpiration(b *testing.B) {
+	d := &TaskDeque{}
+	tasks := make([]Task, 1024)
+	now := time.Now()
+	for i := range tasks {
+		tasks[i].expiration = now.Add(time.Duration(i) * time.Millisecond)
+		d.PushLast(&tasks[i])
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t := d.PopFirst()
+		t.expiration = t.expiration.Add(time.Duration(len(tasks)) * time.Millisecond)
+		d.PushByExpiration(t)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// A TrashedQueue is the state of a queue which was cleared, kept around so
+// that the clear can be undone.
+type TrashedQueue struct {
+	State   *QueueState
+	Deleted time.Time
+}
+
+// TrashInfo summarizes a TrashedQueue for display.
+type TrashInfo struct {
+	Name    string       `json:"name"`
+	Deleted int64        `json:"deleted"`
+	Counts  *QueueCounts `json:"counts"`
+}
+
+// Clear empties the named queue.
+//
+// If q.TrashRetention is non-zero and the queue contained any tasks, the
+// removed state is moved to the trash, from which it may be restored with
+// Restore() until the retention period elapses.
+//
+// Returns the number of pending and running tasks that were deleted.
+func (q *QueueStateMux) Clear(name string) (int, error) {
+	var n int
+	var removed *QueueState
+	err := q.Get(name, func(qs *QueueState) {
+		if q.TrashRetention == 0 {
+			n = qs.Clear()
+		} else {
+			removed = qs.Extract()
+			n = removed.Len()
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if removed != nil && n > 0 {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		q.purgeTrash()
+		q.trash[name] = &TrashedQueue{State: removed, Deleted: time.Now()}
+	}
+	return n, nil
+}
+
+// Restore moves the named queue out of the trash.
+//
+// The queue must not currently contain any pending or running tasks. The
+// number of restored tasks is returned, or false if the queue could not be
+// restored.
+func (q *QueueStateMux) Restore(name string) (int, bool) {
+	q.lock.Lock()
+	q.purgeTrash()
+	trashed, ok := q.trash[name]
+	if ok {
+		delete(q.trash, name)
+	}
+	q.lock.Unlock()
+	if !ok {
+		return 0, false
+	}
+
+	n := trashed.State.Len()
+	err := q.Get(name, func(qs *QueueState) {
+		ok = qs.Replace(trashed.State)
+	})
+	if err != nil {
+		ok = false
+	}
+	if !ok {
+		// Put the queue back so that it can be restored once the conflicting
+		// queue is cleared.
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		if _, exists := q.trash[name]; !exists {
+			q.trash[name] = trashed
+		}
+		return 0, false
+	}
+	return n, true
+}
+
+// Trash lists the queues that are currently in the trash, sorted by name.
+func (q *QueueStateMux) Trash() []*TrashInfo {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.purgeTrash()
+	res := make([]*TrashInfo, 0, len(q.trash))
+	for name, trashed := range q.trash {
+		res = append(res, &TrashInfo{
+			Name:    name,
+			Deleted: trashed.Deleted.UnixMilli(),
+			Counts:  trashed.State.Counts(0, false),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+func (q *QueueStateMux) purgeTrash() {
+	now := time.Now()
+	for name, trashed := range q.trash {
+		if now.Sub(trashed.Deleted) >= q.TrashRetention {
+			delete(q.trash, name)
+		}
+	}
+}
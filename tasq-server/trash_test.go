@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTrashSerialization(t *testing.T) {
+	mux := NewQueueStateMux(time.Minute)
+	mux.TrashRetention = time.Hour
+	mux.Get("a", func(qs *QueueState) {
+		qs.Push("x", 0)
+		qs.Push("y", 0)
+	})
+	mux.Get("b", func(qs *QueueState) {
+		qs.Push("z", 0)
+	})
+	if n, err := mux.Clear("a"); err != nil || n != 2 {
+		t.Fatalf("unexpected clear result: %d, %v", n, err)
+	}
+
+	var buf bytes.Buffer
+	if err := mux.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := DeserializeQueueStateMux(time.Minute, bytes.NewReader(buf.Bytes()),
+		int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.TrashRetention = time.Hour
+	if _, ok := loaded.queues["a"]; ok {
+		t.Fatal("trashed queue was loaded as a live queue")
+	}
+	if trash := loaded.Trash(); len(trash) != 1 || trash[0].Name != "a" ||
+		trash[0].Counts.Pending != 2 {
+		t.Fatalf("unexpected trash: %v", trash)
+	}
+	if n, ok := loaded.Restore("a"); !ok || n != 2 {
+		t.Fatalf("unexpected restore result: %d, %v", n, ok)
+	}
+
+	// Expired trash is left out of the next save.
+	loaded.Clear("b")
+	loaded.TrashRetention = time.Nanosecond
+	buf.Reset()
+	if err := loaded.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = DeserializeQueueStateMux(time.Minute, bytes.NewReader(buf.Bytes()),
+		int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.trash) != 0 {
+		t.Fatalf("expired trash was saved: %v", loaded.trash)
+	}
+}
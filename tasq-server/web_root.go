@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// serveHomepage serves index.html from s.WebRoot if it exists, or the
+// embedded homepage otherwise.
+//
+// Files are read from disk on every request, so edits to the web root take
+// effect as soon as the page is reloaded.
+func (s *Server) serveHomepage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("cache-control", "no-cache")
+	if s.WebRoot != "" {
+		indexPath := filepath.Join(s.WebRoot, "index.html")
+		if info, err := os.Stat(indexPath); err == nil && !info.IsDir() {
+			http.ServeFile(w, r, indexPath)
+			return
+		}
+	}
+	w.Header().Set("content-type", "text/html")
+	err := homepageTemplate.Execute(w, &homepageData{PathPrefix: s.PathPrefix})
+	if err != nil {
+		logger.Error("failed to render homepage", "error", err)
+	}
+}
+
+// ServeStatic serves files from s.WebRoot under the static/ path.
+//
+// Responses must be revalidated by browsers, which is cheap thanks to
+// Last-Modified headers, so that changes to files are picked up immediately.
+func (s *Server) ServeStatic(w http.ResponseWriter, r *http.Request) {
+	if !s.BasicAuth(w, r) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, s.PathPrefix+"static/")
+	if s.WebRoot == "" || name == "" || strings.HasSuffix(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("cache-control", "no-cache")
+	// Cleaning the rooted path prevents escaping the web root with "..".
+	name = path.Clean("/" + name)
+	http.ServeFile(w, r, filepath.Join(s.WebRoot, filepath.FromSlash(name)))
+}
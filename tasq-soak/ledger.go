@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A Ledger records what happened to every task during a soak test, to check
+// the server's delivery guarantees.
+type Ledger struct {
+	lock  sync.Mutex
+	tasks map[string]*taskRecord
+}
+
+type taskRecord struct {
+	// Set once the server acknowledged the push. Tasks whose pushes failed
+	// may or may not have been pushed.
+	acknowledged bool
+
+	deliveries        int
+	failedCompletions int
+}
+
+func NewLedger() *Ledger {
+	return &Ledger{tasks: map[string]*taskRecord{}}
+}
+
+// Pushing records that a task is about to be pushed.
+func (l *Ledger) Pushing(contents string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.tasks[contents] = &taskRecord{}
+}
+
+// Pushed records that the server acknowledged a push.
+func (l *Ledger) Pushed(contents string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.tasks[contents].acknowledged = true
+}
+
+// Delivered records that a consumer popped a task.
+func (l *Ledger) Delivered(contents string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if record, ok := l.tasks[contents]; ok {
+		record.deliveries++
+	} else {
+		// The context was empty at the start, so this shouldn't happen,
+		// but record the task anyway.
+		l.tasks[contents] = &taskRecord{deliveries: 1}
+	}
+}
+
+// FailedCompletion records that a consumer could not complete a task, in
+// which case the task may be delivered again.
+func (l *Ledger) FailedCompletion(contents string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.tasks[contents].failedCompletions++
+}
+
+// A LedgerReport summarizes a Ledger.
+type LedgerReport struct {
+	Pushed            int
+	Unacknowledged    int
+	Delivered         int
+	Duplicates        int
+	FailedCompletions int
+
+	// Problems describes violations of the delivery guarantees:
+	//
+	//     - every acknowledged task is delivered at least once;
+	//     - a task is only delivered again after a failed completion.
+	Problems []string
+}
+
+// Report checks the delivery guarantees and summarizes the ledger.
+func (l *Ledger) Report() *LedgerReport {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	contents := make([]string, 0, len(l.tasks))
+	for c := range l.tasks {
+		contents = append(contents, c)
+	}
+	sort.Strings(contents)
+
+	res := &LedgerReport{}
+	for _, c := range contents {
+		record := l.tasks[c]
+		if record.acknowledged {
+			res.Pushed++
+		} else {
+			res.Unacknowledged++
+		}
+		if record.deliveries > 0 {
+			res.Delivered++
+			res.Duplicates += record.deliveries - 1
+		}
+		res.FailedCompletions += record.failedCompletions
+
+		if record.acknowledged && record.deliveries == 0 {
+			res.Problems = append(res.Problems, fmt.Sprintf("task %q was lost", c))
+		} else if record.deliveries > 1+record.failedCompletions {
+			res.Problems = append(res.Problems, fmt.Sprintf(
+				"task %q was delivered %d times with only %d failed completions",
+				c, record.deliveries, record.failedCompletions,
+			))
+		}
+	}
+	return res
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/tasq"
+)
+
+func main() {
+	var host string
+	var context string
+	var username string
+	var password string
+	var duration time.Duration
+	var drainTimeout time.Duration
+	var producers int
+	var consumers int
+	var taskTimeout time.Duration
+	var serverPID int
+	var saveInterval time.Duration
+	var proxy FaultProxy
+	flag.StringVar(&host, "host", "", "server URL")
+	flag.StringVar(&context, "context", "tasq-soak", "tasq context name")
+	flag.StringVar(&username, "username", "", "basic auth username")
+	flag.StringVar(&password, "password", "", "basic auth password")
+	flag.DurationVar(&duration, "duration", time.Minute, "length of the fault injection phase")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 5*time.Minute,
+		"maximum time to finish the remaining tasks after the fault injection phase")
+	flag.IntVar(&producers, "producers", 4, "number of concurrent producers")
+	flag.IntVar(&consumers, "consumers", 8, "number of concurrent consumers")
+	flag.DurationVar(&taskTimeout, "task-timeout", 5*time.Second,
+		"timeout for popped tasks, after which they are redelivered")
+	flag.IntVar(&serverPID, "server-pid", 0, "if non-zero, the server process to send SIGUSR1 saves to")
+	flag.DurationVar(&saveInterval, "save-interval", 2*time.Second, "mean time between SIGUSR1 saves")
+	flag.Float64Var(&proxy.DropProb, "drop-prob", 0.01,
+		"probability of killing a connection before relaying each chunk of a response")
+	flag.Float64Var(&proxy.DelayProb, "delay-prob", 0.05,
+		"probability of delaying each chunk of a response")
+	flag.DurationVar(&proxy.MaxDelay, "max-delay", 500*time.Millisecond, "maximum response delay")
+	flag.Parse()
+
+	if host == "" {
+		essentials.Die("Must provide -host argument. See -help.")
+	} else if producers <= 0 || consumers <= 0 {
+		essentials.Die("The -producers and -consumers arguments must be positive.")
+	} else if proxy.MaxDelay*4 > taskTimeout {
+		// Otherwise, tasks may expire while a consumer is waiting for a
+		// delayed response, causing duplicates that we don't account for.
+		essentials.Die("The -max-delay argument must be at most a quarter of -task-timeout.")
+	}
+
+	serverURL, err := url.Parse(host)
+	essentials.Must(err)
+	if serverURL.Scheme != "http" {
+		essentials.Die("Only http:// servers are supported.")
+	}
+	proxy.Target = serverURL.Host
+	proxyAddr, err := proxy.Listen()
+	essentials.Must(err)
+	proxyURL := *serverURL
+	proxyURL.Host = proxyAddr
+
+	newClient := func(u *url.URL) *tasq.Client {
+		client, err := tasq.NewClient(u.String(), context, username, password)
+		essentials.Must(err)
+		client.TaskTimeout = taskTimeout
+		client.HTTPTimeout = taskTimeout
+		return client
+	}
+	faultyClient := newClient(&proxyURL)
+	directClient := newClient(serverURL)
+
+	counts, err := directClient.QueueCounts()
+	essentials.Must(err)
+	if counts.Pending+counts.Running > 0 {
+		essentials.Die("The context must be empty at the start of the test.")
+	}
+
+	ledger := NewLedger()
+	var producersDone, draining int32
+	var producerWG, consumerWG sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		producerWG.Add(1)
+		go func(i int) {
+			defer producerWG.Done()
+			for j := 0; atomic.LoadInt32(&producersDone) == 0; j++ {
+				contents := fmt.Sprintf("soak-%d-%d", i, j)
+				ledger.Pushing(contents)
+				if _, err := faultyClient.Push(contents); err == nil {
+					ledger.Pushed(contents)
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < consumers; i++ {
+		consumerWG.Add(1)
+		go func() {
+			defer consumerWG.Done()
+			consume(faultyClient, ledger, &draining)
+		}()
+	}
+
+	stopSaves := make(chan struct{})
+	if serverPID != 0 {
+		go sendSaves(serverPID, saveInterval, stopSaves)
+	}
+
+	log.Printf("injecting faults for %s", duration)
+	time.Sleep(duration)
+	close(stopSaves)
+	proxy.Disable()
+	atomic.StoreInt32(&producersDone, 1)
+	producerWG.Wait()
+	atomic.StoreInt32(&draining, 1)
+
+	log.Printf("draining remaining tasks")
+	drained := make(chan struct{})
+	go func() {
+		consumerWG.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(drainTimeout):
+		log.Printf("timed out waiting for tasks to drain")
+	}
+
+	counts, err = directClient.QueueCounts()
+	essentials.Must(err)
+	report := ledger.Report()
+	log.Printf(
+		"pushed=%d unacknowledged=%d delivered=%d duplicates=%d "+
+			"failed_completions=%d dropped=%d delayed=%d remaining=%d",
+		report.Pushed, report.Unacknowledged, report.Delivered, report.Duplicates,
+		report.FailedCompletions, proxy.NumDropped(), proxy.NumDelayed(),
+		counts.Pending+counts.Running,
+	)
+	for _, problem := range report.Problems {
+		log.Printf("FAIL: %s", problem)
+	}
+	if len(report.Problems) > 0 {
+		os.Exit(1)
+	}
+	log.Printf("PASS")
+}
+
+// consume pops and completes tasks until draining is set and the queue is
+// empty.
+func consume(client *tasq.Client, ledger *Ledger, draining *int32) {
+	for {
+		task, retry, err := client.Pop()
+		if err != nil {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if task == nil {
+			if retry == nil && atomic.LoadInt32(draining) != 0 {
+				return
+			}
+			delay := 100 * time.Millisecond
+			if retry != nil && *retry < delay.Seconds() {
+				delay = time.Duration(*retry * float64(time.Second))
+			}
+			time.Sleep(delay)
+			continue
+		}
+		ledger.Delivered(task.Contents)
+		if err := client.CompletedLease(task.ID, task.Lease); err != nil {
+			ledger.FailedCompletion(task.Contents)
+		}
+	}
+}
+
+// sendSaves sends SIGUSR1 to the server at random intervals until stop is
+// closed.
+func sendSaves(pid int, interval time.Duration, stop <-chan struct{}) {
+	for {
+		select {
+		case <-time.After(time.Duration(rand.ExpFloat64() * float64(interval))):
+		case <-stop:
+			return
+		}
+		if err := syscall.Kill(pid, syscall.SIGUSR1); err != nil {
+			log.Printf("failed to signal server: %s", err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// A FaultProxy relays TCP connections to a server, randomly delaying and
+// killing connections while the server is responding.
+//
+// Faults are only injected into responses, so the server may process a
+// request even though the client sees an error.
+type FaultProxy struct {
+	Target    string
+	DropProb  float64
+	DelayProb float64
+	MaxDelay  time.Duration
+
+	disabled   int32
+	numDropped int64
+	numDelayed int64
+}
+
+// Listen starts relaying connections in the background, and returns the
+// address of the proxy.
+func (f *FaultProxy) Listen() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.relay(conn)
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+// Disable stops injecting faults into new and existing connections.
+func (f *FaultProxy) Disable() {
+	atomic.StoreInt32(&f.disabled, 1)
+}
+
+// NumDropped gets the number of connections which have been killed.
+func (f *FaultProxy) NumDropped() int64 {
+	return atomic.LoadInt64(&f.numDropped)
+}
+
+// NumDelayed gets the number of responses which have been delayed.
+func (f *FaultProxy) NumDelayed() int64 {
+	return atomic.LoadInt64(&f.numDelayed)
+}
+
+func (f *FaultProxy) relay(client net.Conn) {
+	defer client.Close()
+	server, err := net.Dial("tcp", f.Target)
+	if err != nil {
+		return
+	}
+	defer server.Close()
+
+	go func() {
+		io.Copy(server, client)
+		server.Close()
+	}()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := server.Read(buf)
+		if n > 0 {
+			if atomic.LoadInt32(&f.disabled) == 0 {
+				if rand.Float64() < f.DelayProb {
+					atomic.AddInt64(&f.numDelayed, 1)
+					time.Sleep(time.Duration(rand.Int63n(int64(f.MaxDelay) + 1)))
+				}
+				if rand.Float64() < f.DropProb {
+					atomic.AddInt64(&f.numDropped, 1)
+					return
+				}
+			}
+			if _, err := client.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
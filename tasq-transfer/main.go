@@ -5,10 +5,24 @@
 // some tasks being duplicated between the source and destination servers, but
 // no tasks will be removed from the source before being added to the
 // destination.
+//
+// With the -state-file flag, the IDs of tasks which have been pushed to the
+// destination but not yet completed on the source are recorded in a file.
+// An interrupted transfer can then be resumed by running the same command
+// again, which completes these tasks on the source before transferring any
+// more, rather than pushing them to the destination a second time once they
+// expire on the source. Duplicates are still possible if the transfer is
+// interrupted after a batch is pushed but before it is recorded.
+//
+// With the -copy flag, the pending tasks of the source are pushed to the
+// destination without being removed from the source, for example to run the
+// same workload in a second context. In-progress tasks are not copied.
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"io"
 	"log"
 	"time"
 
@@ -28,6 +42,8 @@ func main() {
 	var numTasks int
 	var bufferSize int
 	var waitRunning bool
+	var stateFile string
+	var copyTasks bool
 	flag.StringVar(&sourceHost, "source", "", "source server URL")
 	flag.StringVar(&sourceContext, "source-context", "", "source context")
 	flag.StringVar(&sourceUsername, "source-username", "", "source basic auth username")
@@ -40,6 +56,10 @@ func main() {
 	flag.IntVar(&bufferSize, "buffer-size", 4096, "task buffer size")
 	flag.BoolVar(&waitRunning, "wait-running", false,
 		"attempt to transfer in-progress tasks once they expire")
+	flag.StringVar(&stateFile, "state-file", "",
+		"if specified, record pushed tasks in this file to resume interrupted transfers")
+	flag.BoolVar(&copyTasks, "copy", false,
+		"copy pending tasks without removing them from the source")
 	flag.Parse()
 
 	if sourceHost == "" || destHost == "" {
@@ -52,6 +72,25 @@ func main() {
 	destClient, err := tasq.NewClient(destHost, destContext, destUsername, destPassword)
 	essentials.Must(err)
 
+	if copyTasks {
+		if stateFile != "" || waitRunning {
+			essentials.Die("Cannot use -state-file or -wait-running with -copy.")
+		}
+		copyPending(sourceClient, destClient, numTasks, bufferSize)
+		return
+	}
+
+	var state *TransferState
+	if stateFile != "" {
+		state, err = ReadTransferState(stateFile)
+		essentials.Must(err)
+		resumeTransfer(sourceClient, sourceHost, sourceContext, state)
+		state.Source = sourceHost
+		state.SourceContext = sourceContext
+		state.PushedIDs = nil
+		essentials.Must(state.Write(stateFile))
+	}
+
 	completed := 0
 	for numTasks == -1 || completed < numTasks {
 		bs := bufferSize
@@ -82,11 +121,83 @@ func main() {
 			if _, err := destClient.PushBatch(contents); err != nil {
 				log.Fatalln("ERROR pushing batch:", err)
 			}
+			if state != nil {
+				state.PushedIDs = ids
+				if err := state.Write(stateFile); err != nil {
+					log.Fatalln("ERROR saving state:", err)
+				}
+			}
 			if err := sourceClient.CompletedBatch(ids); err != nil {
 				log.Fatalln("ERROR marking batch as completed:", err)
 			}
+			if state != nil {
+				state.PushedIDs = nil
+				if err := state.Write(stateFile); err != nil {
+					log.Fatalln("ERROR saving state:", err)
+				}
+			}
 			completed += len(tasks)
 			log.Printf("Current status: transferred a total of %d tasks", completed)
 		}
 	}
 }
+
+// resumeTransfer completes the tasks which a previous run pushed to the
+// destination, so that they are not transferred again.
+func resumeTransfer(source *tasq.Client, sourceHost, sourceContext string, state *TransferState) {
+	if len(state.PushedIDs) == 0 {
+		return
+	}
+	if state.Source != sourceHost || state.SourceContext != sourceContext {
+		essentials.Die("State file is from a transfer with a different source.")
+	}
+	log.Printf("Resuming: completing %d previously pushed tasks on the source...",
+		len(state.PushedIDs))
+	if err := source.CompletedBatch(state.PushedIDs); err != nil {
+		// Some tasks may have been completed before the interruption, or
+		// may no longer be in progress. In the latter case, they will be
+		// transferred again.
+		log.Println("WARNING completing previously pushed tasks:", err)
+	}
+}
+
+// copyPending pushes the source's pending tasks to the destination in order,
+// leaving the source unchanged.
+func copyPending(source, dest *tasq.Client, numTasks, bufferSize int) {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(source.Export(w))
+	}()
+	defer r.Close()
+
+	dec := json.NewDecoder(r)
+	copied := 0
+	var contents []string
+	flush := func() {
+		if len(contents) == 0 {
+			return
+		}
+		if _, err := dest.PushBatch(contents); err != nil {
+			log.Fatalln("ERROR pushing batch:", err)
+		}
+		copied += len(contents)
+		contents = contents[:0]
+		log.Printf("Current status: copied a total of %d tasks", copied)
+	}
+	for numTasks == -1 || copied+len(contents) < numTasks {
+		var task struct {
+			Contents string `json:"contents"`
+		}
+		if err := dec.Decode(&task); err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatalln("ERROR reading source tasks:", err)
+		}
+		contents = append(contents, task.Contents)
+		if len(contents) == bufferSize {
+			flush()
+		}
+	}
+	flush()
+	log.Printf("Finished copying %d tasks.", copied)
+}
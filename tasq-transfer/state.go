@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// TransferState is saved to the state file to record tasks which have been
+// pushed to the destination but not yet completed on the source.
+type TransferState struct {
+	Source        string   `json:"source"`
+	SourceContext string   `json:"sourceContext"`
+	PushedIDs     []string `json:"pushedIDs"`
+}
+
+// ReadTransferState reads a state file, returning an empty state if the file
+// does not exist.
+func ReadTransferState(path string) (*TransferState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &TransferState{}, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "read transfer state")
+	}
+	var res TransferState
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, errors.Wrap(err, "read transfer state")
+	}
+	return &res, nil
+}
+
+// Write atomically replaces the state file, so that an interruption never
+// leaves behind a partially written state.
+func (t *TransferState) Write(path string) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return errors.Wrap(err, "write transfer state")
+	}
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.Wrap(err, "write transfer state")
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "write transfer state")
+	}
+	return nil
+}
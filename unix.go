@@ -0,0 +1,76 @@
+package tasq
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// UnixScheme is the URL scheme for servers listening on a Unix domain socket.
+//
+// The URL path is the path of the socket, optionally followed by a colon and
+// the server's path prefix. For example, "http+unix:///var/run/tasq.sock" or
+// "http+unix:///var/run/tasq.sock:/tasq/".
+const UnixScheme = "http+unix"
+
+var unixClientsLock sync.Mutex
+var unixClients = map[unixClientKey]*http.Client{}
+
+type unixClientKey struct {
+	Socket string
+	Base   *http.Client
+}
+
+// splitUnixURL gets the socket path of a UnixScheme URL, and an equivalent
+// http URL to use for requests over the socket.
+func splitUnixURL(u *url.URL) (string, *url.URL) {
+	socket, prefix := u.Path, "/"
+	if idx := strings.Index(u.Path, ":"); idx >= 0 {
+		socket, prefix = u.Path[:idx], u.Path[idx+1:]
+	}
+	res := *u
+	res.Scheme = "http"
+	res.Host = "unix"
+	res.Path = prefix
+	res.RawPath = ""
+	return socket, &res
+}
+
+// requestTarget gets the URL of an endpoint on the given server, and the
+// HTTP client to reach it with.
+func (c *Client) requestTarget(base *url.URL, path string) (*url.URL, *http.Client) {
+	client := c.httpClient()
+	if base.Scheme != UnixScheme {
+		return urlForPath(base, path), client
+	}
+	socket, base := splitUnixURL(base)
+	return urlForPath(base, path), unixClient(socket, client)
+}
+
+// unixClient creates (or reuses) a copy of base which connects to a Unix
+// socket instead of the hosts in request URLs.
+func unixClient(socket string, base *http.Client) *http.Client {
+	unixClientsLock.Lock()
+	defer unixClientsLock.Unlock()
+	key := unixClientKey{Socket: socket, Base: base}
+	if client, ok := unixClients[key]; ok {
+		return client
+	}
+	transport, ok := base.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+	client := *base
+	client.Transport = transport
+	unixClients[key] = &client
+	return &client
+}